@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"filippo.io/age"
+)
+
+// agePrefix marks contents encrypted to age recipients instead of a password
+const agePrefix = "age:"
+
+// ageKeys holds the local identity and the recipients files are encrypted to
+type ageKeys struct {
+	identities []age.Identity
+	recipients []age.Recipient
+}
+
+var (
+	loadedAgeKeys     *ageKeys
+	loadedAgeKeysErr  error
+	loadedAgeKeysOnce sync.Once
+)
+
+func getIdentityFile() (string, error) {
+	dir, err := getStorageDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "identity.txt"), nil
+}
+
+func getRecipientsFile() (string, error) {
+	dir, err := getStorageDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "recipients.txt"), nil
+}
+
+// loadAgeKeys reads ~/.env-sync/identity.txt and ~/.env-sync/recipients.txt once
+func loadAgeKeys() (*ageKeys, error) {
+	loadedAgeKeysOnce.Do(func() {
+		keys := &ageKeys{}
+
+		identityFile, err := getIdentityFile()
+		if err != nil {
+			loadedAgeKeysErr = err
+			return
+		}
+		if data, err := os.ReadFile(identityFile); err == nil {
+			keys.identities, err = age.ParseIdentities(bytes.NewReader(data))
+			if err != nil {
+				loadedAgeKeysErr = fmt.Errorf("invalid identity file %s: %v", identityFile, err)
+				return
+			}
+		}
+
+		recipientsFile, err := getRecipientsFile()
+		if err != nil {
+			loadedAgeKeysErr = err
+			return
+		}
+		if data, err := os.ReadFile(recipientsFile); err == nil && len(bytes.TrimSpace(data)) > 0 {
+			keys.recipients, err = age.ParseRecipients(bytes.NewReader(data))
+			if err != nil {
+				loadedAgeKeysErr = fmt.Errorf("invalid recipients file %s: %v", recipientsFile, err)
+				return
+			}
+		}
+
+		loadedAgeKeys = keys
+	})
+	return loadedAgeKeys, loadedAgeKeysErr
+}
+
+// ageEnabled reports whether uploads are encrypted to recipients instead of a password
+func ageEnabled() bool {
+	keys, err := loadAgeKeys()
+	return err == nil && len(keys.recipients) > 0
+}
+
+// ageProvider encrypts to age recipients and decrypts with the local identity
+type ageProvider struct {
+	recipients []age.Recipient
+}
+
+func (p ageProvider) seal(payload []byte) (string, error) {
+	return encryptAge(string(payload), p.recipients)
+}
+
+func (p ageProvider) open(encryptedData string) ([]byte, error) {
+	plaintext, err := decryptAge(encryptedData)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(plaintext), nil
+}
+
+func encryptAge(plaintext string, recipients []age.Recipient) (string, error) {
+	var buf bytes.Buffer
+	w, err := age.Encrypt(&buf, recipients...)
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt to recipients: %v", err)
+	}
+	if _, err := io.WriteString(w, plaintext); err != nil {
+		return "", fmt.Errorf("failed to encrypt to recipients: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return "", fmt.Errorf("failed to encrypt to recipients: %v", err)
+	}
+	return agePrefix + base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+func decryptAge(encryptedData string) (string, error) {
+	keys, err := loadAgeKeys()
+	if err != nil {
+		return "", err
+	}
+	if len(keys.identities) == 0 {
+		return "", fmt.Errorf("file is encrypted to age recipients but no identity found (run 'env-sync keys generate')")
+	}
+	return decryptAgeWith(encryptedData, keys.identities)
+}
+
+func decryptAgeWith(encryptedData string, identities []age.Identity) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(encryptedData, agePrefix))
+	if err != nil {
+		return "", fmt.Errorf("failed to decode base64: %v", err)
+	}
+
+	r, err := age.Decrypt(bytes.NewReader(data), identities...)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt: %v", err)
+	}
+	plaintext, err := io.ReadAll(r)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt: %v", err)
+	}
+	return string(plaintext), nil
+}
+
+// generateIdentity creates a new X25519 identity and adds its public key to the recipients
+func generateIdentity(force bool) error {
+	identityFile, err := getIdentityFile()
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(identityFile); err == nil && !force {
+		return fmt.Errorf("identity already exists at %s (use --force to replace it)", identityFile)
+	}
+
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		return fmt.Errorf("failed to generate identity: %v", err)
+	}
+
+	contents := fmt.Sprintf("# public key: %s\n%s\n", identity.Recipient(), identity)
+	if err := os.WriteFile(identityFile, []byte(contents), 0600); err != nil {
+		return fmt.Errorf("failed to write identity: %v", err)
+	}
+
+	if err := addRecipient(identity.Recipient().String()); err != nil {
+		return err
+	}
+
+	fmt.Printf("✓ Identity written to %s\n", identityFile)
+	fmt.Printf("Public key: %s\n", identity.Recipient())
+	fmt.Println("Share the public key with teammates so they can add you with 'env-sync keys add'.")
+	return nil
+}
+
+func readRecipientLines() ([]string, error) {
+	recipientsFile, err := getRecipientsFile()
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(recipientsFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+func writeRecipientLines(lines []string) error {
+	recipientsFile, err := getRecipientsFile()
+	if err != nil {
+		return err
+	}
+	contents := ""
+	if len(lines) > 0 {
+		contents = strings.Join(lines, "\n") + "\n"
+	}
+	return os.WriteFile(recipientsFile, []byte(contents), 0644)
+}
+
+// addRecipient appends an age public key to ~/.env-sync/recipients.txt
+func addRecipient(publicKey string) error {
+	if _, err := age.ParseX25519Recipient(publicKey); err != nil {
+		return fmt.Errorf("invalid public key: %v", err)
+	}
+
+	lines, err := readRecipientLines()
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		if line == publicKey {
+			return nil
+		}
+	}
+
+	return writeRecipientLines(append(lines, publicKey))
+}
+
+// removeRecipient drops an age public key from ~/.env-sync/recipients.txt
+func removeRecipient(publicKey string) error {
+	lines, err := readRecipientLines()
+	if err != nil {
+		return err
+	}
+
+	var kept []string
+	for _, line := range lines {
+		if line != publicKey {
+			kept = append(kept, line)
+		}
+	}
+	if len(kept) == len(lines) {
+		return fmt.Errorf("recipient not found: %s", publicKey)
+	}
+
+	return writeRecipientLines(kept)
+}
+
+func manageRecipients(action, publicKey string) error {
+	switch action {
+	case "add":
+		if publicKey == "" {
+			return fmt.Errorf("usage: env-sync keys add <age1...>")
+		}
+		if err := addRecipient(publicKey); err != nil {
+			return err
+		}
+		fmt.Printf("✓ Added recipient %s\n", publicKey)
+		fmt.Println("Run 'env-sync upload' to re-encrypt existing files for the new recipient.")
+	case "remove":
+		if publicKey == "" {
+			return fmt.Errorf("usage: env-sync keys remove <age1...>")
+		}
+		if err := removeRecipient(publicKey); err != nil {
+			return err
+		}
+		fmt.Printf("✓ Removed recipient %s\n", publicKey)
+		fmt.Println("Run 'env-sync upload' to re-encrypt existing files without it.")
+	case "list", "":
+		lines, err := readRecipientLines()
+		if err != nil {
+			return err
+		}
+		if keyURI := kmsKeyURI(); keyURI != "" {
+			fmt.Printf("New files are encrypted under the KMS key %s, not to these recipients.\n", keyURI)
+		}
+		if len(lines) == 0 {
+			if kmsKeyURI() == "" {
+				fmt.Println("No recipients configured. Files are encrypted with the password.")
+			}
+			return nil
+		}
+		fmt.Printf("%d recipient(s):\n", len(lines))
+		for _, line := range lines {
+			fmt.Printf("  - %s\n", line)
+		}
+	default:
+		return fmt.Errorf("unknown keys action: %s (use add, remove or list)", action)
+	}
+	return nil
+}
@@ -0,0 +1,746 @@
+// The env-sync gRPC API, served by `env-sync serve`. Every call needs the
+// server's token as "authorization: Bearer <token>" metadata.
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.7
+// 	protoc        (unknown)
+// source: envsync/v1/envsync.proto
+
+package envsyncv1
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type WatchEvent_Type int32
+
+const (
+	WatchEvent_TYPE_UNSPECIFIED WatchEvent_Type = 0
+	WatchEvent_TYPE_CREATED     WatchEvent_Type = 1
+	WatchEvent_TYPE_UPDATED     WatchEvent_Type = 2
+	WatchEvent_TYPE_DELETED     WatchEvent_Type = 3
+)
+
+// Enum value maps for WatchEvent_Type.
+var (
+	WatchEvent_Type_name = map[int32]string{
+		0: "TYPE_UNSPECIFIED",
+		1: "TYPE_CREATED",
+		2: "TYPE_UPDATED",
+		3: "TYPE_DELETED",
+	}
+	WatchEvent_Type_value = map[string]int32{
+		"TYPE_UNSPECIFIED": 0,
+		"TYPE_CREATED":     1,
+		"TYPE_UPDATED":     2,
+		"TYPE_DELETED":     3,
+	}
+)
+
+func (x WatchEvent_Type) Enum() *WatchEvent_Type {
+	p := new(WatchEvent_Type)
+	*p = x
+	return p
+}
+
+func (x WatchEvent_Type) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (WatchEvent_Type) Descriptor() protoreflect.EnumDescriptor {
+	return file_envsync_v1_envsync_proto_enumTypes[0].Descriptor()
+}
+
+func (WatchEvent_Type) Type() protoreflect.EnumType {
+	return &file_envsync_v1_envsync_proto_enumTypes[0]
+}
+
+func (x WatchEvent_Type) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use WatchEvent_Type.Descriptor instead.
+func (WatchEvent_Type) EnumDescriptor() ([]byte, []int) {
+	return file_envsync_v1_envsync_proto_rawDescGZIP(), []int{8, 0}
+}
+
+// EnvFile describes a stored file. Repo IDs are normalized git remotes,
+// e.g. github.com/user/repo; paths are relative to the repo root.
+type EnvFile struct {
+	state        protoimpl.MessageState `protogen:"open.v1"`
+	RepoId       string                 `protobuf:"bytes,1,opt,name=repo_id,json=repoId,proto3" json:"repo_id,omitempty"`
+	RelativePath string                 `protobuf:"bytes,2,opt,name=relative_path,json=relativePath,proto3" json:"relative_path,omitempty"`
+	// SHA-256 of the plaintext contents, base64 encoded
+	FileHash   string                 `protobuf:"bytes,3,opt,name=file_hash,json=fileHash,proto3" json:"file_hash,omitempty"`
+	ModifiedAt *timestamppb.Timestamp `protobuf:"bytes,4,opt,name=modified_at,json=modifiedAt,proto3" json:"modified_at,omitempty"`
+	UpdatedAt  *timestamppb.Timestamp `protobuf:"bytes,5,opt,name=updated_at,json=updatedAt,proto3" json:"updated_at,omitempty"`
+	// Permission bits, e.g. 0600; 0 if unknown
+	FileMode      uint32   `protobuf:"varint,6,opt,name=file_mode,json=fileMode,proto3" json:"file_mode,omitempty"`
+	Tags          []string `protobuf:"bytes,7,rep,name=tags,proto3" json:"tags,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *EnvFile) Reset() {
+	*x = EnvFile{}
+	mi := &file_envsync_v1_envsync_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *EnvFile) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*EnvFile) ProtoMessage() {}
+
+func (x *EnvFile) ProtoReflect() protoreflect.Message {
+	mi := &file_envsync_v1_envsync_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use EnvFile.ProtoReflect.Descriptor instead.
+func (*EnvFile) Descriptor() ([]byte, []int) {
+	return file_envsync_v1_envsync_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *EnvFile) GetRepoId() string {
+	if x != nil {
+		return x.RepoId
+	}
+	return ""
+}
+
+func (x *EnvFile) GetRelativePath() string {
+	if x != nil {
+		return x.RelativePath
+	}
+	return ""
+}
+
+func (x *EnvFile) GetFileHash() string {
+	if x != nil {
+		return x.FileHash
+	}
+	return ""
+}
+
+func (x *EnvFile) GetModifiedAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.ModifiedAt
+	}
+	return nil
+}
+
+func (x *EnvFile) GetUpdatedAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.UpdatedAt
+	}
+	return nil
+}
+
+func (x *EnvFile) GetFileMode() uint32 {
+	if x != nil {
+		return x.FileMode
+	}
+	return 0
+}
+
+func (x *EnvFile) GetTags() []string {
+	if x != nil {
+		return x.Tags
+	}
+	return nil
+}
+
+type ListRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Only files of this repo, by full or short ID (user/repo)
+	Repo string `protobuf:"bytes,1,opt,name=repo,proto3" json:"repo,omitempty"`
+	// Only files with all of these tags
+	Tags          []string `protobuf:"bytes,2,rep,name=tags,proto3" json:"tags,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListRequest) Reset() {
+	*x = ListRequest{}
+	mi := &file_envsync_v1_envsync_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListRequest) ProtoMessage() {}
+
+func (x *ListRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_envsync_v1_envsync_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListRequest.ProtoReflect.Descriptor instead.
+func (*ListRequest) Descriptor() ([]byte, []int) {
+	return file_envsync_v1_envsync_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *ListRequest) GetRepo() string {
+	if x != nil {
+		return x.Repo
+	}
+	return ""
+}
+
+func (x *ListRequest) GetTags() []string {
+	if x != nil {
+		return x.Tags
+	}
+	return nil
+}
+
+type ListResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Files         []*EnvFile             `protobuf:"bytes,1,rep,name=files,proto3" json:"files,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListResponse) Reset() {
+	*x = ListResponse{}
+	mi := &file_envsync_v1_envsync_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListResponse) ProtoMessage() {}
+
+func (x *ListResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_envsync_v1_envsync_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListResponse.ProtoReflect.Descriptor instead.
+func (*ListResponse) Descriptor() ([]byte, []int) {
+	return file_envsync_v1_envsync_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *ListResponse) GetFiles() []*EnvFile {
+	if x != nil {
+		return x.Files
+	}
+	return nil
+}
+
+type GetRequest struct {
+	state        protoimpl.MessageState `protogen:"open.v1"`
+	RepoId       string                 `protobuf:"bytes,1,opt,name=repo_id,json=repoId,proto3" json:"repo_id,omitempty"`
+	RelativePath string                 `protobuf:"bytes,2,opt,name=relative_path,json=relativePath,proto3" json:"relative_path,omitempty"`
+	// A version from the file's history; 0 for the current one
+	Version       int32 `protobuf:"varint,3,opt,name=version,proto3" json:"version,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetRequest) Reset() {
+	*x = GetRequest{}
+	mi := &file_envsync_v1_envsync_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetRequest) ProtoMessage() {}
+
+func (x *GetRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_envsync_v1_envsync_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetRequest.ProtoReflect.Descriptor instead.
+func (*GetRequest) Descriptor() ([]byte, []int) {
+	return file_envsync_v1_envsync_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *GetRequest) GetRepoId() string {
+	if x != nil {
+		return x.RepoId
+	}
+	return ""
+}
+
+func (x *GetRequest) GetRelativePath() string {
+	if x != nil {
+		return x.RelativePath
+	}
+	return ""
+}
+
+func (x *GetRequest) GetVersion() int32 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+type GetResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	File          *EnvFile               `protobuf:"bytes,1,opt,name=file,proto3" json:"file,omitempty"`
+	Contents      []byte                 `protobuf:"bytes,2,opt,name=contents,proto3" json:"contents,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetResponse) Reset() {
+	*x = GetResponse{}
+	mi := &file_envsync_v1_envsync_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetResponse) ProtoMessage() {}
+
+func (x *GetResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_envsync_v1_envsync_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetResponse.ProtoReflect.Descriptor instead.
+func (*GetResponse) Descriptor() ([]byte, []int) {
+	return file_envsync_v1_envsync_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *GetResponse) GetFile() *EnvFile {
+	if x != nil {
+		return x.File
+	}
+	return nil
+}
+
+func (x *GetResponse) GetContents() []byte {
+	if x != nil {
+		return x.Contents
+	}
+	return nil
+}
+
+type PutRequest struct {
+	state        protoimpl.MessageState `protogen:"open.v1"`
+	RepoId       string                 `protobuf:"bytes,1,opt,name=repo_id,json=repoId,proto3" json:"repo_id,omitempty"`
+	RelativePath string                 `protobuf:"bytes,2,opt,name=relative_path,json=relativePath,proto3" json:"relative_path,omitempty"`
+	Contents     []byte                 `protobuf:"bytes,3,opt,name=contents,proto3" json:"contents,omitempty"`
+	// Permission bits to store; 0 keeps the stored ones, or 0600 for new files
+	FileMode uint32 `protobuf:"varint,4,opt,name=file_mode,json=fileMode,proto3" json:"file_mode,omitempty"`
+	// If set, the put fails with FAILED_PRECONDITION unless the stored file
+	// still has this hash; "new" requires that it doesn't exist yet
+	ExpectedHash  string `protobuf:"bytes,5,opt,name=expected_hash,json=expectedHash,proto3" json:"expected_hash,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *PutRequest) Reset() {
+	*x = PutRequest{}
+	mi := &file_envsync_v1_envsync_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PutRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PutRequest) ProtoMessage() {}
+
+func (x *PutRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_envsync_v1_envsync_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PutRequest.ProtoReflect.Descriptor instead.
+func (*PutRequest) Descriptor() ([]byte, []int) {
+	return file_envsync_v1_envsync_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *PutRequest) GetRepoId() string {
+	if x != nil {
+		return x.RepoId
+	}
+	return ""
+}
+
+func (x *PutRequest) GetRelativePath() string {
+	if x != nil {
+		return x.RelativePath
+	}
+	return ""
+}
+
+func (x *PutRequest) GetContents() []byte {
+	if x != nil {
+		return x.Contents
+	}
+	return nil
+}
+
+func (x *PutRequest) GetFileMode() uint32 {
+	if x != nil {
+		return x.FileMode
+	}
+	return 0
+}
+
+func (x *PutRequest) GetExpectedHash() string {
+	if x != nil {
+		return x.ExpectedHash
+	}
+	return ""
+}
+
+type PutResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	File  *EnvFile               `protobuf:"bytes,1,opt,name=file,proto3" json:"file,omitempty"`
+	// False if the stored contents were already the same
+	Changed       bool `protobuf:"varint,2,opt,name=changed,proto3" json:"changed,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *PutResponse) Reset() {
+	*x = PutResponse{}
+	mi := &file_envsync_v1_envsync_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PutResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PutResponse) ProtoMessage() {}
+
+func (x *PutResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_envsync_v1_envsync_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PutResponse.ProtoReflect.Descriptor instead.
+func (*PutResponse) Descriptor() ([]byte, []int) {
+	return file_envsync_v1_envsync_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *PutResponse) GetFile() *EnvFile {
+	if x != nil {
+		return x.File
+	}
+	return nil
+}
+
+func (x *PutResponse) GetChanged() bool {
+	if x != nil {
+		return x.Changed
+	}
+	return false
+}
+
+type WatchRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Only events for files of this repo, by full or short ID
+	Repo          string `protobuf:"bytes,1,opt,name=repo,proto3" json:"repo,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *WatchRequest) Reset() {
+	*x = WatchRequest{}
+	mi := &file_envsync_v1_envsync_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *WatchRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*WatchRequest) ProtoMessage() {}
+
+func (x *WatchRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_envsync_v1_envsync_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use WatchRequest.ProtoReflect.Descriptor instead.
+func (*WatchRequest) Descriptor() ([]byte, []int) {
+	return file_envsync_v1_envsync_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *WatchRequest) GetRepo() string {
+	if x != nil {
+		return x.Repo
+	}
+	return ""
+}
+
+type WatchEvent struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Type  WatchEvent_Type        `protobuf:"varint,1,opt,name=type,proto3,enum=envsync.v1.WatchEvent_Type" json:"type,omitempty"`
+	// For deletions, the file as it was last seen
+	File          *EnvFile `protobuf:"bytes,2,opt,name=file,proto3" json:"file,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *WatchEvent) Reset() {
+	*x = WatchEvent{}
+	mi := &file_envsync_v1_envsync_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *WatchEvent) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*WatchEvent) ProtoMessage() {}
+
+func (x *WatchEvent) ProtoReflect() protoreflect.Message {
+	mi := &file_envsync_v1_envsync_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use WatchEvent.ProtoReflect.Descriptor instead.
+func (*WatchEvent) Descriptor() ([]byte, []int) {
+	return file_envsync_v1_envsync_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *WatchEvent) GetType() WatchEvent_Type {
+	if x != nil {
+		return x.Type
+	}
+	return WatchEvent_TYPE_UNSPECIFIED
+}
+
+func (x *WatchEvent) GetFile() *EnvFile {
+	if x != nil {
+		return x.File
+	}
+	return nil
+}
+
+var File_envsync_v1_envsync_proto protoreflect.FileDescriptor
+
+const file_envsync_v1_envsync_proto_rawDesc = "" +
+	"\n" +
+	"\x18envsync/v1/envsync.proto\x12\n" +
+	"envsync.v1\x1a\x1fgoogle/protobuf/timestamp.proto\"\x8d\x02\n" +
+	"\aEnvFile\x12\x17\n" +
+	"\arepo_id\x18\x01 \x01(\tR\x06repoId\x12#\n" +
+	"\rrelative_path\x18\x02 \x01(\tR\frelativePath\x12\x1b\n" +
+	"\tfile_hash\x18\x03 \x01(\tR\bfileHash\x12;\n" +
+	"\vmodified_at\x18\x04 \x01(\v2\x1a.google.protobuf.TimestampR\n" +
+	"modifiedAt\x129\n" +
+	"\n" +
+	"updated_at\x18\x05 \x01(\v2\x1a.google.protobuf.TimestampR\tupdatedAt\x12\x1b\n" +
+	"\tfile_mode\x18\x06 \x01(\rR\bfileMode\x12\x12\n" +
+	"\x04tags\x18\a \x03(\tR\x04tags\"5\n" +
+	"\vListRequest\x12\x12\n" +
+	"\x04repo\x18\x01 \x01(\tR\x04repo\x12\x12\n" +
+	"\x04tags\x18\x02 \x03(\tR\x04tags\"9\n" +
+	"\fListResponse\x12)\n" +
+	"\x05files\x18\x01 \x03(\v2\x13.envsync.v1.EnvFileR\x05files\"d\n" +
+	"\n" +
+	"GetRequest\x12\x17\n" +
+	"\arepo_id\x18\x01 \x01(\tR\x06repoId\x12#\n" +
+	"\rrelative_path\x18\x02 \x01(\tR\frelativePath\x12\x18\n" +
+	"\aversion\x18\x03 \x01(\x05R\aversion\"R\n" +
+	"\vGetResponse\x12'\n" +
+	"\x04file\x18\x01 \x01(\v2\x13.envsync.v1.EnvFileR\x04file\x12\x1a\n" +
+	"\bcontents\x18\x02 \x01(\fR\bcontents\"\xa8\x01\n" +
+	"\n" +
+	"PutRequest\x12\x17\n" +
+	"\arepo_id\x18\x01 \x01(\tR\x06repoId\x12#\n" +
+	"\rrelative_path\x18\x02 \x01(\tR\frelativePath\x12\x1a\n" +
+	"\bcontents\x18\x03 \x01(\fR\bcontents\x12\x1b\n" +
+	"\tfile_mode\x18\x04 \x01(\rR\bfileMode\x12#\n" +
+	"\rexpected_hash\x18\x05 \x01(\tR\fexpectedHash\"P\n" +
+	"\vPutResponse\x12'\n" +
+	"\x04file\x18\x01 \x01(\v2\x13.envsync.v1.EnvFileR\x04file\x12\x18\n" +
+	"\achanged\x18\x02 \x01(\bR\achanged\"\"\n" +
+	"\fWatchRequest\x12\x12\n" +
+	"\x04repo\x18\x01 \x01(\tR\x04repo\"\xba\x01\n" +
+	"\n" +
+	"WatchEvent\x12/\n" +
+	"\x04type\x18\x01 \x01(\x0e2\x1b.envsync.v1.WatchEvent.TypeR\x04type\x12'\n" +
+	"\x04file\x18\x02 \x01(\v2\x13.envsync.v1.EnvFileR\x04file\"R\n" +
+	"\x04Type\x12\x14\n" +
+	"\x10TYPE_UNSPECIFIED\x10\x00\x12\x10\n" +
+	"\fTYPE_CREATED\x10\x01\x12\x10\n" +
+	"\fTYPE_UPDATED\x10\x02\x12\x10\n" +
+	"\fTYPE_DELETED\x10\x032\xf1\x01\n" +
+	"\aEnvSync\x129\n" +
+	"\x04List\x12\x17.envsync.v1.ListRequest\x1a\x18.envsync.v1.ListResponse\x126\n" +
+	"\x03Get\x12\x16.envsync.v1.GetRequest\x1a\x17.envsync.v1.GetResponse\x126\n" +
+	"\x03Put\x12\x16.envsync.v1.PutRequest\x1a\x17.envsync.v1.PutResponse\x12;\n" +
+	"\x05Watch\x12\x18.envsync.v1.WatchRequest\x1a\x16.envsync.v1.WatchEvent0\x01B9Z7github.com/markibanez/env-sync/api/envsync/v1;envsyncv1b\x06proto3"
+
+var (
+	file_envsync_v1_envsync_proto_rawDescOnce sync.Once
+	file_envsync_v1_envsync_proto_rawDescData []byte
+)
+
+func file_envsync_v1_envsync_proto_rawDescGZIP() []byte {
+	file_envsync_v1_envsync_proto_rawDescOnce.Do(func() {
+		file_envsync_v1_envsync_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_envsync_v1_envsync_proto_rawDesc), len(file_envsync_v1_envsync_proto_rawDesc)))
+	})
+	return file_envsync_v1_envsync_proto_rawDescData
+}
+
+var file_envsync_v1_envsync_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
+var file_envsync_v1_envsync_proto_msgTypes = make([]protoimpl.MessageInfo, 9)
+var file_envsync_v1_envsync_proto_goTypes = []any{
+	(WatchEvent_Type)(0),          // 0: envsync.v1.WatchEvent.Type
+	(*EnvFile)(nil),               // 1: envsync.v1.EnvFile
+	(*ListRequest)(nil),           // 2: envsync.v1.ListRequest
+	(*ListResponse)(nil),          // 3: envsync.v1.ListResponse
+	(*GetRequest)(nil),            // 4: envsync.v1.GetRequest
+	(*GetResponse)(nil),           // 5: envsync.v1.GetResponse
+	(*PutRequest)(nil),            // 6: envsync.v1.PutRequest
+	(*PutResponse)(nil),           // 7: envsync.v1.PutResponse
+	(*WatchRequest)(nil),          // 8: envsync.v1.WatchRequest
+	(*WatchEvent)(nil),            // 9: envsync.v1.WatchEvent
+	(*timestamppb.Timestamp)(nil), // 10: google.protobuf.Timestamp
+}
+var file_envsync_v1_envsync_proto_depIdxs = []int32{
+	10, // 0: envsync.v1.EnvFile.modified_at:type_name -> google.protobuf.Timestamp
+	10, // 1: envsync.v1.EnvFile.updated_at:type_name -> google.protobuf.Timestamp
+	1,  // 2: envsync.v1.ListResponse.files:type_name -> envsync.v1.EnvFile
+	1,  // 3: envsync.v1.GetResponse.file:type_name -> envsync.v1.EnvFile
+	1,  // 4: envsync.v1.PutResponse.file:type_name -> envsync.v1.EnvFile
+	0,  // 5: envsync.v1.WatchEvent.type:type_name -> envsync.v1.WatchEvent.Type
+	1,  // 6: envsync.v1.WatchEvent.file:type_name -> envsync.v1.EnvFile
+	2,  // 7: envsync.v1.EnvSync.List:input_type -> envsync.v1.ListRequest
+	4,  // 8: envsync.v1.EnvSync.Get:input_type -> envsync.v1.GetRequest
+	6,  // 9: envsync.v1.EnvSync.Put:input_type -> envsync.v1.PutRequest
+	8,  // 10: envsync.v1.EnvSync.Watch:input_type -> envsync.v1.WatchRequest
+	3,  // 11: envsync.v1.EnvSync.List:output_type -> envsync.v1.ListResponse
+	5,  // 12: envsync.v1.EnvSync.Get:output_type -> envsync.v1.GetResponse
+	7,  // 13: envsync.v1.EnvSync.Put:output_type -> envsync.v1.PutResponse
+	9,  // 14: envsync.v1.EnvSync.Watch:output_type -> envsync.v1.WatchEvent
+	11, // [11:15] is the sub-list for method output_type
+	7,  // [7:11] is the sub-list for method input_type
+	7,  // [7:7] is the sub-list for extension type_name
+	7,  // [7:7] is the sub-list for extension extendee
+	0,  // [0:7] is the sub-list for field type_name
+}
+
+func init() { file_envsync_v1_envsync_proto_init() }
+func file_envsync_v1_envsync_proto_init() {
+	if File_envsync_v1_envsync_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_envsync_v1_envsync_proto_rawDesc), len(file_envsync_v1_envsync_proto_rawDesc)),
+			NumEnums:      1,
+			NumMessages:   9,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_envsync_v1_envsync_proto_goTypes,
+		DependencyIndexes: file_envsync_v1_envsync_proto_depIdxs,
+		EnumInfos:         file_envsync_v1_envsync_proto_enumTypes,
+		MessageInfos:      file_envsync_v1_envsync_proto_msgTypes,
+	}.Build()
+	File_envsync_v1_envsync_proto = out.File
+	file_envsync_v1_envsync_proto_goTypes = nil
+	file_envsync_v1_envsync_proto_depIdxs = nil
+}
@@ -0,0 +1,5 @@
+// Package envsyncv1 is the gRPC API served by `env-sync serve`, generated
+// from envsync.proto.
+package envsyncv1
+
+//go:generate protoc -I ../.. --go_out=../.. --go_opt=paths=source_relative --go-grpc_out=../.. --go-grpc_opt=paths=source_relative envsync/v1/envsync.proto
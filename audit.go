@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Audited actions
+const (
+	auditUpload   = "upload"
+	auditDownload = "download"
+	auditMerge    = "merge"
+	auditRollback = "rollback"
+	auditImport   = "import"
+	auditRename   = "rename"
+	auditDelete   = "delete"
+	auditRotate   = "rotate"
+	auditShare    = "share"
+	auditUnshare  = "unshare"
+	auditPrune    = "prune"
+	auditMove     = "move"
+)
+
+// AuditStore is implemented by backends that keep an audit log of every
+// change made to stored files, keys and local copies
+type AuditStore interface {
+	AddAuditEntries(ctx context.Context, entries []AuditEntry) error
+	ListAuditEntries(ctx context.Context, since string) ([]AuditEntry, error)
+}
+
+// AuditEntry is one row of the audit_log table
+type AuditEntry struct {
+	CreatedAt    string `json:"created_at"`
+	Machine      string `json:"machine"`
+	RepoID       string `json:"repo_id"`
+	RelativePath string `json:"relative_path,omitempty"`
+	Action       string `json:"action"`
+	HashBefore   string `json:"hash_before,omitempty"`
+	HashAfter    string `json:"hash_after,omitempty"`
+	Detail       string `json:"detail,omitempty"`
+}
+
+// createAuditTable creates the audit_log table
+func createAuditTable(tx *schemaTx) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS audit_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		created_at DATETIME NOT NULL,
+		machine TEXT NOT NULL,
+		repo_id TEXT NOT NULL,
+		relative_path TEXT NOT NULL,
+		action TEXT NOT NULL,
+		hash_before TEXT NOT NULL,
+		hash_after TEXT NOT NULL,
+		detail TEXT NOT NULL
+	);
+	`
+	if _, err := tx.Exec(tx.ddl(query)); err != nil {
+		return fmt.Errorf("failed to create audit_log table: %v", err)
+	}
+	return nil
+}
+
+// AddAuditEntries appends entries to the audit log in a single transaction
+func (db *Database) AddAuditEntries(ctx context.Context, entries []AuditEntry) error {
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO audit_log (namespace, created_at, machine, repo_id, relative_path, action, hash_before, hash_after, detail) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare audit insert: %v", err)
+	}
+	defer stmt.Close()
+
+	for _, e := range entries {
+		if _, err := stmt.ExecContext(ctx, db.namespace, e.CreatedAt, e.Machine, e.RepoID, e.RelativePath, e.Action, e.HashBefore, e.HashAfter, e.Detail); err != nil {
+			return fmt.Errorf("failed to record audit entry: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit audit entries: %v", err)
+	}
+	return nil
+}
+
+// ListAuditEntries returns audit entries recorded at or after since (all if empty), newest first
+func (db *Database) ListAuditEntries(ctx context.Context, since string) ([]AuditEntry, error) {
+	query := `SELECT created_at, machine, repo_id, relative_path, action, hash_before, hash_after, detail FROM audit_log WHERE namespace = ? AND created_at >= ? ORDER BY id DESC`
+
+	rows, err := db.conn.QueryContext(ctx, query, db.namespace, since)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query audit log: %v", err)
+	}
+	defer rows.Close()
+
+	var entries []AuditEntry
+	for rows.Next() {
+		var e AuditEntry
+		if err := rows.Scan(&e.CreatedAt, &e.Machine, &e.RepoID, &e.RelativePath, &e.Action, &e.HashBefore, &e.HashAfter, &e.Detail); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %v", err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// auditMachine identifies this machine in the audit log
+func auditMachine() string {
+	host, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return host
+}
+
+// newAuditEntry stamps an entry with the current time and this machine
+func newAuditEntry(action, repoID, relativePath, hashBefore, hashAfter string) AuditEntry {
+	return AuditEntry{
+		CreatedAt:    storedNow(),
+		Machine:      auditMachine(),
+		RepoID:       repoID,
+		RelativePath: relativePath,
+		Action:       action,
+		HashBefore:   hashBefore,
+		HashAfter:    hashAfter,
+	}
+}
+
+// auditKey identifies a stored file in a storedHashes map
+func auditKey(repoID, relativePath string) string {
+	return repoID + "\x00" + relativePath
+}
+
+// storedHashes maps every stored file to its current hash, so changes can be
+// logged with the hash they replaced. Errors yield an empty map.
+func storedHashes(ctx context.Context, db Store) map[string]string {
+	hashes := make(map[string]string)
+	records, err := db.ListEnvFiles(ctx)
+	if err != nil {
+		return hashes
+	}
+	for _, record := range records {
+		hashes[auditKey(record.RepoID, record.RelativePath)] = record.FileHash
+	}
+	return hashes
+}
+
+// auditWriteTimeout bounds recording an audit entry, which still happens
+// after the command was cancelled
+const auditWriteTimeout = 10 * time.Second
+
+// recordAudit appends entries to the audit log if the backend keeps one.
+// A failure is logged rather than returned, since the change already happened;
+// for the same reason, cancelling ctx doesn't stop the entries being written.
+func recordAudit(ctx context.Context, db Store, entries ...AuditEntry) {
+	if r, ok := db.(*ReplicatedStore); ok {
+		// The audit log lives in the primary only
+		db = r.primary()
+	}
+	audit, ok := db.(AuditStore)
+	if !ok || len(entries) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), auditWriteTimeout)
+	defer cancel()
+	if err := audit.AddAuditEntries(ctx, entries); err != nil {
+		logger.Warn("failed to record audit entry", "action", entries[0].Action, "repo", entries[0].RepoID, "error", err)
+	}
+}
+
+// showAudit prints audit entries, newest first, matching the repo/path
+// filters, an optional action and a since time
+func showAudit(ctx context.Context, dbConnStr string, filter FileFilter, action string, since time.Duration, limit int) error {
+	db, err := OpenStore(dbConnStr)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	audit, ok := db.(AuditStore)
+	if !ok {
+		return fmt.Errorf("the audit log requires a SQL database backend")
+	}
+	if err := db.InitSchema(ctx); err != nil {
+		return err
+	}
+
+	sinceTime := ""
+	if since > 0 {
+		sinceTime = formatStoredTime(time.Now().Add(-since))
+	}
+	entries, err := audit.ListAuditEntries(ctx, sinceTime)
+	if err != nil {
+		return err
+	}
+
+	var matched []AuditEntry
+	for _, e := range entries {
+		if action != "" && e.Action != action {
+			continue
+		}
+		if !filter.Match(e.RepoID, e.RelativePath) {
+			continue
+		}
+		matched = append(matched, e)
+		if limit > 0 && len(matched) >= limit {
+			break
+		}
+	}
+
+	if jsonOutput {
+		if matched == nil {
+			matched = []AuditEntry{}
+		}
+		printJSON(map[string]interface{}{"entries": matched})
+		return nil
+	}
+
+	if len(matched) == 0 {
+		fmt.Println("No audit entries found")
+		return nil
+	}
+
+	for _, e := range matched {
+		change := ""
+		if e.HashBefore != "" || e.HashAfter != "" {
+			change = fmt.Sprintf("  %s → %s", shortHash(e.HashBefore), shortHash(e.HashAfter))
+		}
+		detail := ""
+		if e.Detail != "" {
+			detail = "  (" + e.Detail + ")"
+		}
+		target := shortenRepoID(e.RepoID)
+		if e.RelativePath != "" {
+			target += "/" + e.RelativePath
+		}
+		fmt.Printf("%s  %-10s %-16s %s%s%s\n", e.CreatedAt, e.Action, e.Machine, target, change, detail)
+	}
+	return nil
+}
+
+// shortHash abbreviates a file hash for display
+func shortHash(hash string) string {
+	if hash == "" {
+		return "-"
+	}
+	return hash[:min(12, len(hash))]
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	backupTimeFormat     = "20060102-150405"
+	defaultBackupKeep    = 50                  // Most recent backup sessions to keep
+	defaultBackupMaxAge  = 30 * 24 * time.Hour // Sessions older than this are pruned
+	backupManifestName   = "manifest.json"
+	backupFilesDirectory = "files"
+)
+
+// BackupEntry records where a backed-up file originally lived
+type BackupEntry struct {
+	OriginalPath string `json:"original_path"`
+	BackupFile   string `json:"backup_file"` // Relative to the session directory
+	BackedUpAt   string `json:"backed_up_at"`
+}
+
+// backupSession groups all backups taken by one env-sync run under
+// ~/.env-sync/backups/<timestamp>/
+type backupSession struct {
+	mu      sync.Mutex
+	dir     string
+	entries []BackupEntry
+}
+
+var (
+	currentBackupSession     *backupSession
+	currentBackupSessionErr  error
+	currentBackupSessionOnce sync.Once
+)
+
+func getBackupsDir() (string, error) {
+	dir, err := getStorageDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "backups"), nil
+}
+
+// getBackupSession creates this run's backup directory on first use and prunes old sessions
+func getBackupSession() (*backupSession, error) {
+	currentBackupSessionOnce.Do(func() {
+		backupsDir, err := getBackupsDir()
+		if err != nil {
+			currentBackupSessionErr = err
+			return
+		}
+
+		name := time.Now().UTC().Format(backupTimeFormat)
+		dir := filepath.Join(backupsDir, name)
+		// Two runs in the same second get distinct sessions
+		for i := 1; ; i++ {
+			if _, err := os.Stat(dir); os.IsNotExist(err) {
+				break
+			}
+			dir = filepath.Join(backupsDir, fmt.Sprintf("%s-%d", name, i))
+		}
+
+		if err := os.MkdirAll(filepath.Join(dir, backupFilesDirectory), 0700); err != nil {
+			currentBackupSessionErr = fmt.Errorf("failed to create backup directory: %v", err)
+			return
+		}
+
+		currentBackupSession = &backupSession{dir: dir}
+
+		if _, err := pruneBackups(defaultBackupKeep, defaultBackupMaxAge); err != nil {
+			logger.Warn("couldn't prune old backups", "error", err)
+		}
+	})
+	return currentBackupSession, currentBackupSessionErr
+}
+
+// backupLocalFile copies localPath into the current backup session before it is
+// overwritten. Missing files and files whose contents won't change are skipped.
+func backupLocalFile(localPath string, newContents []byte) error {
+	existing, err := os.ReadFile(localPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read file for backup: %v", err)
+	}
+	if string(existing) == string(newContents) {
+		return nil
+	}
+
+	session, err := getBackupSession()
+	if err != nil {
+		return err
+	}
+
+	absPath, err := filepath.Abs(localPath)
+	if err != nil {
+		absPath = localPath
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	backupFile := filepath.Join(backupFilesDirectory, fmt.Sprintf("%04d_%s", len(session.entries)+1, filepath.Base(localPath)))
+	if err := os.WriteFile(filepath.Join(session.dir, backupFile), existing, 0600); err != nil {
+		return fmt.Errorf("failed to write backup: %v", err)
+	}
+
+	session.entries = append(session.entries, BackupEntry{
+		OriginalPath: absPath,
+		BackupFile:   filepath.ToSlash(backupFile),
+		BackedUpAt:   time.Now().UTC().Format(time.RFC3339),
+	})
+
+	data, err := json.MarshalIndent(session.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(session.dir, backupManifestName), data, 0600)
+}
+
+// writeFileWithBackup backs up the current file, then writes contents over it
+// with exactly the permissions perm
+func writeFileWithBackup(path string, contents []byte, perm os.FileMode) error {
+	if err := backupLocalFile(path, contents); err != nil {
+		return fmt.Errorf("backup failed, not overwriting: %v", err)
+	}
+	// Tighten an existing file before the new contents land in it
+	if err := os.Chmod(path, perm); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.WriteFile(path, contents, perm); err != nil {
+		return err
+	}
+	// New files were created subject to the umask
+	return os.Chmod(path, perm)
+}
+
+// listBackupSessions returns backup session names, newest first
+func listBackupSessions() ([]string, error) {
+	backupsDir, err := getBackupsDir()
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(backupsDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var sessions []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			sessions = append(sessions, entry.Name())
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(sessions)))
+	return sessions, nil
+}
+
+func loadBackupManifest(session string) ([]BackupEntry, error) {
+	backupsDir, err := getBackupsDir()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(filepath.Join(backupsDir, session, backupManifestName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []BackupEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("invalid backup manifest for %s: %v", session, err)
+	}
+	return entries, nil
+}
+
+// pruneBackups removes sessions beyond the newest keep, and sessions older than maxAge
+func pruneBackups(keep int, maxAge time.Duration) (int, error) {
+	sessions, err := listBackupSessions()
+	if err != nil {
+		return 0, err
+	}
+	backupsDir, err := getBackupsDir()
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	cutoff := time.Now().UTC().Add(-maxAge)
+	for i, session := range sessions {
+		if currentBackupSession != nil && filepath.Join(backupsDir, session) == currentBackupSession.dir {
+			continue
+		}
+
+		expired := false
+		if takenAt, err := time.Parse(backupTimeFormat, session[:min(len(session), len(backupTimeFormat))]); err == nil {
+			expired = maxAge > 0 && takenAt.Before(cutoff)
+		}
+		if (keep > 0 && i >= keep) || expired {
+			if err := os.RemoveAll(filepath.Join(backupsDir, session)); err != nil {
+				return removed, err
+			}
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+func listBackups() error {
+	sessions, err := listBackupSessions()
+	if err != nil {
+		return err
+	}
+
+	if len(sessions) == 0 {
+		fmt.Println("No backups found")
+		return nil
+	}
+
+	fmt.Printf("%d backup session(s):\n", len(sessions))
+	for _, session := range sessions {
+		entries, err := loadBackupManifest(session)
+		if err != nil {
+			fmt.Printf("  %s  (unreadable: %v)\n", session, err)
+			continue
+		}
+		fmt.Printf("  %s  %d file(s)\n", session, len(entries))
+		for _, entry := range entries {
+			fmt.Printf("    - %s\n", entry.OriginalPath)
+		}
+	}
+	return nil
+}
+
+// restoreBackups writes files from a backup session back to their original paths.
+// If match is non-empty, only original paths containing it are restored.
+func restoreBackups(session, match string) error {
+	entries, err := loadBackupManifest(session)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("no backups found in session %s (see 'env-sync backups list')", session)
+	}
+
+	backupsDir, err := getBackupsDir()
+	if err != nil {
+		return err
+	}
+
+	restored := 0
+	for _, entry := range entries {
+		if match != "" && !strings.Contains(filepath.ToSlash(entry.OriginalPath), filepath.ToSlash(match)) {
+			continue
+		}
+
+		contents, err := os.ReadFile(filepath.Join(backupsDir, session, filepath.FromSlash(entry.BackupFile)))
+		if err != nil {
+			logger.Warn("failed to read backup", "file", entry.OriginalPath, "error", err)
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Dir(entry.OriginalPath), 0755); err != nil {
+			logger.Warn("failed to create directory", "file", entry.OriginalPath, "error", err)
+			continue
+		}
+
+		// The current file is backed up too, so a restore can itself be undone
+		if err := writeFileWithBackup(entry.OriginalPath, contents, restoreFileMode(0, entry.OriginalPath)); err != nil {
+			logger.Warn("failed to restore", "file", entry.OriginalPath, "error", err)
+			continue
+		}
+
+		fmt.Printf("✓ Restored: %s\n", entry.OriginalPath)
+		restored++
+	}
+
+	if restored == 0 && match != "" {
+		return fmt.Errorf("no files in session %s match %q", session, match)
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// localRepoID is the repo ID of files outside a git repo with a remote,
+// stored by their path relative to --base
+const localRepoID = "__local__"
+
+// basePathRepoID returns the repo ID of non-git files under the named base
+// path of the config, e.g. "__local__:personal"
+func basePathRepoID(name string) string {
+	return localRepoID + ":" + name
+}
+
+// homeRepoID is the repo ID of non-git files stored relative to the home
+// directory, with local_paths set to "home" in the config
+const homeRepoID = localRepoID + ":~"
+
+// isLocalRepo reports whether repoID holds files outside git repos, relative
+// to --base or to one of the config's base paths
+func isLocalRepo(repoID string) bool {
+	return repoID == localRepoID || strings.HasPrefix(repoID, localRepoID+":")
+}
+
+// configuredBasePaths returns the config's base_paths, by name, as absolute
+// paths. "~/" stands for the home directory. They're worked out once per
+// load of the config.
+var configuredBasePaths = deriveFromConfig(func(config *Config) map[string]string {
+	if len(config.BasePaths) == 0 {
+		return nil
+	}
+	home, _ := os.UserHomeDir()
+	paths := make(map[string]string, len(config.BasePaths))
+	for name, path := range config.BasePaths {
+		if name == "" || name == "~" || strings.ContainsAny(name, `/\`) {
+			logger.Warn("skipping base path with an invalid name", "name", name)
+			continue
+		}
+		if rest, ok := strings.CutPrefix(path, "~/"); ok && home != "" {
+			path = filepath.Join(home, rest)
+		}
+		absPath, err := normalizePath(path)
+		if err != nil {
+			logger.Warn("skipping base path", "name", name, "path", path, "error", err)
+			continue
+		}
+		paths[name] = absPath
+	}
+	return paths
+}).get
+
+// basePathRoots returns the directories of the config's base paths, sorted
+func basePathRoots() []string {
+	var roots []string
+	for _, path := range configuredBasePaths() {
+		roots = append(roots, path)
+	}
+	sort.Strings(roots)
+	return roots
+}
+
+// homeRelativePaths reports whether the config stores non-git files outside
+// its base paths relative to the home directory instead of --base
+var homeRelativePaths = deriveFromConfig(func(config *Config) bool {
+	switch config.LocalPaths {
+	case "", "base":
+		return false
+	case "home":
+		return true
+	default:
+		logger.Warn(`unknown local_paths in the config, using "base"`, "local_paths", config.LocalPaths)
+		return false
+	}
+}).get
+
+// homeDir returns the home directory as an absolute path
+func homeDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return normalizePath(home)
+}
+
+// within reports whether path is dir or inside it
+func within(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// localFileIdentifier returns the repo ID and relative path of a file outside
+// a git repo: relative to the innermost base path of the config containing it,
+// else to the home directory with local_paths set to "home", else to
+// basePath. Relative paths always use forward slashes, so the same file gets
+// the same ID on Windows and Unix.
+func localFileIdentifier(filePath, basePath string) (string, string, error) {
+	absFile, err := normalizePath(filePath)
+	if err != nil {
+		return "", "", err
+	}
+	absBase, err := normalizePath(basePath)
+	if err != nil {
+		return "", "", err
+	}
+	repoID, root := localRepoID, absBase
+	for name, path := range configuredBasePaths() {
+		if !within(path, absFile) {
+			continue
+		}
+		if repoID == localRepoID || len(path) > len(root) {
+			repoID, root = basePathRepoID(name), path
+		}
+	}
+	if repoID == localRepoID && homeRelativePaths() {
+		// Files outside the home directory, e.g. on another drive, stay
+		// relative to basePath
+		if home, err := homeDir(); err == nil && within(home, absFile) {
+			repoID, root = homeRepoID, home
+		}
+	}
+	relPath, err := filepath.Rel(root, absFile)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get relative path: %v", err)
+	}
+	return repoID, filepath.ToSlash(relPath), nil
+}
+
+// basePathOf returns the directory a local repo ID's files are relative to:
+// basePath for "__local__", the home directory for "__local__:~", else the
+// config's base path of that name
+func basePathOf(repoID, basePath string) (string, error) {
+	name, ok := strings.CutPrefix(repoID, localRepoID+":")
+	if !ok {
+		return basePath, nil
+	}
+	if repoID == homeRepoID {
+		return homeDir()
+	}
+	path, ok := configuredBasePaths()[name]
+	if !ok {
+		return "", fmt.Errorf("%s has no base path named %q on this machine (see base_paths in the config)", repoID, name)
+	}
+	return path, nil
+}
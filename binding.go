@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// Stored copies carry the repo ID and path of the file they were written for
+// inside the encrypted payload, where the GCM tag (or age's MAC) covers them:
+// a marker, the uvarint length of "repoID\x00relativePath", the binding
+// itself, then the compressed or delta payload. A copy pasted onto another
+// row, by hand or by a buggy migration, then fails to open instead of
+// silently downloading as the wrong file. Copies written before this, or
+// with share_contents set in the config, have no binding and still open.
+//
+// The binding isn't GCM additional data: age has none, and the binding has to
+// be read back from the copy to name the file it belongs to and to find the
+// copies a move left bound to the old name.
+const bindingSeparator = "\x00"
+
+// contentBinding names the file a stored copy belongs to
+func contentBinding(repoID, relativePath string) string {
+	return repoID + bindingSeparator + relativePath
+}
+
+// bindContents reports whether new copies are bound to their file. With
+// share_contents set they aren't, so identical files can share one copy.
+func bindContents() bool {
+	config, err := loadConfig()
+	return err != nil || !config.ShareContents
+}
+
+// filePayload binds an encoded plaintext to its file, if new copies are bound
+func filePayload(repoID, relativePath string, payload []byte) []byte {
+	if !bindContents() {
+		return payload
+	}
+	return bindPayload(repoID, relativePath, payload)
+}
+
+// bindPayload prefixes an encoded plaintext with the file it belongs to
+func bindPayload(repoID, relativePath string, payload []byte) []byte {
+	binding := contentBinding(repoID, relativePath)
+	bound := []byte{formatMarker, formatBoundV1}
+	bound = binary.AppendUvarint(bound, uint64(len(binding)))
+	bound = append(bound, binding...)
+	return append(bound, payload...)
+}
+
+// unbindPayload splits a bound payload into its binding and the payload it
+// wraps. Unbound payloads are returned as they are, with no binding.
+func unbindPayload(data []byte) (string, []byte, error) {
+	if len(data) < 2 || data[0] != formatMarker || data[1] != formatBoundV1 {
+		return "", data, nil
+	}
+	size, n := binary.Uvarint(data[2:])
+	if n <= 0 || size > uint64(len(data)-2-n) {
+		return "", nil, fmt.Errorf("invalid bound contents")
+	}
+	start := 2 + n
+	return string(data[start : start+int(size)]), data[start+int(size):], nil
+}
+
+// bindingError is returned for a stored copy that was written for another file
+type bindingError struct {
+	binding, repoID, relativePath string
+}
+
+func (e *bindingError) Error() string {
+	repoID, relativePath, _ := strings.Cut(e.binding, bindingSeparator)
+	return fmt.Sprintf("stored contents of %s:%s belong to %s:%s (copied from another file?)", e.repoID, e.relativePath, repoID, relativePath)
+}
+
+// openPayload decrypts one stored copy of a repo's file, leaving the
+// plaintext encoded
+func openPayload(ctx context.Context, db Store, repoID, encryptedData, password string) ([]byte, error) {
+	if strings.HasPrefix(encryptedData, dataKeyPrefix) {
+		key, err := repoDataKey(ctx, db, repoID)
+		if err != nil {
+			return nil, err
+		}
+		if key == nil {
+			return nil, fmt.Errorf("%s is encrypted with a repo key but no key is stored", repoID)
+		}
+		return decryptPayloadWithKey(encryptedData, key)
+	}
+	return decryptPayload(encryptedData, password)
+}
+
+// storedBinding returns the binding of a stored copy, or "" if it has none
+func storedBinding(ctx context.Context, db Store, repoID, encryptedData, password string) (string, error) {
+	payload, err := openPayload(ctx, db, repoID, encryptedData, password)
+	if err != nil {
+		return "", err
+	}
+	binding, _, err := unbindPayload(payload)
+	return binding, err
+}
+
+// rebindContents returns stored contents that open as repoID:relativePath:
+// the contents themselves if they're unbound or already bound to it,
+// otherwise re-encrypted in full. Moves and renames keep the file's copies,
+// which are still bound to its old name.
+func rebindContents(ctx context.Context, db Store, repoID, relativePath, encryptedData, password string) (string, error) {
+	binding, err := storedBinding(ctx, db, repoID, encryptedData, password)
+	if err != nil {
+		return "", err
+	}
+	if binding == "" || binding == contentBinding(repoID, relativePath) {
+		return encryptedData, nil
+	}
+	plaintext, err := openRevisionContents(ctx, db, repoID, relativePath, encryptedData, password)
+	if err != nil {
+		return "", err
+	}
+	return sealContents(ctx, db, repoID, relativePath, plaintext, password)
+}
+
+// rebindEnvFile re-encrypts a file's stored copy under its current name
+// after a move or rename, if it was bound to the old one
+func rebindEnvFile(ctx context.Context, db Store, repoID, relativePath, password string) error {
+	record, err := db.GetEnvFileWithMetadata(ctx, repoID, relativePath)
+	if err != nil || record == nil {
+		return fmt.Errorf("failed to read %s:%s: %v", repoID, relativePath, err)
+	}
+	sealed, err := rebindContents(ctx, db, repoID, relativePath, record.Contents, password)
+	if err != nil {
+		return fmt.Errorf("failed to re-encrypt %s:%s: %v (wrong password?)", repoID, relativePath, err)
+	}
+	if sealed == record.Contents {
+		return nil
+	}
+	return db.UpsertEnvFile(ctx, repoID, relativePath, sealed, record.FileHash, record.FileModifiedAt, record.FileMode)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// bundleHeader starts every export file so import can recognise it
+const bundleHeader = "ENV-SYNC-BUNDLE 1\n"
+
+// envBundle is the portable archive written by export. The records keep their
+// stored (already encrypted) contents, and the whole bundle is encrypted again
+// so repo IDs and paths aren't readable either.
+type envBundle struct {
+	ExportedAt string          `json:"exported_at"`
+	Files      []bundleFile    `json:"files"`
+	Users      []TeamUser      `json:"users,omitempty"`
+	RepoKeys   []bundleRepoKey `json:"repo_keys,omitempty"`
+}
+
+type bundleFile struct {
+	RepoID         string      `json:"repo_id"`
+	RelativePath   string      `json:"relative_path"`
+	Contents       string      `json:"contents"`
+	FileHash       string      `json:"file_hash"`
+	FileModifiedAt string      `json:"file_modified_at"`
+	FileMode       os.FileMode `json:"file_mode,omitempty"`
+}
+
+type bundleRepoKey struct {
+	RepoID     string `json:"repo_id"`
+	UserName   string `json:"user_name"`
+	WrappedKey string `json:"wrapped_key"`
+}
+
+// exportBundle writes every stored record (and team keys, if any) to an encrypted bundle file
+func exportBundle(ctx context.Context, dbConnStr, password, outputPath string, filter FileFilter) error {
+	db, err := OpenStore(dbConnStr)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := db.InitSchema(ctx); err != nil {
+		return err
+	}
+
+	bundle, err := collectBundle(ctx, db, password, filter.Match)
+	if err != nil {
+		return err
+	}
+	if len(bundle.Files) == 0 {
+		return fmt.Errorf("no env files to export")
+	}
+	if err := writeBundle(outputPath, bundle, password); err != nil {
+		return err
+	}
+
+	fmt.Printf("✓ Exported %d file(s) to %s\n", len(bundle.Files), outputPath)
+	return nil
+}
+
+// collectBundle reads the stored records that match, and the team keys of
+// their repos, into a bundle
+func collectBundle(ctx context.Context, db Store, password string, match func(repoID, relativePath string) bool) (*envBundle, error) {
+	records, err := db.ListEnvFiles(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	bundle := &envBundle{ExportedAt: time.Now().UTC().Format(time.RFC3339)}
+	repos := make(map[string]bool)
+	for _, record := range records {
+		if !match(record.RepoID, record.RelativePath) {
+			continue
+		}
+		full, err := db.GetEnvFileWithMetadata(ctx, record.RepoID, record.RelativePath)
+		if err != nil || full == nil {
+			return nil, fmt.Errorf("failed to read %s:%s: %v", record.RepoID, record.RelativePath, err)
+		}
+		// History isn't exported, so deltas against it are stored in full
+		if full.Contents, err = standaloneContents(ctx, db, full.RepoID, full.RelativePath, full.Contents, password); err != nil {
+			return nil, fmt.Errorf("failed to decrypt %s:%s: %v", full.RepoID, full.RelativePath, err)
+		}
+		bundle.Files = append(bundle.Files, bundleFile{
+			RepoID:         full.RepoID,
+			RelativePath:   full.RelativePath,
+			Contents:       full.Contents,
+			FileHash:       full.FileHash,
+			FileModifiedAt: full.FileModifiedAt,
+			FileMode:       full.FileMode,
+		})
+		repos[full.RepoID] = true
+	}
+
+	// Shared repos can only be decrypted with their wrapped data keys
+	if team, ok := db.(TeamStore); ok && len(repos) > 0 {
+		if bundle.Users, err = team.ListUsers(ctx); err != nil {
+			return nil, err
+		}
+		for repoID := range repos {
+			names, err := team.ListRepoKeyGrants(ctx, repoID)
+			if err != nil {
+				return nil, err
+			}
+			for _, name := range names {
+				wrapped, err := team.GetRepoKeyGrant(ctx, repoID, name)
+				if err != nil {
+					return nil, err
+				}
+				bundle.RepoKeys = append(bundle.RepoKeys, bundleRepoKey{RepoID: repoID, UserName: name, WrappedKey: wrapped})
+			}
+		}
+	}
+	return bundle, nil
+}
+
+// writeBundle encrypts a bundle with password and writes it to outputPath
+func writeBundle(outputPath string, bundle *envBundle, password string) error {
+	data, err := json.Marshal(bundle)
+	if err != nil {
+		return fmt.Errorf("failed to encode bundle: %v", err)
+	}
+	sealed, err := Encrypt(string(data), password)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(outputPath, []byte(bundleHeader+sealed+"\n"), 0600); err != nil {
+		return fmt.Errorf("failed to write bundle: %v", err)
+	}
+	return nil
+}
+
+func readBundle(inputPath, password string) (*envBundle, error) {
+	data, err := os.ReadFile(inputPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bundle: %v", err)
+	}
+	if !strings.HasPrefix(string(data), bundleHeader) {
+		return nil, fmt.Errorf("%s is not an env-sync bundle", inputPath)
+	}
+
+	plaintext, err := Decrypt(strings.TrimSpace(strings.TrimPrefix(string(data), bundleHeader)), password)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt bundle: %v (wrong password?)", err)
+	}
+
+	var bundle envBundle
+	if err := json.Unmarshal([]byte(plaintext), &bundle); err != nil {
+		return nil, fmt.Errorf("invalid bundle: %v", err)
+	}
+	return &bundle, nil
+}
+
+// importBundle loads an exported bundle into a database. Existing files with
+// the same repo and path are replaced (their old contents stay in history).
+func importBundle(ctx context.Context, dbConnStr, password, inputPath string, filter FileFilter) error {
+	bundle, err := readBundle(inputPath, password)
+	if err != nil {
+		return err
+	}
+
+	db, err := OpenStore(dbConnStr)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := db.InitSchema(ctx); err != nil {
+		return err
+	}
+
+	var records []EnvFileRecord
+	repos := make(map[string]bool)
+	for _, file := range bundle.Files {
+		if !filter.Match(file.RepoID, file.RelativePath) {
+			continue
+		}
+		records = append(records, EnvFileRecord{
+			RepoID:         file.RepoID,
+			RelativePath:   file.RelativePath,
+			Contents:       file.Contents,
+			FileHash:       file.FileHash,
+			FileModifiedAt: file.FileModifiedAt,
+			FileMode:       file.FileMode,
+		})
+		repos[file.RepoID] = true
+	}
+
+	if len(records) == 0 {
+		return fmt.Errorf("no env files in the bundle match the given filters")
+	}
+
+	if len(bundle.RepoKeys) > 0 {
+		team, ok := db.(TeamStore)
+		if !ok {
+			return fmt.Errorf("the bundle contains shared repos, which need a SQL database backend")
+		}
+		for _, user := range bundle.Users {
+			existing, err := team.GetUser(ctx, user.Name)
+			if err != nil {
+				return err
+			}
+			if existing == nil {
+				if err := team.AddUser(ctx, user.Name, user.PublicKey); err != nil {
+					return err
+				}
+			}
+		}
+		for _, grant := range bundle.RepoKeys {
+			if !repos[grant.RepoID] {
+				continue
+			}
+			if err := team.PutRepoKeyGrant(ctx, grant.RepoID, grant.UserName, grant.WrappedKey); err != nil {
+				return err
+			}
+		}
+	}
+
+	previousHashes := storedHashes(ctx, db)
+	if err := db.UpsertEnvFiles(ctx, records); err != nil {
+		return err
+	}
+
+	entries := make([]AuditEntry, 0, len(records))
+	for _, record := range records {
+		entry := newAuditEntry(auditImport, record.RepoID, record.RelativePath, previousHashes[auditKey(record.RepoID, record.RelativePath)], record.FileHash)
+		entry.Detail = "from " + inputPath
+		entries = append(entries, entry)
+	}
+	recordAudit(ctx, db, entries...)
+
+	fmt.Printf("✓ Imported %d file(s) from %s (exported %s)\n", len(records), inputPath, bundle.ExportedAt)
+	return nil
+}
@@ -0,0 +1,548 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CI tokens give a pipeline read access to one repo's files without the
+// database credentials or the encryption password. Creating a token exports
+// a snapshot of the repo's files, encrypted with a key derived from the
+// token, into ci_tokens; the database only keeps a hash of the token itself.
+// ci-fetch reads that row with any connection that can (a read-only one is
+// enough), so the token can't open other repos or other tokens' snapshots.
+
+// envCIToken is read by ci-fetch when --token isn't given
+const envCIToken = "ENV_SYNC_CI_TOKEN"
+
+// ciTokenPrefix starts every token, so it's recognisable in secret scanners
+const ciTokenPrefix = "envsync_ci_"
+
+// ciToken is a row of ci_tokens
+type ciToken struct {
+	ID          string
+	RepoID      string
+	TokenHash   string // SHA-256 of the token's secret
+	SnapshotKey string // The snapshot key, encrypted with the password, so the snapshot can be refreshed
+	Snapshot    string // The files, encrypted with the snapshot key
+	Includes    string // Comma-separated --include globs the snapshot was limited to
+	Excludes    string // And --exclude globs
+	CreatedBy   string
+	CreatedAt   string
+	ExpiresAt   string
+	RefreshedAt string
+}
+
+// ciSnapshot is what a token's snapshot decrypts to
+type ciSnapshot struct {
+	RepoID     string           `json:"repo_id"`
+	ExportedAt string           `json:"exported_at"`
+	Files      []ciSnapshotFile `json:"files"`
+}
+
+type ciSnapshotFile struct {
+	RelativePath string      `json:"relative_path"`
+	Contents     string      `json:"contents"`
+	FileMode     os.FileMode `json:"file_mode,omitempty"`
+}
+
+// ciTokenStore is implemented by backends that can hold CI tokens
+type ciTokenStore interface {
+	PutCIToken(ctx context.Context, token ciToken) error
+	// GetCIToken returns nil if there is no token with that ID
+	GetCIToken(ctx context.Context, id string) (*ciToken, error)
+	ListCITokens(ctx context.Context) ([]ciToken, error)
+	UpdateCISnapshot(ctx context.Context, id, snapshot, refreshedAt string) error
+	DeleteCIToken(ctx context.Context, id string) (bool, error)
+}
+
+// ciTokenStoreOf returns the CI tokens of the store behind db, if it has
+// them. Like tags, they live in the primary only.
+func ciTokenStoreOf(db Store) ciTokenStore {
+	if r, ok := db.(*ReplicatedStore); ok {
+		db = r.primary()
+	}
+	tokens, _ := db.(ciTokenStore)
+	return tokens
+}
+
+// createCITokenTable creates ci_tokens, one row per CI token
+func createCITokenTable(tx *schemaTx) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS ci_tokens (
+		id TEXT PRIMARY KEY,
+		repo_id TEXT NOT NULL,
+		token_hash TEXT NOT NULL,
+		snapshot_key TEXT NOT NULL,
+		snapshot TEXT NOT NULL,
+		includes TEXT NOT NULL DEFAULT '',
+		excludes TEXT NOT NULL DEFAULT '',
+		created_by TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		expires_at DATETIME NOT NULL,
+		refreshed_at DATETIME NOT NULL
+	);
+	`
+	if _, err := tx.Exec(tx.ddl(query)); err != nil {
+		return fmt.Errorf("failed to create ci_tokens table: %v", err)
+	}
+	return nil
+}
+
+const ciTokenColumns = `id, repo_id, token_hash, snapshot_key, snapshot, includes, excludes, created_by, created_at, expires_at, refreshed_at`
+
+func (db *Database) PutCIToken(ctx context.Context, t ciToken) error {
+	_, err := db.conn.ExecContext(ctx, `INSERT INTO ci_tokens (namespace, `+ciTokenColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		db.namespace, t.ID, t.RepoID, t.TokenHash, t.SnapshotKey, t.Snapshot, t.Includes, t.Excludes, t.CreatedBy, t.CreatedAt, t.ExpiresAt, t.RefreshedAt)
+	if err != nil {
+		return fmt.Errorf("failed to store CI token: %v", err)
+	}
+	return nil
+}
+
+// GetCIToken finds a token in any namespace: IDs are unique, and ci-fetch
+// only has the token to go by
+func (db *Database) GetCIToken(ctx context.Context, id string) (*ciToken, error) {
+	var t ciToken
+	err := db.conn.QueryRowContext(ctx, `SELECT `+ciTokenColumns+` FROM ci_tokens WHERE id = ?`, id).Scan(
+		&t.ID, &t.RepoID, &t.TokenHash, &t.SnapshotKey, &t.Snapshot, &t.Includes, &t.Excludes, &t.CreatedBy, &t.CreatedAt, &t.ExpiresAt, &t.RefreshedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CI token: %v", err)
+	}
+	return &t, nil
+}
+
+func (db *Database) ListCITokens(ctx context.Context) ([]ciToken, error) {
+	rows, err := db.conn.QueryContext(ctx, `SELECT `+ciTokenColumns+` FROM ci_tokens WHERE namespace = ? ORDER BY created_at`, db.namespace)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query CI tokens: %v", err)
+	}
+	defer rows.Close()
+
+	var tokens []ciToken
+	for rows.Next() {
+		var t ciToken
+		if err := rows.Scan(&t.ID, &t.RepoID, &t.TokenHash, &t.SnapshotKey, &t.Snapshot, &t.Includes, &t.Excludes, &t.CreatedBy, &t.CreatedAt, &t.ExpiresAt, &t.RefreshedAt); err != nil {
+			return nil, fmt.Errorf("failed to read CI tokens: %v", err)
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+func (db *Database) UpdateCISnapshot(ctx context.Context, id, snapshot, refreshedAt string) error {
+	if _, err := db.conn.ExecContext(ctx, `UPDATE ci_tokens SET snapshot = ?, refreshed_at = ? WHERE namespace = ? AND id = ?`, snapshot, refreshedAt, db.namespace, id); err != nil {
+		return fmt.Errorf("failed to refresh CI token %s: %v", id, err)
+	}
+	return nil
+}
+
+func (db *Database) DeleteCIToken(ctx context.Context, id string) (bool, error) {
+	result, err := db.conn.ExecContext(ctx, `DELETE FROM ci_tokens WHERE namespace = ? AND id = ?`, db.namespace, id)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete CI token %s: %v", id, err)
+	}
+	n, _ := result.RowsAffected()
+	return n > 0, nil
+}
+
+// PutCIToken seals the repo ID like the files' own
+func (s *SealedDatabase) PutCIToken(ctx context.Context, t ciToken) error {
+	t.RepoID = s.ids.seal(t.RepoID)
+	return s.db.PutCIToken(ctx, t)
+}
+
+func (s *SealedDatabase) GetCIToken(ctx context.Context, id string) (*ciToken, error) {
+	t, err := s.db.GetCIToken(ctx, id)
+	if err != nil || t == nil {
+		return t, err
+	}
+	if t.RepoID, err = s.ids.open(t.RepoID); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (s *SealedDatabase) ListCITokens(ctx context.Context) ([]ciToken, error) {
+	tokens, err := s.db.ListCITokens(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range tokens {
+		if tokens[i].RepoID, err = s.ids.open(tokens[i].RepoID); err != nil {
+			return nil, err
+		}
+	}
+	return tokens, nil
+}
+
+func (s *SealedDatabase) UpdateCISnapshot(ctx context.Context, id, snapshot, refreshedAt string) error {
+	return s.db.UpdateCISnapshot(ctx, id, snapshot, refreshedAt)
+}
+
+func (s *SealedDatabase) DeleteCIToken(ctx context.Context, id string) (bool, error) {
+	return s.db.DeleteCIToken(ctx, id)
+}
+
+// ciSecretHash is what ci_tokens stores of a token's secret
+func ciSecretHash(secret []byte) string {
+	sum := sha256.Sum256(secret)
+	return hex.EncodeToString(sum[:])
+}
+
+// ciSnapshotKey derives the key a token's snapshot is encrypted with. It
+// differs from the stored hash, so the database alone can't decrypt it.
+func ciSnapshotKey(secret []byte) []byte {
+	sum := sha256.Sum256(append([]byte("env-sync ci snapshot\x00"), secret...))
+	return sum[:]
+}
+
+// parseCIToken splits a token into its ID and secret
+func parseCIToken(token string) (id string, secret []byte, err error) {
+	rest, ok := strings.CutPrefix(strings.TrimSpace(token), ciTokenPrefix)
+	if ok {
+		var encoded string
+		if id, encoded, ok = strings.Cut(rest, "_"); ok {
+			secret, err = base64.RawURLEncoding.DecodeString(encoded)
+			ok = err == nil && len(secret) == 32 && id != ""
+		}
+	}
+	if !ok {
+		return "", nil, fmt.Errorf("invalid CI token: expected %s<id>_<secret>", ciTokenPrefix)
+	}
+	return id, secret, nil
+}
+
+// ciTokenExpired reports whether a token's expiry has passed
+func ciTokenExpired(t ciToken, now time.Time) bool {
+	expires, err := parseStoredTime(t.ExpiresAt)
+	return err != nil || !now.Before(expires)
+}
+
+// ciTokenFilter selects the files of a token's repo that go in its snapshot
+func ciTokenFilter(t ciToken) FileFilter {
+	var filter FileFilter
+	if t.Includes != "" {
+		filter.Includes = strings.Split(t.Includes, ",")
+	}
+	if t.Excludes != "" {
+		filter.Excludes = strings.Split(t.Excludes, ",")
+	}
+	return filter
+}
+
+// exportCISnapshot decrypts the token's files with the password and
+// encrypts them again with the snapshot key
+func exportCISnapshot(ctx context.Context, db Store, t ciToken, key []byte, password string) (string, int, error) {
+	records, err := db.ListEnvFiles(ctx)
+	if err != nil {
+		return "", 0, err
+	}
+	filter := ciTokenFilter(t)
+	snapshot := ciSnapshot{RepoID: t.RepoID, ExportedAt: storedNow(), Files: []ciSnapshotFile{}}
+	for _, record := range records {
+		if record.RepoID != t.RepoID || !filter.Match(record.RepoID, record.RelativePath) {
+			continue
+		}
+		full, err := db.GetEnvFileWithMetadata(ctx, record.RepoID, record.RelativePath)
+		if err != nil || full == nil {
+			return "", 0, fmt.Errorf("failed to read %s: %v", record.RelativePath, err)
+		}
+		contents, err := openVerifiedRecord(ctx, db, full, password)
+		if err != nil {
+			return "", 0, fmt.Errorf("failed to export %s: %v", record.RelativePath, err)
+		}
+		snapshot.Files = append(snapshot.Files, ciSnapshotFile{RelativePath: full.RelativePath, Contents: contents, FileMode: full.FileMode})
+	}
+	sort.Slice(snapshot.Files, func(i, j int) bool { return snapshot.Files[i].RelativePath < snapshot.Files[j].RelativePath })
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to encode snapshot: %v", err)
+	}
+	sealed, err := EncryptWithKey(string(data), key)
+	if err != nil {
+		return "", 0, err
+	}
+	return sealed, len(snapshot.Files), nil
+}
+
+// openCITokenStore opens the database with the password checked, and
+// deletes tokens that have expired along with their snapshots
+func openCITokenStore(ctx context.Context, dbConnStr, password string) (Store, ciTokenStore, error) {
+	db, err := OpenStore(dbConnStr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := db.InitSchema(ctx); err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	tokens := ciTokenStoreOf(db)
+	if tokens == nil {
+		db.Close()
+		return nil, nil, fmt.Errorf("CI tokens require a SQL database backend")
+	}
+	if err := checkPassword(ctx, db, password); err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+
+	existing, err := tokens.ListCITokens(ctx)
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	now := time.Now()
+	for _, t := range existing {
+		if ciTokenExpired(t, now) {
+			if _, err := tokens.DeleteCIToken(ctx, t.ID); err != nil {
+				logger.Warn("failed to delete expired CI token", "id", t.ID, "error", err)
+			}
+		}
+	}
+	return db, tokens, nil
+}
+
+// createCIToken exports a snapshot of a repo's files and prints a token that
+// can fetch it until ttl has passed
+func createCIToken(ctx context.Context, dbConnStr, password, repoRef string, ttl time.Duration, filter FileFilter) error {
+	db, tokens, err := openCITokenStore(ctx, dbConnStr, password)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	repoID, err := resolveRepoID(ctx, db, repoRef)
+	if err != nil {
+		return err
+	}
+
+	idBytes := make([]byte, 8)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(idBytes); err != nil {
+		return fmt.Errorf("failed to generate token: %v", err)
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return fmt.Errorf("failed to generate token: %v", err)
+	}
+	key := ciSnapshotKey(secret)
+	sealedKey, err := Encrypt(hex.EncodeToString(key), password)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	t := ciToken{
+		ID:          hex.EncodeToString(idBytes),
+		RepoID:      repoID,
+		TokenHash:   ciSecretHash(secret),
+		SnapshotKey: sealedKey,
+		Includes:    strings.Join(filter.Includes, ","),
+		Excludes:    strings.Join(filter.Excludes, ","),
+		CreatedBy:   auditMachine(),
+		CreatedAt:   formatStoredTime(now),
+		ExpiresAt:   formatStoredTime(now.Add(ttl)),
+		RefreshedAt: formatStoredTime(now),
+	}
+	var count int
+	if t.Snapshot, count, err = exportCISnapshot(ctx, db, t, key, password); err != nil {
+		return err
+	}
+	if count == 0 {
+		return fmt.Errorf("no stored files of %s match", shortenRepoID(repoID))
+	}
+	if err := tokens.PutCIToken(ctx, t); err != nil {
+		return err
+	}
+
+	token := ciTokenPrefix + t.ID + "_" + base64.RawURLEncoding.EncodeToString(secret)
+	if jsonOutput {
+		printJSON(map[string]interface{}{"id": t.ID, "repo_id": repoID, "files": count, "expires_at": t.ExpiresAt, "token": token})
+		return nil
+	}
+	fmt.Printf("✓ Created CI token %s for %d file(s) of %s, expires %s\n\n", t.ID, count, shortenRepoID(repoID), t.ExpiresAt)
+	fmt.Printf("  %s\n\n", token)
+	fmt.Println("The token is shown only once. Store it as a CI secret (e.g. " + envCIToken + ") and run:")
+	fmt.Println("  env-sync ci-fetch --db <read-only connection string>")
+	fmt.Println("Files changed later reach CI after 'env-sync ci-token refresh'.")
+	return nil
+}
+
+// manageCITokens lists, refreshes or revokes CI tokens
+func manageCITokens(ctx context.Context, dbConnStr, password, action string, args []string) error {
+	db, tokens, err := openCITokenStore(ctx, dbConnStr, password)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	existing, err := tokens.ListCITokens(ctx)
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "list":
+		type tokenReport struct {
+			ID          string `json:"id"`
+			RepoID      string `json:"repo_id"`
+			Includes    string `json:"include,omitempty"`
+			Excludes    string `json:"exclude,omitempty"`
+			CreatedBy   string `json:"created_by"`
+			CreatedAt   string `json:"created_at"`
+			RefreshedAt string `json:"refreshed_at"`
+			ExpiresAt   string `json:"expires_at"`
+		}
+		reports := []tokenReport{}
+		for _, t := range existing {
+			reports = append(reports, tokenReport{t.ID, t.RepoID, t.Includes, t.Excludes, t.CreatedBy, t.CreatedAt, t.RefreshedAt, t.ExpiresAt})
+		}
+		if jsonOutput {
+			printJSON(map[string]interface{}{"tokens": reports})
+			return nil
+		}
+		if len(reports) == 0 {
+			fmt.Println("No CI tokens")
+			return nil
+		}
+		for _, r := range reports {
+			fmt.Printf("  %s  %-40s expires %s  (refreshed %s, by %s)\n", r.ID, shortenRepoID(r.RepoID), r.ExpiresAt, r.RefreshedAt, r.CreatedBy)
+		}
+		return nil
+
+	case "revoke":
+		if len(args) != 1 {
+			return usageErrorf("a token ID is required")
+		}
+		deleted, err := tokens.DeleteCIToken(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		if !deleted {
+			return fmt.Errorf("no CI token %s", args[0])
+		}
+		fmt.Printf("✓ Revoked CI token %s\n", args[0])
+		return nil
+
+	case "refresh":
+		refreshed := 0
+		for _, t := range existing {
+			if len(args) > 0 && t.ID != args[0] {
+				continue
+			}
+			keyHex, err := Decrypt(t.SnapshotKey, password)
+			if err != nil {
+				return fmt.Errorf("failed to open CI token %s: %v (wrong password?)", t.ID, err)
+			}
+			key, err := hex.DecodeString(keyHex)
+			if err != nil {
+				return fmt.Errorf("invalid CI token %s: %v", t.ID, err)
+			}
+			snapshot, count, err := exportCISnapshot(ctx, db, t, key, password)
+			if err != nil {
+				return err
+			}
+			if err := tokens.UpdateCISnapshot(ctx, t.ID, snapshot, storedNow()); err != nil {
+				return err
+			}
+			fmt.Printf("✓ Refreshed CI token %s: %d file(s) of %s\n", t.ID, count, shortenRepoID(t.RepoID))
+			refreshed++
+		}
+		if len(args) > 0 && refreshed == 0 {
+			return fmt.Errorf("no CI token %s", args[0])
+		}
+		if refreshed == 0 {
+			fmt.Println("No CI tokens")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown action %s", action)
+}
+
+// ciFetch writes the files of a token's snapshot under outputDir. It opens
+// the database without the password and never writes to it, so a read-only
+// connection string is enough.
+func ciFetch(ctx context.Context, dbConnStr, token, outputDir string) error {
+	id, secret, err := parseCIToken(token)
+	if err != nil {
+		return err
+	}
+
+	// Only the ci_tokens row is read, so sealed identifiers need no password
+	connString, _ := splitEncryptIDs(dbConnStr)
+	backend, err := openBackend(connString)
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+	tokens, ok := backend.(*Database)
+	if !ok {
+		return fmt.Errorf("CI tokens require a SQL database backend")
+	}
+
+	t, err := tokens.GetCIToken(ctx, id)
+	if err != nil {
+		return err
+	}
+	// The same error for unknown and wrong tokens
+	if t == nil || subtle.ConstantTimeCompare([]byte(t.TokenHash), []byte(ciSecretHash(secret))) != 1 {
+		return fmt.Errorf("invalid or revoked CI token")
+	}
+	if ciTokenExpired(*t, time.Now()) {
+		return fmt.Errorf("CI token %s expired at %s", id, t.ExpiresAt)
+	}
+
+	plaintext, err := DecryptWithKey(t.Snapshot, ciSnapshotKey(secret))
+	if err != nil {
+		return fmt.Errorf("failed to decrypt CI snapshot: %v", err)
+	}
+	var snapshot ciSnapshot
+	if err := json.Unmarshal([]byte(plaintext), &snapshot); err != nil {
+		return fmt.Errorf("invalid CI snapshot: %v", err)
+	}
+
+	for _, file := range snapshot.Files {
+		rel := filepath.FromSlash(path.Clean(file.RelativePath))
+		if !filepath.IsLocal(rel) {
+			logger.Warn("skipping path outside the output directory", "path", file.RelativePath)
+			continue
+		}
+		fullPath := filepath.Join(outputDir, rel)
+		if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+			return fmt.Errorf("failed to create directory for %s: %v", file.RelativePath, err)
+		}
+		mode := file.FileMode
+		if mode == 0 {
+			mode = defaultFileMode
+		}
+		if err := os.WriteFile(fullPath, localEnvContents(fullPath, []byte(file.Contents)), mode); err != nil {
+			return fmt.Errorf("failed to write %s: %v", fullPath, err)
+		}
+		if !jsonOutput {
+			fmt.Printf("✓ %s\n", fullPath)
+		}
+	}
+	if jsonOutput {
+		printJSON(map[string]interface{}{"repo_id": snapshot.RepoID, "exported_at": snapshot.ExportedAt, "files": len(snapshot.Files)})
+		return nil
+	}
+	fmt.Printf("\n✓ Fetched %d file(s) of %s (snapshot from %s)\n", len(snapshot.Files), shortenRepoID(snapshot.RepoID), snapshot.ExportedAt)
+	return nil
+}
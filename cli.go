@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// command is one node of the command tree. Commands that do something define
+// their flags in setup, which returns the function that runs the command with
+// its positional arguments. Groups such as "repos" only list subcommands and
+// run the first one when none is named.
+type command struct {
+	name        string
+	args        string // positional arguments shown in help, e.g. "<repo>/<path>"
+	summary     string
+	aliases     []string
+	hidden      bool
+	passthrough bool // hand the raw arguments to run instead of parsing them
+	setup       func(fs *flag.FlagSet) func(ctx context.Context, args []string) error
+	subcommands []*command
+}
+
+// lookup finds a subcommand by name or alias
+func (c *command) lookup(name string) *command {
+	for _, sub := range c.subcommands {
+		if sub.name == name {
+			return sub
+		}
+		for _, alias := range sub.aliases {
+			if alias == name {
+				return sub
+			}
+		}
+	}
+	return nil
+}
+
+// visibleSubcommands returns the subcommands listed in help
+func (c *command) visibleSubcommands() []*command {
+	var visible []*command
+	for _, sub := range c.subcommands {
+		if !sub.hidden {
+			visible = append(visible, sub)
+		}
+	}
+	return visible
+}
+
+// usageError reports missing or invalid arguments. It's printed with the
+// command's usage line.
+type usageError struct {
+	msg   string
+	usage string
+}
+
+func (e *usageError) Error() string {
+	return e.msg
+}
+
+// usageErrorf returns a usageError for the running command
+func usageErrorf(format string, args ...interface{}) error {
+	return &usageError{msg: fmt.Sprintf(format, args...)}
+}
+
+// commandPath joins the names along path, skipping the root
+func commandPath(path []*command) string {
+	var names []string
+	for _, cmd := range path[1:] {
+		names = append(names, cmd.name)
+	}
+	return strings.Join(names, " ")
+}
+
+// usageLine returns the one-line synopsis of the last command in path
+func usageLine(path []*command) string {
+	cmd := path[len(path)-1]
+	line := "env-sync " + commandPath(path)
+	if cmd.setup == nil && len(cmd.subcommands) > 0 {
+		line += " <command>"
+	}
+	if strings.HasPrefix(cmd.args, "-- ") {
+		// Flags after -- belong to the wrapped command
+		return line + " [flags] " + cmd.args
+	}
+	if cmd.args != "" {
+		line += " " + cmd.args
+	}
+	return line + " [flags]"
+}
+
+// isHelpFlag reports whether arg asks for help
+func isHelpFlag(arg string) bool {
+	return arg == "-h" || arg == "-help" || arg == "--help" || arg == "--h"
+}
+
+// resolveCommand walks args down the command tree and returns the path to
+// the command to run along with its remaining arguments
+func resolveCommand(root *command, args []string) ([]*command, []string, error) {
+	path := []*command{root}
+	cmd := root
+	for len(cmd.subcommands) > 0 {
+		if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+			if cmd == root || cmd.setup != nil || (len(args) > 0 && isHelpFlag(args[0])) {
+				break
+			}
+			cmd = cmd.subcommands[0]
+			path = append(path, cmd)
+			continue
+		}
+
+		sub := cmd.lookup(args[0])
+		if sub == nil {
+			if cmd.setup != nil {
+				// A positional argument of cmd itself
+				break
+			}
+			if cmd == root {
+				return nil, nil, &usageError{msg: "unknown command: " + args[0], usage: "env-sync <command> [flags] (see 'env-sync help')"}
+			}
+			var names []string
+			for _, s := range cmd.visibleSubcommands() {
+				names = append(names, s.name)
+			}
+			return nil, nil, &usageError{
+				msg:   fmt.Sprintf("unknown %s command: %s (use %s)", commandPath(path), args[0], joinOr(names)),
+				usage: usageLine(path),
+			}
+		}
+		cmd, args = sub, args[1:]
+		path = append(path, cmd)
+	}
+	return path, args, nil
+}
+
+// commandLineFlags are the flags of the running command that were given on
+// the command line, as opposed to filled in from the environment or profile
+var commandLineFlags = make(map[string]bool)
+
+// runCommand resolves and runs the command named by args
+func runCommand(ctx context.Context, root *command, args []string) error {
+	path, args, err := resolveCommand(root, args)
+	if err != nil {
+		return err
+	}
+	cmd := path[len(path)-1]
+
+	if cmd.setup == nil {
+		printCommandHelp(path)
+		return nil
+	}
+
+	fs := flag.NewFlagSet(commandPath(path), flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	run := cmd.setup(fs)
+
+	if cmd.passthrough {
+		if len(args) > 0 && isHelpFlag(args[0]) {
+			printCommandHelp(path)
+			return nil
+		}
+		return run(ctx, args)
+	}
+
+	positional, err := parseInterleaved(fs, args)
+	if errors.Is(err, flag.ErrHelp) {
+		printCommandHelp(path)
+		return nil
+	}
+	if err != nil {
+		err = &usageError{msg: err.Error()}
+	} else {
+		fs.Visit(func(f *flag.Flag) {
+			commandLineFlags[f.Name] = true
+		})
+		err = applyFlagDefaults(fs)
+	}
+	if err == nil {
+		err = run(ctx, positional)
+	}
+
+	var usageErr *usageError
+	if errors.As(err, &usageErr) && usageErr.usage == "" {
+		usageErr.usage = usageLine(path)
+	}
+	return err
+}
+
+// interruptContext returns a context that is cancelled on Ctrl+C or SIGTERM,
+// so a long-running command can stop between files and save what it has
+// done. Only the first signal is caught; a second one exits right away.
+func interruptContext(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(parent)
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-sigChan:
+			signal.Stop(sigChan)
+			logger.Warn("interrupted, stopping after the files in progress (press Ctrl+C again to quit now)", "signal", sig.String())
+			cancel(fmt.Errorf("received %s", sig))
+		case <-ctx.Done():
+			signal.Stop(sigChan)
+		}
+	}()
+	return ctx, func() { cancel(nil) }
+}
+
+// parseInterleaved parses flags that may appear before, between or after
+// positional arguments, and returns the positional arguments in order.
+// Everything after "--" is positional.
+func parseInterleaved(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		rest := fs.Args()
+		if len(rest) == 0 {
+			return positional, nil
+		}
+		if consumed := len(args) - len(rest); consumed > 0 && args[consumed-1] == "--" {
+			return append(positional, rest...), nil
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+}
+
+// applyFlagDefaults fills in flags that weren't given on the command line,
+// first from ENV_SYNC_DB and ENV_SYNC_BASE, then from the active profile
+func applyFlagDefaults(fs *flag.FlagSet) error {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	for name, envVar := range map[string]string{"db": envDB, "base": envBase} {
+		if value := os.Getenv(envVar); value != "" && !given[name] && fs.Lookup(name) != nil {
+			fs.Set(name, value)
+			given[name] = true
+		}
+	}
+
+	profile, err := loadProfile()
+	if err != nil {
+		return err
+	}
+	for name, value := range profile {
+		if given[name] || fs.Lookup(name) == nil {
+			continue
+		}
+		values, ok := value.([]interface{})
+		if !ok {
+			values = []interface{}{value}
+		}
+		for _, v := range values {
+			if err := fs.Set(name, profileValueString(v)); err != nil {
+				return fmt.Errorf("invalid value %q for %s in profile %s: %v", profileValueString(v), name, activeProfileName(), err)
+			}
+		}
+	}
+	return nil
+}
+
+// printCommandHelp prints the usage, flags and subcommands of the last command in path
+func printCommandHelp(path []*command) {
+	cmd := path[len(path)-1]
+	if len(path) == 1 {
+		printUsage()
+		return
+	}
+
+	fmt.Printf("Usage: %s\n", usageLine(path))
+	if cmd.summary != "" {
+		fmt.Printf("\n%s\n", cmd.summary)
+	}
+
+	if subs := cmd.visibleSubcommands(); len(subs) > 0 {
+		fmt.Println("\nCommands:")
+		var rows [][2]string
+		for _, sub := range subs {
+			rows = append(rows, [2]string{strings.TrimSpace(sub.name + " " + sub.args), sub.summary})
+		}
+		printColumns(rows)
+	}
+
+	if cmd.setup != nil {
+		fs := flag.NewFlagSet(commandPath(path), flag.ContinueOnError)
+		cmd.setup(fs)
+		printFlags(fs)
+	}
+
+	if len(cmd.subcommands) > 0 {
+		fmt.Printf("\nRun 'env-sync help %s <command>' to see a command's flags.\n", commandPath(path))
+	}
+	fmt.Println("\nGlobal flags such as --json, --profile and --verbose are listed by 'env-sync help'.")
+}
+
+// printFlags lists a flag set's flags with their defaults
+func printFlags(fs *flag.FlagSet) {
+	var rows [][2]string
+	fs.VisitAll(func(f *flag.Flag) {
+		name, usage := flag.UnquoteUsage(f)
+		if placeholder, ok := flagPlaceholders[f.Name]; ok && !strings.Contains(f.Usage, "`") {
+			name = placeholder
+		}
+		left := "--" + f.Name
+		if name != "" {
+			left += " <" + name + ">"
+		}
+		if !isZeroDefault(f.DefValue) && !strings.Contains(usage, "default") {
+			usage += fmt.Sprintf(" (default: %s)", f.DefValue)
+		}
+		rows = append(rows, [2]string{left, usage})
+	})
+	if len(rows) == 0 {
+		return
+	}
+
+	fmt.Println("\nFlags:")
+	printColumns(rows)
+}
+
+// printColumns prints name/description rows with the descriptions aligned
+func printColumns(rows [][2]string) {
+	width := 0
+	for _, row := range rows {
+		width = max(width, len(row[0]))
+	}
+	for _, row := range rows {
+		fmt.Printf("  %-*s  %s\n", width, row[0], row[1])
+	}
+}
+
+// flagPlaceholders name the values of common flags in help, where the flag
+// type ("string", "value") says little
+var flagPlaceholders = map[string]string{
+	"db":       "conn-string",
+	"password": "pwd",
+	"base":     "path",
+	"output":   "path",
+	"input":    "file",
+	"repo":     "glob",
+	"include":  "glob",
+	"exclude":  "glob",
+	"pattern":  "glob",
+	"scan":     "path",
+	"path":     "path",
+	"with":     "user",
+}
+
+// isZeroDefault reports whether a flag's default is worth leaving out of help
+func isZeroDefault(value string) bool {
+	switch value {
+	case "", "0", "false", "0s", "[]":
+		return true
+	}
+	return false
+}
+
+// joinOr joins names as "a, b or c"
+func joinOr(names []string) string {
+	if len(names) < 2 {
+		return strings.Join(names, "")
+	}
+	return strings.Join(names[:len(names)-1], ", ") + " or " + names[len(names)-1]
+}
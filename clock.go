@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Sync decides which copy of a file is newer by modification time, so a
+// machine whose clock runs ahead would keep winning and overwrite newer
+// copies from elsewhere. When sync connects to a SQL database it measures
+// how far this machine's clock is off the server's, and file times are
+// moved onto the server's clock before they're stored or compared, and back
+// when a downloaded file's time is set.
+
+// clockSkew is how far this machine's clock is ahead of the database
+// server's, as last measured; 0 until measured or if it's too small to matter
+var clockSkew atomic.Int64
+
+// minClockSkew is the smallest skew that is corrected: below it the
+// measurement's round trip blurs the result, and sync allows a second of
+// difference between copies anyway
+const minClockSkew = 2 * time.Second
+
+// maxClockSkew is how far this machine's clock may be off the database
+// server's before sync and doctor warn about it
+const maxClockSkew = time.Minute
+
+// serverTime returns the database server's current time
+func (db *Database) serverTime(ctx context.Context) (time.Time, error) {
+	var value string
+	if err := db.conn.QueryRowContext(ctx, `SELECT CURRENT_TIMESTAMP`).Scan(&value); err != nil {
+		return time.Time{}, err
+	}
+	t, err := parseStoredTime(value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unexpected time %q", value)
+	}
+	return t, nil
+}
+
+// clockDatabaseOf returns the SQL database whose clock db's times should
+// follow: the primary of replicated stores. Nil for other backends, which
+// have no clock to ask.
+func clockDatabaseOf(db Store) *Database {
+	if r, ok := db.(*ReplicatedStore); ok {
+		db = r.primary()
+	}
+	return databaseOf(db)
+}
+
+// measureClockSkew returns how far this machine's clock is ahead of the
+// database server's, taking the local time halfway through the query
+func measureClockSkew(ctx context.Context, db *Database) (time.Duration, error) {
+	start := time.Now()
+	server, err := db.serverTime(ctx)
+	if err != nil {
+		return 0, err
+	}
+	local := start.Add(time.Since(start) / 2)
+	return local.Sub(server), nil
+}
+
+// updateClockSkew measures the skew against db's server and corrects file
+// times by it from now on. Backends without a clock, and failed
+// measurements, keep the last skew known.
+func updateClockSkew(ctx context.Context, db Store) {
+	sqlDB := clockDatabaseOf(db)
+	if sqlDB == nil {
+		return
+	}
+	skew, err := measureClockSkew(ctx, sqlDB)
+	if err != nil {
+		logger.Debug("couldn't read the database server's time", "error", err)
+		return
+	}
+	if skew.Abs() > maxClockSkew {
+		logger.Warn("this machine's clock is off the database server's; correcting file times, but turn on automatic time sync (NTP)",
+			"ahead_by", skew.Round(time.Second).String())
+	}
+	if skew.Abs() < minClockSkew {
+		skew = 0
+	}
+	clockSkew.Store(int64(skew))
+}
+
+// toServerTime moves a time read from this machine's clock, like a file's
+// modification time, onto the database server's clock
+func toServerTime(t time.Time) time.Time {
+	return t.Add(-time.Duration(clockSkew.Load())).UTC()
+}
+
+// toLocalTime moves a stored time onto this machine's clock
+func toLocalTime(t time.Time) time.Time {
+	return t.Add(time.Duration(clockSkew.Load()))
+}
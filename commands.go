@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 )
 
-func uploadEnvFiles(dbConnStr, password, basePath string) error {
+// uploadEnvFiles uploads the remembered files that opts.Filter selects, to
+// the database and opts.Replicas, and adds tags to each. Of opts, Force,
+// Environment, AllowProd, the size limit and linting apply as they do to sync.
+func uploadEnvFiles(ctx context.Context, dbConnStr, password, basePath string, batchSize int, tags []string, opts SyncOptions) error {
 	// Load scanned env files
 	files, err := loadEnvFiles()
 	if err != nil {
@@ -18,98 +23,242 @@ func uploadEnvFiles(dbConnStr, password, basePath string) error {
 		return fmt.Errorf("no env files found. Run 'env-sync scan <path>' first")
 	}
 
-	// Connect to database
-	db, err := NewDatabase(dbConnStr)
+	files = filterFiles(files, basePath, opts.Filter)
+	if len(files) == 0 {
+		return fmt.Errorf("no env files match the given filters")
+	}
+
+	// Connect to database (and any replicas)
+	db, err := openReplicatedStore(dbConnStr, opts.Replicas)
 	if err != nil {
+		if databaseUnreachable(err) {
+			return queueOfflineEdits(files, basePath, password, opts, err)
+		}
 		return err
 	}
 	defer db.Close()
 
 	// Initialize schema
-	if err := db.InitSchema(); err != nil {
+	if err := db.InitSchema(ctx); err != nil {
+		if databaseUnreachable(err) {
+			return queueOfflineEdits(files, basePath, password, opts, err)
+		}
+		return err
+	}
+	updateClockSkew(ctx, db)
+
+	lock, err := acquireSyncLock(ctx, db, opts.Force)
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
+	if err := checkPassword(ctx, db, password); err != nil {
+		return err
+	}
+
+	// Edits queued while offline go first, so each becomes a revision
+	state, err := loadSyncState()
+	if err != nil {
+		return err
+	}
+	flushUploadQueue(ctx, db, password, state, opts)
+
+	if len(tags) > 0 && tagStoreOf(db) == nil {
+		return fmt.Errorf("tags require a SQL database backend")
+	}
+	stored, err := loadFileTags(ctx, db, opts.Filter)
+	if err != nil {
+		return err
+	}
+	if files = allowedFiles(files, basePath, nil, nil, stored, opts); len(files) == 0 {
+		return fmt.Errorf("no env files match the given filters")
+	}
+	if files = dropLargeFiles(files, opts); len(files) == 0 {
+		return fmt.Errorf("every matching env file is over --max-file-size (use --force-large to upload them)")
+	}
+	if err := lintFiles(files, opts); err != nil {
 		return err
 	}
 
 	fmt.Printf("Uploading %d .env file(s)...\n", len(files))
 
 	// Upload files
-	if err := db.UploadEnvFiles(files, basePath, password); err != nil {
+	if err := UploadEnvFiles(ctx, db, files, basePath, password, batchSize, tags); err != nil {
 		return err
 	}
 
+	printReplicaReport(db)
 	fmt.Println("\n✓ Upload complete!")
 	return nil
 }
 
-func downloadEnvFiles(dbConnStr, password, outputPath string) error {
+// downloadEnvFiles writes stored files under outputPath in repo-named folders.
+// With inPlace, outputPath must be inside a git checkout and only that repo's
+// files are written, to their original locations within it. Files are
+// decrypted and written by a pool of workers.
+func downloadEnvFiles(ctx context.Context, dbConnStr, password, outputPath string, filter FileFilter, inPlace bool, workers int, environment string, allowProd bool) error {
+	var repoRoot, repoID string
+	if inPlace {
+		var err error
+		repoRoot, repoID, err = GetRepoRoot(outputPath)
+		if err != nil {
+			return fmt.Errorf("--restore-in-place must be run inside a git repository with a remote: %v", err)
+		}
+		filter.Repos = append([]string{repoID}, gitRemoteAliases(repoRoot, repoID)...)
+	}
+
 	// Connect to database
-	db, err := NewDatabase(dbConnStr)
+	db, err := OpenStore(dbConnStr)
 	if err != nil {
 		return err
 	}
 	defer db.Close()
 
-	// List all env files
-	records, err := db.ListEnvFiles()
+	// List all env files along with their contents
+	records, err := db.ListEnvFilesWithContents(ctx)
 	if err != nil {
 		return err
 	}
 
-	if len(records) == 0 {
-		fmt.Println("No .env files found in database")
-		return nil
+	tags, err := loadFileTags(ctx, db, filter)
+	if err != nil {
+		return err
 	}
+	filter.tagged = tags
 
-	fmt.Printf("Downloading %d .env file(s)...\n", len(records))
-
+	var selected []EnvFileRecord
 	for _, record := range records {
-		// Get encrypted contents
-		encryptedContents, err := db.GetEnvFile(record.RepoID, record.RelativePath)
-		if err != nil {
-			fmt.Printf("Warning: failed to get %s:%s: %v\n", record.RepoID, record.RelativePath, err)
+		if !filter.Match(record.RepoID, record.RelativePath) {
 			continue
 		}
-
-		// Decrypt contents
-		contents, err := Decrypt(encryptedContents, password)
-		if err != nil {
-			fmt.Printf("Warning: failed to decrypt %s:%s: %v (wrong password?)\n", record.RepoID, record.RelativePath, err)
+		if reason := environmentConflict(tags[auditKey(record.RepoID, record.RelativePath)], environment, allowProd); reason != "" {
+			logger.Warn("skipping file of another environment", "repo", record.RepoID, "path", record.RelativePath, "reason", reason)
 			continue
 		}
+		selected = append(selected, record)
+	}
+	records = selected
 
-		// Create output path based on repo ID
-		// For git repos, use shortened repo name; for local, use relative path
-		var fullDir string
-		if record.RepoID == "__local__" {
-			fullDir = filepath.Join(outputPath, filepath.Dir(filepath.FromSlash(record.RelativePath)))
+	if len(records) == 0 {
+		if inPlace {
+			fmt.Printf("No .env files found in database for %s\n", repoID)
 		} else {
-			// Use repo name as folder (e.g., "github.com/user/repo" -> "user_repo")
-			repoFolder := strings.ReplaceAll(record.RepoID, "/", "_")
-			relDir := filepath.Dir(record.RelativePath)
-			if relDir == "." {
-				fullDir = filepath.Join(outputPath, repoFolder)
-			} else {
-				fullDir = filepath.Join(outputPath, repoFolder, filepath.FromSlash(relDir))
-			}
+			fmt.Println("No .env files found in database")
 		}
+		return nil
+	}
 
-		// Create directory if it doesn't exist
-		if err := os.MkdirAll(fullDir, 0755); err != nil {
-			fmt.Printf("Warning: failed to create directory %s: %v\n", fullDir, err)
-			continue
-		}
+	if workers < 1 {
+		workers = 1
+	}
+	if len(records) < workers {
+		workers = len(records)
+	}
 
-		// Write file
-		filename := filepath.Base(record.RelativePath)
-		fullPath := filepath.Join(fullDir, filename)
-		if err := os.WriteFile(fullPath, []byte(contents), 0644); err != nil {
-			fmt.Printf("Warning: failed to write %s: %v\n", fullPath, err)
-			continue
-		}
+	fmt.Printf("Downloading %d .env file(s) with %d workers...\n", len(records), workers)
+
+	jobs := make(chan EnvFileRecord, len(records))
+	results := make(chan string, len(records))
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for record := range jobs {
+				if ctx.Err() != nil {
+					return
+				}
+				if fullPath, ok := downloadRecord(ctx, db, record, password, outputPath, repoRoot, inPlace); ok {
+					results <- fullPath
+				}
+			}
+		}()
+	}
+
+	for _, record := range records {
+		jobs <- record
+	}
+	close(jobs)
 
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	downloaded := 0
+	for fullPath := range results {
 		fmt.Printf("✓ Downloaded: %s\n", fullPath)
+		downloaded++
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("download interrupted after %d of %d file(s)", downloaded, len(records))
 	}
 
 	fmt.Println("\n✓ Download complete!")
 	return nil
 }
+
+// downloadRecord decrypts one record and writes it to its place under
+// outputPath (or repoRoot when inPlace). Failures are logged and skipped.
+func downloadRecord(ctx context.Context, db Store, record EnvFileRecord, password, outputPath, repoRoot string, inPlace bool) (string, bool) {
+	// Decrypt contents
+	contents, err := openContents(ctx, db, record.RepoID, record.RelativePath, record.Contents, password)
+	if err != nil {
+		logger.Warn("failed to decrypt (wrong password?)", "repo", record.RepoID, "path", record.RelativePath, "error", err)
+		return "", false
+	}
+	if HashFile(contents) != record.FileHash {
+		logger.Warn("skipping corrupted record: its contents don't match the stored hash", "repo", record.RepoID, "path", record.RelativePath)
+		return "", false
+	}
+
+	// Create output path based on repo ID
+	// For git repos, use shortened repo name; for local, use relative path
+	var fullDir string
+	if inPlace {
+		fullDir = filepath.Join(repoRoot, filepath.Dir(filepath.FromSlash(record.RelativePath)))
+		if rel, err := filepath.Rel(repoRoot, fullDir); err != nil || strings.HasPrefix(rel, "..") {
+			logger.Warn("skipping path outside the repository", "path", record.RelativePath)
+			return "", false
+		}
+	} else if record.RepoID == localRepoID {
+		fullDir = filepath.Join(outputPath, filepath.Dir(filepath.FromSlash(record.RelativePath)))
+	} else if record.RepoID == homeRepoID {
+		fullDir = filepath.Join(outputPath, "home", filepath.Dir(filepath.FromSlash(record.RelativePath)))
+	} else if name, ok := strings.CutPrefix(record.RepoID, localRepoID+":"); ok {
+		// Files of a named base path go into a folder of that name
+		fullDir = filepath.Join(outputPath, name, filepath.Dir(filepath.FromSlash(record.RelativePath)))
+	} else {
+		// Use repo name as folder (e.g., "github.com/user/repo" -> "user_repo")
+		repoFolder := strings.ReplaceAll(record.RepoID, "/", "_")
+		relDir := filepath.Dir(record.RelativePath)
+		if relDir == "." {
+			fullDir = filepath.Join(outputPath, repoFolder)
+		} else {
+			fullDir = filepath.Join(outputPath, repoFolder, filepath.FromSlash(relDir))
+		}
+	}
+
+	// Create directory if it doesn't exist
+	if err := os.MkdirAll(fullDir, 0755); err != nil {
+		logger.Warn("failed to create directory", "dir", fullDir, "error", err)
+		return "", false
+	}
+
+	// Write file
+	filename := filepath.Base(record.RelativePath)
+	fullPath := filepath.Join(fullDir, filename)
+	previousHash := ""
+	if existing, err := os.ReadFile(fullPath); err == nil {
+		previousHash = envFileHash(fullPath, existing)
+	}
+	if err := writeEnvFile(fullPath, []byte(contents), restoreFileMode(record.FileMode, fullPath)); err != nil {
+		logger.Warn("failed to write file", "file", fullPath, "error", err)
+		return "", false
+	}
+	recordAudit(ctx, db, newAuditEntry(auditDownload, record.RepoID, record.RelativePath, previousHash, HashFile(contents)))
+
+	return fullPath, true
+}
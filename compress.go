@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// Compressed plaintexts start with a zero byte, which never begins a text
+// file, followed by a format version. Anything else is a legacy record that
+// was stored uncompressed. Binary files that happen to start with a zero
+// byte are stored behind a raw format header so they aren't misread.
+// Deltas against an earlier revision (see delta.go) and contents bound to
+// their file (see binding.go) use the same header.
+const (
+	formatMarker  byte = 0x00
+	formatGzipV1  byte = 0x01
+	formatRawV1   byte = 0x02
+	formatDeltaV1 byte = 0x03
+	formatBoundV1 byte = 0x04
+	minCompressed      = 256 // Smaller files aren't worth the gzip header
+)
+
+// compressPlaintext gzips plaintext before it is encrypted, keeping the raw
+// text when compression wouldn't make it smaller
+func compressPlaintext(plaintext string) []byte {
+	if len(plaintext) < minCompressed {
+		return rawPlaintext(plaintext)
+	}
+
+	var buf bytes.Buffer
+	buf.Write([]byte{formatMarker, formatGzipV1})
+	w, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return rawPlaintext(plaintext)
+	}
+	if _, err := io.WriteString(w, plaintext); err != nil {
+		return rawPlaintext(plaintext)
+	}
+	if err := w.Close(); err != nil {
+		return rawPlaintext(plaintext)
+	}
+
+	if buf.Len() >= len(plaintext) {
+		return rawPlaintext(plaintext)
+	}
+	return buf.Bytes()
+}
+
+// rawPlaintext stores plaintext uncompressed, escaping it when it starts
+// with the format marker
+func rawPlaintext(plaintext string) []byte {
+	if len(plaintext) == 0 || plaintext[0] != formatMarker {
+		return []byte(plaintext)
+	}
+	return append([]byte{formatMarker, formatRawV1}, plaintext...)
+}
+
+// decompressPlaintext reverses compressPlaintext after decryption
+func decompressPlaintext(data []byte) (string, error) {
+	if len(data) < 2 || data[0] != formatMarker {
+		return string(data), nil
+	}
+
+	switch data[1] {
+	case formatGzipV1:
+		r, err := gzip.NewReader(bytes.NewReader(data[2:]))
+		if err != nil {
+			return "", fmt.Errorf("failed to decompress: %v", err)
+		}
+		defer r.Close()
+		plaintext, err := io.ReadAll(r)
+		if err != nil {
+			return "", fmt.Errorf("failed to decompress: %v", err)
+		}
+		return string(plaintext), nil
+	case formatRawV1:
+		return string(data[2:]), nil
+	case formatDeltaV1:
+		return "", parseDeltaPayload(data)
+	case formatBoundV1:
+		_, inner, err := unbindPayload(data)
+		if err != nil {
+			return "", err
+		}
+		return decompressPlaintext(inner)
+	default:
+		return "", fmt.Errorf("unsupported content format version %d (upgrade env-sync)", data[1])
+	}
+}
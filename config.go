@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// envProfile selects a profile when --profile isn't given
+const envProfile = "ENV_SYNC_PROFILE"
+
+// configPath and profileName are set by the global --config and --profile flags
+var (
+	configPath  string
+	profileName string
+)
+
+// Config is the optional ~/.env-sync/config.json
+type Config struct {
+	// DefaultProfile is used when neither --profile nor ENV_SYNC_PROFILE is set
+	DefaultProfile string `json:"default_profile,omitempty"`
+	// Profiles map a name to flag defaults keyed by flag name, e.g.
+	// {"db": "libsql://...", "workers": 20, "exclude": [".env.local"]}.
+	// Every command that has a flag of that name picks the value up.
+	Profiles map[string]map[string]interface{} `json:"profiles,omitempty"`
+	// GitRemotes names the remotes whose URL identifies a repo, most
+	// preferred first, e.g. ["upstream", "origin"] (default: ["origin"])
+	GitRemotes []string `json:"git_remotes,omitempty"`
+	// BranchRepos are globs of repo IDs whose files are stored per branch,
+	// e.g. ["github.com/acme/api"], so long-lived branches keep their own values
+	BranchRepos []string `json:"branch_repos,omitempty"`
+	// AllowRepos, if set, are globs of the only repo IDs whose files are
+	// synced, e.g. ["github.com/mycompany/*"]; files of other repos that a
+	// scan finds are left alone. Non-git files only pass with "__local__*".
+	AllowRepos []string `json:"allow_repos,omitempty"`
+	// DenyRepos are globs of repo IDs whose files are never synced, even if
+	// AllowRepos matches them
+	DenyRepos []string `json:"deny_repos,omitempty"`
+	// BasePaths are extra directories, by name, that sync scans besides
+	// --base, e.g. {"personal": "~/personal"}. Files outside git repos under
+	// one are stored relative to it, as repo "__local__:<name>".
+	BasePaths map[string]string `json:"base_paths,omitempty"`
+	// LocalPaths is what other files outside git repos are stored relative
+	// to: "base" for --base (the default), or "home" for the home directory,
+	// as repo "__local__:~", so they match across machines with different
+	// --base directories
+	LocalPaths string `json:"local_paths,omitempty"`
+	// KMSKey encrypts new copies under a random data key each, wrapped by
+	// this cloud KMS key, e.g. "awskms://alias/env-sync" (see kms.go), so
+	// reading them takes access to the key instead of the password
+	KMSKey string `json:"kms_key,omitempty"`
+	// SMTP is the mail server digests are emailed through
+	SMTP *SMTPConfig `json:"smtp,omitempty"`
+	// Encoding is "utf-8" (the default) to store UTF-16 and other files as
+	// UTF-8 without a byte order mark, or "raw" to store them byte for byte
+	Encoding string `json:"encoding,omitempty"`
+	// LineEndings is "auto" (the default) to store LF line endings and write
+	// those of the local file, or CRLF for new files on Windows; "lf" or
+	// "crlf" to always write those; or "raw" to leave them alone
+	LineEndings string `json:"line_endings,omitempty"`
+	// ShareContents stores new copies without binding them to their file,
+	// so identical files can share one stored copy (see binding.go)
+	ShareContents bool `json:"share_contents,omitempty"`
+}
+
+var loadedConfig *Config
+
+// getConfigFile returns the --config path, or ~/.env-sync/config.json
+func getConfigFile() (string, error) {
+	if configPath != "" {
+		return configPath, nil
+	}
+	dir, err := getStorageDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "config.json"), nil
+}
+
+// loadConfig reads the config file once. A missing default config file is an
+// empty config; a missing --config file is an error.
+func loadConfig() (*Config, error) {
+	if loadedConfig != nil {
+		return loadedConfig, nil
+	}
+
+	configFile, err := getConfigFile()
+	if err != nil {
+		return nil, err
+	}
+
+	config := &Config{}
+	data, err := os.ReadFile(configFile)
+	switch {
+	case os.IsNotExist(err) && configPath == "":
+	case err != nil:
+		return nil, fmt.Errorf("failed to read config: %v", err)
+	default:
+		if err := json.Unmarshal(data, config); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", configFile, err)
+		}
+	}
+
+	loadedConfig = config
+	return config, nil
+}
+
+// reloadConfig reads the config file again, for a running daemon. If it
+// doesn't load, the config in use is kept. Flag defaults from a profile
+// stay as they were parsed.
+func reloadConfig() error {
+	previous := loadedConfig
+	loadedConfig = nil
+	if _, err := loadConfig(); err != nil {
+		loadedConfig = previous
+		return err
+	}
+	return nil
+}
+
+// configDerived caches a value worked out from the config until the config
+// is reloaded
+type configDerived[T any] struct {
+	mu     sync.Mutex
+	config *Config
+	value  T
+	derive func(*Config) T
+}
+
+// emptyConfig stands in for a config that doesn't load
+var emptyConfig = &Config{}
+
+func deriveFromConfig[T any](derive func(*Config) T) *configDerived[T] {
+	return &configDerived[T]{derive: derive}
+}
+
+func (d *configDerived[T]) get() T {
+	config, err := loadConfig()
+	if err != nil {
+		config = emptyConfig
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.config != config {
+		d.value = d.derive(config)
+		d.config = config
+	}
+	return d.value
+}
+
+// activeProfileName returns --profile, else ENV_SYNC_PROFILE, else the
+// config's default_profile
+func activeProfileName() string {
+	if profileName != "" {
+		return profileName
+	}
+	if name := os.Getenv(envProfile); name != "" {
+		return name
+	}
+	if config, err := loadConfig(); err == nil {
+		return config.DefaultProfile
+	}
+	return ""
+}
+
+// loadProfile returns the active profile's flag defaults, or nil when no
+// profile is selected
+func loadProfile() (map[string]interface{}, error) {
+	config, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	name := activeProfileName()
+	if name == "" {
+		return nil, nil
+	}
+	profile, ok := config.Profiles[name]
+	if !ok {
+		configFile, _ := getConfigFile()
+		return nil, fmt.Errorf("profile %q not found in %s", name, configFile)
+	}
+	return profile, nil
+}
+
+// profileValueString formats a JSON profile value as a flag value
+func profileValueString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
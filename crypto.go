@@ -8,17 +8,74 @@ import (
 	"encoding/base64"
 	"fmt"
 	"io"
-
-	"golang.org/x/crypto/argon2"
+	"strings"
 )
 
-// deriveKey derives a 32-byte key from a password using Argon2
-func deriveKey(password string, salt []byte) []byte {
-	return argon2.IDKey([]byte(password), salt, 1, 64*1024, 4, 32)
+// Encrypt encrypts plaintext using AES-GCM with the given password, or to
+// the configured age recipients if ~/.env-sync/recipients.txt has any, or
+// under the configured KMS key (see kms.go).
+// Password-encrypted output starts with a header recording the Argon2 parameters.
+func Encrypt(plaintext, password string) (string, error) {
+	return encryptPayload(compressPlaintext(plaintext), password)
 }
 
-// Encrypt encrypts plaintext using AES-GCM with the given password
-func Encrypt(plaintext, password string) (string, error) {
+// encryptionProvider is one way of encrypting stored copies: with the
+// password, to age recipients, or under a KMS key. Each kind of copy starts
+// with its own prefix, so it opens whichever is configured now.
+type encryptionProvider interface {
+	// seal encrypts an encoded plaintext (see compressPlaintext)
+	seal(payload []byte) (string, error)
+	// open reverses seal
+	open(encryptedData string) ([]byte, error)
+}
+
+// newEncryptionProvider returns what new copies are encrypted with: the
+// configured KMS key, else the age recipients, else the password
+func newEncryptionProvider(password string) (encryptionProvider, error) {
+	if keyURI := kmsKeyURI(); keyURI != "" {
+		return kmsProvider{keyURI: keyURI}, nil
+	}
+	keys, err := loadAgeKeys()
+	if err != nil {
+		return nil, err
+	}
+	if len(keys.recipients) > 0 {
+		return ageProvider{recipients: keys.recipients}, nil
+	}
+	return passwordProvider(password), nil
+}
+
+// providerOf returns what opens a stored copy
+func providerOf(encryptedData, password string) encryptionProvider {
+	switch {
+	case strings.HasPrefix(encryptedData, agePrefix):
+		return ageProvider{}
+	case strings.HasPrefix(encryptedData, kmsPrefix):
+		return kmsProvider{}
+	default:
+		return passwordProvider(password)
+	}
+}
+
+// passwordless reports whether new copies are encrypted without the
+// password, to age recipients or under a KMS key
+func passwordless() bool {
+	return ageEnabled() || kmsKeyURI() != ""
+}
+
+// encryptPayload encrypts an already encoded plaintext (see compressPlaintext)
+func encryptPayload(payload []byte, password string) (string, error) {
+	provider, err := newEncryptionProvider(password)
+	if err != nil {
+		return "", err
+	}
+	return provider.seal(payload)
+}
+
+// passwordProvider encrypts with a key derived from the password by Argon2
+type passwordProvider string
+
+func (password passwordProvider) seal(payload []byte) (string, error) {
 	// Generate a random salt
 	salt := make([]byte, 16)
 	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
@@ -26,7 +83,8 @@ func Encrypt(plaintext, password string) (string, error) {
 	}
 
 	// Derive key from password
-	key := deriveKey(password, salt)
+	params := encryptKDF
+	key := deriveKey(string(password), salt, params)
 
 	// Create AES cipher
 	block, err := aes.NewCipher(key)
@@ -46,58 +104,158 @@ func Encrypt(plaintext, password string) (string, error) {
 		return "", fmt.Errorf("failed to generate nonce: %v", err)
 	}
 
-	// Encrypt
-	ciphertext := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+	// Compress, then encrypt, authenticating the header so it can't be altered
+	header := encodeKDFHeader(params)
+	ciphertext := gcm.Seal(nonce, nonce, payload, header)
 
-	// Combine salt + ciphertext and encode to base64
-	result := append(salt, ciphertext...)
-	return base64.StdEncoding.EncodeToString(result), nil
+	// Combine header + salt + ciphertext and encode to base64
+	result := append(append(header, salt...), ciphertext...)
+	return passwordPrefix + base64.StdEncoding.EncodeToString(result), nil
 }
 
-// Decrypt decrypts ciphertext using AES-GCM with the given password
+// Decrypt decrypts ciphertext using AES-GCM with the given password, with
+// the local age identity if it was encrypted to recipients, or through the
+// KMS that wrapped its data key
 func Decrypt(encryptedData, password string) (string, error) {
+	payload, err := decryptPayload(encryptedData, password)
+	if err != nil {
+		return "", err
+	}
+	return decompressPlaintext(payload)
+}
+
+// decryptPayload reverses encryptPayload, leaving the plaintext encoded
+func decryptPayload(encryptedData, password string) ([]byte, error) {
+	return providerOf(encryptedData, password).open(encryptedData)
+}
+
+func (password passwordProvider) open(encryptedData string) ([]byte, error) {
+	if password == "" {
+		return nil, fmt.Errorf("file is encrypted with a password, use --password")
+	}
+
 	// Decode from base64
-	data, err := base64.StdEncoding.DecodeString(encryptedData)
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(encryptedData, passwordPrefix))
 	if err != nil {
-		return "", fmt.Errorf("failed to decode base64: %v", err)
+		return nil, fmt.Errorf("failed to decode base64: %v", err)
+	}
+
+	// Read the KDF parameters from the header; older records have none
+	params := legacyKDF
+	var header []byte
+	if strings.HasPrefix(encryptedData, passwordPrefix) {
+		params, err = decodeKDFHeader(data)
+		if err != nil {
+			return nil, err
+		}
+		header, data = data[:kdfHeaderSize], data[kdfHeaderSize:]
 	}
 
 	// Extract salt (first 16 bytes)
 	if len(data) < 16 {
-		return "", fmt.Errorf("invalid encrypted data: too short")
+		return nil, fmt.Errorf("invalid encrypted data: too short")
 	}
 	salt := data[:16]
 	ciphertext := data[16:]
 
 	// Derive key from password
-	key := deriveKey(password, salt)
+	key := deriveKey(string(password), salt, params)
 
 	// Create AES cipher
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		return "", fmt.Errorf("failed to create cipher: %v", err)
+		return nil, fmt.Errorf("failed to create cipher: %v", err)
 	}
 
 	// Create GCM mode
 	gcm, err := cipher.NewGCM(block)
 	if err != nil {
-		return "", fmt.Errorf("failed to create GCM: %v", err)
+		return nil, fmt.Errorf("failed to create GCM: %v", err)
 	}
 
 	// Extract nonce
 	nonceSize := gcm.NonceSize()
 	if len(ciphertext) < nonceSize {
-		return "", fmt.Errorf("invalid ciphertext: too short")
+		return nil, fmt.Errorf("invalid ciphertext: too short")
 	}
 	nonce, ciphertext := ciphertext[:nonceSize], ciphertext[nonceSize:]
 
 	// Decrypt
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt: %v", err)
+	}
+
+	return plaintext, nil
+}
+
+// dataKeyPrefix marks contents encrypted with a shared repo's data key
+const dataKeyPrefix = "dk:"
+
+// EncryptWithKey encrypts plaintext using AES-GCM with a raw 32-byte key
+func EncryptWithKey(plaintext string, key []byte) (string, error) {
+	return encryptPayloadWithKey(compressPlaintext(plaintext), key)
+}
+
+// encryptPayloadWithKey encrypts an already encoded plaintext with a raw key
+func encryptPayloadWithKey(payload []byte, key []byte) (string, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", fmt.Errorf("failed to create cipher: %v", err)
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", fmt.Errorf("failed to create GCM: %v", err)
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %v", err)
+	}
+
+	ciphertext := gcm.Seal(nonce, nonce, payload, nil)
+	return dataKeyPrefix + base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+// DecryptWithKey decrypts data produced by EncryptWithKey
+func DecryptWithKey(encryptedData string, key []byte) (string, error) {
+	payload, err := decryptPayloadWithKey(encryptedData, key)
+	if err != nil {
+		return "", err
+	}
+	return decompressPlaintext(payload)
+}
+
+// decryptPayloadWithKey reverses encryptPayloadWithKey
+func decryptPayloadWithKey(encryptedData string, key []byte) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(encryptedData, dataKeyPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode base64: %v", err)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %v", err)
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %v", err)
+	}
+
+	nonceSize := gcm.NonceSize()
+	if len(data) < nonceSize {
+		return nil, fmt.Errorf("invalid ciphertext: too short")
+	}
+	nonce, ciphertext := data[:nonceSize], data[nonceSize:]
+
 	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
 	if err != nil {
-		return "", fmt.Errorf("failed to decrypt: %v", err)
+		return nil, fmt.Errorf("failed to decrypt: %v", err)
 	}
 
-	return string(plaintext), nil
+	return plaintext, nil
 }
 
 // HashPassword creates a SHA-256 hash of the password for verification
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// daemonStatus is the state reported by the daemon's /status endpoint
+type daemonStatus struct {
+	mu           sync.Mutex
+	StartedAt    time.Time        `json:"started_at"`
+	Running      bool             `json:"running"`
+	SyncCount    int              `json:"sync_count"`
+	LastSyncAt   *time.Time       `json:"last_sync_at,omitempty"`
+	LastDuration string           `json:"last_duration,omitempty"`
+	LastError    string           `json:"last_error,omitempty"`
+	LastStats    *syncStatsReport `json:"last_stats,omitempty"`
+	NextSyncAt   time.Time        `json:"next_sync_at"`
+}
+
+// scheduleSync sets when the first sync is due, if the daemon doesn't
+// sync on startup
+func (s *daemonStatus) scheduleSync(next time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.NextSyncAt = next
+}
+
+func (s *daemonStatus) startSync() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Running = true
+}
+
+func (s *daemonStatus) finishSync(stats *SyncStats, err error, duration time.Duration, next time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.Running = false
+	s.SyncCount++
+	s.LastSyncAt = &now
+	s.LastDuration = duration.Round(time.Millisecond).String()
+	s.NextSyncAt = next
+	s.LastError = ""
+	if err != nil {
+		s.LastError = err.Error()
+	}
+	s.LastStats = nil
+	if stats != nil {
+		s.LastStats = &syncStatsReport{
+			Uploaded:   atomic.LoadInt64(&stats.FilesUploaded),
+			Downloaded: atomic.LoadInt64(&stats.FilesDownloaded),
+			Skipped:    atomic.LoadInt64(&stats.FilesSkipped),
+			Merged:     atomic.LoadInt64(&stats.FilesMerged),
+			Moved:      atomic.LoadInt64(&stats.FilesMoved),
+			Conflicts:  atomic.LoadInt64(&stats.FilesConflict),
+			Corrupted:  atomic.LoadInt64(&stats.FilesCorrupted),
+			Errors:     int(atomic.LoadInt64(&stats.FilesError)),
+		}
+	}
+}
+
+func (s *daemonStatus) writeJSON(w http.ResponseWriter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+// getDaemonTokenFile returns ~/.env-sync/daemon.token, the bearer token a
+// POST to the daemon's /sync must carry
+func getDaemonTokenFile() (string, error) {
+	dir, err := getStorageDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "daemon.token"), nil
+}
+
+// loadDaemonToken returns the daemon's /sync token, creating it on first use.
+// Only the user the daemon runs as can read it.
+func loadDaemonToken() (string, error) {
+	tokenFile, err := getDaemonTokenFile()
+	if err != nil {
+		return "", err
+	}
+
+	data, err := os.ReadFile(tokenFile)
+	if err == nil {
+		token := strings.TrimSpace(string(data))
+		if len(token) < 32 {
+			return "", fmt.Errorf("invalid daemon token %s", tokenFile)
+		}
+		return token, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to read daemon token: %v", err)
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", fmt.Errorf("failed to generate daemon token: %v", err)
+	}
+	f, err := os.OpenFile(tokenFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		// Another process created it first
+		return loadDaemonToken()
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to create daemon token: %v", err)
+	}
+	token := hex.EncodeToString(secret)
+	_, err = f.WriteString(token + "\n")
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tokenFile)
+		return "", fmt.Errorf("failed to write daemon token: %v", err)
+	}
+	return token, nil
+}
+
+// startStatusServer serves /healthz, /status, /metrics and /sync for monitoring
+// the daemon. A POST to /sync with token as its bearer token queues an
+// immediate sync on trigger; without a token, /sync is turned off.
+func startStatusServer(addr string, status *daemonStatus, metrics *syncMetrics, trigger chan<- struct{}, token string) *http.Server {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		status.writeJSON(w)
+	})
+
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.writeTo(w)
+	})
+
+	mux.HandleFunc("/sync", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "use POST to trigger a sync", http.StatusMethodNotAllowed)
+			return
+		}
+		if token == "" {
+			http.Error(w, "triggering a sync over HTTP is turned off", http.StatusServiceUnavailable)
+			return
+		}
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "missing or wrong bearer token", http.StatusUnauthorized)
+			return
+		}
+
+		// Non-blocking: if a sync is already queued, this request joins it
+		select {
+		case trigger <- struct{}{}:
+		default:
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(`{"status":"queued"}` + "\n"))
+	})
+
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Error("HTTP server failed", "addr", addr, "error", err)
+		}
+	}()
+
+	return server
+}
+
+// daemonConn keeps the daemon's store open between syncs, so each tick
+// doesn't reconnect and set up the schema again. The connection is checked
+// before every sync and reopened if it broke.
+type daemonConn struct {
+	dbConnStr string
+	replicas  []string
+	maxConns  int
+	lifetime  time.Duration
+	store     Store
+}
+
+// get returns the open store, connecting first if there is none or the
+// last one stopped answering
+func (c *daemonConn) get(ctx context.Context) (Store, error) {
+	if pool, ok := c.store.(connPool); ok {
+		if err := pool.Ping(); err != nil {
+			logger.Warn("database connection lost, reconnecting", "error", err)
+			c.close()
+		}
+	}
+	if c.store != nil {
+		if r, ok := c.store.(*ReplicatedStore); ok {
+			r.reconnectReplicas(ctx, c.maxConns, c.lifetime)
+			r.resetCounts()
+		}
+		return c.store, nil
+	}
+
+	store, err := openReplicatedStore(c.dbConnStr, c.replicas)
+	if err != nil {
+		return nil, err
+	}
+	if err := store.InitSchema(ctx); err != nil {
+		store.Close()
+		return nil, err
+	}
+	if pool, ok := store.(connPool); ok {
+		pool.SetPoolLimits(c.maxConns, c.lifetime)
+	}
+	logger.Info("database connected", "max_conns", c.maxConns, "conn_lifetime", c.lifetime.String())
+	c.store = store
+	return store, nil
+}
+
+func (c *daemonConn) close() {
+	if c.store != nil {
+		c.store.Close()
+		c.store = nil
+	}
+}
+
+var (
+	daemonStop     = make(chan struct{})
+	daemonStopOnce sync.Once
+)
+
+// stopDaemon asks a running daemon loop to exit, e.g. when the Windows
+// service manager stops the service
+func stopDaemon() {
+	daemonStopOnce.Do(func() { close(daemonStop) })
+}
+
+// daemonTiming says when the daemon syncs: every Interval, or at the times
+// Schedule matches instead, each time delayed by a random part of Jitter
+type daemonTiming struct {
+	Interval time.Duration
+	Schedule *cronSchedule
+	Jitter   time.Duration
+}
+
+// next is when the sync after now is due
+func (t daemonTiming) next(now time.Time) time.Time {
+	return nextSyncTime(now, t.Interval, t.Schedule, t.Jitter)
+}
+
+// runDaemon syncs on timing's schedule until stopped, and right away on a
+// POST to /sync, SIGUSR1 or SIGHUP, which reloads the config too. With
+// retention.OlderThan set, old revisions are pruned after a sync once a day;
+// with a digest, it's sent after the sync once it's due.
+func runDaemon(ctx context.Context, conn *daemonConn, password, basePath string, timing daemonTiming, httpAddr string, opts SyncOptions, retention pruneOptions, digest *digestSchedule) {
+	opts.LogResults = true
+	defer conn.close()
+	schedule := ""
+	if timing.Schedule != nil {
+		schedule = timing.Schedule.expr
+	}
+	logger.Info("env-sync daemon starting",
+		"database", conn.dbConnStr[:min(50, len(conn.dbConnStr))]+"...",
+		"base", basePath,
+		"interval", timing.Interval.String(),
+		"schedule", schedule,
+		"jitter", timing.Jitter.String(),
+		"workers", opts.Workers,
+		"replicas", len(opts.Replicas),
+		"http", httpAddr,
+		"prune_older_than", formatAge(retention.OlderThan))
+
+	// A service stop cancels a running sync the way Ctrl+C does
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	go func() {
+		select {
+		case <-daemonStop:
+			cancel(errors.New("service stop"))
+		case <-ctx.Done():
+		}
+	}()
+
+	status := &daemonStatus{StartedAt: time.Now()}
+	metrics := newSyncMetrics()
+	trigger := make(chan struct{}, 1)
+	if httpAddr != "" {
+		// Anyone who can reach the port could otherwise make the daemon sync
+		token, err := loadDaemonToken()
+		if err != nil {
+			logger.Warn("POST /sync is turned off", "error", err)
+		}
+		server := startStatusServer(httpAddr, status, metrics, trigger, token)
+		defer server.Close()
+	}
+	signals, stopSignals := notifyDaemonSignals()
+	defer stopSignals()
+
+	var lastPrune, nextSync time.Time
+	runSync := func(reason string) {
+		logger.Info("running sync", "reason", reason)
+		status.startSync()
+		start := time.Now()
+		var stats *SyncStats
+		store, err := conn.get(ctx)
+		if err == nil {
+			opts.Store = store
+			stats, err = syncEnvFiles(ctx, conn.dbConnStr, password, basePath, opts)
+		} else if databaseUnreachable(err) {
+			err = queueOfflineSync(basePath, password, opts, err)
+		}
+		if ctx.Err() != nil {
+			// Shutting down: what was synced is saved, the rest waits for the next start
+			logger.Info("sync stopped", "error", err)
+			return
+		}
+		var busy *syncBusyError
+		if errors.As(err, &busy) {
+			// Not counted as a failure: the next cycle tries again
+			logger.Warn("skipping sync, another one is running", "holder", busy.heldBy)
+		} else if err != nil {
+			logger.Error("sync failed", "error", err)
+			if opts.Notifier != nil {
+				opts.Notifier.syncFailed(err)
+			}
+		}
+		duration := time.Since(start)
+		nextSync = timing.next(time.Now())
+		status.finishSync(stats, err, duration, nextSync)
+		if busy == nil {
+			metrics.observe(stats, err, duration)
+		}
+
+		if err == nil && retention.OlderThan > 0 && time.Since(lastPrune) >= daemonPruneInterval {
+			lastPrune = time.Now()
+			result, err := pruneHistory(ctx, opts.Store, password, retention)
+			if err != nil {
+				logger.Error("prune failed", "error", err)
+			} else {
+				logger.Info("pruned old revisions", "revisions", result.Revisions, "files", result.Files, "older_than", formatAge(retention.OlderThan))
+			}
+		}
+		digest.sendIfDue()
+	}
+
+	// Sync right away, unless a schedule says when syncs may run
+	if timing.Schedule == nil {
+		runSync("initial")
+	} else {
+		nextSync = timing.next(time.Now())
+		status.scheduleSync(nextSync)
+	}
+
+	timer := time.NewTimer(time.Until(nextSync))
+	defer timer.Stop()
+
+	logger.Info("daemon running, press Ctrl+C to stop", "next_sync_in", untilSync(nextSync))
+
+	for {
+		select {
+		case <-timer.C:
+			runSync("scheduled")
+		case <-trigger:
+			runSync("http")
+		case sig := <-signals:
+			if reloadsConfig(sig) {
+				reloadDaemonConfig()
+			}
+			runSync("signal " + sig.String())
+		case <-ctx.Done():
+			logger.Info("shutting down", "reason", context.Cause(ctx).Error())
+			return
+		}
+		timer.Reset(time.Until(nextSync))
+		logger.Info("waiting", "next_sync_in", untilSync(nextSync))
+	}
+}
+
+// reloadDaemonConfig reads the config file again, keeping the old one if the
+// new one doesn't load
+func reloadDaemonConfig() {
+	configFile, _ := getConfigFile()
+	if err := reloadConfig(); err != nil {
+		logger.Error("config reload failed, keeping the previous config", "file", configFile, "error", err)
+		return
+	}
+	logger.Info("config reloaded", "file", configFile)
+}
+
+// untilSync is how long until the next sync, for the log
+func untilSync(next time.Time) string {
+	return time.Until(next).Round(time.Second).String()
+}
@@ -0,0 +1,22 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyDaemonSignals relays SIGHUP and SIGUSR1, which make the daemon sync
+// right away; SIGHUP reloads the config first. stop stops relaying them.
+func notifyDaemonSignals() (signals <-chan os.Signal, stop func()) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP, syscall.SIGUSR1)
+	return c, func() { signal.Stop(c) }
+}
+
+// reloadsConfig reports whether sig asks the daemon to reload its config
+func reloadsConfig(sig os.Signal) bool {
+	return sig == syscall.SIGHUP
+}
@@ -0,0 +1,15 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// notifyDaemonSignals relays nothing: Windows has no SIGHUP or SIGUSR1, so
+// syncs are triggered through the status server's /sync instead
+func notifyDaemonSignals() (signals <-chan os.Signal, stop func()) {
+	return nil, func() {}
+}
+
+func reloadsConfig(sig os.Signal) bool {
+	return false
+}
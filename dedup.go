@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// blobStore is implemented by backends that store each distinct encrypted
+// copy once, so identical files can share it
+type blobStore interface {
+	// FindContents returns the stored copies of current files whose
+	// plaintext hash is fileHash, with the repo each belongs to
+	FindContents(ctx context.Context, fileHash string) ([]EnvFileRecord, error)
+	// BlobUsage reports how much space the shared copies save
+	BlobUsage(ctx context.Context) (*blobUsage, error)
+}
+
+// blobUsage compares the contents the files and revisions refer to with
+// what is actually stored
+type blobUsage struct {
+	Files        int   `json:"files"`
+	Revisions    int   `json:"revisions"`
+	Blobs        int   `json:"blobs"`
+	LogicalBytes int64 `json:"logical_bytes"`
+	StoredBytes  int64 `json:"stored_bytes"`
+	// SharedAcrossFiles is false while copies are bound to their file (the
+	// default), so only a file's own revisions share a copy
+	SharedAcrossFiles bool `json:"shared_across_files"`
+}
+
+// SavedBytes is how much less is stored than without deduplication
+func (u *blobUsage) SavedBytes() int64 {
+	return u.LogicalBytes - u.StoredBytes
+}
+
+// FindContents returns the distinct stored copies of files with this hash
+func (db *Database) FindContents(ctx context.Context, fileHash string) ([]EnvFileRecord, error) {
+	query := `SELECT DISTINCT f.repo_id, ` + blobContents + ` FROM env_files f ` + blobJoin + ` WHERE f.namespace = ? AND f.file_hash = ?`
+
+	rows, err := db.conn.QueryContext(ctx, query, db.namespace, fileHash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query env files: %v", err)
+	}
+	defer rows.Close()
+
+	var records []EnvFileRecord
+	for rows.Next() {
+		record := EnvFileRecord{FileHash: fileHash}
+		if err := rows.Scan(&record.RepoID, &record.Contents); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %v", err)
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+// BlobUsage counts the files, revisions and blobs and their sizes. Rows
+// written before blobs count as stored inline. Blobs are shared between
+// namespaces, so this covers all of them.
+func (db *Database) BlobUsage(ctx context.Context) (*blobUsage, error) {
+	var usage blobUsage
+	err := db.conn.QueryRowContext(ctx, `SELECT
+		(SELECT COUNT(*) FROM env_files),
+		(SELECT COUNT(*) FROM env_file_versions),
+		(SELECT COUNT(*) FROM env_blobs)`).Scan(&usage.Files, &usage.Revisions, &usage.Blobs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count blobs: %v", err)
+	}
+
+	err = db.conn.QueryRowContext(ctx, `SELECT COALESCE(SUM(LENGTH(`+blobContents+`)), 0)
+		FROM (SELECT blob_hash, contents FROM env_files UNION ALL SELECT blob_hash, contents FROM env_file_versions) f `+blobJoin).Scan(&usage.LogicalBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to measure contents: %v", err)
+	}
+
+	err = db.conn.QueryRowContext(ctx, `SELECT
+		(SELECT COALESCE(SUM(LENGTH(contents)), 0) FROM env_blobs) +
+		(SELECT COALESCE(SUM(LENGTH(contents)), 0) FROM env_files) +
+		(SELECT COALESCE(SUM(LENGTH(contents)), 0) FROM env_file_versions)`).Scan(&usage.StoredBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to measure blobs: %v", err)
+	}
+	return &usage, nil
+}
+
+func (s *SealedDatabase) FindContents(ctx context.Context, fileHash string) ([]EnvFileRecord, error) {
+	records, err := s.db.FindContents(ctx, fileHash)
+	if err != nil {
+		return nil, err
+	}
+	for i := range records {
+		if records[i].RepoID, err = s.ids.open(records[i].RepoID); err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+func (s *SealedDatabase) BlobUsage(ctx context.Context) (*blobUsage, error) {
+	return s.db.BlobUsage(ctx)
+}
+
+// blobStoreOf returns the blob store behind db, if it has one. With replicas
+// that is the primary; a copy found there is self-contained, so every
+// replica can store it too.
+func blobStoreOf(db Store) blobStore {
+	if r, ok := db.(*ReplicatedStore); ok {
+		db = r.primary()
+	}
+	blobs, _ := db.(blobStore)
+	return blobs
+}
+
+// reuseContents returns an already stored encrypted copy of plaintext that
+// the file can point at instead of a new one, or "" if there is none. Only
+// copies encrypted exactly as a new one would be qualify: with the password
+// and current KDF settings, or with this repo's own data key, and not bound
+// to a file. Copies encrypted to age recipients or under a KMS key aren't
+// shared, since the recipients or key may differ. New copies are bound, so
+// nothing is shared, unless share_contents is set.
+func reuseContents(ctx context.Context, db Store, repoID, plaintext, password string) string {
+	blobs := blobStoreOf(db)
+	if blobs == nil || passwordless() || bindContents() {
+		return ""
+	}
+
+	fileHash := HashFile(plaintext)
+	candidates, err := blobs.FindContents(ctx, fileHash)
+	if err != nil || len(candidates) == 0 {
+		return ""
+	}
+
+	key, err := repoDataKey(ctx, db, repoID)
+	if err != nil {
+		return ""
+	}
+	for _, candidate := range candidates {
+		if key != nil {
+			if candidate.RepoID != repoID || encryptionKind(candidate.Contents) != dataKeyPrefix {
+				continue
+			}
+		} else if !usesCurrentKDF(candidate.Contents) {
+			continue
+		}
+
+		payload, err := openPayload(ctx, db, candidate.RepoID, candidate.Contents, password)
+		if err != nil {
+			continue
+		}
+		if binding, _, err := unbindPayload(payload); err != nil || binding != "" {
+			continue
+		}
+		// Deltas depend on their own file's history, so they fail here too
+		contents, err := decompressPlaintext(payload)
+		if err == nil && HashFile(contents) == fileHash {
+			return candidate.Contents
+		}
+	}
+	return ""
+}
+
+// usesCurrentKDF reports whether contents were encrypted with the password
+// and the Argon2 parameters new uploads use
+func usesCurrentKDF(encryptedData string) bool {
+	if !strings.HasPrefix(encryptedData, passwordPrefix) {
+		return false
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(encryptedData, passwordPrefix))
+	if err != nil {
+		return false
+	}
+	params, err := decodeKDFHeader(data)
+	return err == nil && params == encryptKDF
+}
+
+// loadListDetails reads the deduplication savings of a database, nil for
+// backends that don't store blobs, and the tags of its files, nil for
+// backends without tags
+func loadListDetails(ctx context.Context, dbConnStr string, filter FileFilter) (*blobUsage, map[string][]string, error) {
+	db, err := OpenStore(dbConnStr)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer db.Close()
+
+	if err := db.InitSchema(ctx); err != nil {
+		return nil, nil, err
+	}
+
+	tags, err := loadFileTags(ctx, db, filter)
+	if err != nil {
+		return nil, nil, err
+	}
+	blobs := blobStoreOf(db)
+	if blobs == nil {
+		return nil, tags, nil
+	}
+	usage, err := blobs.BlobUsage(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	usage.SharedAcrossFiles = !bindContents()
+	return usage, tags, nil
+}
+
+// formatBytes returns a size in B, KB or MB
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	default:
+		return fmt.Sprintf("%d B", n)
+	}
+}
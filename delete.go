@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// deleteOptions says which copies of a file 'env-sync delete' removes
+type deleteOptions struct {
+	Remote bool // The stored file with its history and tags
+	Local  bool // The file in the checkout under --base
+	Yes    bool // Don't ask for confirmation
+}
+
+// deleteReport is the JSON output of 'env-sync delete'
+type deleteReport struct {
+	RepoID        string `json:"repo_id"`
+	RelativePath  string `json:"relative_path"`
+	RemoteDeleted bool   `json:"remote_deleted"`
+	Revisions     int    `json:"revisions,omitempty"`
+	LocalPath     string `json:"local_path,omitempty"`
+	LocalDeleted  bool   `json:"local_deleted"`
+}
+
+// deleteEnvFile deletes a stored file and/or its local copy, after showing
+// what is about to go and asking for confirmation
+func deleteEnvFile(ctx context.Context, dbConnStr, password, basePath, ref string, opts deleteOptions) error {
+	db, err := OpenStore(dbConnStr)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := db.InitSchema(ctx); err != nil {
+		return err
+	}
+
+	record, err := resolveEnvFileRef(ctx, db, ref)
+	if err != nil {
+		return err
+	}
+	full, err := db.GetEnvFileWithMetadata(ctx, record.RepoID, record.RelativePath)
+	if err != nil || full == nil {
+		return fmt.Errorf("failed to read %s: %v", ref, err)
+	}
+	versions, err := db.ListEnvFileVersions(ctx, full.RepoID, full.RelativePath)
+	if err != nil {
+		return err
+	}
+
+	var localPath string
+	localExists := false
+	if opts.Local {
+		if localPath, err = localEnvFilePath(full, basePath); err != nil {
+			return err
+		}
+		if _, err := os.Stat(localPath); err == nil {
+			localExists = true
+		} else if !opts.Remote {
+			return fmt.Errorf("%s doesn't exist, nothing to delete", localPath)
+		}
+	}
+
+	if !opts.Yes {
+		if jsonOutput || !term.IsTerminal(int(os.Stdin.Fd())) {
+			return usageErrorf("refusing to delete without confirmation: run in a terminal or pass --yes")
+		}
+		printDeletePreview(ctx, db, full, versions, password, opts, localPath, localExists)
+		confirmed, err := confirmDelete(bufio.NewReader(os.Stdin))
+		if err != nil {
+			return err
+		}
+		if !confirmed {
+			fmt.Println("Nothing deleted")
+			return nil
+		}
+	}
+
+	report := deleteReport{RepoID: full.RepoID, RelativePath: full.RelativePath}
+	displayName := fmt.Sprintf("%s (%s)", full.RelativePath, shortenRepoID(full.RepoID))
+
+	// The local copy goes first, so if deleting the stored copy fails there
+	// is still one to restore it from
+	if opts.Local && localExists {
+		if err := os.Remove(localPath); err != nil {
+			return fmt.Errorf("failed to delete %s: %v", localPath, err)
+		}
+		report.LocalPath, report.LocalDeleted = localPath, true
+		if !jsonOutput {
+			fmt.Printf("✓ Deleted %s\n", localPath)
+		}
+	}
+
+	if opts.Remote {
+		if err := db.DeleteEnvFile(ctx, full.RepoID, full.RelativePath); err != nil {
+			return err
+		}
+		entry := newAuditEntry(auditDelete, full.RepoID, full.RelativePath, full.FileHash, "")
+		entry.Detail = fmt.Sprintf("delete command, %d revision(s)", len(versions))
+		recordAudit(ctx, db, entry)
+		report.RemoteDeleted, report.Revisions = true, len(versions)
+		if !jsonOutput {
+			fmt.Printf("✓ Deleted the stored copy of %s and %d revision(s)\n", displayName, len(versions))
+		}
+	}
+
+	// Forget the local file once both copies are gone. A file deleted only
+	// locally is marked as synced instead, which is what stops sync from
+	// downloading it again.
+	if opts.Local && localPath != "" {
+		err := updateEnvFileStore(func(store *EnvFileStore) {
+			if opts.Remote {
+				delete(store.Synced, localPath)
+				store.Files = slices.DeleteFunc(store.Files, func(file string) bool { return file == localPath })
+				return
+			}
+			if store.Synced == nil {
+				store.Synced = make(map[string]syncBase)
+			}
+			if base, ok := store.Synced[localPath]; !ok || base.RepoID != full.RepoID || base.RelativePath != full.RelativePath {
+				store.Synced[localPath] = syncBase{RepoID: full.RepoID, RelativePath: full.RelativePath, Hash: full.FileHash, SyncedAt: time.Now().UTC().Format("2006-01-02 15:04:05")}
+			}
+		})
+		if err != nil {
+			logger.Warn("failed to update the local inventory", "error", err)
+		}
+	}
+
+	if jsonOutput {
+		printJSON(report)
+	} else if opts.Remote && !opts.Local {
+		fmt.Println("Machines that still have the file upload it again on their next sync; run 'env-sync delete --local-only' there first")
+	}
+	return nil
+}
+
+// printDeletePreview shows the file about to be deleted: its metadata, its
+// history and the keys of its latest version, with values masked
+func printDeletePreview(ctx context.Context, db Store, record *EnvFileRecord, versions []EnvFileVersion, password string, opts deleteOptions, localPath string, localExists bool) {
+	fmt.Printf("File:      %s\n", record.RelativePath)
+	fmt.Printf("Repo:      %s\n", record.RepoID)
+	fmt.Printf("Modified:  %s (stored %s)\n", record.FileModifiedAt, record.UpdatedAt)
+	fmt.Printf("Hash:      %s\n", record.FileHash)
+	if len(versions) > 0 {
+		latest := versions[0]
+		fmt.Printf("History:   %d revision(s), latest v%d from %s\n", len(versions), latest.Version, latest.CreatedAt)
+	}
+	if localPath != "" {
+		state := "exists"
+		if !localExists {
+			state = "missing"
+		}
+		fmt.Printf("Local:     %s (%s)\n", localPath, state)
+	}
+
+	contents, err := openContents(ctx, db, record.RepoID, record.RelativePath, record.Contents, password)
+	if err != nil {
+		fmt.Printf("Contents:  can't be shown (%v)\n", err)
+	} else {
+		fmt.Println("Latest version:")
+		lines := strings.Split(strings.TrimRight(contents, "\n"), "\n")
+		dotenv := isDotenvName(path.Base(record.RelativePath))
+		for _, line := range lines {
+			if dotenv {
+				fmt.Printf("  %s\n", displayEnvLine(line, false))
+			} else {
+				fmt.Printf("  %s\n", maskSecretLine(line))
+			}
+		}
+	}
+
+	var targets []string
+	if opts.Local {
+		targets = append(targets, "the local file")
+	}
+	if opts.Remote {
+		targets = append(targets, "the stored copy and its history")
+	}
+	fmt.Printf("\nThis deletes %s.\n", strings.Join(targets, " and "))
+}
+
+// confirmDelete asks whether to go ahead with the deletion
+func confirmDelete(reader *bufio.Reader) (bool, error) {
+	fmt.Print("Delete? [y/N] ")
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return false, fmt.Errorf("failed to read answer: %v", err)
+	}
+	switch strings.ToLower(strings.TrimSpace(line)) {
+	case "y", "yes":
+		return true, nil
+	}
+	return false, nil
+}
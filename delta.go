@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Large files that change by a line or two are stored as a delta against the
+// previous revision instead of in full. A delta names its base by hash and is
+// rebuilt from the file's history when read. After maxDeltaDepth deltas in a
+// row a full snapshot is stored again, so reads never walk a long chain.
+const (
+	minDeltaSize  = 1024    // Smaller files are cheaper to store whole
+	maxDeltaDepth = 10      // Deltas in a row before the next full snapshot
+	maxDeltaCells = 1 << 20 // Bounds the LCS table for the changed lines
+	baseHashSize  = 44      // A base64 SHA-256, as returned by HashFile
+)
+
+// A delta payload is the format header, the delta's depth (1 for a delta
+// against a full snapshot), the base hash and the script
+const deltaHeaderSize = 3 + baseHashSize
+
+// Delta script operations, each followed by a uvarint line count
+const (
+	deltaCopy   byte = 'c' // Copy lines from the base
+	deltaSkip   byte = 's' // Drop lines from the base
+	deltaInsert byte = 'i' // New lines follow, each prefixed with its uvarint length
+)
+
+// deltaPayload is decrypted contents that were stored as a delta.
+// decompressPlaintext returns it as an error, so code that can't resolve
+// deltas fails instead of treating the script as the file.
+type deltaPayload struct {
+	depth    int
+	baseHash string
+	script   []byte
+}
+
+func (d *deltaPayload) Error() string {
+	return "contents are stored as a delta against an earlier revision"
+}
+
+// parseDeltaPayload reads a delta payload, returning it as an error
+func parseDeltaPayload(data []byte) error {
+	if len(data) < deltaHeaderSize {
+		return fmt.Errorf("invalid delta: too short")
+	}
+	return &deltaPayload{
+		depth:    int(data[2]),
+		baseHash: string(data[3:deltaHeaderSize]),
+		script:   data[deltaHeaderSize:],
+	}
+}
+
+// encode returns the payload stored for the delta
+func (d *deltaPayload) encode() []byte {
+	payload := []byte{formatMarker, formatDeltaV1, byte(d.depth)}
+	payload = append(payload, d.baseHash...)
+	return append(payload, d.script...)
+}
+
+// sealEnvFile encrypts a file's contents for upload, reusing a stored copy of
+// identical contents if there is one, or as a delta against the stored copy
+// when that is much smaller than storing the file again
+func sealEnvFile(ctx context.Context, db Store, repoID, relativePath, plaintext, password string) (string, error) {
+	if reused := reuseContents(ctx, db, repoID, plaintext, password); reused != "" {
+		return reused, nil
+	}
+	// A replica that missed a write wouldn't have the base revision
+	if _, replicated := db.(*ReplicatedStore); !replicated && len(plaintext) >= minDeltaSize {
+		if sealed := sealDelta(ctx, db, repoID, relativePath, plaintext, password); sealed != "" {
+			return sealed, nil
+		}
+	}
+	return sealContents(ctx, db, repoID, relativePath, plaintext, password)
+}
+
+// sealDelta returns the encrypted delta from the stored copy to plaintext,
+// or "" if the file should be stored in full
+func sealDelta(ctx context.Context, db Store, repoID, relativePath, plaintext, password string) string {
+	previous, err := db.GetEnvFileWithMetadata(ctx, repoID, relativePath)
+	if err != nil || previous == nil || previous.FileHash == HashFile(plaintext) || len(previous.FileHash) != baseHashSize {
+		return ""
+	}
+	// Age recipients and KMS keys can change between revisions, so only
+	// chain copies that anyone who can read the new one can also read
+	kind := encryptionKind(previous.Contents)
+	if kind != passwordPrefix && kind != dataKeyPrefix {
+		return ""
+	}
+
+	base, depth, err := openRevision(ctx, db, repoID, relativePath, previous.Contents, password, false, 0)
+	if err != nil || depth >= maxDeltaDepth || !hasRevision(ctx, db, repoID, relativePath, previous.FileHash) {
+		return ""
+	}
+
+	delta := &deltaPayload{depth: depth + 1, baseHash: previous.FileHash, script: encodeDelta(base, plaintext)}
+	payload := delta.encode()
+	if 2*len(payload) > len(compressPlaintext(plaintext)) {
+		return ""
+	}
+
+	sealed, err := sealPayload(ctx, db, repoID, relativePath, payload, password)
+	if err != nil || encryptionKind(sealed) != kind {
+		return ""
+	}
+	return sealed
+}
+
+// standaloneContents returns stored contents that can be read without the
+// file's history, re-encrypting a delta as a full copy. Contents that aren't
+// a delta, or can't be decrypted here, are returned unchanged.
+func standaloneContents(ctx context.Context, db Store, repoID, relativePath, encryptedData, password string) (string, error) {
+	if kind := encryptionKind(encryptedData); kind != passwordPrefix && kind != dataKeyPrefix {
+		return encryptedData, nil
+	}
+	var delta *deltaPayload
+	if _, err := decryptContents(ctx, db, repoID, relativePath, encryptedData, password, false); !errors.As(err, &delta) {
+		return encryptedData, nil
+	}
+
+	plaintext, err := openContents(ctx, db, repoID, relativePath, encryptedData, password)
+	if err != nil {
+		return "", err
+	}
+	return sealContents(ctx, db, repoID, relativePath, plaintext, password)
+}
+
+// encryptionKind returns the prefix that says how contents were encrypted
+func encryptionKind(encryptedData string) string {
+	for _, prefix := range []string{passwordPrefix, dataKeyPrefix, agePrefix, kmsPrefix} {
+		if strings.HasPrefix(encryptedData, prefix) {
+			return prefix
+		}
+	}
+	return ""
+}
+
+// openRevision decrypts stored contents, rebuilding deltas from their base
+// revisions, and returns how many deltas deep the contents were. Earlier
+// revisions may be bound to a name the file had before a move or rename.
+func openRevision(ctx context.Context, db Store, repoID, relativePath, encryptedData, password string, revision bool, hops int) (string, int, error) {
+	contents, err := decryptContents(ctx, db, repoID, relativePath, encryptedData, password, revision)
+	var delta *deltaPayload
+	if !errors.As(err, &delta) {
+		return contents, 0, err
+	}
+	if hops >= maxDeltaDepth {
+		return "", 0, fmt.Errorf("delta chain of %s:%s is too long", repoID, relativePath)
+	}
+
+	base, err := findRevision(ctx, db, repoID, relativePath, delta.baseHash)
+	if err != nil {
+		return "", 0, err
+	}
+	baseContents, _, err := openRevision(ctx, db, repoID, relativePath, base.Contents, password, true, hops+1)
+	if err != nil {
+		return "", 0, err
+	}
+	contents, err = applyDelta(baseContents, delta.script)
+	if err != nil {
+		return "", 0, err
+	}
+	return contents, delta.depth, nil
+}
+
+// findRevision returns the newest stored revision with the given hash
+func findRevision(ctx context.Context, db Store, repoID, relativePath, fileHash string) (*EnvFileVersion, error) {
+	versions, err := db.ListEnvFileVersions(ctx, repoID, relativePath)
+	if err != nil {
+		return nil, err
+	}
+	for _, version := range versions {
+		if version.FileHash == fileHash {
+			return db.GetEnvFileVersion(ctx, repoID, relativePath, version.Version)
+		}
+	}
+	return nil, fmt.Errorf("the revision %s:%s was stored against is missing from its history", repoID, relativePath)
+}
+
+// hasRevision reports whether the history holds a revision with the given hash
+func hasRevision(ctx context.Context, db Store, repoID, relativePath, fileHash string) bool {
+	versions, err := db.ListEnvFileVersions(ctx, repoID, relativePath)
+	if err != nil {
+		return false
+	}
+	for _, version := range versions {
+		if version.FileHash == fileHash {
+			return true
+		}
+	}
+	return false
+}
+
+// splitLines splits contents after each newline, keeping the newlines
+func splitLines(contents string) []string {
+	lines := strings.SplitAfter(contents, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// encodeDelta returns the script that turns base into target
+func encodeDelta(base, target string) []byte {
+	a, b := splitLines(base), splitLines(target)
+
+	// Only diff the lines between the unchanged start and end
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	changedA, changedB := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+
+	var ops []diffOp
+	if len(changedA)*len(changedB) <= maxDeltaCells {
+		ops = diffLines(changedA, changedB)
+	} else {
+		for _, line := range changedA {
+			ops = append(ops, diffOp{'-', line})
+		}
+		for _, line := range changedB {
+			ops = append(ops, diffOp{'+', line})
+		}
+	}
+
+	var w deltaWriter
+	w.add(deltaCopy, prefix)
+	for _, op := range ops {
+		switch op.kind {
+		case '-':
+			w.add(deltaSkip, 1)
+		case '+':
+			w.insert(op.line)
+		default:
+			w.add(deltaCopy, 1)
+		}
+	}
+	w.add(deltaCopy, suffix)
+	return w.finish()
+}
+
+// deltaWriter builds a delta script, merging consecutive operations
+type deltaWriter struct {
+	buf   []byte
+	op    byte
+	count int
+	lines []string
+}
+
+func (w *deltaWriter) add(op byte, count int) {
+	if count == 0 {
+		return
+	}
+	if op != w.op {
+		w.flush()
+		w.op = op
+	}
+	w.count += count
+}
+
+func (w *deltaWriter) insert(line string) {
+	w.add(deltaInsert, 1)
+	w.lines = append(w.lines, line)
+}
+
+func (w *deltaWriter) flush() {
+	if w.count > 0 {
+		w.buf = append(w.buf, w.op)
+		w.buf = binary.AppendUvarint(w.buf, uint64(w.count))
+		for _, line := range w.lines {
+			w.buf = binary.AppendUvarint(w.buf, uint64(len(line)))
+			w.buf = append(w.buf, line...)
+		}
+	}
+	w.op, w.count, w.lines = 0, 0, nil
+}
+
+func (w *deltaWriter) finish() []byte {
+	w.flush()
+	return w.buf
+}
+
+// applyDelta rebuilds the contents a delta script was made for
+func applyDelta(base string, script []byte) (string, error) {
+	invalid := fmt.Errorf("invalid delta")
+	lines := splitLines(base)
+	pos := 0
+
+	var out strings.Builder
+	for len(script) > 0 {
+		op := script[0]
+		count, n := binary.Uvarint(script[1:])
+		if n <= 0 {
+			return "", invalid
+		}
+		script = script[1+n:]
+
+		switch op {
+		case deltaCopy, deltaSkip:
+			if count > uint64(len(lines)-pos) {
+				return "", invalid
+			}
+			if op == deltaCopy {
+				for _, line := range lines[pos : pos+int(count)] {
+					out.WriteString(line)
+				}
+			}
+			pos += int(count)
+		case deltaInsert:
+			for ; count > 0; count-- {
+				length, n := binary.Uvarint(script)
+				if n <= 0 || length > uint64(len(script)-n) {
+					return "", invalid
+				}
+				out.Write(script[n : n+int(length)])
+				script = script[n+int(length):]
+			}
+		default:
+			return "", invalid
+		}
+	}
+	if pos != len(lines) {
+		return "", invalid
+	}
+	return out.String(), nil
+}
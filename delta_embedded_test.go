@@ -0,0 +1,151 @@
+//go:build libsql_embedded
+
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+const deltaTestPassword = "test-password"
+
+// cheapKDF makes password encryptions in the test fast
+func cheapKDF(t *testing.T) {
+	saved := encryptKDF
+	encryptKDF = kdfParams{Iterations: 1, MemoryKiB: 8 * 1024, Threads: 1}
+	t.Cleanup(func() { encryptKDF = saved })
+}
+
+// uploadRevision stores contents as the next revision of ./.env in repo
+func uploadRevision(t *testing.T, db *Database, contents string) {
+	t.Helper()
+	ctx := context.Background()
+	current, err := db.GetEnvFileWithMetadata(ctx, "repo", "./.env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := uploadContents(ctx, db, "repo", "./.env", deltaTestPassword, contents, time.Now(), 0o600, current); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// storedDepth returns the contents stored for ./.env and how many deltas
+// deep they are
+func storedDepth(t *testing.T, db *Database) (string, int) {
+	t.Helper()
+	ctx := context.Background()
+	record, err := db.GetEnvFileWithMetadata(ctx, "repo", "./.env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, depth, err := openRevision(ctx, db, record.RepoID, record.RelativePath, record.Contents, deltaTestPassword, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return contents, depth
+}
+
+func TestDeltaChainRollsOverToSnapshot(t *testing.T) {
+	cheapKDF(t)
+	db := openTestDatabase(t)
+	for revision := 0; revision <= maxDeltaDepth+1; revision++ {
+		want := deltaTestContents(revision)
+		uploadRevision(t, db, want)
+
+		// The first upload and the one after maxDeltaDepth deltas are
+		// stored in full
+		wantDepth := revision
+		if revision > maxDeltaDepth {
+			wantDepth = 0
+		}
+		contents, depth := storedDepth(t, db)
+		if contents != want {
+			t.Fatalf("revision %d reads back as %q, want %q", revision, contents, want)
+		}
+		if depth != wantDepth {
+			t.Errorf("revision %d is stored %d deltas deep, want %d", revision, depth, wantDepth)
+		}
+	}
+
+	// Every earlier revision still rebuilds from its chain
+	ctx := context.Background()
+	versions, err := db.ListEnvFileVersions(ctx, "repo", "./.env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != maxDeltaDepth+2 {
+		t.Fatalf("%d revisions stored, want %d", len(versions), maxDeltaDepth+2)
+	}
+	for i, version := range versions {
+		stored, err := db.GetEnvFileVersion(ctx, "repo", "./.env", version.Version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, err := openRevisionContents(ctx, db, "repo", "./.env", stored.Contents, deltaTestPassword)
+		if err != nil {
+			t.Fatalf("version %d: %v", version.Version, err)
+		}
+		if want := deltaTestContents(len(versions) - 1 - i); contents != want {
+			t.Errorf("version %d reads back as %q, want %q", version.Version, contents, want)
+		}
+	}
+}
+
+func TestPruneKeepsDeltaBases(t *testing.T) {
+	cheapKDF(t)
+	db := openTestDatabase(t)
+	ctx := context.Background()
+
+	// A small revision stored in full, a snapshot and two deltas on top of it
+	uploadRevision(t, db, "SMALL=1\n")
+	for revision := range 3 {
+		uploadRevision(t, db, deltaTestContents(revision))
+	}
+	if _, depth := storedDepth(t, db); depth != 2 {
+		t.Fatalf("current copy is stored %d deltas deep, want 2", depth)
+	}
+
+	old := formatStoredTime(time.Now().Add(-48 * time.Hour))
+	if _, err := db.conn.Exec(`UPDATE env_file_versions SET created_at = ?`, old); err != nil {
+		t.Fatal(err)
+	}
+	versions, err := db.ListEnvFileVersions(ctx, "repo", "./.env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldest := versions[len(versions)-1].Version
+
+	result, err := pruneHistory(ctx, db, deltaTestPassword, pruneOptions{OlderThan: time.Hour, Keep: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Revisions != 1 || result.Kept != 2 {
+		t.Errorf("prune removed %d and kept %d older revisions, want 1 removed and the 2 the current copy is stored against kept", result.Revisions, result.Kept)
+	}
+
+	remaining, err := db.ListEnvFileVersions(ctx, "repo", "./.env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slices.ContainsFunc(remaining, func(v EnvFileVersion) bool { return v.Version == oldest }) {
+		t.Errorf("version %d, which no delta needs, survived the prune", oldest)
+	}
+	for i, version := range remaining {
+		stored, err := db.GetEnvFileVersion(ctx, "repo", "./.env", version.Version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, err := openRevisionContents(ctx, db, "repo", "./.env", stored.Contents, deltaTestPassword)
+		if err != nil {
+			t.Fatalf("version %d after prune: %v", version.Version, err)
+		}
+		if want := deltaTestContents(len(remaining) - 1 - i); contents != want {
+			t.Errorf("version %d after prune reads back as %q, want %q", version.Version, contents, want)
+		}
+	}
+	if contents, _ := storedDepth(t, db); contents != deltaTestContents(2) {
+		t.Errorf("current copy after prune reads back as %q, want %q", contents, deltaTestContents(2))
+	}
+}
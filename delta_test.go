@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// deltaTestContents returns a file big enough to be stored as a delta, with
+// one line that differs for each revision
+func deltaTestContents(revision int) string {
+	var b strings.Builder
+	for i := range 100 {
+		if i == 50 {
+			fmt.Fprintf(&b, "REVISION=%d\n", revision)
+			continue
+		}
+		fmt.Fprintf(&b, "KEY_%d=%s\n", i, HashFile(fmt.Sprint(i)))
+	}
+	return b.String()
+}
+
+func TestDeltaPayloadRoundTrip(t *testing.T) {
+	for depth := 1; depth <= maxDeltaDepth; depth++ {
+		t.Run(fmt.Sprint(depth), func(t *testing.T) {
+			base, target := deltaTestContents(depth-1), deltaTestContents(depth)
+			delta := &deltaPayload{depth: depth, baseHash: HashFile(base), script: encodeDelta(base, target)}
+
+			var parsed *deltaPayload
+			if err := parseDeltaPayload(delta.encode()); !errors.As(err, &parsed) {
+				t.Fatalf("parseDeltaPayload(encode()) = %v, want a *deltaPayload", err)
+			}
+			if parsed.depth != depth || parsed.baseHash != delta.baseHash || string(parsed.script) != string(delta.script) {
+				t.Errorf("parseDeltaPayload(encode()) = depth %d, base %q, want depth %d, base %q and the same script", parsed.depth, parsed.baseHash, depth, delta.baseHash)
+			}
+			got, err := applyDelta(base, parsed.script)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != target {
+				t.Errorf("applyDelta(base, script) = %q, want %q", got, target)
+			}
+		})
+	}
+}
+
+func TestApplyDelta(t *testing.T) {
+	tests := []struct {
+		name         string
+		base, target string
+	}{
+		{"unchanged", "A=1\nB=2\n", "A=1\nB=2\n"},
+		{"changed line", "A=1\nB=2\nC=3\n", "A=1\nB=20\nC=3\n"},
+		{"added lines", "A=1\n", "A=1\nB=2\nC=3\n"},
+		{"removed lines", "A=1\nB=2\nC=3\n", "C=3\n"},
+		{"no final newline", "A=1\nB=2", "A=1\nB=3"},
+		{"from empty", "", "A=1\n"},
+		{"to empty", "A=1\n", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := applyDelta(tt.base, encodeDelta(tt.base, tt.target))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.target {
+				t.Errorf("applyDelta(%q, encodeDelta(...)) = %q, want %q", tt.base, got, tt.target)
+			}
+		})
+	}
+}
+
+func TestApplyDeltaRejectsWrongBase(t *testing.T) {
+	script := encodeDelta("A=1\nB=2\nC=3\n", "A=1\nC=3\n")
+	if _, err := applyDelta("A=1\n", script); err == nil {
+		t.Error("applyDelta against a shorter base succeeded, want an error")
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+const (
+	colorRed    = "\033[31m"
+	colorGreen  = "\033[32m"
+	colorYellow = "\033[33m"
+	colorCyan   = "\033[36m"
+	colorReset  = "\033[0m"
+)
+
+// diffOp is one line of a line-level diff
+type diffOp struct {
+	kind byte // ' ', '-' or '+'
+	line string
+}
+
+// diffEnvFiles shows a line-level diff between remote and local copies.
+// If ref is empty, every scanned file under basePath that differs is shown.
+// Values are masked unless showValues is set.
+func diffEnvFiles(ctx context.Context, dbConnStr, password, basePath, ref string, showValues, noColor bool) error {
+	files, err := scanForEnvFilesQuiet(basePath)
+	if err != nil {
+		return fmt.Errorf("failed to scan for env files: %v", err)
+	}
+
+	db, err := OpenStore(dbConnStr)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := db.InitSchema(ctx); err != nil {
+		return err
+	}
+
+	var target *EnvFileRecord
+	if ref != "" {
+		target, err = resolveEnvFileRef(ctx, db, ref)
+		if err != nil {
+			return err
+		}
+	}
+
+	useColor := !noColor && os.Getenv("NO_COLOR") == "" && term.IsTerminal(int(os.Stdout.Fd()))
+
+	differences := 0
+	matched := false
+	for _, file := range files {
+		repoID, relativePath, err := GetFileIdentifier(file, basePath)
+		if err != nil {
+			logger.Warn("failed to get identifier", "file", file, "error", err)
+			continue
+		}
+		repoID = storedRepoID(ctx, db, file, repoID, relativePath)
+		if target != nil && (repoID != target.RepoID || relativePath != target.RelativePath) {
+			continue
+		}
+		matched = true
+
+		localContents, err := os.ReadFile(file)
+		if err != nil {
+			logger.Warn("failed to read file", "file", file, "error", err)
+			continue
+		}
+
+		record, err := db.GetEnvFileWithMetadata(ctx, repoID, relativePath)
+		if err != nil {
+			logger.Warn("failed to get env file", "repo", repoID, "path", relativePath, "error", err)
+			continue
+		}
+
+		remoteContents := ""
+		if record != nil {
+			if record.FileHash == envFileHash(relativePath, localContents, record.FileHash) {
+				continue
+			}
+			remoteContents, err = openContents(ctx, db, repoID, relativePath, record.Contents, password)
+			if err != nil {
+				logger.Warn("failed to decrypt (wrong password?)", "repo", repoID, "path", relativePath, "error", err)
+				continue
+			}
+		}
+
+		differences++
+		header := fmt.Sprintf("%s (%s)", relativePath, shortenRepoID(repoID))
+		if record == nil {
+			header += " [not in remote]"
+		}
+		printDiff(os.Stdout, header, string(normalizeEnvContents(relativePath, []byte(remoteContents))), string(normalizeEnvContents(relativePath, localContents)), isDotenvName(path.Base(relativePath)), showValues, useColor)
+	}
+
+	if target != nil && !matched {
+		return fmt.Errorf("%s/%s was not found under %s", target.RepoID, target.RelativePath, basePath)
+	}
+
+	if differences == 0 {
+		fmt.Println("No differences between local and remote")
+	}
+
+	return nil
+}
+
+// printDiff prints one file's diff. Lines of dotenv files are masked by key;
+// other text files have everything after a ':' or '=' masked, and binary
+// files are only reported as different.
+func printDiff(w io.Writer, header, remote, local string, dotenv, showValues, useColor bool) {
+	paint := func(color, text string) string {
+		if !useColor {
+			return text
+		}
+		return color + text + colorReset
+	}
+
+	fmt.Fprintln(w, paint(colorCyan, "=== "+header))
+	fmt.Fprintln(w, paint(colorRed, "--- remote"))
+	fmt.Fprintln(w, paint(colorGreen, "+++ local"))
+
+	if isBinaryContents(remote) || isBinaryContents(local) {
+		fmt.Fprintf(w, "Binary files differ (remote %d bytes, local %d bytes)\n\n", len(remote), len(local))
+		return
+	}
+
+	// Diff the real lines so a changed value shows up even when its masked form doesn't change
+	remoteLines, localLines := envLinesForDiff(remote), envLinesForDiff(local)
+	if !dotenv {
+		remoteLines, localLines = strings.Split(strings.TrimSuffix(remote, "\n"), "\n"), strings.Split(strings.TrimSuffix(local, "\n"), "\n")
+	}
+	for _, op := range diffLines(remoteLines, localLines) {
+		line := op.line
+		if dotenv {
+			line = displayEnvLine(op.line, showValues)
+		} else if !showValues {
+			line = maskSecretLine(op.line)
+		}
+		switch op.kind {
+		case '-':
+			fmt.Fprintln(w, paint(colorRed, "- "+line))
+		case '+':
+			fmt.Fprintln(w, paint(colorGreen, "+ "+line))
+		default:
+			fmt.Fprintln(w, "  "+line)
+		}
+	}
+	fmt.Fprintln(w)
+}
+
+// envLinesForDiff splits contents into raw lines
+func envLinesForDiff(contents string) []string {
+	doc := ParseEnv(contents)
+	lines := make([]string, len(doc.Lines))
+	for i, line := range doc.Lines {
+		lines[i] = line.Raw
+	}
+	return lines
+}
+
+// diffLines computes a minimal line diff using the longest common subsequence
+func diffLines(a, b []string) []diffOp {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var ops []diffOp
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			ops = append(ops, diffOp{' ', a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			ops = append(ops, diffOp{'-', a[i]})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		ops = append(ops, diffOp{'-', a[i]})
+	}
+	for ; j < len(b); j++ {
+		ops = append(ops, diffOp{'+', b[j]})
+	}
+
+	return ops
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envSMTPPassword is the password for the config's SMTP server
+const envSMTPPassword = "ENV_SYNC_SMTP_PASSWORD"
+
+// defaultDigestInterval is how often the daemon sends a digest
+const defaultDigestInterval = 7 * 24 * time.Hour
+
+// SMTPConfig is the mail server digests are sent through, the config's
+// "smtp". Its password comes from ENV_SYNC_SMTP_PASSWORD or PasswordFile,
+// never from the config itself.
+type SMTPConfig struct {
+	Host         string `json:"host"`
+	Port         int    `json:"port,omitempty"` // Default 587 (STARTTLS); 465 is TLS from the start
+	Username     string `json:"username,omitempty"`
+	PasswordFile string `json:"password_file,omitempty"`
+	From         string `json:"from"`
+}
+
+// digestRepo is what happened to one repo's files in a digest's period
+type digestRepo struct {
+	RepoID    string `json:"repo_id"`
+	Uploads   int    `json:"uploads"`
+	Downloads int    `json:"downloads"`
+	Merges    int    `json:"merges"`
+	Moves     int    `json:"moves"`
+	Conflicts int    `json:"conflicts"`
+	Corrupted int    `json:"corrupted"`
+	Errors    int    `json:"errors"`
+}
+
+func (r digestRepo) problems() int {
+	return r.Conflicts + r.Corrupted + r.Errors
+}
+
+// syncDigest summarizes the syncs of this machine over a period, per repo
+type syncDigest struct {
+	Machine    string          `json:"machine"`
+	From       string          `json:"from"`
+	To         string          `json:"to"`
+	Runs       int             `json:"runs"`
+	FailedRuns int             `json:"failed_runs"` // Runs with at least one error
+	Totals     syncStatsReport `json:"totals"`
+	Repos      []digestRepo    `json:"repos"` // Most problems first, then most changes
+}
+
+// loadDigest summarizes the stats history between from and to
+func loadDigest(from, to time.Time) (syncDigest, error) {
+	key, err := loadMachineKey()
+	if err != nil {
+		return syncDigest{}, err
+	}
+	statsFile, err := getStatsFile()
+	if err != nil {
+		return syncDigest{}, err
+	}
+	runs, err := readSyncRuns(statsFile, key)
+	if err != nil {
+		return syncDigest{}, err
+	}
+	return buildDigest(runs, from, to), nil
+}
+
+func buildDigest(runs []syncRun, from, to time.Time) syncDigest {
+	digest := syncDigest{
+		Machine: auditMachine(),
+		From:    from.UTC().Format(time.RFC3339),
+		To:      to.UTC().Format(time.RFC3339),
+		Repos:   []digestRepo{},
+	}
+	repos := make(map[string]*digestRepo)
+	for _, run := range runs {
+		started, err := time.Parse(time.RFC3339, run.Time)
+		if err != nil || started.Before(from) || !started.Before(to) {
+			continue
+		}
+		digest.Runs++
+		if run.Stats.Errors > 0 {
+			digest.FailedRuns++
+		}
+		addSyncStats(&digest.Totals, run.Stats)
+
+		for _, change := range run.Changes {
+			repo := repos[change.RepoID]
+			if repo == nil {
+				repo = &digestRepo{RepoID: change.RepoID}
+				repos[change.RepoID] = repo
+			}
+			switch {
+			case change.Error:
+				repo.Errors++
+			case change.Action == actionUpload:
+				repo.Uploads++
+			case change.Action == actionDownload:
+				repo.Downloads++
+			case change.Action == actionMerge:
+				repo.Merges++
+			case change.Action == actionMove:
+				repo.Moves++
+			case change.Action == actionConflict:
+				repo.Conflicts++
+			case change.Action == actionCorrupted:
+				repo.Corrupted++
+			}
+		}
+	}
+
+	for _, repo := range repos {
+		digest.Repos = append(digest.Repos, *repo)
+	}
+	sort.Slice(digest.Repos, func(i, j int) bool {
+		a, b := digest.Repos[i], digest.Repos[j]
+		if a.problems() != b.problems() {
+			return a.problems() > b.problems()
+		}
+		if changesA, changesB := a.Uploads+a.Downloads+a.Merges+a.Moves, b.Uploads+b.Downloads+b.Merges+b.Moves; changesA != changesB {
+			return changesA > changesB
+		}
+		return a.RepoID < b.RepoID
+	})
+	return digest
+}
+
+// summary is the digest in one line, e.g. for the email subject
+func (d syncDigest) summary() string {
+	t := d.Totals
+	return fmt.Sprintf("%d sync(s), %d file(s) changed, %d conflict(s), %d error(s)",
+		d.Runs, t.Uploaded+t.Downloaded+t.Merged+t.Moved, t.Conflicts, t.Errors)
+}
+
+// text renders the digest as plain text
+func (d syncDigest) text() string {
+	from, _ := time.Parse(time.RFC3339, d.From)
+	to, _ := time.Parse(time.RFC3339, d.To)
+	var b strings.Builder
+	fmt.Fprintf(&b, "env-sync digest for %s, %s to %s\n\n", d.Machine, from.Local().Format("Jan 2"), to.Local().Format("Jan 2 2006"))
+	fmt.Fprintf(&b, "%d sync(s), %d with errors\n", d.Runs, d.FailedRuns)
+	t := d.Totals
+	fmt.Fprintf(&b, "Files: ↑ %d uploaded, ↓ %d downloaded, ⇄ %d merged, ↪ %d moved, ⚠ %d conflicts, ✗ %d errors\n",
+		t.Uploaded, t.Downloaded, t.Merged, t.Moved, t.Conflicts, t.Errors)
+	if d.Runs == 0 {
+		b.WriteString("\nNo syncs ran in this period. Is the daemon running?\n")
+		return b.String()
+	}
+	if len(d.Repos) == 0 {
+		b.WriteString("\nEverything was already in sync.\n")
+		return b.String()
+	}
+
+	fmt.Fprintf(&b, "\n%-40s %4s %4s %4s %4s %9s %6s\n", "REPO", "UP", "DOWN", "MRG", "MOVE", "CONFLICTS", "ERRORS")
+	for _, repo := range d.Repos {
+		fmt.Fprintf(&b, "%-40s %4d %4d %4d %4d %9d %6d\n", shortenRepoID(repo.RepoID),
+			repo.Uploads, repo.Downloads, repo.Merges, repo.Moves, repo.Conflicts+repo.Corrupted, repo.Errors)
+	}
+	return b.String()
+}
+
+// digestSender delivers digests by email, through the config's SMTP
+// server, and/or to a webhook
+type digestSender struct {
+	emails   []string
+	smtp     *SMTPConfig
+	password string
+	webhook  *notifier
+}
+
+// newDigestSender checks the digest flags and the SMTP settings. It returns
+// nil when there's nowhere to send digests to.
+func newDigestSender(emails []string, webhookURL, webhookFormat string) (*digestSender, error) {
+	var recipients []string
+	for _, list := range emails {
+		for _, email := range strings.Split(list, ",") {
+			if email = strings.TrimSpace(email); email == "" {
+				continue
+			}
+			if _, err := mail.ParseAddress(email); err != nil {
+				return nil, fmt.Errorf("invalid digest email address %q: %v", email, err)
+			}
+			recipients = append(recipients, email)
+		}
+	}
+	if len(recipients) == 0 && webhookURL == "" {
+		return nil, nil
+	}
+
+	sender := &digestSender{emails: recipients}
+	if len(recipients) > 0 {
+		config, err := loadConfig()
+		if err != nil {
+			return nil, err
+		}
+		if config.SMTP == nil || config.SMTP.Host == "" || config.SMTP.From == "" {
+			return nil, fmt.Errorf("emailing digests needs \"smtp\" with a host and from address in the config")
+		}
+		sender.smtp = config.SMTP
+		sender.password = os.Getenv(envSMTPPassword)
+		if sender.password == "" && config.SMTP.PasswordFile != "" {
+			if sender.password, err = readPasswordFile(config.SMTP.PasswordFile); err != nil {
+				return nil, err
+			}
+		}
+		if config.SMTP.Username != "" && sender.password == "" {
+			return nil, fmt.Errorf("the SMTP server needs a password: set %s or password_file under \"smtp\" in the config", envSMTPPassword)
+		}
+	}
+	if webhookURL != "" {
+		webhook, err := newNotifier(webhookURL, webhookFormat, false, nil)
+		if err != nil {
+			return nil, err
+		}
+		sender.webhook = webhook
+	}
+	return sender, nil
+}
+
+// send delivers a digest to every destination. A webhook failure is only
+// logged, as for notifications; an email failure is returned.
+func (s *digestSender) send(digest syncDigest) error {
+	if s.webhook != nil {
+		s.webhook.send("digest", digest.summary(), digest.text(), webhookPayload{Digest: &digest})
+	}
+	if len(s.emails) == 0 {
+		return nil
+	}
+	return s.sendEmail("env-sync digest for "+digest.Machine+": "+digest.summary(), digest.text())
+}
+
+func (s *digestSender) sendEmail(subject, body string) error {
+	port := s.smtp.Port
+	if port == 0 {
+		port = 587
+	}
+	addr := net.JoinHostPort(s.smtp.Host, strconv.Itoa(port))
+
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", s.smtp.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(s.emails, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	from, err := mail.ParseAddress(s.smtp.From)
+	if err != nil {
+		return fmt.Errorf("invalid smtp from address %q: %v", s.smtp.From, err)
+	}
+	var auth smtp.Auth
+	if s.smtp.Username != "" {
+		auth = smtp.PlainAuth("", s.smtp.Username, s.password, s.smtp.Host)
+	}
+	if port != 465 {
+		// Uses STARTTLS when the server offers it; PlainAuth refuses to
+		// send the password unencrypted except to localhost
+		if err := smtp.SendMail(addr, auth, from.Address, s.emails, []byte(msg.String())); err != nil {
+			return fmt.Errorf("failed to email digest: %v", err)
+		}
+		return nil
+	}
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: s.smtp.Host})
+	if err != nil {
+		return fmt.Errorf("failed to email digest: %v", err)
+	}
+	client, err := smtp.NewClient(conn, s.smtp.Host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to email digest: %v", err)
+	}
+	defer client.Close()
+	if err := sendSMTPMessage(client, auth, from.Address, s.emails, msg.String()); err != nil {
+		return fmt.Errorf("failed to email digest: %v", err)
+	}
+	return nil
+}
+
+// sendSMTPMessage sends one message on an open connection
+func sendSMTPMessage(client *smtp.Client, auth smtp.Auth, from string, to []string, msg string) error {
+	if auth != nil {
+		if err := client.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err := client.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte(msg)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// showDigest prints the digest of the last since, or sends it
+func showDigest(since time.Duration, sender *digestSender) error {
+	now := time.Now()
+	digest, err := loadDigest(now.Add(-since), now)
+	if err != nil {
+		return err
+	}
+	if sender != nil {
+		if err := sender.send(digest); err != nil {
+			return err
+		}
+		fmt.Printf("✓ Sent digest: %s\n", digest.summary())
+		return nil
+	}
+	if jsonOutput {
+		printJSON(digest)
+		return nil
+	}
+	fmt.Print(digest.text())
+	return nil
+}
+
+// digestSchedule sends a digest from the daemon every interval. When the
+// last one went out is kept in the inventory, so restarts don't reset it.
+type digestSchedule struct {
+	sender   *digestSender
+	interval time.Duration
+}
+
+// sendIfDue sends the digest once interval has passed since the last one.
+// A daemon without any digest sent yet starts counting now.
+func (d *digestSchedule) sendIfDue() {
+	if d == nil {
+		return
+	}
+	store, err := loadEnvFileStore()
+	if err != nil {
+		logger.Warn("failed to check digest schedule", "error", err)
+		return
+	}
+	now := time.Now()
+	last, err := time.Parse(time.RFC3339, store.DigestSentAt)
+	if err == nil && now.Sub(last) < d.interval {
+		return
+	}
+	if err == nil {
+		digest, err := loadDigest(last, now)
+		if err == nil {
+			err = d.sender.send(digest)
+		}
+		if err != nil {
+			// Tried again after the next sync
+			logger.Error("digest failed", "error", err)
+			return
+		}
+		logger.Info("sent digest", "summary", digest.summary())
+	}
+	if err := updateEnvFileStore(func(store *EnvFileStore) {
+		store.DigestSentAt = now.UTC().Format(time.RFC3339)
+	}); err != nil {
+		logger.Warn("failed to save digest time", "error", err)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// writeComposeEnv writes a stored .env file in the env_file format of
+// docker compose, to outputPath or, without one, to stdout
+func writeComposeEnv(ctx context.Context, dbConnStr, password, repoRef, file, outputPath string) error {
+	vars, err := loadRepoEnv(ctx, dbConnStr, password, repoRef, file)
+	if err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	for _, v := range vars {
+		if strings.ContainsAny(v[0], "= \t\n") {
+			logger.Warn("skipping variable that docker compose can't read", "key", v[0])
+			continue
+		}
+		b.WriteString(v[0] + "=" + composeQuote(v[1]) + "\n")
+	}
+
+	if outputPath == "" {
+		fmt.Print(b.String())
+		return nil
+	}
+	if err := os.WriteFile(outputPath, []byte(b.String()), 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %v", outputPath, err)
+	}
+	if jsonOutput {
+		printJSON(map[string]interface{}{"output": outputPath, "variables": len(vars)})
+		return nil
+	}
+	fmt.Printf("✓ Wrote %d variable(s) to %s\n", len(vars), outputPath)
+	return nil
+}
+
+// composeQuote quotes a value so docker compose reads it back unchanged.
+// Compose interpolates ${VAR} in unquoted and double-quoted values, so
+// anything beyond plain characters is single-quoted, and values that can't
+// be single-quoted are double-quoted with $ escaped as $$.
+func composeQuote(value string) string {
+	if value == "" || strings.IndexFunc(value, func(c rune) bool {
+		return !(c == '_' || c == '-' || c == '.' || c == '/' || c == ':' || c == '@' || c == ',' || c == '+' ||
+			(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9'))
+	}) < 0 {
+		return value
+	}
+	if !strings.ContainsAny(value, "'\n\r") {
+		return "'" + value + "'"
+	}
+	escaped := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "$", "$$").Replace(value)
+	return `"` + escaped + `"`
+}
+
+// dockerSecretName is what docker accepts as a secret name
+var dockerSecretName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,63}$`)
+
+// createDockerSecrets pipes each variable of a stored .env file into
+// 'docker secret create', named prefix+KEY. The values only pass through
+// docker's stdin. With keys, only those variables are created; with replace,
+// an existing secret of the same name is removed first.
+func createDockerSecrets(ctx context.Context, dbConnStr, password, repoRef, file, prefix string, keys []string, replace, dryRun bool) error {
+	vars, err := loadRepoEnv(ctx, dbConnStr, password, repoRef, file)
+	if err != nil {
+		return err
+	}
+
+	if len(keys) > 0 {
+		values := make(map[string]string, len(vars))
+		for _, v := range vars {
+			values[v[0]] = v[1]
+		}
+		vars = vars[:0]
+		for _, key := range keys {
+			value, ok := values[key]
+			if !ok {
+				return fmt.Errorf("%s has no variable %s", file, key)
+			}
+			vars = append(vars, [2]string{key, value})
+		}
+	}
+
+	if !dryRun {
+		if _, err := exec.LookPath("docker"); err != nil {
+			return fmt.Errorf("docker not found in PATH: %v", err)
+		}
+	}
+
+	var created []string
+	for _, v := range vars {
+		name := prefix + v[0]
+		if !dockerSecretName.MatchString(name) {
+			logger.Warn("skipping variable that isn't a valid docker secret name", "key", v[0], "name", name)
+			continue
+		}
+		if dryRun {
+			notef("Would create docker secret %s\n", name)
+			created = append(created, name)
+			continue
+		}
+
+		if replace {
+			if out, err := exec.Command("docker", "secret", "rm", name).CombinedOutput(); err != nil && !strings.Contains(string(out), "No such secret") {
+				return fmt.Errorf("failed to remove docker secret %s: %s", name, strings.TrimSpace(string(out)))
+			}
+		}
+		cmd := exec.Command("docker", "secret", "create", name, "-")
+		cmd.Stdin = strings.NewReader(v[1])
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			msg := strings.TrimSpace(stderr.String())
+			if msg == "" {
+				msg = err.Error()
+			}
+			if strings.Contains(msg, "already exists") {
+				msg += " (use --replace)"
+			}
+			return fmt.Errorf("failed to create docker secret %s: %s", name, msg)
+		}
+		notef("✓ Created docker secret %s\n", name)
+		created = append(created, name)
+	}
+
+	if jsonOutput {
+		printJSON(map[string]interface{}{"secrets": append([]string{}, created...), "dry_run": dryRun})
+	}
+	return nil
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Outcomes of a doctor check
+const (
+	checkOK   = "ok"
+	checkWarn = "warn"
+	checkFail = "fail"
+	checkSkip = "skip"
+)
+
+// doctorCheck is the outcome of one check, with what to do about a problem
+type doctorCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail"`
+	Fix    string `json:"fix,omitempty"`
+}
+
+// doctorReport collects the checks as they run
+type doctorReport struct {
+	Checks []doctorCheck `json:"checks"`
+}
+
+func (r *doctorReport) add(name, status, detail, fix string) {
+	r.Checks = append(r.Checks, doctorCheck{Name: name, Status: status, Detail: detail, Fix: fix})
+}
+
+func (r *doctorReport) count(status string) int {
+	n := 0
+	for _, check := range r.Checks {
+		if check.Status == status {
+			n++
+		}
+	}
+	return n
+}
+
+// runDoctor checks everything env-sync depends on and prints how to fix what
+// isn't right. Without dbConnStr the database checks are skipped. Nothing is
+// changed: the schema isn't migrated and no password is pinned.
+func runDoctor(ctx context.Context, dbConnStr, passwordFlag string) error {
+	report := &doctorReport{Checks: []doctorCheck{}}
+	checkGit(report)
+	checkStorageIntegrity(report)
+	checkStoragePermissions(report)
+	if dbConnStr == "" {
+		report.add("database", checkSkip, "no --db given", "pass --db or set "+envDB+" to check the database too")
+	} else {
+		checkDatabase(ctx, report, dbConnStr, passwordFlag)
+	}
+
+	if jsonOutput {
+		printJSON(report)
+	} else {
+		icons := map[string]string{checkOK: "✓", checkWarn: "⚠", checkFail: "✗", checkSkip: "-"}
+		for _, check := range report.Checks {
+			fmt.Printf("%s %-12s %s\n", icons[check.Status], check.Name, check.Detail)
+			if check.Fix != "" && check.Status != checkOK {
+				fmt.Printf("  %-12s → %s\n", "", check.Fix)
+			}
+		}
+		fmt.Printf("\n%d ok, %d warning(s), %d failed\n", report.count(checkOK), report.count(checkWarn), report.count(checkFail))
+	}
+	if failed := report.count(checkFail); failed > 0 {
+		return fmt.Errorf("%d check(s) failed", failed)
+	}
+	return nil
+}
+
+// checkGit checks that git can be run, since repos are identified by it
+func checkGit(report *doctorReport) {
+	path, err := exec.LookPath("git")
+	if err != nil {
+		report.add("git", checkFail, "git not found in PATH",
+			"install git; without it every file is stored as a non-git file relative to --base")
+		return
+	}
+	out, err := exec.Command(path, "--version").Output()
+	if err != nil {
+		report.add("git", checkFail, fmt.Sprintf("%s doesn't run: %v", path, err), "reinstall git")
+		return
+	}
+	report.add("git", checkOK, strings.TrimSpace(string(out)), "")
+}
+
+// checkStorageIntegrity checks that the local files in ~/.env-sync can be
+// read: the config, the machine key, the inventory and the stats history
+func checkStorageIntegrity(report *doctorReport) {
+	configFile, _ := getConfigFile()
+	if _, err := loadConfig(); err != nil {
+		report.add("config", checkFail, err.Error(), "fix the JSON in "+configFile)
+	} else {
+		report.add("config", checkOK, configFile, "")
+	}
+
+	keyFile, err := getMachineKeyFile()
+	if err != nil {
+		report.add("machine key", checkFail, err.Error(), "")
+		return
+	}
+	storageFile, _ := getStorageFile()
+	if _, err := os.Stat(keyFile); os.IsNotExist(err) {
+		if _, err := os.Stat(storageFile); err == nil {
+			report.add("machine key", checkFail, keyFile+" is missing, so the inventory can't be decrypted",
+				"restore machine.key from a backup, or remove "+storageFile+" and run 'env-sync scan' again")
+			return
+		}
+		report.add("machine key", checkOK, "not created yet (made on the first scan)", "")
+	} else if _, err := loadMachineKey(); err != nil {
+		report.add("machine key", checkFail, err.Error(), "restore machine.key from a backup, or remove it and "+storageFile+" and run 'env-sync scan' again")
+		return
+	} else {
+		report.add("machine key", checkOK, keyFile, "")
+	}
+
+	store, err := loadEnvFileStore()
+	if err != nil {
+		report.add("inventory", checkFail, err.Error(), "remove "+storageFile+" and run 'env-sync scan' again")
+		return
+	}
+	missing := 0
+	for _, file := range store.Files {
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			missing++
+		}
+	}
+	switch {
+	case len(store.Files) == 0:
+		report.add("inventory", checkWarn, "no env files remembered yet", "run 'env-sync scan <path>' or 'env-sync sync'")
+	case missing > 0:
+		report.add("inventory", checkWarn, fmt.Sprintf("%d file(s), %d no longer exist", len(store.Files), missing),
+			"run 'env-sync scan <path>' again to forget them")
+	default:
+		report.add("inventory", checkOK, fmt.Sprintf("%d file(s), last scan %s", len(store.Files), store.LastScan), "")
+	}
+
+	total, unreadable, err := countStatsEntries()
+	switch {
+	case err != nil:
+		report.add("stats", checkFail, err.Error(), "")
+	case unreadable > 0:
+		statsFile, _ := getStatsFile()
+		report.add("stats", checkWarn, fmt.Sprintf("%d of %d entries can't be read (machine.key replaced?)", unreadable, total),
+			"remove "+statsFile+" to start the history over")
+	default:
+		report.add("stats", checkOK, fmt.Sprintf("%d sync run(s) recorded", total), "")
+	}
+
+	queue, err := loadUploadQueue()
+	switch {
+	case err != nil:
+		report.add("queue", checkFail, err.Error(), "")
+	case len(queue) > 0:
+		report.add("queue", checkWarn, fmt.Sprintf("%d edit(s) queued offline since %s", len(queue), queue[0].QueuedAt),
+			"run 'env-sync sync' once the database is reachable to upload them")
+	default:
+		report.add("queue", checkOK, "no edits waiting for the database", "")
+	}
+}
+
+// countStatsEntries counts the lines of the stats history, and those that
+// don't decrypt with the machine key
+func countStatsEntries() (total, unreadable int, err error) {
+	statsFile, err := getStatsFile()
+	if err != nil {
+		return 0, 0, err
+	}
+	f, err := os.Open(statsFile)
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	key, err := loadMachineKey()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		total++
+		if _, err := DecryptWithKey(line, key); err != nil {
+			unreadable++
+		}
+	}
+	return total, unreadable, scanner.Err()
+}
+
+// publicStorageFiles hold nothing secret, so others may read them
+var publicStorageFiles = []string{"recipients.txt", "skip.txt", "patterns.txt"}
+
+// checkStoragePermissions checks that other users can't read the secrets in
+// ~/.env-sync (the machine key, identity, inventory, backups) or change
+// anything in it
+func checkStoragePermissions(report *doctorReport) {
+	if runtime.GOOS == "windows" {
+		report.add("permissions", checkSkip, "not checked on Windows, where the profile directory is private", "")
+		return
+	}
+	dir, err := getStorageDir()
+	if err != nil {
+		report.add("permissions", checkFail, err.Error(), "")
+		return
+	}
+
+	var readable, writable []string
+	err = filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil || entry.Type()&fs.ModeSymlink != 0 {
+			return nil
+		}
+		perm := info.Mode().Perm()
+		if perm&0022 != 0 {
+			writable = append(writable, path)
+		}
+		if !entry.IsDir() && perm&0044 != 0 && !slices.Contains(publicStorageFiles, entry.Name()) {
+			readable = append(readable, path)
+		}
+		if entry.IsDir() && path != dir && perm&0044 != 0 {
+			// Backups hold plaintext copies
+			readable = append(readable, path)
+		}
+		return nil
+	})
+	if err != nil {
+		report.add("permissions", checkFail, err.Error(), "")
+		return
+	}
+
+	switch {
+	case len(writable) > 0:
+		report.add("permissions", checkFail, fmt.Sprintf("other users can change %s", describePaths(writable)),
+			"chmod go-w "+strings.Join(writable, " "))
+	case len(readable) > 0:
+		report.add("permissions", checkWarn, fmt.Sprintf("other users can read %s", describePaths(readable)),
+			"chmod go-rwx "+strings.Join(readable, " "))
+	default:
+		report.add("permissions", checkOK, dir+" is private", "")
+	}
+}
+
+// describePaths names the first few of paths
+func describePaths(paths []string) string {
+	if len(paths) <= 3 {
+		return strings.Join(paths, ", ")
+	}
+	return fmt.Sprintf("%s and %d more", strings.Join(paths[:3], ", "), len(paths)-3)
+}
+
+// checkDatabase checks that the database is reachable and how fast, its
+// schema version, the password against its verifier, and the clock of its
+// server against this machine's
+func checkDatabase(ctx context.Context, report *doctorReport, dbConnStr, passwordFlag string) {
+	start := time.Now()
+	db, err := OpenStore(dbConnStr)
+	if err != nil {
+		report.add("database", checkFail, err.Error(),
+			"check the connection string, the network (or --ssh) and the database's credentials")
+		return
+	}
+	defer db.Close()
+	connect := time.Since(start)
+
+	latency := ""
+	if pool, ok := db.(connPool); ok {
+		var total time.Duration
+		const pings = 3
+		for range pings {
+			pingStart := time.Now()
+			if err := pool.Ping(); err != nil {
+				report.add("database", checkFail, "connected, then the ping failed: "+err.Error(), "check the network and the database's status")
+				return
+			}
+			total += time.Since(pingStart)
+		}
+		latency = fmt.Sprintf(", ping %v", (total / pings).Round(time.Millisecond))
+	}
+	report.add("database", checkOK, fmt.Sprintf("connected in %v%s", connect.Round(time.Millisecond), latency), "")
+
+	if sqlDB := databaseOf(db); sqlDB == nil {
+		report.add("schema", checkSkip, "this backend has no schema", "")
+	} else {
+		version, err := sqlDB.schemaVersion(ctx)
+		switch {
+		case err != nil:
+			report.add("schema", checkWarn, "not set up yet", "run 'env-sync migrate' or any sync to create it")
+		case version < latestSchemaVersion:
+			report.add("schema", checkWarn, fmt.Sprintf("version %d, this env-sync writes %d", version, latestSchemaVersion),
+				"run 'env-sync migrate' (every sync does too)")
+		case version > latestSchemaVersion:
+			report.add("schema", checkWarn, fmt.Sprintf("version %d is newer than this env-sync (%d)", version, latestSchemaVersion),
+				"run 'env-sync self-update'")
+		default:
+			report.add("schema", checkOK, fmt.Sprintf("version %d", version), "")
+		}
+		if sqlDB.namespace != "" {
+			report.add("namespace", checkOK, fmt.Sprintf("working in namespace %q", sqlDB.namespace), "")
+		}
+
+		skew, err := measureClockSkew(ctx, sqlDB)
+		switch {
+		case err != nil:
+			report.add("clock", checkWarn, "couldn't read the server's time: "+err.Error(), "")
+		case skew > maxClockSkew || skew < -maxClockSkew:
+			direction := "ahead of"
+			if skew < 0 {
+				direction = "behind"
+			}
+			report.add("clock", checkWarn, fmt.Sprintf("this machine is %v %s the database server", skew.Abs().Round(time.Second), direction),
+				"turn on automatic time sync (NTP); sync corrects file times by the difference it measures, but other backends can't")
+		default:
+			report.add("clock", checkOK, fmt.Sprintf("within %v of the database server", maxClockSkew), "")
+		}
+	}
+
+	checkDoctorPassword(ctx, report, db, passwordFlag)
+}
+
+// checkDoctorPassword checks the password against the database's verifier,
+// without pinning one
+func checkDoctorPassword(ctx context.Context, report *doctorReport, db Store, passwordFlag string) {
+	if passwordless() {
+		report.add("password", checkSkip, "new files are encrypted without the password (age recipients or KMS)", "")
+		return
+	}
+	verifiers := passwordVerifierOf(db)
+	if verifiers == nil {
+		report.add("password", checkSkip, "this backend keeps no password verifier", "")
+		return
+	}
+	verifier, err := verifiers.PasswordVerifier(ctx)
+	if err != nil {
+		report.add("password", checkWarn, "couldn't read the verifier: "+err.Error(), "run 'env-sync migrate' if the schema isn't set up yet")
+		return
+	}
+	if verifier == "" {
+		report.add("password", checkOK, "no password pinned yet; the next sync with one pins it", "")
+		return
+	}
+	password, err := resolvePassword(passwordFlag)
+	if err != nil {
+		report.add("password", checkFail, err.Error(), "pass --password or run 'env-sync login'")
+		return
+	}
+	ok, err := matchesPasswordVerifier(verifier, password)
+	switch {
+	case err != nil:
+		report.add("password", checkFail, err.Error(), "")
+	case !ok:
+		report.add("password", checkFail, "doesn't match the password pinned in the database",
+			"use the password your other machines use; 'env-sync login' saves it in the OS keychain")
+	default:
+		report.add("password", checkOK, "matches the database's verifier", "")
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// replicaEncryptParam is the URL option that encrypts an embedded replica's
+// file at rest, e.g. libsql://db.turso.io?authToken=...&replica=true&replica_encrypt=true
+const replicaEncryptParam = "replica_encrypt"
+
+// embeddedReplica is a local libsql database file that mirrors a Turso
+// primary. Writes land locally and Sync exchanges changes with the primary.
+type embeddedReplica interface {
+	Sync() error
+	Close() error
+}
+
+// wantsEmbeddedReplica reports whether a Turso URL has a replica parameter
+func wantsEmbeddedReplica(connString string) bool {
+	u, err := url.Parse(connString)
+	return err == nil && u.Query().Has("replica")
+}
+
+// newReplicaDatabase opens a Turso URL with a replica parameter, e.g.
+// libsql://db.turso.io?authToken=...&replica=true, as an embedded replica.
+// The latest changes are pulled if the primary is reachable; otherwise the
+// local copy is used until it is.
+func newReplicaDatabase(connString string) (*Database, error) {
+	u, err := url.Parse(connString)
+	if err != nil {
+		return nil, fmt.Errorf("invalid database URL: %v", err)
+	}
+	query := u.Query()
+
+	localPath, err := replicaPath(query.Get("replica"), u.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	primary := *u
+	primary.RawQuery = ""
+	authToken := query.Get("authToken")
+
+	encrypt := query.Get(replicaEncryptParam)
+	key, err := prepareReplicaFile(localPath, primary.String(), authToken, encrypt == "true" || encrypt == "1")
+	if err != nil {
+		return nil, err
+	}
+	conn, replica, err := openEmbeddedReplica(localPath, primary.String(), authToken, key)
+	if err != nil {
+		return nil, err
+	}
+	if key != "" {
+		// A wrong key only shows once the file is read
+		if _, err := conn.Exec("SELECT count(*) FROM sqlite_master"); err != nil {
+			conn.Close()
+			replica.Close()
+			return nil, fmt.Errorf("failed to open encrypted replica %s: %v (wrong password? after changing it, delete the replica and its .salt file to pull it again)", localPath, err)
+		}
+	}
+
+	db := &Database{conn: conn, namespace: activeNamespace(), replica: replica}
+	if err := replica.Sync(); err != nil {
+		logger.Warn("primary unreachable, working from the local replica", "replica", localPath, "error", err)
+	}
+	return db, nil
+}
+
+// replicaPath resolves the replica parameter: "true" or "1" picks a file
+// per database host in ~/.env-sync, anything else is a path
+func replicaPath(value, host string) (string, error) {
+	if value == "true" || value == "1" {
+		dir, err := getStorageDir()
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(dir, "replica-"+strings.ReplaceAll(host, ":", "_")+".db"), nil
+	}
+	if strings.HasPrefix(value, "~/") {
+		dir, err := getStorageDir()
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(filepath.Dir(dir), value[2:]), nil
+	}
+	return value, nil
+}
+
+// prepareReplicaFile returns the key to open the replica at localPath with,
+// or "" to open it unencrypted. An unencrypted replica that should be
+// encrypted is pushed to the primary and removed, to be pulled again.
+func prepareReplicaFile(localPath, primaryURL, authToken string, encrypt bool) (string, error) {
+	saltPath := localPath + ".salt"
+	_, err := os.Stat(saltPath)
+	encrypted := err == nil
+	_, err = os.Stat(localPath)
+	exists := err == nil
+
+	switch {
+	case !encrypt && encrypted && exists:
+		return "", fmt.Errorf("replica %s is encrypted; add %s=true to the URL, or delete it and %s to start over", localPath, replicaEncryptParam, saltPath)
+	case !encrypt:
+		// A salt left by a replica that was never created
+		os.Remove(saltPath)
+		return "", nil
+	case exists && !encrypted:
+		if err := retirePlainReplica(localPath, primaryURL, authToken); err != nil {
+			return "", err
+		}
+	}
+	return replicaKey(saltPath)
+}
+
+// replicaKey derives the key of an encrypted replica from the encryption
+// password and a random salt kept in saltPath, created on first use
+func replicaKey(saltPath string) (string, error) {
+	password, err := resolvePassword("")
+	if err != nil {
+		return "", err
+	}
+	if password == "" {
+		return "", fmt.Errorf("%s needs the encryption password: use --password, --password-file or %s", replicaEncryptParam, envPassword)
+	}
+
+	salt, err := os.ReadFile(saltPath)
+	if os.IsNotExist(err) {
+		salt = make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		if err := os.WriteFile(saltPath, salt, 0600); err != nil {
+			return "", fmt.Errorf("failed to save replica salt: %v", err)
+		}
+	} else if err != nil {
+		return "", fmt.Errorf("failed to read replica salt: %v", err)
+	}
+	key := argon2.IDKey([]byte(password), salt, legacyKDF.Iterations, legacyKDF.MemoryKiB, legacyKDF.Threads, 32)
+	return hex.EncodeToString(key), nil
+}
+
+// retirePlainReplica pushes what was written to an unencrypted replica while
+// offline to the primary, then removes its files
+func retirePlainReplica(localPath, primaryURL, authToken string) error {
+	conn, replica, err := openEmbeddedReplica(localPath, primaryURL, authToken, "")
+	if err != nil {
+		return err
+	}
+	err = replica.Sync()
+	conn.Close()
+	replica.Close()
+	if err != nil {
+		return fmt.Errorf("can't encrypt replica %s until the primary is reachable, since it may hold changes not pushed yet: %v", localPath, err)
+	}
+
+	// libsql keeps its WAL and sync metadata next to the file
+	files, _ := filepath.Glob(localPath + "-*")
+	for _, file := range append(files, localPath) {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove unencrypted replica: %v", err)
+		}
+	}
+	logger.Info("replaced the unencrypted replica with an encrypted one", "replica", localPath)
+	return nil
+}
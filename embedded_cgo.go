@@ -0,0 +1,45 @@
+//go:build libsql_embedded
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	libsql "github.com/tursodatabase/go-libsql"
+)
+
+// libsqlUsesGoHTTP is false: go-libsql makes its own connections
+const libsqlUsesGoHTTP = false
+
+// libsqlReplica adapts the go-libsql connector to embeddedReplica
+type libsqlReplica struct {
+	connector *libsql.Connector
+}
+
+func (r libsqlReplica) Sync() error {
+	_, err := r.connector.Sync()
+	return err
+}
+
+func (r libsqlReplica) Close() error {
+	return r.connector.Close()
+}
+
+// openEmbeddedReplica opens (creating it if needed) a local database file
+// that accepts writes offline and pushes them to primaryURL on Sync. With an
+// encryptionKey, the file is encrypted at rest.
+func openEmbeddedReplica(localPath, primaryURL, authToken, encryptionKey string) (*sql.DB, embeddedReplica, error) {
+	var opts []libsql.Option
+	if authToken != "" {
+		opts = append(opts, libsql.WithAuthToken(authToken))
+	}
+	if encryptionKey != "" {
+		opts = append(opts, libsql.WithEncryption(encryptionKey))
+	}
+	connector, err := libsql.NewSyncedDatabaseConnector(localPath, primaryURL, opts...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open embedded replica %s: %v", localPath, err)
+	}
+	return sql.OpenDB(connector), libsqlReplica{connector}, nil
+}
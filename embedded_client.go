@@ -0,0 +1,19 @@
+//go:build !libsql_embedded
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	_ "github.com/tursodatabase/libsql-client-go/libsql"
+)
+
+// libsqlUsesGoHTTP is set when libsql:// URLs are served by libsql-client-go,
+// whose requests go through Go's HTTP client and so can be tunneled
+const libsqlUsesGoHTTP = true
+
+// openEmbeddedReplica needs the cgo libsql driver, which this build leaves out
+func openEmbeddedReplica(localPath, primaryURL, authToken, encryptionKey string) (*sql.DB, embeddedReplica, error) {
+	return nil, nil, fmt.Errorf("this env-sync build can't keep an embedded replica; rebuild with -tags libsql_embedded (needs cgo on Linux or macOS)")
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+// Env files are stored as UTF-8 without a byte order mark, with LF line
+// endings, whatever they look like on disk: files saved on Windows as UTF-16
+// or with a UTF-8 BOM would otherwise be restored byte for byte and look
+// corrupt on Linux. They are read through readEnvFile and written through
+// writeEnvFile, which gives them the line endings of the file they replace,
+// or the platform's for new files. "encoding" and "line_endings" in the
+// config turn either conversion off. Binary files synced with --pattern,
+// such as keystores, are never converted (see storedAsText).
+
+// textFormat is how local env files are converted to and from the stored form
+type textFormat struct {
+	// decode converts UTF-16 and legacy (Windows-1252) files to UTF-8 and
+	// drops byte order marks
+	decode bool
+	// lineEndings is "auto", "lf", "crlf" or "raw" (stored as they are)
+	lineEndings string
+}
+
+var localTextFormat = deriveFromConfig(func(config *Config) textFormat {
+	format := textFormat{decode: true, lineEndings: "auto"}
+	switch config.Encoding {
+	case "", "utf-8", "utf8":
+	case "raw":
+		format.decode = false
+	default:
+		logger.Warn(`unknown encoding in the config, using "utf-8"`, "encoding", config.Encoding)
+	}
+	switch config.LineEndings {
+	case "", "auto":
+	case "lf", "crlf", "raw":
+		format.lineEndings = config.LineEndings
+	default:
+		logger.Warn(`unknown line_endings in the config, using "auto"`, "line_endings", config.LineEndings)
+	}
+	return format
+}).get
+
+var (
+	utf8BOM    = []byte{0xEF, 0xBB, 0xBF}
+	utf16LEBOM = []byte{0xFF, 0xFE}
+	utf16BEBOM = []byte{0xFE, 0xFF}
+)
+
+// decodeText converts data to UTF-8 without a byte order mark. UTF-16 is
+// recognized by its BOM or, without one, by the zero bytes of ASCII text;
+// anything else that isn't valid UTF-8 is taken as Windows-1252.
+func decodeText(data []byte) []byte {
+	switch {
+	case bytes.HasPrefix(data, utf8BOM):
+		return data[len(utf8BOM):]
+	case bytes.HasPrefix(data, utf16LEBOM):
+		return decodeUTF16(data[2:], false)
+	case bytes.HasPrefix(data, utf16BEBOM):
+		return decodeUTF16(data[2:], true)
+	}
+	if bigEndian, ok := looksLikeUTF16(data); ok {
+		return decodeUTF16(data, bigEndian)
+	}
+	if utf8.Valid(data) {
+		return data
+	}
+	decoded, err := charmap.Windows1252.NewDecoder().Bytes(data)
+	if err != nil {
+		return data
+	}
+	return decoded
+}
+
+// looksLikeUTF16 reports whether data is UTF-16 without a BOM, as written
+// by some Windows tools: every other byte of ASCII text is zero
+func looksLikeUTF16(data []byte) (bigEndian, ok bool) {
+	if len(data) < 2 || len(data)%2 != 0 {
+		return false, false
+	}
+	var evenZeros, oddZeros int
+	for i, b := range data {
+		if b != 0 {
+			continue
+		}
+		if i%2 == 0 {
+			evenZeros++
+		} else {
+			oddZeros++
+		}
+	}
+	half := len(data) / 2
+	switch {
+	case oddZeros*2 >= half && evenZeros == 0:
+		return false, true
+	case evenZeros*2 >= half && oddZeros == 0:
+		return true, true
+	}
+	return false, false
+}
+
+func decodeUTF16(data []byte, bigEndian bool) []byte {
+	units := make([]uint16, len(data)/2)
+	for i := range units {
+		if bigEndian {
+			units[i] = uint16(data[2*i])<<8 | uint16(data[2*i+1])
+		} else {
+			units[i] = uint16(data[2*i+1])<<8 | uint16(data[2*i])
+		}
+	}
+	runes := utf16.Decode(units)
+	out := make([]byte, 0, len(runes))
+	for _, r := range runes {
+		out = utf8.AppendRune(out, r)
+	}
+	return out
+}
+
+// storedAsText reports whether the contents of the file at path are
+// converted to and from the stored form: always for .env files, which may be
+// UTF-16 or Windows-1252, and for other files unless they are binary
+func storedAsText(path string, data []byte) bool {
+	return isDotenvName(filepath.Base(path)) || !isBinaryContents(string(data))
+}
+
+// normalizeEnvContents converts the contents of the local file at path to
+// the stored form
+func normalizeEnvContents(path string, data []byte) []byte {
+	if !storedAsText(path, data) {
+		return data
+	}
+	format := localTextFormat()
+	if format.decode {
+		data = decodeText(data)
+	}
+	if format.lineEndings != "raw" {
+		data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	}
+	return data
+}
+
+// readEnvFile reads a local env file in the stored form
+func readEnvFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return normalizeEnvContents(path, data), nil
+}
+
+// envFileHash hashes the contents of the local file at path, as read from
+// disk, in the stored form. Copies stored before contents were normalized, or by a
+// machine with other settings, may still have CRLF line endings or the
+// original encoding; if the file matches one of storedHashes in either of
+// those forms, that hash is returned, so it isn't mistaken for a change.
+func envFileHash(path string, data []byte, storedHashes ...string) string {
+	contents := normalizeEnvContents(path, data)
+	hash := HashFile(string(contents))
+	if slices.Contains(storedHashes, hash) {
+		return hash
+	}
+	rawHash := HashFile(string(data))
+	crlfHash := HashFile(string(bytes.ReplaceAll(contents, []byte("\n"), []byte("\r\n"))))
+	for _, storedHash := range storedHashes {
+		if storedHash != "" && (storedHash == rawHash || storedHash == crlfHash) {
+			return storedHash
+		}
+	}
+	return hash
+}
+
+// localEnvContents converts stored contents to what is written to path:
+// UTF-8 with the line endings of the file already there, or the platform's
+// if there is none (CRLF on Windows), unless line_endings says otherwise
+func localEnvContents(path string, contents []byte) []byte {
+	lineEndings := localTextFormat().lineEndings
+	if lineEndings == "raw" || !storedAsText(path, contents) {
+		return contents
+	}
+	crlf := lineEndings == "crlf"
+	if lineEndings == "auto" {
+		if existing, err := os.ReadFile(path); err == nil {
+			crlf = bytes.Contains(decodeText(existing), []byte("\r\n"))
+		} else {
+			crlf = runtime.GOOS == "windows"
+		}
+	}
+	contents = bytes.ReplaceAll(contents, []byte("\r\n"), []byte("\n"))
+	if crlf {
+		contents = bytes.ReplaceAll(contents, []byte("\n"), []byte("\r\n"))
+	}
+	return contents
+}
+
+// writeEnvFile writes stored contents to a local env file, converted by
+// localEnvContents, backing up the file it replaces
+func writeEnvFile(path string, contents []byte, perm os.FileMode) error {
+	return writeFileWithBackup(path, localEnvContents(path, contents), perm)
+}
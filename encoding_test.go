@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDecodeText(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"utf-8", []byte("KEY=välue\n"), "KEY=välue\n"},
+		{"utf-8 bom", []byte("\xEF\xBB\xBFKEY=1\n"), "KEY=1\n"},
+		{"utf-16le bom", []byte("\xFF\xFEK\x00=\x001\x00"), "K=1"},
+		{"utf-16be bom", []byte("\xFE\xFF\x00K\x00=\x001"), "K=1"},
+		{"utf-16le without bom", []byte("K\x00=\x001\x00"), "K=1"},
+		{"utf-16be without bom", []byte("\x00K\x00=\x001"), "K=1"},
+		{"windows-1252", []byte("KEY=caf\xE9\n"), "KEY=café\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(decodeText(tt.data)); got != tt.want {
+				t.Errorf("decodeText(%q) = %q, want %q", tt.data, got, tt.want)
+			}
+		})
+	}
+}
+
+// keystore looks like binary data that decodeText would mangle: it isn't
+// valid UTF-8, has CRLF byte pairs and is mostly zeros at odd offsets
+var keystore = []byte{0xFE, 0xED, 0xFE, 0xED, 0x00, 0x02, 0x0D, 0x0A, 0x41, 0x00, 0x42, 0x00, 0x9C, 0x00, 0x0D, 0x0A}
+
+func TestNormalizeEnvContents(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	tests := []struct {
+		name string
+		path string
+		data []byte
+		want []byte
+	}{
+		{"crlf .env", ".env", []byte("A=1\r\nB=2\r\n"), []byte("A=1\nB=2\n")},
+		{"utf-16 .env", "app/.env.local", []byte("\xFF\xFEA\x00=\x001\x00\r\x00\n\x00"), []byte("A=1\n")},
+		{"windows-1252 .env", ".env", []byte("A=caf\xE9\r\n"), []byte("A=café\n")},
+		{"crlf text pattern", "config/secrets.yaml", []byte("a: 1\r\nb: 2\r\n"), []byte("a: 1\nb: 2\n")},
+		{"bom text pattern", "terraform.tfvars", []byte("\xEF\xBB\xBFa = 1\n"), []byte("a = 1\n")},
+		{"binary keystore", "certs/app.jks", keystore, keystore},
+		{"binary with zero bytes", "key.der", []byte("0\x82\x01\x00\r\n"), []byte("0\x82\x01\x00\r\n")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := normalizeEnvContents(tt.path, tt.data); !bytes.Equal(got, tt.want) {
+				t.Errorf("normalizeEnvContents(%q, %q) = %q, want %q", tt.path, tt.data, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLocalEnvContents(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	dir := t.TempDir()
+
+	crlfFile := filepath.Join(dir, ".env")
+	if err := os.WriteFile(crlfFile, []byte("OLD=1\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if got := localEnvContents(crlfFile, []byte("A=1\nB=2\n")); string(got) != "A=1\r\nB=2\r\n" {
+		t.Errorf("CRLF file: got %q", got)
+	}
+
+	lfFile := filepath.Join(dir, ".env.test")
+	if err := os.WriteFile(lfFile, []byte("OLD=1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if got := localEnvContents(lfFile, []byte("A=1\r\nB=2\n")); string(got) != "A=1\nB=2\n" {
+		t.Errorf("LF file: got %q", got)
+	}
+
+	binaryFile := filepath.Join(dir, "app.jks")
+	if err := os.WriteFile(binaryFile, []byte("text\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if got := localEnvContents(binaryFile, keystore); !bytes.Equal(got, keystore) {
+		t.Errorf("binary file: got %q, want it byte for byte", got)
+	}
+}
+
+func TestReadEnvFileKeepsBinaryFiles(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	path := filepath.Join(t.TempDir(), "app.jks")
+	if err := os.WriteFile(path, keystore, 0600); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readEnvFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, keystore) {
+		t.Errorf("readEnvFile = %q, want %q", got, keystore)
+	}
+	if hash := envFileHash(path, keystore); hash != HashFile(string(keystore)) {
+		t.Errorf("envFileHash = %s, want the hash of the raw bytes", hash)
+	}
+}
+
+func TestEnvFileHashMatchesLegacyForms(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	data := []byte("A=1\r\nB=2\r\n")
+	normalized := HashFile("A=1\nB=2\n")
+	raw := HashFile(string(data))
+
+	if got := envFileHash(".env", data); got != normalized {
+		t.Errorf("no stored hash: got %s, want the normalized hash", got)
+	}
+	if got := envFileHash(".env", data, raw); got != raw {
+		t.Errorf("stored with CRLF: got %s, want the stored hash", got)
+	}
+	if got := envFileHash(".env", []byte("A=1\nB=2\n"), raw); got != raw {
+		t.Errorf("stored with CRLF, LF locally: got %s, want the stored hash", got)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"strings"
+)
+
+// EnvLine is a single line of a .env file
+// Comments and blank lines have an empty Key and are kept verbatim in Raw
+type EnvLine struct {
+	Key   string
+	Value string // Value as written, including any quotes
+	Raw   string
+}
+
+// EnvDocument is a parsed .env file that preserves ordering, comments and formatting
+type EnvDocument struct {
+	Lines           []EnvLine
+	Newline         string
+	TrailingNewline bool
+}
+
+// ParseEnv parses .env contents into KEY=VALUE pairs
+func ParseEnv(contents string) *EnvDocument {
+	doc := &EnvDocument{Newline: "\n"}
+	if strings.Contains(contents, "\r\n") {
+		doc.Newline = "\r\n"
+	}
+
+	contents = strings.ReplaceAll(contents, "\r\n", "\n")
+	doc.TrailingNewline = strings.HasSuffix(contents, "\n")
+	contents = strings.TrimSuffix(contents, "\n")
+	if contents == "" {
+		doc.TrailingNewline = true
+		return doc
+	}
+
+	for _, raw := range strings.Split(contents, "\n") {
+		doc.Lines = append(doc.Lines, parseEnvLine(raw))
+	}
+
+	return doc
+}
+
+func parseEnvLine(raw string) EnvLine {
+	line := strings.TrimSpace(raw)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return EnvLine{Raw: raw}
+	}
+
+	line = strings.TrimPrefix(line, "export ")
+	idx := strings.Index(line, "=")
+	if idx <= 0 {
+		return EnvLine{Raw: raw}
+	}
+
+	return EnvLine{
+		Key:   strings.TrimSpace(line[:idx]),
+		Value: strings.TrimSpace(line[idx+1:]),
+		Raw:   raw,
+	}
+}
+
+// Get returns the value of a key as written in the file
+func (d *EnvDocument) Get(key string) (string, bool) {
+	for i := len(d.Lines) - 1; i >= 0; i-- {
+		if d.Lines[i].Key == key {
+			return d.Lines[i].Value, true
+		}
+	}
+	return "", false
+}
+
+// line returns the last line defining key
+func (d *EnvDocument) line(key string) EnvLine {
+	for i := len(d.Lines) - 1; i >= 0; i-- {
+		if d.Lines[i].Key == key {
+			return d.Lines[i]
+		}
+	}
+	return EnvLine{}
+}
+
+// Keys returns all keys in file order
+func (d *EnvDocument) Keys() []string {
+	var keys []string
+	seen := make(map[string]bool)
+	for _, line := range d.Lines {
+		if line.Key != "" && !seen[line.Key] {
+			seen[line.Key] = true
+			keys = append(keys, line.Key)
+		}
+	}
+	return keys
+}
+
+// Set updates a key in place, or appends it if it doesn't exist
+func (d *EnvDocument) Set(key, value string) {
+	for i := range d.Lines {
+		if d.Lines[i].Key == key {
+			d.Lines[i].Value = value
+			d.Lines[i].Raw = key + "=" + value
+			return
+		}
+	}
+	d.Lines = append(d.Lines, EnvLine{Key: key, Value: value, Raw: key + "=" + value})
+}
+
+// Delete removes every line defining key
+func (d *EnvDocument) Delete(key string) {
+	lines := d.Lines[:0]
+	for _, line := range d.Lines {
+		if line.Key != key {
+			lines = append(lines, line)
+		}
+	}
+	d.Lines = lines
+}
+
+// Render turns the document back into file contents
+func (d *EnvDocument) Render() string {
+	if len(d.Lines) == 0 {
+		return ""
+	}
+	raws := make([]string, len(d.Lines))
+	for i, line := range d.Lines {
+		raws[i] = line.Raw
+	}
+	rendered := strings.Join(raws, d.Newline)
+	if d.TrailingNewline {
+		rendered += d.Newline
+	}
+	return rendered
+}
+
+// unquoteEnvValue strips matching surrounding quotes from a value
+func unquoteEnvValue(value string) string {
+	if len(value) >= 2 {
+		first, last := value[0], value[len(value)-1]
+		if (first == '"' || first == '\'') && first == last {
+			return value[1 : len(value)-1]
+		}
+	}
+	return value
+}
+
+// mergeEnvContents3 merges local and remote changes made since base at the key
+// level. A key changed (or added, or removed) on only one side takes that
+// side's version. Keys changed differently on both sides are conflicts, and
+// the preferred side wins. Without a base (""), every key that differs was
+// changed on both sides, and keys only one side has are kept.
+func mergeEnvContents3(base, local, remote string, preferLocal bool) (string, []string) {
+	baseDoc, localDoc, remoteDoc := ParseEnv(base), ParseEnv(local), ParseEnv(remote)
+	merged := ParseEnv(local)
+
+	keys := localDoc.Keys()
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		seen[key] = true
+	}
+	for _, key := range append(remoteDoc.Keys(), baseDoc.Keys()...) {
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+
+	var conflicts []string
+	for _, key := range keys {
+		baseValue, inBase := baseDoc.Get(key)
+		localValue, inLocal := localDoc.Get(key)
+		remoteValue, inRemote := remoteDoc.Get(key)
+
+		localChanged := inLocal != inBase || localValue != baseValue
+		remoteChanged := inRemote != inBase || remoteValue != baseValue
+		sameResult := inLocal == inRemote && localValue == remoteValue
+
+		takeRemote := false
+		switch {
+		case sameResult || !remoteChanged:
+			// Keep local
+		case !localChanged:
+			takeRemote = true
+		default:
+			conflicts = append(conflicts, key)
+			takeRemote = !preferLocal
+		}
+		if !takeRemote {
+			continue
+		}
+
+		if !inRemote {
+			merged.Delete(key)
+			continue
+		}
+		remoteLine := remoteDoc.line(key)
+		replaced := false
+		for i := range merged.Lines {
+			if merged.Lines[i].Key == key {
+				merged.Lines[i] = remoteLine
+				replaced = true
+			}
+		}
+		if !replaced {
+			merged.Lines = append(merged.Lines, remoteLine)
+		}
+	}
+
+	return merged.Render(), conflicts
+}
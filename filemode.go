@@ -0,0 +1,35 @@
+package main
+
+import (
+	"os"
+	"runtime"
+)
+
+// defaultFileMode is used for downloaded files whose permissions weren't stored
+// and that don't exist locally yet
+const defaultFileMode os.FileMode = 0644
+
+// localFileMode returns the permission bits to store for a local file, or 0
+// when they're unknown. Windows has no Unix permissions worth carrying over.
+func localFileMode(path string) os.FileMode {
+	if runtime.GOOS == "windows" {
+		return 0
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Mode().Perm()
+}
+
+// restoreFileMode chooses the permissions for writing a downloaded file: the
+// stored mode if there is one, else the local file's current mode, else 0644
+func restoreFileMode(stored os.FileMode, path string) os.FileMode {
+	if stored != 0 {
+		return stored
+	}
+	if info, err := os.Stat(path); err == nil {
+		return info.Mode().Perm()
+	}
+	return defaultFileMode
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"path"
+	"slices"
+	"strings"
+)
+
+// stringList is a repeatable flag that also accepts comma-separated values
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	for _, part := range strings.Split(value, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			*l = append(*l, part)
+		}
+	}
+	return nil
+}
+
+// FileFilter selects which env files an operation applies to
+// Repos match the repo ID (full or shortened, e.g. "github.com/myorg/*" or "myorg/*").
+// Includes/Excludes match the relative path or just the file name (e.g. ".env.local").
+// Paths match the relative path as a glob or as a directory prefix (e.g. "packages/api").
+// Tags select stored files carrying any of them; they only apply once the
+// store's tags are known, so local files are checked again after connecting.
+type FileFilter struct {
+	Repos    []string
+	Includes []string
+	Excludes []string
+	Paths    []string
+	Tags     []string
+
+	tagged map[string][]string // Tags of the stored files, by auditKey; nil until loaded
+}
+
+// IsEmpty reports whether the filter lets everything through
+func (f FileFilter) IsEmpty() bool {
+	allow, deny := configuredRepoPolicy()
+	return len(f.Repos) == 0 && len(f.Includes) == 0 && len(f.Excludes) == 0 && len(f.Paths) == 0 && len(f.Tags) == 0 && len(allow) == 0 && len(deny) == 0
+}
+
+// Match reports whether a file identified by repoID and relativePath passes
+// the filter. Repos the config doesn't allow never do.
+func (f FileFilter) Match(repoID, relativePath string) bool {
+	// A repo stored per branch is also matched without the branch
+	repoIDs := []string{repoID, shortenRepoID(repoID), repoWithoutBranch(repoID), shortenRepoID(repoWithoutBranch(repoID))}
+	if !repoAllowed(repoIDs) {
+		return false
+	}
+	if len(f.Repos) > 0 && !matchAnyGlob(f.Repos, repoIDs...) {
+		return false
+	}
+
+	if len(f.Paths) > 0 && !matchAnyPath(f.Paths, relativePath) {
+		return false
+	}
+
+	name := path.Base(relativePath)
+	if len(f.Includes) > 0 && !matchAnyGlob(f.Includes, relativePath, name) {
+		return false
+	}
+	if matchAnyGlob(f.Excludes, relativePath, name) {
+		return false
+	}
+
+	if len(f.Tags) > 0 && f.tagged != nil {
+		fileTags := f.tagged[auditKey(repoID, relativePath)]
+		if !slices.ContainsFunc(f.Tags, func(tag string) bool { return slices.Contains(fileTags, strings.ToLower(tag)) }) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// configuredRepoPolicy returns the allow_repos and deny_repos of the config
+func configuredRepoPolicy() (allow, deny []string) {
+	config, err := loadConfig()
+	if err != nil {
+		return nil, nil
+	}
+	return config.AllowRepos, config.DenyRepos
+}
+
+// repoAllowed reports whether the config lets env-sync touch the files of a
+// repo, given as its IDs in full and shortened forms
+func repoAllowed(repoIDs []string) bool {
+	allow, deny := configuredRepoPolicy()
+	if len(allow) > 0 && !matchAnyGlob(allow, repoIDs...) {
+		return false
+	}
+	return !matchAnyGlob(deny, repoIDs...)
+}
+
+func matchAnyGlob(patterns []string, candidates ...string) bool {
+	for _, pattern := range patterns {
+		for _, candidate := range candidates {
+			if ok, _ := path.Match(pattern, candidate); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchAnyPath matches a relative path against globs or directory prefixes
+func matchAnyPath(patterns []string, relativePath string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.TrimSuffix(strings.TrimPrefix(pattern, "./"), "/")
+		if ok, _ := path.Match(pattern, relativePath); ok {
+			return true
+		}
+		if strings.HasPrefix(relativePath, pattern+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// filterFiles keeps the local files whose identifiers pass the filter
+func filterFiles(files []string, basePath string, filter FileFilter) []string {
+	if filter.IsEmpty() {
+		return files
+	}
+
+	var kept []string
+	for _, file := range files {
+		repoID, relativePath, err := GetFileIdentifier(file, basePath)
+		if err != nil {
+			logger.Warn("failed to get identifier", "file", file, "error", err)
+			continue
+		}
+		if filter.Match(repoID, relativePath) {
+			kept = append(kept, file)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// gcOptions controls what gc does with the orphaned repos it finds
+type gcOptions struct {
+	ArchivePath string // Bundle the orphaned repos are written to before they're deleted
+	Yes         bool   // Act on every orphaned repo without asking
+	DryRun      bool
+}
+
+// orphanedRepo is a stored repo with no checkout under the base path and no
+// remembered file on this machine
+type orphanedRepo struct {
+	RepoID      string `json:"repo_id"`
+	Files       int    `json:"files"`
+	LastUpdated string `json:"last_updated"`
+	Action      string `json:"action,omitempty"` // archive, delete or skip
+}
+
+// findCheckouts returns the repo IDs, with every remote's alias, of the git
+// checkouts under basePath and the config's base paths. Hidden and skipped
+// directories aren't searched.
+func findCheckouts(basePath string) (map[string]bool, error) {
+	skipDirs, err := loadSkipDirs()
+	if err != nil {
+		logger.Warn("failed to load skip directories", "error", err)
+	}
+
+	checkedOut := make(map[string]bool)
+	for _, root := range append([]string{basePath}, basePathRoots()...) {
+		if err := walkCheckouts(root, skipDirs, checkedOut); err != nil {
+			return nil, err
+		}
+	}
+	return checkedOut, nil
+}
+
+// walkCheckouts adds the git checkouts under root to checkedOut
+func walkCheckouts(root string, skipDirs []string, checkedOut map[string]bool) error {
+	return filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			// Unreadable directories are skipped, like scan does
+			return nil
+		}
+		if !entry.IsDir() {
+			return nil
+		}
+		name := entry.Name()
+		if path != root && (strings.HasPrefix(name, ".") || matchAnyGlob(skipDirs, name)) {
+			return filepath.SkipDir
+		}
+		if _, err := os.Stat(filepath.Join(path, ".git")); err != nil {
+			return nil
+		}
+		// Repos inside this one (submodules, nested clones) are walked too
+		if root, repoID, err := GetRepoRoot(path); err == nil {
+			checkedOut[repoWithoutBranch(repoID)] = true
+			for _, alias := range gitRemoteAliases(root, repoID) {
+				checkedOut[repoWithoutBranch(alias)] = true
+			}
+		}
+		return nil
+	})
+}
+
+// findOrphanedRepos returns the stored repos that have no checkout under
+// basePath and none of whose files this machine remembers. Non-git files
+// ("__local__") aren't considered.
+func findOrphanedRepos(records []EnvFileRecord, basePath string, filter FileFilter) ([]orphanedRepo, error) {
+	checkedOut, err := findCheckouts(basePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search %s for checkouts: %v", basePath, err)
+	}
+
+	// Remembered files that still exist keep their repo, wherever it is
+	files, err := loadEnvFiles()
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if _, err := os.Stat(file); err != nil {
+			continue
+		}
+		if repoID, _, err := GetFileIdentifier(file, basePath); err == nil {
+			checkedOut[repoWithoutBranch(repoID)] = true
+		}
+	}
+
+	var orphans []orphanedRepo
+	for _, summary := range summarizeRepos(records) {
+		if isLocalRepo(summary.RepoID) || checkedOut[repoWithoutBranch(summary.RepoID)] {
+			continue
+		}
+		if !slices.ContainsFunc(records, func(record EnvFileRecord) bool {
+			return record.RepoID == summary.RepoID && filter.Match(record.RepoID, record.RelativePath)
+		}) {
+			continue
+		}
+		orphans = append(orphans, orphanedRepo{RepoID: summary.RepoID, Files: summary.Files, LastUpdated: summary.LastUpdated})
+	}
+	return orphans, nil
+}
+
+// runGC finds stored repos this machine no longer has and archives or
+// deletes them, asking about each one unless opts.Yes is set
+func runGC(ctx context.Context, dbConnStr, password, basePath string, filter FileFilter, opts gcOptions) error {
+	db, err := OpenStore(dbConnStr)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := db.InitSchema(ctx); err != nil {
+		return err
+	}
+
+	records, err := db.ListEnvFiles(ctx)
+	if err != nil {
+		return err
+	}
+	orphans, err := findOrphanedRepos(records, basePath, filter)
+	if err != nil {
+		return err
+	}
+
+	interactive := !opts.Yes && !opts.DryRun && !jsonOutput && term.IsTerminal(int(os.Stdin.Fd()))
+	if len(orphans) == 0 {
+		if jsonOutput {
+			printJSON(map[string]interface{}{"orphaned": []orphanedRepo{}})
+		} else {
+			fmt.Printf("✓ Every stored repo is checked out under %s\n", basePath)
+		}
+		return nil
+	}
+	if !jsonOutput {
+		fmt.Printf("%d stored repo(s) aren't checked out under %s:\n", len(orphans), basePath)
+		for _, orphan := range orphans {
+			fmt.Printf("  %-50s %3d file(s)  updated %s\n", orphan.RepoID, orphan.Files, orphan.LastUpdated)
+		}
+	}
+
+	// Decide first, so the archive is written before anything is deleted
+	defaultAction := "delete"
+	if opts.ArchivePath != "" {
+		defaultAction = "archive"
+	}
+	var reader *bufio.Reader
+	if interactive {
+		reader = bufio.NewReader(os.Stdin)
+		fmt.Println()
+	}
+decide:
+	for i := range orphans {
+		switch {
+		case interactive:
+			action, err := promptGCAction(reader, orphans[i])
+			if err != nil {
+				return err
+			}
+			if action == "quit" {
+				orphans = orphans[:i]
+				break decide
+			}
+			orphans[i].Action = action
+		case opts.Yes && !opts.DryRun:
+			orphans[i].Action = defaultAction
+		default:
+			orphans[i].Action = "skip"
+		}
+	}
+
+	if !opts.Yes && !interactive && !jsonOutput {
+		if opts.DryRun {
+			fmt.Println("\nDry run: nothing changed")
+		} else {
+			fmt.Println("\nNothing changed: run in a terminal to choose for each repo, or with --yes to delete them (--archive <file> to keep a copy)")
+		}
+		return nil
+	}
+
+	archived := func(repoID, relativePath string) bool {
+		return slices.ContainsFunc(orphans, func(o orphanedRepo) bool { return o.RepoID == repoID && o.Action == "archive" })
+	}
+	if slices.ContainsFunc(orphans, func(o orphanedRepo) bool { return o.Action == "archive" }) {
+		archivePath := opts.ArchivePath
+		if archivePath == "" {
+			archivePath = fmt.Sprintf("env-sync-archive-%s.envsync", time.Now().UTC().Format("20060102-150405"))
+		}
+		bundle, err := collectBundle(ctx, db, password, archived)
+		if err != nil {
+			return err
+		}
+		if err := writeBundle(archivePath, bundle, password); err != nil {
+			return err
+		}
+		notef("✓ Archived %d file(s) to %s (restore with 'env-sync import --input %s')\n", len(bundle.Files), archivePath, archivePath)
+	}
+
+	for _, orphan := range orphans {
+		if orphan.Action != "archive" && orphan.Action != "delete" {
+			continue
+		}
+		if err := db.DeleteRepo(ctx, orphan.RepoID); err != nil {
+			return err
+		}
+		var entries []AuditEntry
+		for _, record := range records {
+			if record.RepoID == orphan.RepoID {
+				entry := newAuditEntry(auditDelete, orphan.RepoID, record.RelativePath, record.FileHash, "")
+				entry.Detail = "gc: " + orphan.Action
+				entries = append(entries, entry)
+			}
+		}
+		recordAudit(ctx, db, entries...)
+		if !jsonOutput {
+			fmt.Printf("✓ Removed %s (%d file(s) and their history)\n", orphan.RepoID, orphan.Files)
+		}
+	}
+
+	if jsonOutput {
+		printJSON(map[string]interface{}{"orphaned": orphans, "dry_run": opts.DryRun})
+	}
+	return nil
+}
+
+// promptGCAction asks what to do with an orphaned repo
+func promptGCAction(reader *bufio.Reader, orphan orphanedRepo) (string, error) {
+	for {
+		fmt.Printf("%s (%d file(s)): [a]rchive and delete, [d]elete, [s]kip or [q]uit? ", orphan.RepoID, orphan.Files)
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return "", fmt.Errorf("failed to read answer: %v", err)
+		}
+		switch strings.ToLower(strings.TrimSpace(line)) {
+		case "a", "archive":
+			return "archive", nil
+		case "d", "delete":
+			return "delete", nil
+		case "s", "skip", "":
+			return "skip", nil
+		case "q", "quit":
+			return "quit", nil
+		}
+	}
+}
@@ -0,0 +1,549 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	secretmanager "cloud.google.com/go/secretmanager/apiv1"
+	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+// Labels and annotations set on every secret written by env-sync. Labels
+// only allow short lowercase values, so the exact repo ID and path are kept
+// in annotations and the labels are there for filtering in the console.
+const (
+	gcsmStoreLabel = "env-sync-store"
+	gcsmRepoLabel  = "env-sync-repo"
+	gcsmPathLabel  = "env-sync-path"
+
+	gcsmRepoAnnotation     = "env-sync/repo-id"
+	gcsmPathAnnotation     = "env-sync/relative-path"
+	gcsmHashAnnotation     = "env-sync/file-hash"
+	gcsmModTimeAnnotation  = "env-sync/file-modified-at"
+	gcsmUpdatedAnnotation  = "env-sync/updated-at"
+	gcsmDefaultPrefix      = "env-sync"
+	gcsmSecretIDHashLength = 40
+)
+
+var gcsmPrefixPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,200}$`)
+
+// GCSMStore keeps each env file as a Google Cloud Secret Manager secret named
+// <prefix>_<hash of repo and path>. Every upload adds a secret version, so
+// revision history, IAM and audit logging come from the platform.
+type GCSMStore struct {
+	client    *secretmanager.Client
+	project   string
+	prefix    string
+	locations []string // User-managed replication locations; empty means automatic
+}
+
+// gcsmPayload is the JSON stored in each secret version
+type gcsmPayload struct {
+	Contents       string      `json:"contents"`
+	FileHash       string      `json:"file_hash"`
+	FileModifiedAt string      `json:"file_modified_at"`
+	FileMode       os.FileMode `json:"file_mode,omitempty"`
+}
+
+// NewGCSMStore connects to Secret Manager in a GCP project
+// URL format: gcsm://project-id/prefix[?locations=us-east1,europe-west1]
+// Credentials come from Application Default Credentials (gcloud auth, service account, workload identity)
+func NewGCSMStore(connString string) (*GCSMStore, error) {
+	u, err := url.Parse(connString)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Secret Manager URL: %v", err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid Secret Manager URL: missing project ID (use gcsm://project-id/prefix)")
+	}
+
+	prefix := strings.Trim(u.Path, "/")
+	if prefix == "" {
+		prefix = gcsmDefaultPrefix
+	}
+	if !gcsmPrefixPattern.MatchString(prefix) {
+		return nil, fmt.Errorf("invalid Secret Manager prefix %q (use letters, digits, - and _)", prefix)
+	}
+
+	var locations []string
+	if value := u.Query().Get("locations"); value != "" {
+		locations = strings.Split(value, ",")
+	}
+
+	client, err := secretmanager.NewClient(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to Secret Manager: %v", err)
+	}
+
+	return &GCSMStore{client: client, project: u.Host, prefix: prefix, locations: locations}, nil
+}
+
+func (g *GCSMStore) Close() error {
+	return g.client.Close()
+}
+
+// InitSchema is a no-op, secrets are created on first upload
+func (g *GCSMStore) InitSchema(ctx context.Context) error {
+	return nil
+}
+
+func (g *GCSMStore) parent() string {
+	return "projects/" + g.project
+}
+
+// secretName returns the full resource name of the secret for a file
+func (g *GCSMStore) secretName(repoID, relativePath string) string {
+	sum := sha256.Sum256([]byte(repoID + "\x00" + relativePath))
+	return g.parent() + "/secrets/" + g.prefix + "_" + hex.EncodeToString(sum[:])[:gcsmSecretIDHashLength]
+}
+
+// gcsmLabelValue squeezes a string into the label value charset (lowercase
+// letters, digits, - and _, at most 63 characters)
+func gcsmLabelValue(value string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(value) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '-' || r == '_' {
+			b.WriteRune(r)
+		} else {
+			b.WriteRune('-')
+		}
+	}
+	label := b.String()
+	if len(label) > 63 {
+		label = label[:63]
+	}
+	return label
+}
+
+func (g *GCSMStore) replication() *secretmanagerpb.Replication {
+	if len(g.locations) == 0 {
+		return &secretmanagerpb.Replication{
+			Replication: &secretmanagerpb.Replication_Automatic_{Automatic: &secretmanagerpb.Replication_Automatic{}},
+		}
+	}
+	var replicas []*secretmanagerpb.Replication_UserManaged_Replica
+	for _, location := range g.locations {
+		replicas = append(replicas, &secretmanagerpb.Replication_UserManaged_Replica{Location: location})
+	}
+	return &secretmanagerpb.Replication{
+		Replication: &secretmanagerpb.Replication_UserManaged_{UserManaged: &secretmanagerpb.Replication_UserManaged{Replicas: replicas}},
+	}
+}
+
+func isGCSMNotFound(err error) bool {
+	return status.Code(err) == codes.NotFound
+}
+
+// getSecret returns the secret for a file, or nil if it doesn't exist
+func (g *GCSMStore) getSecret(ctx context.Context, repoID, relativePath string) (*secretmanagerpb.Secret, error) {
+	secret, err := g.client.GetSecret(ctx, &secretmanagerpb.GetSecretRequest{Name: g.secretName(repoID, relativePath)})
+	if isGCSMNotFound(err) {
+		return nil, nil
+	}
+	return secret, err
+}
+
+// accessPayload reads and decodes one version ("latest" or a number) of a secret
+func (g *GCSMStore) accessPayload(ctx context.Context, secretName, version string) (*gcsmPayload, error) {
+	resp, err := g.client.AccessSecretVersion(ctx, &secretmanagerpb.AccessSecretVersionRequest{
+		Name: secretName + "/versions/" + version,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var payload gcsmPayload
+	if err := json.Unmarshal(resp.GetPayload().GetData(), &payload); err != nil {
+		return nil, fmt.Errorf("invalid payload in %s: %v", secretName, err)
+	}
+	return &payload, nil
+}
+
+// record builds a file record from a secret's annotations
+func (g *GCSMStore) record(secret *secretmanagerpb.Secret) EnvFileRecord {
+	annotations := secret.GetAnnotations()
+	return EnvFileRecord{
+		RepoID:         annotations[gcsmRepoAnnotation],
+		RelativePath:   annotations[gcsmPathAnnotation],
+		FileHash:       annotations[gcsmHashAnnotation],
+		FileModifiedAt: normalizeStoredTime(annotations[gcsmModTimeAnnotation]),
+		CreatedAt:      formatStoredTime(secret.GetCreateTime().AsTime()),
+		UpdatedAt:      normalizeStoredTime(annotations[gcsmUpdatedAnnotation]),
+	}
+}
+
+// UpsertEnvFile adds a secret version, creating the secret on first upload
+func (g *GCSMStore) UpsertEnvFile(ctx context.Context, repoID, relativePath, encryptedContents, fileHash, fileModTime string, fileMode os.FileMode) error {
+	now := storedNow()
+	fileModTime = normalizeStoredTime(fileModTime)
+	name := g.secretName(repoID, relativePath)
+
+	annotations := map[string]string{
+		gcsmRepoAnnotation:    repoID,
+		gcsmPathAnnotation:    relativePath,
+		gcsmHashAnnotation:    fileHash,
+		gcsmModTimeAnnotation: fileModTime,
+		gcsmUpdatedAnnotation: now,
+	}
+
+	secret, err := g.getSecret(ctx, repoID, relativePath)
+	if err != nil {
+		return fmt.Errorf("failed to upsert env file: %v", err)
+	}
+	if secret == nil {
+		_, err = g.client.CreateSecret(ctx, &secretmanagerpb.CreateSecretRequest{
+			Parent:   g.parent(),
+			SecretId: path.Base(name),
+			Secret: &secretmanagerpb.Secret{
+				Replication: g.replication(),
+				Labels: map[string]string{
+					gcsmStoreLabel: gcsmLabelValue(g.prefix),
+					gcsmRepoLabel:  gcsmLabelValue(shortenRepoID(repoID)),
+					gcsmPathLabel:  gcsmLabelValue(relativePath),
+				},
+				Annotations: annotations,
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create secret: %v", err)
+		}
+	}
+
+	data, err := json.Marshal(gcsmPayload{Contents: encryptedContents, FileHash: fileHash, FileModifiedAt: fileModTime, FileMode: fileMode})
+	if err != nil {
+		return err
+	}
+	if _, err := g.client.AddSecretVersion(ctx, &secretmanagerpb.AddSecretVersionRequest{
+		Parent:  name,
+		Payload: &secretmanagerpb.SecretPayload{Data: data},
+	}); err != nil {
+		return fmt.Errorf("failed to record env file version: %v", err)
+	}
+
+	// Keep the hash and timestamps on the secret so listing doesn't need to read payloads
+	if secret != nil {
+		_, err = g.client.UpdateSecret(ctx, &secretmanagerpb.UpdateSecretRequest{
+			Secret:     &secretmanagerpb.Secret{Name: name, Annotations: annotations},
+			UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"annotations"}},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to update secret metadata: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// UpsertEnvFiles writes many env files. Secret Manager has no transactions,
+// so each file is written in turn and the first failure is returned.
+func (g *GCSMStore) UpsertEnvFiles(ctx context.Context, records []EnvFileRecord) error {
+	for _, record := range records {
+		if err := g.UpsertEnvFile(ctx, record.RepoID, record.RelativePath, record.Contents, record.FileHash, record.FileModifiedAt, record.FileMode); err != nil {
+			return fmt.Errorf("%s:%s: %v", record.RepoID, record.RelativePath, err)
+		}
+	}
+	return nil
+}
+
+// GetEnvFile retrieves the encrypted contents of an env file
+func (g *GCSMStore) GetEnvFile(ctx context.Context, repoID, relativePath string) (string, error) {
+	payload, err := g.accessPayload(ctx, g.secretName(repoID, relativePath), "latest")
+	if isGCSMNotFound(err) {
+		return "", fmt.Errorf("env file not found: %s:%s", repoID, relativePath)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to query env file: %v", err)
+	}
+	return payload.Contents, nil
+}
+
+// GetEnvFileWithMetadata retrieves an env file with its metadata
+func (g *GCSMStore) GetEnvFileWithMetadata(ctx context.Context, repoID, relativePath string) (*EnvFileRecord, error) {
+	secret, err := g.getSecret(ctx, repoID, relativePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query env file: %v", err)
+	}
+	if secret == nil {
+		return nil, nil // Not found
+	}
+
+	payload, err := g.accessPayload(ctx, secret.GetName(), "latest")
+	if isGCSMNotFound(err) {
+		return nil, nil // Created but no version written yet
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query env file: %v", err)
+	}
+
+	record := g.record(secret)
+	record.Contents = payload.Contents
+	record.FileHash = payload.FileHash
+	record.FileModifiedAt = normalizeStoredTime(payload.FileModifiedAt)
+	record.FileMode = payload.FileMode
+	return &record, nil
+}
+
+// listSecrets returns every secret written by this store
+func (g *GCSMStore) listSecrets(ctx context.Context) ([]*secretmanagerpb.Secret, error) {
+	it := g.client.ListSecrets(ctx, &secretmanagerpb.ListSecretsRequest{
+		Parent: g.parent(),
+		Filter: fmt.Sprintf("labels.%s=%s", gcsmStoreLabel, gcsmLabelValue(g.prefix)),
+	})
+
+	var secrets []*secretmanagerpb.Secret
+	for {
+		secret, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		// Labels are lowercased, so make sure the secret really has our prefix
+		if !strings.HasPrefix(path.Base(secret.GetName()), g.prefix+"_") {
+			continue
+		}
+		secrets = append(secrets, secret)
+	}
+	return secrets, nil
+}
+
+// ListEnvFiles returns all env files stored under the prefix
+func (g *GCSMStore) ListEnvFiles(ctx context.Context) ([]EnvFileRecord, error) {
+	secrets, err := g.listSecrets(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query env files: %v", err)
+	}
+
+	var records []EnvFileRecord
+	for _, secret := range secrets {
+		record := g.record(secret)
+		if record.FileHash == "" {
+			continue // No version written yet
+		}
+		records = append(records, record)
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].RepoID != records[j].RepoID {
+			return records[i].RepoID < records[j].RepoID
+		}
+		return records[i].RelativePath < records[j].RelativePath
+	})
+
+	return records, nil
+}
+
+// ListEnvFilesWithContents returns all env files including their encrypted
+// contents, reading the latest version of each secret
+func (g *GCSMStore) ListEnvFilesWithContents(ctx context.Context) ([]EnvFileRecord, error) {
+	records, err := g.ListEnvFiles(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range records {
+		payload, err := g.accessPayload(ctx, g.secretName(records[i].RepoID, records[i].RelativePath), "latest")
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s:%s: %v", records[i].RepoID, records[i].RelativePath, err)
+		}
+		records[i].Contents = payload.Contents
+		records[i].FileMode = payload.FileMode
+	}
+	return records, nil
+}
+
+// listVersions returns the enabled versions of a secret, newest first
+func (g *GCSMStore) listVersions(ctx context.Context, secretName string) ([]*secretmanagerpb.SecretVersion, error) {
+	it := g.client.ListSecretVersions(ctx, &secretmanagerpb.ListSecretVersionsRequest{
+		Parent: secretName,
+		Filter: "state:ENABLED",
+	})
+
+	var versions []*secretmanagerpb.SecretVersion
+	for {
+		version, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, version)
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		return gcsmVersionNumber(versions[i]) > gcsmVersionNumber(versions[j])
+	})
+	return versions, nil
+}
+
+func gcsmVersionNumber(version *secretmanagerpb.SecretVersion) int {
+	n, _ := strconv.Atoi(path.Base(version.GetName()))
+	return n
+}
+
+// ListEnvFileVersions returns all recorded revisions of an env file, newest first
+func (g *GCSMStore) ListEnvFileVersions(ctx context.Context, repoID, relativePath string) ([]EnvFileVersion, error) {
+	name := g.secretName(repoID, relativePath)
+	secretVersions, err := g.listVersions(ctx, name)
+	if isGCSMNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query env file versions: %v", err)
+	}
+
+	var versions []EnvFileVersion
+	for _, secretVersion := range secretVersions {
+		n := gcsmVersionNumber(secretVersion)
+		payload, err := g.accessPayload(ctx, name, strconv.Itoa(n))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read version %d: %v", n, err)
+		}
+		versions = append(versions, EnvFileVersion{
+			RepoID:         repoID,
+			RelativePath:   relativePath,
+			Version:        n,
+			FileHash:       payload.FileHash,
+			FileModifiedAt: normalizeStoredTime(payload.FileModifiedAt),
+			CreatedAt:      formatStoredTime(secretVersion.GetCreateTime().AsTime()),
+		})
+	}
+
+	return versions, nil
+}
+
+// GetEnvFileVersion retrieves a specific revision of an env file
+func (g *GCSMStore) GetEnvFileVersion(ctx context.Context, repoID, relativePath string, version int) (*EnvFileVersion, error) {
+	name := g.secretName(repoID, relativePath)
+	secretVersion, err := g.client.GetSecretVersion(ctx, &secretmanagerpb.GetSecretVersionRequest{
+		Name: name + "/versions/" + strconv.Itoa(version),
+	})
+	if isGCSMNotFound(err) {
+		return nil, fmt.Errorf("version %d not found for %s:%s", version, repoID, relativePath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query env file version: %v", err)
+	}
+
+	payload, err := g.accessPayload(ctx, name, strconv.Itoa(version))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query env file version: %v", err)
+	}
+
+	return &EnvFileVersion{
+		RepoID:         repoID,
+		RelativePath:   relativePath,
+		Version:        version,
+		Contents:       payload.Contents,
+		FileHash:       payload.FileHash,
+		FileModifiedAt: normalizeStoredTime(payload.FileModifiedAt),
+		FileMode:       payload.FileMode,
+		CreatedAt:      formatStoredTime(secretVersion.GetCreateTime().AsTime()),
+	}, nil
+}
+
+// RenameRepo copies every file of oldRepoID, oldest revision first, into new
+// secrets for newRepoID and then deletes the old secrets. Secret Manager
+// numbers versions itself, so the copied history is renumbered from 1.
+func (g *GCSMStore) RenameRepo(ctx context.Context, oldRepoID, newRepoID string) error {
+	records, err := g.ListEnvFiles(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		if record.RepoID != oldRepoID {
+			continue
+		}
+		oldName := g.secretName(oldRepoID, record.RelativePath)
+		versions, err := g.listVersions(ctx, oldName)
+		if err != nil {
+			return fmt.Errorf("failed to list versions of %s: %v", record.RelativePath, err)
+		}
+		for i := len(versions) - 1; i >= 0; i-- {
+			payload, err := g.accessPayload(ctx, oldName, strconv.Itoa(gcsmVersionNumber(versions[i])))
+			if err != nil {
+				return fmt.Errorf("failed to read %s: %v", record.RelativePath, err)
+			}
+			if err := g.UpsertEnvFile(ctx, newRepoID, record.RelativePath, payload.Contents, payload.FileHash, payload.FileModifiedAt, payload.FileMode); err != nil {
+				return err
+			}
+		}
+		if err := g.client.DeleteSecret(ctx, &secretmanagerpb.DeleteSecretRequest{Name: oldName}); err != nil {
+			return fmt.Errorf("failed to delete %s: %v", oldName, err)
+		}
+	}
+	return nil
+}
+
+// MoveEnvFile copies a file's revisions, oldest first, into a new secret for
+// newPath and deletes the old one. The history is renumbered from 1.
+func (g *GCSMStore) MoveEnvFile(ctx context.Context, repoID, oldPath, newPath string) error {
+	existing, err := g.GetEnvFileWithMetadata(ctx, repoID, newPath)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return fmt.Errorf("%s is already stored", newPath)
+	}
+
+	oldName := g.secretName(repoID, oldPath)
+	versions, err := g.listVersions(ctx, oldName)
+	if err != nil {
+		return fmt.Errorf("failed to list versions of %s: %v", oldPath, err)
+	}
+	for i := len(versions) - 1; i >= 0; i-- {
+		payload, err := g.accessPayload(ctx, oldName, strconv.Itoa(gcsmVersionNumber(versions[i])))
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", oldPath, err)
+		}
+		if err := g.UpsertEnvFile(ctx, repoID, newPath, payload.Contents, payload.FileHash, payload.FileModifiedAt, payload.FileMode); err != nil {
+			return err
+		}
+	}
+	if err := g.client.DeleteSecret(ctx, &secretmanagerpb.DeleteSecretRequest{Name: oldName}); err != nil {
+		return fmt.Errorf("failed to delete %s: %v", oldName, err)
+	}
+	return nil
+}
+
+// DeleteEnvFile deletes the file's secret with every version of it
+func (g *GCSMStore) DeleteEnvFile(ctx context.Context, repoID, relativePath string) error {
+	name := g.secretName(repoID, relativePath)
+	if err := g.client.DeleteSecret(ctx, &secretmanagerpb.DeleteSecretRequest{Name: name}); err != nil {
+		return fmt.Errorf("failed to delete %s: %v", name, err)
+	}
+	return nil
+}
+
+// DeleteRepo deletes the secrets of every file of repoID
+func (g *GCSMStore) DeleteRepo(ctx context.Context, repoID string) error {
+	secrets, err := g.listSecrets(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to query env files: %v", err)
+	}
+	for _, secret := range secrets {
+		if secret.GetAnnotations()[gcsmRepoAnnotation] != repoID {
+			continue
+		}
+		if err := g.client.DeleteSecret(ctx, &secretmanagerpb.DeleteSecretRequest{Name: secret.GetName()}); err != nil {
+			return fmt.Errorf("failed to delete %s: %v", secret.GetName(), err)
+		}
+	}
+	return nil
+}
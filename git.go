@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strings"
+	"sync"
 )
 
 // GitInfo holds git repository information for a file
@@ -33,7 +36,7 @@ func GetGitInfo(filePath string) (*GitInfo, error) {
 	}
 
 	// Normalize the remote URL
-	normalizedURL := normalizeGitURL(remoteURL)
+	normalizedURL := branchRepoID(gitRoot, normalizeGitURL(remoteURL))
 
 	// Get path relative to git root
 	relPath, err := filepath.Rel(gitRoot, filePath)
@@ -51,20 +54,22 @@ func GetGitInfo(filePath string) (*GitInfo, error) {
 	}, nil
 }
 
-// findGitRoot finds the git repository root by looking for .git directory
+// findGitRoot returns the root of the checkout containing startPath: the
+// nearest directory with a .git directory, or with a .git file pointing to
+// the repository of a worktree or submodule. A submodule that isn't checked
+// out is still its own root, so its files aren't keyed to the parent repo.
 func findGitRoot(startPath string) (string, error) {
 	currentPath := startPath
 
 	for {
-		gitPath := filepath.Join(currentPath, ".git")
-		if info, err := os.Stat(gitPath); err == nil {
-			if info.IsDir() {
-				return currentPath, nil
+		if _, err := os.Stat(filepath.Join(currentPath, ".git")); err == nil {
+			if _, err := resolveGitDir(currentPath); err != nil {
+				return "", err
 			}
-			// Could be a git worktree (file pointing to actual .git)
-			if !info.IsDir() {
-				return currentPath, nil
+			if submodule := submoduleContaining(currentPath, startPath); submodule != "" {
+				return submodule, nil
 			}
+			return currentPath, nil
 		}
 
 		// Move up one directory
@@ -77,17 +82,269 @@ func findGitRoot(startPath string) (string, error) {
 	}
 }
 
-// getGitRemoteURL gets the origin remote URL using git command
-func getGitRemoteURL(gitRoot string) (string, error) {
-	cmd := exec.Command("git", "remote", "get-url", "origin")
-	cmd.Dir = gitRoot
+// resolveGitDir returns the repository directory of the checkout at gitRoot:
+// its .git directory, or the directory named by the "gitdir:" line of a .git
+// file, as git writes for worktrees and submodules
+func resolveGitDir(gitRoot string) (string, error) {
+	gitPath := filepath.Join(gitRoot, ".git")
+	info, err := os.Stat(gitPath)
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		return gitPath, nil
+	}
 
+	data, err := os.ReadFile(gitPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %v", gitPath, err)
+	}
+	gitDir, ok := strings.CutPrefix(strings.TrimSpace(string(data)), "gitdir:")
+	if !ok {
+		return "", fmt.Errorf("invalid .git file: %s", gitPath)
+	}
+	gitDir = filepath.FromSlash(strings.TrimSpace(gitDir))
+	if !filepath.IsAbs(gitDir) {
+		gitDir = filepath.Join(gitRoot, gitDir)
+	}
+	if info, err := os.Stat(gitDir); err != nil || !info.IsDir() {
+		return "", fmt.Errorf("%s points to a missing repository: %s", gitPath, gitDir)
+	}
+	return gitDir, nil
+}
+
+// gitSubmodule is one entry of a repository's .gitmodules
+type gitSubmodule struct {
+	name string
+	path string // Relative to the parent's root, with forward slashes
+	url  string
+}
+
+// gitSubmodules caches each git root's .gitmodules entries
+var gitSubmodules sync.Map // git root -> []gitSubmodule
+
+// listSubmodules returns the submodules declared in gitRoot/.gitmodules
+func listSubmodules(gitRoot string) []gitSubmodule {
+	if submodules, ok := gitSubmodules.Load(gitRoot); ok {
+		return submodules.([]gitSubmodule)
+	}
+
+	var submodules []gitSubmodule
+	modulesFile := filepath.Join(gitRoot, ".gitmodules")
+	if _, err := os.Stat(modulesFile); err == nil {
+		cmd := gitCommand("config", "--file", modulesFile, "--get-regexp", `^submodule\..*\.(path|url)$`)
+		output, err := cmd.Output()
+		if err != nil {
+			logger.Warn("failed to read .gitmodules", "file", modulesFile, "error", err)
+		}
+
+		byName := make(map[string]*gitSubmodule)
+		for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+			key, value, ok := strings.Cut(line, " ")
+			if !ok {
+				continue
+			}
+			// Names may contain dots, the field never does
+			key = strings.TrimPrefix(key, "submodule.")
+			dot := strings.LastIndex(key, ".")
+			name, field := key[:dot], key[dot+1:]
+			if byName[name] == nil {
+				submodules = append(submodules, gitSubmodule{name: name})
+				byName[name] = &submodules[len(submodules)-1]
+			}
+			if field == "path" {
+				byName[name].path = strings.Trim(strings.TrimSpace(value), "/")
+			} else {
+				byName[name].url = strings.TrimSpace(value)
+			}
+		}
+	}
+	gitSubmodules.Store(gitRoot, submodules)
+	return submodules
+}
+
+// submoduleContaining returns the directory of the submodule of gitRoot that
+// contains path, or "" if path isn't inside one
+func submoduleContaining(gitRoot, path string) string {
+	rel, err := filepath.Rel(gitRoot, path)
+	if err != nil || rel == "." {
+		return ""
+	}
+	rel = filepath.ToSlash(rel)
+	for _, submodule := range listSubmodules(gitRoot) {
+		if submodule.path != "" && (rel == submodule.path || strings.HasPrefix(rel, submodule.path+"/")) {
+			return filepath.Join(gitRoot, filepath.FromSlash(submodule.path))
+		}
+	}
+	return ""
+}
+
+// submoduleURL returns the URL the parent repository's .gitmodules gives the
+// submodule at gitRoot, or "" if it isn't a submodule. Relative URLs are
+// resolved against the parent's remote, as git does.
+func submoduleURL(gitRoot string) string {
+	parentRoot, err := findGitRoot(filepath.Dir(gitRoot))
+	if err != nil {
+		return ""
+	}
+	for _, submodule := range listSubmodules(parentRoot) {
+		if submodule.url == "" || filepath.Join(parentRoot, filepath.FromSlash(submodule.path)) != gitRoot {
+			continue
+		}
+		if !strings.HasPrefix(submodule.url, "./") && !strings.HasPrefix(submodule.url, "../") {
+			return submodule.url
+		}
+		parentURL, err := getGitRemoteURL(parentRoot)
+		if err != nil {
+			return ""
+		}
+		return resolveSubmoduleURL(parentURL, submodule.url)
+	}
+	return ""
+}
+
+// resolveSubmoduleURL resolves a relative submodule URL against the parent's
+// remote, e.g. "../lib.git" against "git@github.com:acme/app.git" is
+// "git@github.com:acme/lib.git"
+func resolveSubmoduleURL(parentURL, rel string) string {
+	base := strings.TrimSuffix(parentURL, "/") + "/"
+	for {
+		switch {
+		case strings.HasPrefix(rel, "./"):
+			rel = rel[2:]
+		case strings.HasPrefix(rel, "../"):
+			rel = rel[3:]
+			trimmed := strings.TrimSuffix(base, "/")
+			if i := strings.LastIndexAny(trimmed, "/:"); i >= 0 {
+				base = trimmed[:i+1]
+			}
+		default:
+			return base + rel
+		}
+	}
+}
+
+// gitRemote is one configured remote of a repository
+type gitRemote struct {
+	name string
+	url  string
+}
+
+// gitRemotes caches each git root's remotes, since sync looks them up for every file
+var gitRemotes sync.Map // git root -> []gitRemote
+
+// listGitRemotes returns the remotes of the repository at gitRoot
+func listGitRemotes(gitRoot string) ([]gitRemote, error) {
+	if remotes, ok := gitRemotes.Load(gitRoot); ok {
+		return remotes.([]gitRemote), nil
+	}
+
+	gitDir, err := resolveGitDir(gitRoot)
+	if err != nil {
+		// A submodule that isn't checked out has no repository of its own
+		gitRemotes.Store(gitRoot, []gitRemote(nil))
+		return nil, nil
+	}
+
+	// Name the repository explicitly, so the parent's config is never read
+	// and GIT_DIR from a calling git hook doesn't point elsewhere
+	cmd := gitCommand("--git-dir", gitDir, "config", "--get-regexp", `^remote\..*\.url$`)
 	output, err := cmd.Output()
 	if err != nil {
-		return "", fmt.Errorf("failed to get git remote: %v", err)
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+			// No remotes at all
+			output, err = nil, nil
+		} else {
+			return nil, fmt.Errorf("failed to list git remotes: %v", err)
+		}
+	}
+
+	var remotes []gitRemote
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		key, url, ok := strings.Cut(line, " ")
+		if !ok {
+			continue
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(key, "remote."), ".url")
+		remotes = append(remotes, gitRemote{name: name, url: strings.TrimSpace(url)})
+	}
+	gitRemotes.Store(gitRoot, remotes)
+	return remotes, nil
+}
+
+// preferredRemoteNames returns the remotes whose URL identifies a repo, most
+// preferred first: git_remotes from the config file, or just origin
+func preferredRemoteNames() []string {
+	if config, err := loadConfig(); err == nil && len(config.GitRemotes) > 0 {
+		return config.GitRemotes
+	}
+	return []string{"origin"}
+}
+
+// getGitRemoteURL returns the URL of the first preferred remote the repo has
+func getGitRemoteURL(gitRoot string) (string, error) {
+	remotes, err := listGitRemotes(gitRoot)
+	if err != nil {
+		return "", err
 	}
+	names := preferredRemoteNames()
+	for _, name := range names {
+		for _, remote := range remotes {
+			if remote.name == name {
+				return remote.url, nil
+			}
+		}
+	}
+	// A submodule without the remote still has the URL it was added with
+	if url := submoduleURL(gitRoot); url != "" {
+		return url, nil
+	}
+	return "", fmt.Errorf("failed to get git remote: no %s remote", joinOr(names))
+}
 
-	return strings.TrimSpace(string(output)), nil
+// gitRemoteAliases returns the normalized URLs of the repo's remotes other
+// than repoID, so files stored under another remote of the same repo (e.g.
+// by a machine where origin is a fork) can be found
+func gitRemoteAliases(gitRoot, repoID string) []string {
+	remotes, err := listGitRemotes(gitRoot)
+	if err != nil {
+		return nil
+	}
+	var aliases []string
+	for _, remote := range remotes {
+		alias := branchRepoID(gitRoot, normalizeGitURL(remote.url))
+		if alias != repoID && !slices.Contains(aliases, alias) {
+			aliases = append(aliases, alias)
+		}
+	}
+	return aliases
+}
+
+// fileRemoteAliases returns gitRemoteAliases for the repo containing filePath
+func fileRemoteAliases(filePath, repoID string) []string {
+	gitRoot, err := findGitRoot(filepath.Dir(filePath))
+	if err != nil {
+		return nil
+	}
+	return gitRemoteAliases(gitRoot, repoID)
+}
+
+// storedRepoID returns the repo ID a local file is stored under: repoID, or
+// the first alias that already holds the file when repoID doesn't
+func storedRepoID(ctx context.Context, db Store, filePath, repoID, relativePath string) string {
+	aliases := fileRemoteAliases(filePath, repoID)
+	if len(aliases) == 0 {
+		return repoID
+	}
+	if record, err := db.GetEnvFileWithMetadata(ctx, repoID, relativePath); err != nil || record != nil {
+		return repoID
+	}
+	for _, alias := range aliases {
+		if record, err := db.GetEnvFileWithMetadata(ctx, alias, relativePath); err == nil && record != nil {
+			return alias
+		}
+	}
+	return repoID
 }
 
 // normalizeGitURL normalizes various git URL formats to a consistent format
@@ -122,9 +379,71 @@ func normalizeGitURL(url string) string {
 	return url
 }
 
+// GetRepoRoot returns the git root and normalized origin URL of the repo containing dir
+func GetRepoRoot(dir string) (string, string, error) {
+	gitRoot, err := findGitRoot(dir)
+	if err != nil {
+		return "", "", err
+	}
+
+	remoteURL, err := getGitRemoteURL(gitRoot)
+	if err != nil {
+		return "", "", err
+	}
+
+	return gitRoot, branchRepoID(gitRoot, normalizeGitURL(remoteURL)), nil
+}
+
+// branchSeparator joins a repo ID and the branch its files are stored for,
+// e.g. "github.com/acme/api#release". Normalized remote URLs never contain it.
+const branchSeparator = "#"
+
+// branchRepoID returns the repo ID files of the checkout at gitRoot are stored
+// under: repoID itself, or repoID and the checked-out branch if branch_repos
+// in the config file selects the repo. A detached HEAD uses plain repoID.
+func branchRepoID(gitRoot, repoID string) string {
+	config, err := loadConfig()
+	if err != nil || !matchAnyGlob(config.BranchRepos, repoID, shortenRepoID(repoID)) {
+		return repoID
+	}
+	branch := currentBranch(gitRoot)
+	if branch == "" {
+		logger.Debug("detached HEAD, syncing the repo's shared files", "repo", repoID)
+		return repoID
+	}
+	return repoID + branchSeparator + branch
+}
+
+// currentBranch returns the branch checked out at gitRoot, or "" on a
+// detached HEAD. Worktrees have a HEAD of their own in their git dir.
+func currentBranch(gitRoot string) string {
+	gitDir, err := resolveGitDir(gitRoot)
+	if err != nil {
+		return ""
+	}
+	data, err := os.ReadFile(filepath.Join(gitDir, "HEAD"))
+	if err != nil {
+		return ""
+	}
+	branch, ok := strings.CutPrefix(strings.TrimSpace(string(data)), "ref: refs/heads/")
+	if !ok {
+		return ""
+	}
+	return branch
+}
+
+// repoWithoutBranch returns repoID without the branch branchRepoID added
+func repoWithoutBranch(repoID string) string {
+	repo, _, _ := strings.Cut(repoID, branchSeparator)
+	return repo
+}
+
 // GetFileIdentifier returns a unique identifier for a file
 // Uses git remote + relative path for git repos, falls back to relative path from base
 func GetFileIdentifier(filePath, basePath string) (repoID string, relativePath string, err error) {
+	if filePath, err = normalizePath(filePath); err != nil {
+		return "", "", err
+	}
 	gitInfo, err := GetGitInfo(filePath)
 	if err != nil {
 		return "", "", err
@@ -136,11 +455,5 @@ func GetFileIdentifier(filePath, basePath string) (repoID string, relativePath s
 	}
 
 	// Fallback: use relative path from base directory
-	relPath, err := filepath.Rel(basePath, filePath)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to get relative path: %v", err)
-	}
-
-	// Use a special prefix for non-git files
-	return "__local__", filepath.ToSlash(relPath), nil
+	return localFileIdentifier(filePath, basePath)
 }
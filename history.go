@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// resolveEnvFileRef finds the stored env file matching a "<repo>/<path>" reference.
+// The repo part may be the full repo ID (github.com/user/repo), the shortened
+// form shown in sync output (user/repo), or "__local__"/"[local]" for non-git
+// files ("__local__:name"/"[local:name]" under a named base path).
+func resolveEnvFileRef(ctx context.Context, db Store, ref string) (*EnvFileRecord, error) {
+	records, err := db.ListEnvFiles(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ref = strings.TrimPrefix(ref, "/")
+	var matches []EnvFileRecord
+	for _, record := range records {
+		candidates := []string{
+			record.RepoID + "/" + record.RelativePath,
+			shortenRepoID(record.RepoID) + "/" + record.RelativePath,
+		}
+		for _, candidate := range candidates {
+			if candidate == ref {
+				matches = append(matches, record)
+				break
+			}
+		}
+	}
+
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("no env file matches %q", ref)
+	}
+	if len(matches) > 1 {
+		return nil, fmt.Errorf("%q is ambiguous, use the full repo ID (e.g. %s/%s)", ref, matches[0].RepoID, matches[0].RelativePath)
+	}
+
+	return &matches[0], nil
+}
+
+// showHistory lists the stored revisions of a file. With changes, each
+// revision is decrypted and the keys it added, changed or removed are shown,
+// with values masked unless showValues is set.
+func showHistory(ctx context.Context, dbConnStr, ref, password string, changes, showValues bool) error {
+	db, err := OpenStore(dbConnStr)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := db.InitSchema(ctx); err != nil {
+		return err
+	}
+
+	record, err := resolveEnvFileRef(ctx, db, ref)
+	if err != nil {
+		return err
+	}
+
+	versions, err := db.ListEnvFileVersions(ctx, record.RepoID, record.RelativePath)
+	if err != nil {
+		return err
+	}
+
+	if len(versions) == 0 {
+		fmt.Printf("No history recorded for %s (%s)\n", record.RelativePath, shortenRepoID(record.RepoID))
+		return nil
+	}
+
+	fmt.Printf("History for %s (%s):\n", record.RelativePath, shortenRepoID(record.RepoID))
+	for _, version := range versions {
+		current := ""
+		if version.FileHash == record.FileHash {
+			current = "  (current)"
+		}
+		fmt.Printf("  v%-4d modified %s  uploaded %s  hash %s%s\n", version.Version, version.FileModifiedAt, version.CreatedAt, version.FileHash[:min(12, len(version.FileHash))], current)
+	}
+
+	if !changes {
+		return nil
+	}
+	if !isDotenvName(path.Base(record.RelativePath)) {
+		fmt.Println("\nKey changes are only shown for .env files")
+		return nil
+	}
+
+	// Versions are newest first; compare each one with the one before it
+	docs := make([]*EnvDocument, len(versions))
+	for i, version := range versions {
+		stored, err := db.GetEnvFileVersion(ctx, record.RepoID, record.RelativePath, version.Version)
+		if err != nil {
+			return err
+		}
+		contents, err := openRevisionContents(ctx, db, record.RepoID, record.RelativePath, stored.Contents, password)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt version %d: %v (wrong password?)", version.Version, err)
+		}
+		docs[i] = ParseEnv(contents)
+	}
+
+	fmt.Println("\nChanges:")
+	for i, version := range versions {
+		previous := ParseEnv("")
+		if i+1 < len(docs) {
+			previous = docs[i+1]
+		}
+		fmt.Printf("  v%d\n", version.Version)
+		printKeyChanges(previous, docs[i], showValues)
+	}
+
+	return nil
+}
+
+// printKeyChanges lists keys added (+), changed (~) and removed (-) between two versions
+func printKeyChanges(before, after *EnvDocument, showValues bool) {
+	display := func(line EnvLine) string {
+		if showValues {
+			return line.Key + "=" + line.Value
+		}
+		return maskEnvLine(line)
+	}
+
+	changed := false
+	for _, key := range after.Keys() {
+		value, _ := after.Get(key)
+		if old, ok := before.Get(key); !ok {
+			fmt.Printf("    + %s\n", display(after.line(key)))
+		} else if old != value {
+			fmt.Printf("    ~ %s\n", display(after.line(key)))
+		} else {
+			continue
+		}
+		changed = true
+	}
+	for _, key := range before.Keys() {
+		if _, ok := after.Get(key); !ok {
+			fmt.Printf("    - %s\n", key)
+			changed = true
+		}
+	}
+	if !changed {
+		fmt.Println("    (no key changes)")
+	}
+}
+
+func rollbackEnvFile(ctx context.Context, dbConnStr, password, ref string, version int) error {
+	db, err := OpenStore(dbConnStr)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := db.InitSchema(ctx); err != nil {
+		return err
+	}
+
+	record, err := resolveEnvFileRef(ctx, db, ref)
+	if err != nil {
+		return err
+	}
+	if err := rollbackRecord(ctx, db, record, password, version); err != nil {
+		return err
+	}
+
+	fmt.Printf("✓ Rolled back %s (%s) to version %d\n", record.RelativePath, shortenRepoID(record.RepoID), version)
+	return nil
+}
+
+// rollbackRecord stores an earlier version of a file as its newest revision
+func rollbackRecord(ctx context.Context, db Store, record *EnvFileRecord, password string, version int) error {
+	target, err := db.GetEnvFileVersion(ctx, record.RepoID, record.RelativePath, version)
+	if err != nil {
+		return err
+	}
+
+	// Make sure the password is right before touching the current copy. A
+	// revision from before a move or rename is re-encrypted under the
+	// current name.
+	if _, err := openRevisionContents(ctx, db, record.RepoID, record.RelativePath, target.Contents, password); err != nil {
+		return fmt.Errorf("failed to decrypt version %d: %v (wrong password?)", version, err)
+	}
+	contents, err := rebindContents(ctx, db, record.RepoID, record.RelativePath, target.Contents, password)
+	if err != nil {
+		return err
+	}
+
+	// Stamp the restored revision with the current time so the next sync on
+	// every machine treats the remote copy as newer and pulls it down
+	fileModTime := storedNow()
+	if err := db.UpsertEnvFile(ctx, record.RepoID, record.RelativePath, contents, target.FileHash, fileModTime, target.FileMode); err != nil {
+		return err
+	}
+	entry := newAuditEntry(auditRollback, record.RepoID, record.RelativePath, record.FileHash, target.FileHash)
+	entry.Detail = fmt.Sprintf("version %d", version)
+	recordAudit(ctx, db, entry)
+	return nil
+}
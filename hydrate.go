@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// cloneRepo runs git clone and returns the absolute path of the new checkout.
+// Without dir, the checkout goes where git would put it.
+func cloneRepo(url, dir string) (string, error) {
+	if dir == "" {
+		name := strings.TrimRight(url, "/")
+		name = strings.TrimSuffix(name[strings.LastIndexAny(name, "/:")+1:], ".git")
+		if name == "" {
+			return "", fmt.Errorf("can't derive a directory from %s, pass one", url)
+		}
+		dir = name
+	}
+
+	cmd := gitCommand("clone", "--", url, dir)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("git clone failed: %v", err)
+	}
+	return filepath.Abs(dir)
+}
+
+// hydrateCheckout writes the stored files of the repo checked out at dir to
+// their places in the working tree and remembers them for sync. A local file
+// that differs from the stored copy is left alone unless force is set.
+func hydrateCheckout(ctx context.Context, dbConnStr, password, dir string, filter FileFilter, force bool) error {
+	root, repoID, err := GetRepoRoot(dir)
+	if err != nil {
+		return fmt.Errorf("%s is not a git checkout with a remote: %v", dir, err)
+	}
+	filter.Repos = append([]string{repoID}, gitRemoteAliases(root, repoID)...)
+
+	db, err := OpenStore(dbConnStr)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := db.InitSchema(ctx); err != nil {
+		return err
+	}
+
+	records, err := db.ListEnvFilesWithContents(ctx)
+	if err != nil {
+		return err
+	}
+	var selected []EnvFileRecord
+	for _, record := range records {
+		if filter.Match(record.RepoID, record.RelativePath) {
+			selected = append(selected, record)
+		}
+	}
+	if len(selected) == 0 {
+		fmt.Printf("No .env files found in database for %s\n", repoID)
+		return nil
+	}
+
+	state, err := loadSyncState()
+	if err != nil {
+		return err
+	}
+
+	var hydrated []string
+	skipped := 0
+	for _, record := range selected {
+		localPath := filepath.Join(root, filepath.FromSlash(record.RelativePath))
+		if rel, err := filepath.Rel(root, localPath); err != nil || strings.HasPrefix(rel, "..") {
+			logger.Warn("skipping path outside the repository", "path", record.RelativePath)
+			continue
+		}
+
+		if existing, err := os.ReadFile(localPath); err == nil && !force {
+			if envFileHash(localPath, existing, record.FileHash) != record.FileHash {
+				fmt.Printf("⚠ Skipped %s: the local copy differs (use --force to overwrite)\n", record.RelativePath)
+				skipped++
+				continue
+			}
+			fmt.Printf("✓ Up to date: %s\n", record.RelativePath)
+		} else {
+			if _, ok := downloadRecord(ctx, db, record, password, "", root, true); !ok {
+				continue
+			}
+			fmt.Printf("✓ Wrote %s\n", record.RelativePath)
+		}
+
+		// Both copies match now, so the next sync has a base to merge against
+		state.set(localPath, record.RepoID, record.RelativePath, record.FileHash)
+		hydrated = append(hydrated, localPath)
+	}
+
+	if err := state.save(); err != nil {
+		logger.Warn("failed to save sync state", "error", err)
+	}
+	if _, err := rememberEnvFiles(hydrated, nil); err != nil {
+		return err
+	}
+
+	fmt.Printf("\n✓ Hydrated %d of %d file(s) in %s\n", len(hydrated), len(selected), root)
+	if skipped > 0 {
+		fmt.Printf("  %d file(s) skipped because they differ locally\n", skipped)
+	}
+	return nil
+}
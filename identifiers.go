@@ -0,0 +1,508 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// encryptIDsParam is the connection string option that stores repo IDs and
+// relative paths as opaque tokens, e.g. libsql://host?authToken=...&encrypt_ids=true
+const encryptIDsParam = "encrypt_ids"
+
+// identifierPrefix marks an encrypted identifier
+const identifierPrefix = "id1."
+
+// identifierSalt is fixed so every machine derives the same identifier key
+// from the same password; tokens must be deterministic to be looked up
+var identifierSalt = []byte("env-sync identifiers v1")
+
+// splitEncryptIDs removes the encrypt_ids option from a connection string and
+// reports whether it was turned on
+func splitEncryptIDs(connString string) (string, bool) {
+	base, query, found := strings.Cut(connString, "?")
+	if !found {
+		return connString, false
+	}
+
+	enabled := false
+	var kept []string
+	for _, param := range strings.Split(query, "&") {
+		name, value, _ := strings.Cut(param, "=")
+		if name == encryptIDsParam {
+			enabled = value == "" || value == "true" || value == "1"
+			continue
+		}
+		kept = append(kept, param)
+	}
+	if len(kept) == 0 {
+		return base, enabled
+	}
+	return base + "?" + strings.Join(kept, "&"), enabled
+}
+
+// identifierCipher deterministically encrypts identifiers (AES-GCM with a
+// synthetic nonce, the HMAC of the plaintext), so equal names give equal
+// tokens that can still be decrypted for listing
+type identifierCipher struct {
+	aead   cipher.AEAD
+	macKey []byte
+}
+
+var identifierCiphers sync.Map // password -> *identifierCipher
+
+// newIdentifierCipher derives the identifier keys from the encryption password.
+// The Argon2 cost is fixed, independent of --kdf-*, for the same reason as the salt.
+func newIdentifierCipher(password string) (*identifierCipher, error) {
+	if c, ok := identifierCiphers.Load(password); ok {
+		return c.(*identifierCipher), nil
+	}
+
+	key := argon2.IDKey([]byte(password), identifierSalt, legacyKDF.Iterations, legacyKDF.MemoryKiB, legacyKDF.Threads, 64)
+	block, err := aes.NewCipher(key[:32])
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %v", err)
+	}
+
+	c := &identifierCipher{aead: aead, macKey: key[32:]}
+	identifierCiphers.Store(password, c)
+	return c, nil
+}
+
+// seal returns the token stored for an identifier. Empty strings stay empty.
+func (c *identifierCipher) seal(plaintext string) string {
+	if plaintext == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, c.macKey)
+	mac.Write([]byte(plaintext))
+	nonce := mac.Sum(nil)[:c.aead.NonceSize()]
+
+	sealed := c.aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return identifierPrefix + base64.RawURLEncoding.EncodeToString(sealed)
+}
+
+// open decrypts a token. Values written before encrypt_ids was turned on
+// aren't tokens and are returned unchanged.
+func (c *identifierCipher) open(token string) (string, error) {
+	if !strings.HasPrefix(token, identifierPrefix) {
+		return token, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(token, identifierPrefix))
+	if err != nil || len(data) < c.aead.NonceSize() {
+		return "", fmt.Errorf("invalid encrypted identifier")
+	}
+	nonce, ciphertext := data[:c.aead.NonceSize()], data[c.aead.NonceSize():]
+	plaintext, err := c.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt identifier (wrong password?)")
+	}
+	return string(plaintext), nil
+}
+
+// openRecord decrypts a record's repo ID and path in place
+func (c *identifierCipher) openRecord(repoID, relativePath *string) error {
+	var err error
+	if *repoID, err = c.open(*repoID); err != nil {
+		return err
+	}
+	*relativePath, err = c.open(*relativePath)
+	return err
+}
+
+// SealedStore stores repo IDs and relative paths encrypted, so the backend
+// only sees opaque tokens. Contents are encrypted as usual by the callers.
+type SealedStore struct {
+	inner Store
+	ids   *identifierCipher
+}
+
+// SealedDatabase is a SealedStore over a SQL database, which also encrypts
+// the repo IDs of team key grants and the audit log
+type SealedDatabase struct {
+	*SealedStore
+	db *Database
+}
+
+// newSealedStore wraps inner, deriving the identifier key from the
+// encryption password
+func newSealedStore(inner Store) (Store, error) {
+	password, err := resolvePassword("")
+	if err != nil {
+		return nil, err
+	}
+	if password == "" {
+		return nil, fmt.Errorf("%s needs the encryption password: use --password, --password-file or %s", encryptIDsParam, envPassword)
+	}
+	ids, err := newIdentifierCipher(password)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed := &SealedStore{inner: inner, ids: ids}
+	if db, ok := inner.(*Database); ok {
+		return &SealedDatabase{SealedStore: sealed, db: db}, nil
+	}
+	return sealed, nil
+}
+
+func (s *SealedStore) Close() error {
+	return s.inner.Close()
+}
+
+// InitSchema refuses a store with files written before encrypt_ids was
+// turned on: lookups by token wouldn't find them, so every one would be
+// stored a second time while the old names stayed readable
+func (s *SealedStore) InitSchema(ctx context.Context) error {
+	if err := s.inner.InitSchema(ctx); err != nil {
+		return err
+	}
+	records, err := s.inner.ListEnvFiles(ctx)
+	if err != nil {
+		return err
+	}
+	plain := 0
+	for _, record := range records {
+		if !isSealedIdentifier(record.RepoID) || !isSealedIdentifier(record.RelativePath) {
+			plain++
+		}
+	}
+	if plain > 0 {
+		return fmt.Errorf("%d file(s) in this store were written without %s; export them with the old connection string and import them into a fresh store with %s=true", plain, encryptIDsParam, encryptIDsParam)
+	}
+	return nil
+}
+
+// InitSchema also encrypts the identifiers of rows written before
+// encrypt_ids was turned on, which SQL databases can do in place
+func (s *SealedDatabase) InitSchema(ctx context.Context) error {
+	if err := s.db.InitSchema(ctx); err != nil {
+		return err
+	}
+	return s.db.sealPlainIdentifiers(ctx, s.ids)
+}
+
+// isSealedIdentifier reports whether a stored identifier is a token
+func isSealedIdentifier(value string) bool {
+	return value == "" || strings.HasPrefix(value, identifierPrefix)
+}
+
+// sealedColumns are the columns SealedDatabase stores tokens in, by table
+var sealedColumns = []struct {
+	table   string
+	columns []string
+}{
+	{"env_files", []string{"repo_id", "relative_path"}},
+	{"env_file_versions", []string{"repo_id", "relative_path"}},
+	{"env_file_tags", []string{"repo_id", "relative_path"}},
+	{"repo_keys", []string{"repo_id"}},
+	{"audit_log", []string{"repo_id", "relative_path", "detail"}},
+	{"ci_tokens", []string{"repo_id"}},
+}
+
+// sealPlainIdentifiers replaces the plaintext repo IDs, paths and audit
+// details of this namespace with their tokens, in one transaction. Once
+// done it finds nothing to do, so it runs on every start rather than as a
+// schema migration, which couldn't know the password. A file stored both
+// ways, by a machine without encrypt_ids, can't be converted and fails.
+func (db *Database) sealPlainIdentifiers(ctx context.Context, ids *identifierCipher) error {
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	sealed := 0
+	for _, t := range sealedColumns {
+		for _, column := range t.columns {
+			rows, err := tx.QueryContext(ctx, fmt.Sprintf(`SELECT DISTINCT %s FROM %s WHERE namespace = ? AND %s <> '' AND substr(%s, 1, %d) <> ?`,
+				column, t.table, column, column, len(identifierPrefix)), db.namespace, identifierPrefix)
+			if err != nil {
+				return fmt.Errorf("failed to read %s.%s: %v", t.table, column, err)
+			}
+			var plain []string
+			for rows.Next() {
+				var value string
+				if err := rows.Scan(&value); err != nil {
+					rows.Close()
+					return fmt.Errorf("failed to read %s.%s: %v", t.table, column, err)
+				}
+				plain = append(plain, value)
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return fmt.Errorf("failed to read %s.%s: %v", t.table, column, err)
+			}
+
+			for _, value := range plain {
+				result, err := tx.ExecContext(ctx, fmt.Sprintf(`UPDATE %s SET %s = ? WHERE namespace = ? AND %s = ?`, t.table, column, column),
+					ids.seal(value), db.namespace, value)
+				if err != nil {
+					return fmt.Errorf("failed to encrypt %s.%s %q, which may be stored both with and without %s: %v", t.table, column, value, encryptIDsParam, err)
+				}
+				n, _ := result.RowsAffected()
+				sealed += int(n)
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit: %v", err)
+	}
+	if sealed > 0 {
+		logger.Info("encrypted identifiers written before encrypt_ids was turned on", "values", sealed)
+	}
+	return nil
+}
+
+func (s *SealedStore) Ping() error {
+	if pool, ok := s.inner.(connPool); ok {
+		return pool.Ping()
+	}
+	return nil
+}
+
+func (s *SealedStore) SetPoolLimits(maxConns int, lifetime time.Duration) {
+	if pool, ok := s.inner.(connPool); ok {
+		pool.SetPoolLimits(maxConns, lifetime)
+	}
+}
+
+func (s *SealedStore) UpsertEnvFile(ctx context.Context, repoID, relativePath, encryptedContents, fileHash, fileModTime string, fileMode os.FileMode) error {
+	return s.inner.UpsertEnvFile(ctx, s.ids.seal(repoID), s.ids.seal(relativePath), encryptedContents, fileHash, fileModTime, fileMode)
+}
+
+func (s *SealedStore) UpsertEnvFiles(ctx context.Context, records []EnvFileRecord) error {
+	sealed := make([]EnvFileRecord, len(records))
+	for i, record := range records {
+		record.RepoID, record.RelativePath = s.ids.seal(record.RepoID), s.ids.seal(record.RelativePath)
+		sealed[i] = record
+	}
+	return s.inner.UpsertEnvFiles(ctx, sealed)
+}
+
+// UpsertEnvFileIf writes conditionally if the backend can; see upsertIfUnchanged
+func (s *SealedStore) UpsertEnvFileIf(ctx context.Context, record EnvFileRecord, base *EnvFileRecord) error {
+	repoID, relativePath := record.RepoID, record.RelativePath
+	record.RepoID, record.RelativePath = s.ids.seal(repoID), s.ids.seal(relativePath)
+	err := upsertIfUnchanged(ctx, s.inner, record, base)
+	var stale *staleWriteError
+	if errors.As(err, &stale) {
+		stale.repoID, stale.relativePath = repoID, relativePath
+	}
+	return err
+}
+
+func (s *SealedStore) GetEnvFile(ctx context.Context, repoID, relativePath string) (string, error) {
+	return s.inner.GetEnvFile(ctx, s.ids.seal(repoID), s.ids.seal(relativePath))
+}
+
+func (s *SealedStore) GetEnvFileWithMetadata(ctx context.Context, repoID, relativePath string) (*EnvFileRecord, error) {
+	record, err := s.inner.GetEnvFileWithMetadata(ctx, s.ids.seal(repoID), s.ids.seal(relativePath))
+	if err != nil || record == nil {
+		return record, err
+	}
+	record.RepoID, record.RelativePath = repoID, relativePath
+	return record, nil
+}
+
+func (s *SealedStore) ListEnvFiles(ctx context.Context) ([]EnvFileRecord, error) {
+	return s.openRecords(s.inner.ListEnvFiles(ctx))
+}
+
+func (s *SealedStore) ListEnvFilesWithContents(ctx context.Context) ([]EnvFileRecord, error) {
+	return s.openRecords(s.inner.ListEnvFilesWithContents(ctx))
+}
+
+// openRecords decrypts listed records and restores the repo/path order that
+// the tokens scrambled
+func (s *SealedStore) openRecords(records []EnvFileRecord, err error) ([]EnvFileRecord, error) {
+	if err != nil {
+		return nil, err
+	}
+	for i := range records {
+		if err := s.ids.openRecord(&records[i].RepoID, &records[i].RelativePath); err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].RepoID != records[j].RepoID {
+			return records[i].RepoID < records[j].RepoID
+		}
+		return records[i].RelativePath < records[j].RelativePath
+	})
+	return records, nil
+}
+
+func (s *SealedStore) ListEnvFileVersions(ctx context.Context, repoID, relativePath string) ([]EnvFileVersion, error) {
+	versions, err := s.inner.ListEnvFileVersions(ctx, s.ids.seal(repoID), s.ids.seal(relativePath))
+	if err != nil {
+		return nil, err
+	}
+	for i := range versions {
+		versions[i].RepoID, versions[i].RelativePath = repoID, relativePath
+	}
+	return versions, nil
+}
+
+func (s *SealedStore) GetEnvFileVersion(ctx context.Context, repoID, relativePath string, version int) (*EnvFileVersion, error) {
+	v, err := s.inner.GetEnvFileVersion(ctx, s.ids.seal(repoID), s.ids.seal(relativePath), version)
+	if err != nil {
+		return nil, err
+	}
+	v.RepoID, v.RelativePath = repoID, relativePath
+	return v, nil
+}
+
+func (s *SealedStore) RenameRepo(ctx context.Context, oldRepoID, newRepoID string) error {
+	return s.inner.RenameRepo(ctx, s.ids.seal(oldRepoID), s.ids.seal(newRepoID))
+}
+
+func (s *SealedStore) MoveEnvFile(ctx context.Context, repoID, oldPath, newPath string) error {
+	return s.inner.MoveEnvFile(ctx, s.ids.seal(repoID), s.ids.seal(oldPath), s.ids.seal(newPath))
+}
+
+func (s *SealedStore) DeleteRepo(ctx context.Context, repoID string) error {
+	return s.inner.DeleteRepo(ctx, s.ids.seal(repoID))
+}
+
+func (s *SealedStore) DeleteEnvFile(ctx context.Context, repoID, relativePath string) error {
+	return s.inner.DeleteEnvFile(ctx, s.ids.seal(repoID), s.ids.seal(relativePath))
+}
+
+func (s *SealedStore) DeleteEnvFileVersions(ctx context.Context, repoID, relativePath string, versions []int) error {
+	pruner, ok := s.inner.(historyPruner)
+	if !ok {
+		return fmt.Errorf("this backend doesn't support pruning history")
+	}
+	return pruner.DeleteEnvFileVersions(ctx, s.ids.seal(repoID), s.ids.seal(relativePath), versions)
+}
+
+func (s *SealedDatabase) AcquireSyncLock(ctx context.Context, holder string, lease time.Duration) (string, error) {
+	return s.db.AcquireSyncLock(ctx, holder, lease)
+}
+
+func (s *SealedDatabase) RefreshSyncLock(ctx context.Context, holder string, lease time.Duration) error {
+	return s.db.RefreshSyncLock(ctx, holder, lease)
+}
+
+func (s *SealedDatabase) ReleaseSyncLock(ctx context.Context, holder string) error {
+	return s.db.ReleaseSyncLock(ctx, holder)
+}
+
+func (s *SealedDatabase) AddUser(ctx context.Context, name, publicKey string) error {
+	return s.db.AddUser(ctx, name, publicKey)
+}
+
+func (s *SealedDatabase) ListUsers(ctx context.Context) ([]TeamUser, error) {
+	return s.db.ListUsers(ctx)
+}
+
+func (s *SealedDatabase) GetUser(ctx context.Context, name string) (*TeamUser, error) {
+	return s.db.GetUser(ctx, name)
+}
+
+func (s *SealedDatabase) GetUserByPublicKey(ctx context.Context, publicKey string) (*TeamUser, error) {
+	return s.db.GetUserByPublicKey(ctx, publicKey)
+}
+
+func (s *SealedDatabase) RepoHasKey(ctx context.Context, repoID string) (bool, error) {
+	return s.db.RepoHasKey(ctx, s.ids.seal(repoID))
+}
+
+func (s *SealedDatabase) GetRepoKeyGrant(ctx context.Context, repoID, userName string) (string, error) {
+	return s.db.GetRepoKeyGrant(ctx, s.ids.seal(repoID), userName)
+}
+
+func (s *SealedDatabase) PutRepoKeyGrant(ctx context.Context, repoID, userName, wrappedKey string) error {
+	return s.db.PutRepoKeyGrant(ctx, s.ids.seal(repoID), userName, wrappedKey)
+}
+
+func (s *SealedDatabase) DeleteRepoKeyGrant(ctx context.Context, repoID, userName string) error {
+	return s.db.DeleteRepoKeyGrant(ctx, s.ids.seal(repoID), userName)
+}
+
+func (s *SealedDatabase) ListRepoKeyGrants(ctx context.Context, repoID string) ([]string, error) {
+	return s.db.ListRepoKeyGrants(ctx, s.ids.seal(repoID))
+}
+
+func (s *SealedDatabase) ListAllRepoKeyGrants(ctx context.Context) ([]RepoKeyGrant, error) {
+	grants, err := s.db.ListAllRepoKeyGrants(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range grants {
+		if grants[i].RepoID, err = s.ids.open(grants[i].RepoID); err != nil {
+			return nil, err
+		}
+	}
+	return grants, nil
+}
+
+func (s *SealedDatabase) ShareRepoFiles(ctx context.Context, repoID, userName, wrappedKey string, files []EnvFileRecord, revisions []EnvFileVersion) error {
+	sealedFiles := make([]EnvFileRecord, len(files))
+	for i, file := range files {
+		file.RepoID, file.RelativePath = s.ids.seal(file.RepoID), s.ids.seal(file.RelativePath)
+		sealedFiles[i] = file
+	}
+	sealedRevisions := make([]EnvFileVersion, len(revisions))
+	for i, revision := range revisions {
+		revision.RepoID, revision.RelativePath = s.ids.seal(revision.RepoID), s.ids.seal(revision.RelativePath)
+		sealedRevisions[i] = revision
+	}
+	return s.db.ShareRepoFiles(ctx, s.ids.seal(repoID), userName, wrappedKey, sealedFiles, sealedRevisions)
+}
+
+// AddAuditEntries encrypts the repo, path and detail (which may name another
+// repo or path) of each entry
+func (s *SealedDatabase) AddAuditEntries(ctx context.Context, entries []AuditEntry) error {
+	sealed := make([]AuditEntry, len(entries))
+	for i, e := range entries {
+		e.RepoID, e.RelativePath, e.Detail = s.ids.seal(e.RepoID), s.ids.seal(e.RelativePath), s.ids.seal(e.Detail)
+		sealed[i] = e
+	}
+	return s.db.AddAuditEntries(ctx, sealed)
+}
+
+func (s *SealedDatabase) ListAuditEntries(ctx context.Context, since string) ([]AuditEntry, error) {
+	entries, err := s.db.ListAuditEntries(ctx, since)
+	if err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		if err := s.ids.openRecord(&entries[i].RepoID, &entries[i].RelativePath); err != nil {
+			return nil, err
+		}
+		if entries[i].Detail, err = s.ids.open(entries[i].Detail); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// databaseOf returns the SQL database behind db, if there is one
+func databaseOf(db Store) *Database {
+	switch s := db.(type) {
+	case *Database:
+		return s
+	case *SealedDatabase:
+		return s.db
+	}
+	return nil
+}
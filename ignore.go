@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// ignoreFileName is read from the scan root and from any directory below it
+const ignoreFileName = ".envsyncignore"
+
+// gitIgnoreFileName rules are applied to directories only, so build output is
+// skipped while .env files a repo ignores (as it should) are still found
+const gitIgnoreFileName = ".gitignore"
+
+// ignoreRule is one line of a .envsyncignore or .gitignore file
+type ignoreRule struct {
+	base    string // Directory containing the ignore file
+	regex   *regexp.Regexp
+	negate  bool
+	dirOnly bool
+	fromGit bool // Loaded from .gitignore
+}
+
+// ignoreMatcher evaluates .gitignore and .envsyncignore files found while
+// walking a scan root. It is safe for concurrent use.
+type ignoreMatcher struct {
+	root  string
+	mu    sync.Mutex
+	rules map[string][]ignoreRule // Rules keyed by the directory they were loaded from
+}
+
+func newIgnoreMatcher(root string) *ignoreMatcher {
+	m := &ignoreMatcher{root: filepath.Clean(root), rules: make(map[string][]ignoreRule)}
+	m.loadDir(m.root)
+	return m
+}
+
+// loadDir returns the rules of dir/.gitignore and dir/.envsyncignore, reading
+// them the first time. The .envsyncignore rules come last so they can
+// re-include what git ignores.
+func (m *ignoreMatcher) loadDir(dir string) []ignoreRule {
+	dir = filepath.Clean(dir)
+	m.mu.Lock()
+	rules, ok := m.rules[dir]
+	m.mu.Unlock()
+	if ok {
+		return rules
+	}
+
+	// Two walkers may read the same files; both get the same rules
+	rules = readIgnoreFile(dir, gitIgnoreFileName)
+	for i := range rules {
+		rules[i].fromGit = true
+	}
+	rules = append(rules, readIgnoreFile(dir, ignoreFileName)...)
+
+	m.mu.Lock()
+	m.rules[dir] = rules
+	m.mu.Unlock()
+	return rules
+}
+
+func readIgnoreFile(dir, name string) []ignoreRule {
+	f, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var rules []ignoreRule
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if rule, ok := parseIgnoreLine(dir, scanner.Text()); ok {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+func parseIgnoreLine(base, line string) (ignoreRule, bool) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignoreRule{}, false
+	}
+
+	rule := ignoreRule{base: base}
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\`) {
+		line = line[1:] // Escaped leading "!" or "#"
+	}
+
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimSuffix(line, "/")
+	}
+	if line == "" {
+		return ignoreRule{}, false
+	}
+
+	// Patterns containing a slash are relative to the ignore file's directory,
+	// others match a name at any depth
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+
+	expr := globToRegex(line)
+	if anchored {
+		expr = "^" + expr + "$"
+	} else {
+		expr = "(^|/)" + expr + "$"
+	}
+
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return ignoreRule{}, false
+	}
+	rule.regex = re
+	return rule, true
+}
+
+// globToRegex converts a gitignore glob (with ** support) to a regular expression
+func globToRegex(glob string) string {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			b.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "/**"):
+			b.WriteString("(/.*)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i:], ']')
+			if end < 0 {
+				b.WriteString(regexp.QuoteMeta(string(c)))
+				continue
+			}
+			class := glob[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i += end
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
+
+// Ignored reports whether path is excluded by the ignore files between the
+// scan root and path. Deeper files override shallower ones, and later lines
+// override earlier ones, as in gitignore. .gitignore rules only skip directories.
+func (m *ignoreMatcher) Ignored(path string, isDir bool) bool {
+	path = filepath.Clean(path)
+
+	// Collect ancestor directories from the root down to path's parent
+	var dirs []string
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		dirs = append([]string{dir}, dirs...)
+		if dir == m.root || dir == filepath.Dir(dir) {
+			break
+		}
+	}
+
+	ignored := false
+	for _, dir := range dirs {
+		rules := m.loadDir(dir)
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		rel = filepath.ToSlash(rel)
+		for _, rule := range rules {
+			if (rule.dirOnly || rule.fromGit) && !isDir {
+				continue
+			}
+			if rule.regex.MatchString(rel) {
+				ignored = !rule.negate
+			}
+		}
+	}
+	return ignored
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Tools 'env-sync import --from' reads secrets from
+const (
+	importFrom1Password   = "1password"
+	importFromBitwarden   = "bitwarden"
+	importFromDotenvVault = "dotenv-vault"
+)
+
+// importOptions says where 'env-sync import --from' reads and what it creates
+type importOptions struct {
+	From   string
+	RepoID string   // Repo the files are stored under (--into)
+	Items  []string // 1Password or Bitwarden items, as name[=path]
+	Vault  string   // 1Password vault to look items up in
+	Input  string   // Bitwarden JSON export, or the .env.vault file
+	Keys   []string // dotenv-vault DOTENV_KEYs, one per environment
+	Filter FileFilter
+}
+
+// importedFile is one env file built from another tool's secrets
+type importedFile struct {
+	RelativePath string
+	Contents     string
+	Source       string // Where it came from, for output and the audit log
+}
+
+// envKeyName is what an item field must be called to become a variable
+var envKeyName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// importFromTool creates env files from 1Password items, Bitwarden items or
+// a dotenv-vault file. Files already stored under the same path are replaced
+// (their old contents stay in history).
+func importFromTool(ctx context.Context, dbConnStr, password string, opts importOptions) error {
+	var files []importedFile
+	var err error
+	switch opts.From {
+	case importFrom1Password:
+		files, err = readOnePasswordItems(ctx, opts)
+	case importFromBitwarden:
+		files, err = readBitwardenItems(ctx, opts)
+	case importFromDotenvVault:
+		files, err = readDotenvVault(opts)
+	default:
+		return usageErrorf("unknown --from %q (use 1password, bitwarden or dotenv-vault)", opts.From)
+	}
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]string)
+	kept := files[:0]
+	for _, file := range files {
+		if other, ok := seen[file.RelativePath]; ok {
+			return fmt.Errorf("%s and %s would both be imported as %s; give one another path with --item name=path", other, file.Source, file.RelativePath)
+		}
+		seen[file.RelativePath] = file.Source
+		if opts.Filter.Match(opts.RepoID, file.RelativePath) {
+			kept = append(kept, file)
+		}
+	}
+	if len(kept) == 0 {
+		return fmt.Errorf("nothing to import matches the given filters")
+	}
+
+	db, err := OpenStore(dbConnStr)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := db.InitSchema(ctx); err != nil {
+		return err
+	}
+
+	records := make([]EnvFileRecord, 0, len(kept))
+	for _, file := range kept {
+		encrypted, err := sealEnvFile(ctx, db, opts.RepoID, file.RelativePath, file.Contents, password)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt %s: %v", file.RelativePath, err)
+		}
+		records = append(records, EnvFileRecord{
+			RepoID:         opts.RepoID,
+			RelativePath:   file.RelativePath,
+			Contents:       encrypted,
+			FileHash:       HashFile(file.Contents),
+			FileModifiedAt: storedNow(),
+		})
+	}
+
+	previousHashes := storedHashes(ctx, db)
+	if err := db.UpsertEnvFiles(ctx, records); err != nil {
+		return err
+	}
+
+	entries := make([]AuditEntry, 0, len(kept))
+	for i, file := range kept {
+		record := records[i]
+		entry := newAuditEntry(auditImport, record.RepoID, record.RelativePath, previousHashes[auditKey(record.RepoID, record.RelativePath)], record.FileHash)
+		entry.Detail = "from " + file.Source
+		entries = append(entries, entry)
+		fmt.Printf("✓ Imported %s → %s (%s)\n", file.Source, record.RelativePath, shortenRepoID(record.RepoID))
+	}
+	recordAudit(ctx, db, entries...)
+
+	fmt.Printf("✓ Imported %d file(s) from %s\n", len(kept), opts.From)
+	return nil
+}
+
+// importItemTarget splits an --item argument into the item name and the
+// path of the file it becomes, .env unless given as name=path
+func importItemTarget(arg string) (string, string, error) {
+	name, relativePath := arg, ".env"
+	if i := strings.LastIndex(arg, "="); i > 0 {
+		name, relativePath = arg[:i], arg[i+1:]
+	}
+	relativePath = path.Clean(strings.TrimPrefix(relativePath, "./"))
+	if relativePath == "." || path.IsAbs(relativePath) || relativePath == ".." || strings.HasPrefix(relativePath, "../") {
+		return "", "", usageErrorf("invalid path in --item %q: use a path inside the repo, e.g. name=.env.production", arg)
+	}
+	return name, relativePath, nil
+}
+
+// itemField is a named value of a 1Password or Bitwarden item
+type itemField struct {
+	Name  string
+	Value string
+}
+
+// itemContents builds a .env file from an item: its notes, if they hold a
+// pasted .env file, then every field named like a variable
+func itemContents(source, notes string, fields []itemField) (string, error) {
+	doc := ParseEnv("")
+	if len(ParseEnv(notes).Keys()) > 0 {
+		doc = ParseEnv(notes)
+		doc.TrailingNewline = true
+	}
+	for _, field := range fields {
+		if field.Name == "" || field.Value == "" {
+			continue
+		}
+		if !envKeyName.MatchString(field.Name) {
+			logger.Warn("skipping field that isn't a valid variable name", "item", source, "field", field.Name)
+			continue
+		}
+		doc.Set(field.Name, dotenvQuote(field.Value))
+	}
+	if len(doc.Keys()) == 0 {
+		return "", fmt.Errorf("%s has no fields named like variables (e.g. DATABASE_URL) and no .env file in its notes", source)
+	}
+	return doc.Render(), nil
+}
+
+// dotenvQuote quotes a value so .env parsers read it back unchanged: plain
+// values as they are, others single-quoted, and those that can't be
+// single-quoted double-quoted with escapes
+func dotenvQuote(value string) string {
+	if !strings.ContainsAny(value, " \t\"'#$\\`\n\r") {
+		return value
+	}
+	if !strings.ContainsAny(value, "'\n\r") {
+		return "'" + value + "'"
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "$", `\$`).Replace(value) + `"`
+}
+
+// runImportTool runs a password manager's CLI and returns what it printed
+func runImportTool(ctx context.Context, name string, args ...string) ([]byte, error) {
+	if _, err := exec.LookPath(name); err != nil {
+		return nil, fmt.Errorf("%s not found in PATH: %v", name, err)
+	}
+	cmd := exec.CommandContext(ctx, name, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = err.Error()
+		}
+		return nil, fmt.Errorf("%s %s failed: %s", name, strings.Join(args[:min(len(args), 3)], " "), msg)
+	}
+	return out, nil
+}
+
+// onePasswordItem is the part of 'op item get --format json' that is imported
+type onePasswordItem struct {
+	Title  string `json:"title"`
+	Fields []struct {
+		Label   string `json:"label"`
+		Value   string `json:"value"`
+		Purpose string `json:"purpose"`
+	} `json:"fields"`
+}
+
+// readOnePasswordItems reads each --item with the 1Password CLI, which must
+// be signed in ('op signin' or OP_SERVICE_ACCOUNT_TOKEN)
+func readOnePasswordItems(ctx context.Context, opts importOptions) ([]importedFile, error) {
+	if len(opts.Items) == 0 {
+		return nil, usageErrorf("--item is required with --from 1password")
+	}
+	var files []importedFile
+	for _, arg := range opts.Items {
+		name, relativePath, err := importItemTarget(arg)
+		if err != nil {
+			return nil, err
+		}
+		args := []string{"item", "get", name, "--format", "json"}
+		if opts.Vault != "" {
+			args = append(args, "--vault", opts.Vault)
+		}
+		out, err := runImportTool(ctx, "op", args...)
+		if err != nil {
+			return nil, err
+		}
+		var item onePasswordItem
+		if err := json.Unmarshal(out, &item); err != nil {
+			return nil, fmt.Errorf("invalid 1Password item %s: %v", name, err)
+		}
+
+		source := fmt.Sprintf("1password item %q", name)
+		var notes string
+		var fields []itemField
+		for _, field := range item.Fields {
+			if field.Purpose == "NOTES" {
+				notes = field.Value
+				continue
+			}
+			fields = append(fields, itemField{Name: field.Label, Value: field.Value})
+		}
+		contents, err := itemContents(source, notes, fields)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, importedFile{RelativePath: relativePath, Contents: contents, Source: source})
+	}
+	return files, nil
+}
+
+// bitwardenItem is the part of a Bitwarden item that is imported, as printed
+// by 'bw get item' or found in an unencrypted JSON export
+type bitwardenItem struct {
+	Name   string `json:"name"`
+	Notes  string `json:"notes"`
+	Fields []struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	} `json:"fields"`
+}
+
+// readBitwardenItems reads each --item from a JSON export given with
+// --input, or else with the Bitwarden CLI, which must be unlocked (BW_SESSION)
+func readBitwardenItems(ctx context.Context, opts importOptions) ([]importedFile, error) {
+	if len(opts.Items) == 0 {
+		return nil, usageErrorf("--item is required with --from bitwarden")
+	}
+
+	var exported []bitwardenItem
+	if opts.Input != "" {
+		data, err := os.ReadFile(opts.Input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", opts.Input, err)
+		}
+		var export struct {
+			Encrypted bool            `json:"encrypted"`
+			Items     []bitwardenItem `json:"items"`
+		}
+		if err := json.Unmarshal(data, &export); err != nil {
+			return nil, fmt.Errorf("invalid Bitwarden export %s: %v", opts.Input, err)
+		}
+		if export.Encrypted {
+			return nil, fmt.Errorf("%s is an encrypted export; export as plain JSON, or leave out --input to use the bw CLI", opts.Input)
+		}
+		exported = export.Items
+	}
+
+	var files []importedFile
+	for _, arg := range opts.Items {
+		name, relativePath, err := importItemTarget(arg)
+		if err != nil {
+			return nil, err
+		}
+
+		var item *bitwardenItem
+		if opts.Input != "" {
+			for i := range exported {
+				if exported[i].Name == name {
+					if item != nil {
+						return nil, fmt.Errorf("%s has more than one item named %q", opts.Input, name)
+					}
+					item = &exported[i]
+				}
+			}
+			if item == nil {
+				return nil, fmt.Errorf("%s has no item named %q", opts.Input, name)
+			}
+		} else {
+			out, err := runImportTool(ctx, "bw", "get", "item", name)
+			if err != nil {
+				return nil, fmt.Errorf("%v (run 'bw unlock' and export BW_SESSION first)", err)
+			}
+			item = &bitwardenItem{}
+			if err := json.Unmarshal(out, item); err != nil {
+				return nil, fmt.Errorf("invalid Bitwarden item %s: %v", name, err)
+			}
+		}
+
+		source := fmt.Sprintf("bitwarden item %q", name)
+		fields := make([]itemField, len(item.Fields))
+		for i, field := range item.Fields {
+			fields[i] = itemField{Name: field.Name, Value: field.Value}
+		}
+		contents, err := itemContents(source, item.Notes, fields)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, importedFile{RelativePath: relativePath, Contents: contents, Source: source})
+	}
+	return files, nil
+}
+
+// readDotenvVault decrypts the environments of a .env.vault file, one per
+// DOTENV_KEY (from --key, or comma-separated in DOTENV_KEY). The development
+// environment becomes .env and every other one .env.<environment>, the
+// files dotenv-vault built them from.
+func readDotenvVault(opts importOptions) ([]importedFile, error) {
+	input := opts.Input
+	if input == "" {
+		input = ".env.vault"
+	}
+	keys := opts.Keys
+	if len(keys) == 0 && os.Getenv("DOTENV_KEY") != "" {
+		keys = strings.Split(os.Getenv("DOTENV_KEY"), ",")
+	}
+	if len(keys) == 0 {
+		return nil, usageErrorf("--key or DOTENV_KEY is required with --from dotenv-vault (run 'npx dotenv-vault keys' to list them)")
+	}
+
+	data, err := os.ReadFile(input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", input, err)
+	}
+	vault := ParseEnv(string(data))
+
+	var files []importedFile
+	for _, dotenvKey := range keys {
+		environment, key, err := parseDotenvKey(strings.TrimSpace(dotenvKey))
+		if err != nil {
+			return nil, err
+		}
+		name := "DOTENV_VAULT_" + strings.ToUpper(environment)
+		encrypted, ok := vault.Get(name)
+		if !ok {
+			return nil, fmt.Errorf("%s has no %s environment (%s)", input, environment, name)
+		}
+		contents, err := decryptDotenvVault(unquoteEnvValue(encrypted), key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt the %s environment of %s: %v (wrong DOTENV_KEY?)", environment, input, err)
+		}
+
+		relativePath := ".env"
+		if environment != "development" {
+			relativePath = ".env." + environment
+		}
+		files = append(files, importedFile{RelativePath: relativePath, Contents: contents, Source: fmt.Sprintf("%s (%s)", input, environment)})
+	}
+	return files, nil
+}
+
+// parseDotenvKey reads the environment and AES key out of a DOTENV_KEY,
+// dotenv://:key_<64 hex digits>@dotenv.org/vault/.env.vault?environment=production
+func parseDotenvKey(dotenvKey string) (string, []byte, error) {
+	u, err := url.Parse(dotenvKey)
+	if err != nil || u.Scheme != "dotenv" || u.User == nil {
+		return "", nil, fmt.Errorf("invalid DOTENV_KEY: expected dotenv://:key_...@dotenv.org/vault/.env.vault?environment=...")
+	}
+	secret, _ := u.User.Password()
+	environment := u.Query().Get("environment")
+	if environment == "" {
+		return "", nil, fmt.Errorf("invalid DOTENV_KEY: missing environment")
+	}
+	key, err := hex.DecodeString(strings.TrimPrefix(secret, "key_"))
+	if err != nil || len(key) != 32 {
+		return "", nil, fmt.Errorf("invalid DOTENV_KEY for %s: the key must be 64 hex digits", environment)
+	}
+	return environment, key, nil
+}
+
+// decryptDotenvVault opens one environment of a .env.vault: base64 of a
+// 12-byte nonce followed by the AES-256-GCM ciphertext and tag
+func decryptDotenvVault(encrypted string, key []byte) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return "", fmt.Errorf("invalid base64: %v", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	if len(data) < gcm.NonceSize()+gcm.Overhead() {
+		return "", fmt.Errorf("ciphertext too short")
+	}
+	plaintext, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strconv"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// passwordPrefix marks password-encrypted contents whose header records the
+// Argon2 parameters used. Contents without a prefix use legacyKDF.
+const passwordPrefix = "pw:"
+
+// passwordFormatVersion is the first header byte after passwordPrefix
+const passwordFormatVersion = 1
+
+// kdfHeaderSize is version(1) + iterations(4) + memory KiB(4) + threads(1)
+const kdfHeaderSize = 10
+
+// Upper bounds accepted when decrypting, so a crafted header can't make us
+// allocate unbounded memory or spin forever
+const (
+	maxKDFMemoryKiB  = 4 * 1024 * 1024
+	maxKDFIterations = 64
+)
+
+// kdfParams are the Argon2id cost parameters for deriving a key from a password
+type kdfParams struct {
+	Iterations uint32
+	MemoryKiB  uint32
+	Threads    uint8
+}
+
+// legacyKDF are the parameters of records written before the header existed
+var legacyKDF = kdfParams{Iterations: 1, MemoryKiB: 64 * 1024, Threads: 4}
+
+// Global --kdf-memory (MiB) and --kdf-iterations flags, falling back to
+// ENV_SYNC_KDF_MEMORY and ENV_SYNC_KDF_ITERATIONS
+var (
+	kdfMemory     string
+	kdfIterations string
+)
+
+// encryptKDF is used for new password encryptions, set by setupKDF
+var encryptKDF = legacyKDF
+
+// setupKDF applies the configured Argon2 cost to new encryptions
+func setupKDF() error {
+	if kdfMemory == "" {
+		kdfMemory = os.Getenv("ENV_SYNC_KDF_MEMORY")
+	}
+	if kdfIterations == "" {
+		kdfIterations = os.Getenv("ENV_SYNC_KDF_ITERATIONS")
+	}
+
+	params := legacyKDF
+	if kdfMemory != "" {
+		mib, err := strconv.ParseUint(kdfMemory, 10, 32)
+		if err != nil || mib < 8 || mib*1024 > maxKDFMemoryKiB {
+			return fmt.Errorf("invalid --kdf-memory %q (use MiB between 8 and %d)", kdfMemory, maxKDFMemoryKiB/1024)
+		}
+		params.MemoryKiB = uint32(mib * 1024)
+	}
+	if kdfIterations != "" {
+		n, err := strconv.ParseUint(kdfIterations, 10, 32)
+		if err != nil || n < 1 || n > maxKDFIterations {
+			return fmt.Errorf("invalid --kdf-iterations %q (use 1 to %d)", kdfIterations, maxKDFIterations)
+		}
+		params.Iterations = uint32(n)
+	}
+
+	encryptKDF = params
+	return nil
+}
+
+// deriveKey derives a 32-byte key from a password using Argon2id
+func deriveKey(password string, salt []byte, params kdfParams) []byte {
+	return argon2.IDKey([]byte(password), salt, params.Iterations, params.MemoryKiB, params.Threads, 32)
+}
+
+func encodeKDFHeader(params kdfParams) []byte {
+	header := make([]byte, kdfHeaderSize)
+	header[0] = passwordFormatVersion
+	binary.BigEndian.PutUint32(header[1:5], params.Iterations)
+	binary.BigEndian.PutUint32(header[5:9], params.MemoryKiB)
+	header[9] = params.Threads
+	return header
+}
+
+func decodeKDFHeader(data []byte) (kdfParams, error) {
+	if len(data) < kdfHeaderSize {
+		return kdfParams{}, fmt.Errorf("invalid encrypted data: too short")
+	}
+	if data[0] != passwordFormatVersion {
+		return kdfParams{}, fmt.Errorf("unsupported encryption format version %d (upgrade env-sync)", data[0])
+	}
+
+	params := kdfParams{
+		Iterations: binary.BigEndian.Uint32(data[1:5]),
+		MemoryKiB:  binary.BigEndian.Uint32(data[5:9]),
+		Threads:    data[9],
+	}
+	if params.Iterations < 1 || params.Iterations > maxKDFIterations ||
+		params.MemoryKiB < 8*uint32(params.Threads) || params.MemoryKiB > maxKDFMemoryKiB || params.Threads == 0 {
+		return kdfParams{}, fmt.Errorf("unsupported key derivation parameters in encrypted data")
+	}
+	return params, nil
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	cloudkms "google.golang.org/api/cloudkms/v1"
+)
+
+// kmsPrefix marks contents encrypted under a random data key that a cloud
+// KMS wrapped (envelope encryption). After the prefix, base64 of: the
+// uvarint length of the key URI, the URI, the uvarint length of the wrapped
+// data key, the wrapped key, then the AES-GCM nonce and ciphertext, with
+// everything before the nonce authenticated as additional data.
+const kmsPrefix = "kms:"
+
+// envKMSKey overrides kms_key in the config
+const envKMSKey = "ENV_SYNC_KMS_KEY"
+
+// kmsTimeout bounds each call to the KMS
+const kmsTimeout = 30 * time.Second
+
+// kmsContext is bound to every data key the KMS wraps, so the wrapped keys
+// can't be unwrapped through the KMS for another purpose. IAM policies can
+// require it too (kms:EncryptionContext:app on AWS).
+const kmsContext = "env-sync"
+
+// kmsKeyURI returns the KMS key new copies are encrypted under, or "" to
+// use age recipients or the password
+func kmsKeyURI() string {
+	if keyURI := strings.TrimSpace(os.Getenv(envKMSKey)); keyURI != "" {
+		return keyURI
+	}
+	config, err := loadConfig()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(config.KMSKey)
+}
+
+// keyWrapper wraps and unwraps data keys with a key that never leaves the KMS
+type keyWrapper interface {
+	wrapKey(ctx context.Context, dataKey []byte) ([]byte, error)
+	unwrapKey(ctx context.Context, wrapped []byte) ([]byte, error)
+}
+
+var (
+	keyWrappersMu sync.Mutex
+	keyWrappers   = make(map[string]keyWrapper) // key URI -> client
+
+	// unwrappedKeys caches data keys by their wrapped form, so reading a copy
+	// twice in one run doesn't ask the KMS twice
+	unwrappedKeys sync.Map
+)
+
+// openKeyWrapper returns the client for a key URI:
+//
+//	awskms://<key ID, ARN or alias/name>[?region=eu-west-1]
+//	gcpkms://projects/<p>/locations/<l>/keyRings/<r>/cryptoKeys/<k>
+func openKeyWrapper(ctx context.Context, keyURI string) (keyWrapper, error) {
+	keyWrappersMu.Lock()
+	defer keyWrappersMu.Unlock()
+	if wrapper, ok := keyWrappers[keyURI]; ok {
+		return wrapper, nil
+	}
+
+	var wrapper keyWrapper
+	var err error
+	if keyID, ok := strings.CutPrefix(keyURI, "awskms://"); ok {
+		wrapper, err = newAWSKeyWrapper(ctx, keyID)
+	} else if name, ok := strings.CutPrefix(keyURI, "gcpkms://"); ok {
+		wrapper, err = newGCPKeyWrapper(ctx, name)
+	} else {
+		err = fmt.Errorf("unsupported KMS key %q (use awskms://... or gcpkms://...)", keyURI)
+	}
+	if err != nil {
+		return nil, err
+	}
+	keyWrappers[keyURI] = wrapper
+	return wrapper, nil
+}
+
+// kmsProvider encrypts every copy under its own random data key, wrapped by
+// the KMS key. Copies name the key that wrapped them, so reading one needs
+// access to that key rather than the password or kms_key.
+type kmsProvider struct {
+	keyURI string
+}
+
+func (p kmsProvider) seal(payload []byte) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), kmsTimeout)
+	defer cancel()
+	wrapper, err := openKeyWrapper(ctx, p.keyURI)
+	if err != nil {
+		return "", err
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return "", fmt.Errorf("failed to generate data key: %v", err)
+	}
+	wrapped, err := wrapper.wrapKey(ctx, dataKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to wrap data key with %s: %v", p.keyURI, err)
+	}
+
+	header := binary.AppendUvarint(nil, uint64(len(p.keyURI)))
+	header = append(header, p.keyURI...)
+	header = binary.AppendUvarint(header, uint64(len(wrapped)))
+	header = append(header, wrapped...)
+
+	gcm, err := newDataKeyGCM(dataKey)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	ciphertext := gcm.Seal(nonce, nonce, payload, header)
+	return kmsPrefix + base64.StdEncoding.EncodeToString(append(header, ciphertext...)), nil
+}
+
+func (kmsProvider) open(encryptedData string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(encryptedData, kmsPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode base64: %v", err)
+	}
+	keyURI, rest, err := readKMSField(data)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, rest, err := readKMSField(rest)
+	if err != nil {
+		return nil, err
+	}
+	header, data := data[:len(data)-len(rest)], rest
+
+	dataKey, err := unwrapKMSDataKey(string(keyURI), wrapped)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newDataKeyGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	nonceSize := gcm.NonceSize()
+	if len(data) < nonceSize {
+		return nil, fmt.Errorf("invalid ciphertext: too short")
+	}
+	nonce, ciphertext := data[:nonceSize], data[nonceSize:]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt: %v", err)
+	}
+	return plaintext, nil
+}
+
+// readKMSField splits a length-prefixed field off the front of data
+func readKMSField(data []byte) ([]byte, []byte, error) {
+	size, n := binary.Uvarint(data)
+	if n <= 0 || size > uint64(len(data)-n) {
+		return nil, nil, fmt.Errorf("invalid KMS-encrypted contents")
+	}
+	return data[n : n+int(size)], data[n+int(size):], nil
+}
+
+// unwrapKMSDataKey asks the KMS key that wrapped a data key to unwrap it
+func unwrapKMSDataKey(keyURI string, wrapped []byte) ([]byte, error) {
+	if key, ok := unwrappedKeys.Load(string(wrapped)); ok {
+		return key.([]byte), nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), kmsTimeout)
+	defer cancel()
+	wrapper, err := openKeyWrapper(ctx, keyURI)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := wrapper.unwrapKey(ctx, wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key with %s (no access to the key?): %v", keyURI, err)
+	}
+	if len(dataKey) != 32 {
+		return nil, fmt.Errorf("%s returned a data key of %d bytes", keyURI, len(dataKey))
+	}
+	unwrappedKeys.Store(string(wrapped), dataKey)
+	return dataKey, nil
+}
+
+func newDataKeyGCM(dataKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %v", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %v", err)
+	}
+	return gcm, nil
+}
+
+// awsKeyWrapper wraps data keys with an AWS KMS symmetric key. Credentials
+// come from the standard AWS chain, as for S3.
+type awsKeyWrapper struct {
+	client *kms.Client
+	keyID  string
+}
+
+func newAWSKeyWrapper(ctx context.Context, keyID string) (*awsKeyWrapper, error) {
+	keyID, query, _ := strings.Cut(keyID, "?")
+	if keyID == "" {
+		return nil, fmt.Errorf("invalid AWS KMS key: use awskms://<key ID, ARN or alias/name>")
+	}
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf("invalid AWS KMS key options: %v", err)
+	}
+
+	var opts []func(*config.LoadOptions) error
+	region := params.Get("region")
+	if parts := strings.Split(keyID, ":"); region == "" && len(parts) > 3 && parts[0] == "arn" {
+		// arn:aws:kms:<region>:<account>:key/<id>
+		region = parts[3]
+	}
+	if region != "" {
+		opts = append(opts, config.WithRegion(region))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %v", err)
+	}
+	return &awsKeyWrapper{client: kms.NewFromConfig(cfg), keyID: keyID}, nil
+}
+
+func (w *awsKeyWrapper) wrapKey(ctx context.Context, dataKey []byte) ([]byte, error) {
+	out, err := w.client.Encrypt(ctx, &kms.EncryptInput{
+		KeyId:             &w.keyID,
+		Plaintext:         dataKey,
+		EncryptionContext: map[string]string{"app": kmsContext},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.CiphertextBlob, nil
+}
+
+func (w *awsKeyWrapper) unwrapKey(ctx context.Context, wrapped []byte) ([]byte, error) {
+	out, err := w.client.Decrypt(ctx, &kms.DecryptInput{
+		KeyId:             &w.keyID,
+		CiphertextBlob:    wrapped,
+		EncryptionContext: map[string]string{"app": kmsContext},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Plaintext, nil
+}
+
+// gcpKeyWrapper wraps data keys with a Google Cloud KMS symmetric key.
+// Credentials come from Application Default Credentials, as for Secret
+// Manager.
+type gcpKeyWrapper struct {
+	keys *cloudkms.ProjectsLocationsKeyRingsCryptoKeysService
+	name string
+}
+
+func newGCPKeyWrapper(ctx context.Context, name string) (*gcpKeyWrapper, error) {
+	if !strings.HasPrefix(name, "projects/") || !strings.Contains(name, "/cryptoKeys/") {
+		return nil, fmt.Errorf("invalid Cloud KMS key: use gcpkms://projects/<p>/locations/<l>/keyRings/<r>/cryptoKeys/<k>")
+	}
+	service, err := cloudkms.NewService(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Cloud KMS client: %v", err)
+	}
+	return &gcpKeyWrapper{keys: service.Projects.Locations.KeyRings.CryptoKeys, name: name}, nil
+}
+
+func (w *gcpKeyWrapper) wrapKey(ctx context.Context, dataKey []byte) ([]byte, error) {
+	resp, err := w.keys.Encrypt(w.name, &cloudkms.EncryptRequest{
+		Plaintext:                   base64.StdEncoding.EncodeToString(dataKey),
+		AdditionalAuthenticatedData: base64.StdEncoding.EncodeToString([]byte(kmsContext)),
+	}).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(resp.Ciphertext)
+}
+
+func (w *gcpKeyWrapper) unwrapKey(ctx context.Context, wrapped []byte) ([]byte, error) {
+	resp, err := w.keys.Decrypt(w.name, &cloudkms.DecryptRequest{
+		Ciphertext:                  base64.StdEncoding.EncodeToString(wrapped),
+		AdditionalAuthenticatedData: base64.StdEncoding.EncodeToString([]byte(kmsContext)),
+	}).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(resp.Plaintext)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// lintIssue is a problem found in a .env file, on a 1-based line
+type lintIssue struct {
+	Line    int
+	Message string
+}
+
+func (i lintIssue) String() string {
+	return fmt.Sprintf("line %d: %s", i.Line, i.Message)
+}
+
+// lintEnvContents checks .env contents for the mistakes that break dotenv
+// loaders or silently change values: lines that aren't KEY=VALUE, invalid
+// key names, unterminated quotes, keys defined twice, unquoted values with
+// spaces and mixed line endings. Quoted values may span several lines.
+func lintEnvContents(contents string) []lintIssue {
+	var issues []lintIssue
+	crlf := strings.Count(contents, "\r\n")
+	if lf := strings.Count(contents, "\n"); crlf > 0 && crlf < lf {
+		issues = append(issues, lintIssue{Line: firstLineEnding(contents, crlf*2 > lf), Message: fmt.Sprintf("mixed line endings (%d CRLF, %d LF)", crlf, lf-crlf)})
+	}
+
+	lines := strings.Split(strings.ReplaceAll(contents, "\r\n", "\n"), "\n")
+	defined := make(map[string]int)
+	for i := 0; i < len(lines); i++ {
+		lineNo := i + 1
+		raw := lines[i]
+		if strings.Contains(raw, "\r") {
+			issues = append(issues, lintIssue{Line: lineNo, Message: "stray carriage return"})
+			raw = strings.ReplaceAll(raw, "\r", "")
+		}
+		line := strings.TrimSpace(raw)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		switch {
+		case !ok:
+			issues = append(issues, lintIssue{Line: lineNo, Message: fmt.Sprintf("not a KEY=VALUE line: %q", truncateLint(line))})
+			continue
+		case !envKeyName.MatchString(key):
+			issues = append(issues, lintIssue{Line: lineNo, Message: fmt.Sprintf("invalid key name %q", truncateLint(key))})
+			continue
+		}
+
+		if first, ok := defined[key]; ok {
+			issues = append(issues, lintIssue{Line: lineNo, Message: fmt.Sprintf("duplicate key %s (first defined on line %d)", key, first)})
+		} else {
+			defined[key] = lineNo
+		}
+
+		if value == "" {
+			continue
+		}
+		if quote := value[0]; quote == '"' || quote == '\'' || quote == '`' {
+			// The value runs to the matching quote, possibly lines later
+			end := i
+			for !closesQuote(value, quote) && end+1 < len(lines) {
+				end++
+				value += "\n" + strings.TrimRight(lines[end], "\r \t")
+			}
+			if !closesQuote(value, quote) {
+				issues = append(issues, lintIssue{Line: lineNo, Message: fmt.Sprintf("unterminated %c quote in %s", quote, key)})
+				return issues
+			}
+			i = end
+			continue
+		}
+
+		// An unquoted value ends at an inline comment
+		if idx := strings.Index(value, " #"); idx >= 0 {
+			value = strings.TrimSpace(value[:idx])
+		}
+		if strings.ContainsAny(value, " \t") {
+			issues = append(issues, lintIssue{Line: lineNo, Message: fmt.Sprintf("unquoted value with spaces in %s; quote it", key)})
+		}
+	}
+	return issues
+}
+
+// closesQuote reports whether value, which starts with quote, also ends with
+// an unescaped one after it, ignoring a trailing comment
+func closesQuote(value string, quote byte) bool {
+	for i := 1; i < len(value); i++ {
+		switch value[i] {
+		case '\\':
+			if quote == '"' {
+				i++
+			}
+		case quote:
+			rest := strings.TrimSpace(value[i+1:])
+			return rest == "" || strings.HasPrefix(rest, "#")
+		}
+	}
+	return false
+}
+
+// firstLineEnding returns the first line ending with CRLF, or with a bare LF
+// when bareLF is set, so the warning points at the odd ones out
+func firstLineEnding(contents string, bareLF bool) int {
+	for i, line := range strings.SplitAfter(contents, "\n") {
+		if strings.HasSuffix(line, "\r\n") != bareLF && strings.HasSuffix(line, "\n") {
+			return i + 1
+		}
+	}
+	return 1
+}
+
+func truncateLint(s string) string {
+	if len(s) > 40 {
+		return s[:40] + "..."
+	}
+	return s
+}
+
+// addLintFlags registers --lint and --strict
+func addLintFlags(fs *flag.FlagSet) (lint, strict *bool) {
+	lint = fs.Bool("lint", false, "Check .env files before uploading them and warn about duplicate keys, unquoted spaces, mixed line endings and broken lines")
+	strict = fs.Bool("strict", false, "Like --lint, but don't upload a file with issues and fail the sync")
+	return lint, strict
+}
+
+// lintUpload checks a .env file about to be uploaded when --lint or --strict
+// is set. Issues are logged as warnings; with --strict the file is counted as
+// invalid and the returned error keeps it out of the database.
+func lintUpload(stats *SyncStats, filePath, contents string, opts SyncOptions) error {
+	if !opts.Lint && !opts.Strict || !isDotenvName(filepath.Base(filePath)) {
+		return nil
+	}
+	issues := lintEnvContents(contents)
+	if len(issues) == 0 {
+		return nil
+	}
+	if opts.Strict {
+		atomic.AddInt64(&stats.FilesInvalid, 1)
+		return fmt.Errorf("lint failed (--strict): %s", joinLintIssues(issues))
+	}
+	for _, issue := range issues {
+		logger.Warn("env file lint: "+issue.Message, "file", filePath, "line", issue.Line)
+	}
+	return nil
+}
+
+// lintFiles lints the .env files among files before an upload. Issues are
+// logged as warnings; with --strict any issue stops the upload.
+func lintFiles(files []string, opts SyncOptions) error {
+	var failed []string
+	for _, file := range files {
+		contents, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		if err := lintUpload(&SyncStats{}, file, string(contents), opts); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", file, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d file(s) failed lint, nothing was uploaded:\n  %s", len(failed), strings.Join(failed, "\n  "))
+	}
+	return nil
+}
+
+func joinLintIssues(issues []lintIssue) string {
+	parts := make([]string, len(issues))
+	for i, issue := range issues {
+		parts[i] = issue.String()
+	}
+	return strings.Join(parts, "; ")
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Formats of list --remote
+const (
+	listFormatTable = "table"
+	listFormatCSV   = "csv"
+	listFormatYAML  = "yaml"
+)
+
+// Orders of list --remote, by column
+var listSortKeys = []string{"repo", "path", "size", "modified", "updated"}
+
+// remoteListOptions selects, orders and formats the records list --remote prints
+type remoteListOptions struct {
+	Filter  FileFilter
+	Format  string
+	Sort    string
+	Reverse bool
+}
+
+// remoteListEntry is a stored file as list --remote prints it
+type remoteListEntry struct {
+	RepoID         string `json:"repo_id"`
+	RelativePath   string `json:"relative_path"`
+	Size           int    `json:"size"` // Of the encrypted contents, as stored
+	Hash           string `json:"hash"` // Prefix of the file hash
+	FileModifiedAt string `json:"file_modified_at"`
+	UpdatedAt      string `json:"updated_at"`
+}
+
+// checkListOptions rejects an unknown --format or --sort
+func checkListOptions(opts remoteListOptions) error {
+	if !slices.Contains([]string{listFormatTable, listFormatCSV, listFormatYAML}, opts.Format) {
+		return usageErrorf("--format must be table, csv or yaml")
+	}
+	if !slices.Contains(listSortKeys, opts.Sort) {
+		return usageErrorf("--sort must be one of %s", strings.Join(listSortKeys, ", "))
+	}
+	return nil
+}
+
+// listRemoteFiles prints the files stored in the database that opts.Filter
+// selects, ordered by opts.Sort, as a table, CSV or YAML (or JSON with --json)
+func listRemoteFiles(ctx context.Context, dbConnStr string, opts remoteListOptions) error {
+	db, err := OpenStore(dbConnStr)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := db.InitSchema(ctx); err != nil {
+		return err
+	}
+	records, err := db.ListEnvFilesWithContents(ctx)
+	if err != nil {
+		return err
+	}
+	tags, err := loadFileTags(ctx, db, opts.Filter)
+	if err != nil {
+		return err
+	}
+	opts.Filter.tagged = tags
+
+	entries := []remoteListEntry{}
+	for _, record := range records {
+		if !opts.Filter.Match(record.RepoID, record.RelativePath) {
+			continue
+		}
+		entries = append(entries, remoteListEntry{
+			RepoID:         record.RepoID,
+			RelativePath:   record.RelativePath,
+			Size:           len(record.Contents),
+			Hash:           record.FileHash[:min(12, len(record.FileHash))],
+			FileModifiedAt: normalizeStoredTime(record.FileModifiedAt),
+			UpdatedAt:      normalizeStoredTime(record.UpdatedAt),
+		})
+	}
+	sortRemoteList(entries, opts.Sort, opts.Reverse)
+
+	if jsonOutput {
+		printJSON(map[string]interface{}{"files": entries})
+		return nil
+	}
+	switch opts.Format {
+	case listFormatCSV:
+		return printRemoteListCSV(entries)
+	case listFormatYAML:
+		printRemoteListYAML(entries)
+		return nil
+	}
+
+	if len(entries) == 0 {
+		fmt.Println("No stored files match")
+		return nil
+	}
+	rows := [][]string{{"REPO", "PATH", "SIZE", "HASH", "MODIFIED", "UPDATED"}}
+	for _, entry := range entries {
+		rows = append(rows, []string{shortenRepoID(entry.RepoID), entry.RelativePath, formatBytes(int64(entry.Size)), entry.Hash,
+			tableTime(entry.FileModifiedAt), tableTime(entry.UpdatedAt)})
+	}
+	widths := make([]int, len(rows[0]))
+	for _, row := range rows {
+		for i, cell := range row {
+			widths[i] = max(widths[i], len([]rune(cell)))
+		}
+	}
+	for _, row := range rows {
+		line := ""
+		for i, cell := range row {
+			if i == len(row)-1 {
+				line += cell
+			} else if i == 2 {
+				// Sizes line up on the right
+				line += strings.Repeat(" ", widths[i]-len([]rune(cell))) + cell + "  "
+			} else {
+				line += cell + strings.Repeat(" ", widths[i]-len([]rune(cell))+2)
+			}
+		}
+		fmt.Println(line)
+	}
+	fmt.Printf("\n%d stored file(s) (sizes are of the encrypted contents)\n", len(entries))
+	return nil
+}
+
+// sortRemoteList orders entries by key, then by repo and path
+func sortRemoteList(entries []remoteListEntry, key string, reverse bool) {
+	slices.SortStableFunc(entries, func(a, b remoteListEntry) int {
+		var c int
+		switch key {
+		case "path":
+			c = strings.Compare(a.RelativePath, b.RelativePath)
+		case "size":
+			c = a.Size - b.Size
+		case "modified":
+			// Normalized times sort as text
+			c = strings.Compare(a.FileModifiedAt, b.FileModifiedAt)
+		case "updated":
+			c = strings.Compare(a.UpdatedAt, b.UpdatedAt)
+		}
+		if c == 0 {
+			c = strings.Compare(a.RepoID, b.RepoID)
+		}
+		if c == 0 {
+			c = strings.Compare(a.RelativePath, b.RelativePath)
+		}
+		if reverse {
+			return -c
+		}
+		return c
+	})
+}
+
+// tableTime shortens a normalized timestamp for the table, in local time
+func tableTime(value string) string {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return value
+	}
+	return t.Local().Format("2006-01-02 15:04")
+}
+
+func printRemoteListCSV(entries []remoteListEntry) error {
+	w := csv.NewWriter(os.Stdout)
+	w.Write([]string{"repo_id", "relative_path", "size", "hash", "file_modified_at", "updated_at"})
+	for _, entry := range entries {
+		w.Write([]string{entry.RepoID, entry.RelativePath, strconv.Itoa(entry.Size), entry.Hash, entry.FileModifiedAt, entry.UpdatedAt})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// printRemoteListYAML prints entries as a YAML list. Strings are double
+// quoted, so paths with ':' or '#' can't be misread.
+func printRemoteListYAML(entries []remoteListEntry) {
+	if len(entries) == 0 {
+		fmt.Println("[]")
+		return
+	}
+	for _, entry := range entries {
+		fmt.Printf("- repo_id: %s\n", strconv.Quote(entry.RepoID))
+		fmt.Printf("  relative_path: %s\n", strconv.Quote(entry.RelativePath))
+		fmt.Printf("  size: %d\n", entry.Size)
+		fmt.Printf("  hash: %s\n", strconv.Quote(entry.Hash))
+		fmt.Printf("  file_modified_at: %s\n", strconv.Quote(entry.FileModifiedAt))
+		fmt.Printf("  updated_at: %s\n", strconv.Quote(entry.UpdatedAt))
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// syncLockLease is how long a database lock outlives a sync that stopped
+// refreshing it, e.g. because its machine lost power
+const syncLockLease = 5 * time.Minute
+
+// syncLockReleaseTimeout bounds giving up the lease, which still happens
+// after the sync itself was cancelled
+const syncLockReleaseTimeout = 10 * time.Second
+
+// syncLocker is implemented by backends that can hold a lock in the store
+// itself, so syncs from different machines don't interleave their writes
+type syncLocker interface {
+	// AcquireSyncLock takes the lock for holder until the lease runs out.
+	// If someone else has it, heldBy describes them and nothing is taken.
+	AcquireSyncLock(ctx context.Context, holder string, lease time.Duration) (heldBy string, err error)
+	RefreshSyncLock(ctx context.Context, holder string, lease time.Duration) error
+	ReleaseSyncLock(ctx context.Context, holder string) error
+}
+
+// syncLockerOf returns the lock of the store behind db, if it has one. With
+// replicas the primary's lock covers them all.
+func syncLockerOf(db Store) syncLocker {
+	if r, ok := db.(*ReplicatedStore); ok {
+		db = r.primary()
+	}
+	locker, _ := db.(syncLocker)
+	return locker
+}
+
+// syncBusyError reports that another sync holds the lock
+type syncBusyError struct {
+	heldBy string
+}
+
+func (e *syncBusyError) Error() string {
+	return fmt.Sprintf("another sync is running (%s); wait for it to finish or use --force", e.heldBy)
+}
+
+// lockFileInfo is the contents of ~/.env-sync/sync.lock
+type lockFileInfo struct {
+	Host      string `json:"host"`
+	PID       int    `json:"pid"`
+	StartedAt string `json:"started_at"`
+}
+
+func (l lockFileInfo) String() string {
+	return fmt.Sprintf("pid %d on %s since %s UTC", l.PID, l.Host, l.StartedAt)
+}
+
+// syncLock is held while a sync or upload writes: a lock file for this
+// machine and, where the backend has one, a lease in the database
+type syncLock struct {
+	file   string
+	db     syncLocker
+	ctx    context.Context // Of the sync, for refreshing the lease
+	holder string
+	stop   chan struct{}
+}
+
+// acquireSyncLock takes the local and database locks, or returns a
+// *syncBusyError naming whoever holds one. With force no lock is taken or
+// checked.
+func acquireSyncLock(ctx context.Context, db Store, force bool) (*syncLock, error) {
+	if force {
+		return &syncLock{}, nil
+	}
+
+	dir, err := getStorageDir()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get storage directory: %v", err)
+	}
+	info := lockFileInfo{Host: auditMachine(), PID: os.Getpid(), StartedAt: time.Now().UTC().Format("2006-01-02 15:04:05")}
+	lock := &syncLock{file: filepath.Join(dir, "sync.lock"), holder: info.String()}
+	if err := lock.createFile(info); err != nil {
+		return nil, err
+	}
+
+	if locker := syncLockerOf(db); locker != nil {
+		heldBy, err := locker.AcquireSyncLock(ctx, lock.holder, syncLockLease)
+		if err == nil && heldBy != "" {
+			err = &syncBusyError{heldBy: heldBy}
+		}
+		if err != nil {
+			os.Remove(lock.file)
+			return nil, err
+		}
+		lock.db = locker
+		lock.ctx = ctx
+		lock.stop = make(chan struct{})
+		go lock.refresh()
+	}
+	return lock, nil
+}
+
+// createFile creates the lock file, replacing one left behind by a process
+// of this machine that no longer runs
+func (l *syncLock) createFile(info lockFileInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		f, err := os.OpenFile(l.file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			_, err = f.Write(data)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(l.file)
+				return fmt.Errorf("failed to write %s: %v", l.file, err)
+			}
+			return nil
+		}
+		if !os.IsExist(err) || attempt > 0 {
+			return fmt.Errorf("failed to create %s: %v", l.file, err)
+		}
+
+		var existing lockFileInfo
+		if data, err := os.ReadFile(l.file); err == nil && json.Unmarshal(data, &existing) == nil {
+			if existing.Host != info.Host || processAlive(existing.PID) {
+				return &syncBusyError{heldBy: existing.String()}
+			}
+		}
+		logger.Debug("removing stale lock file", "file", l.file, "holder", existing.String())
+		if err := os.Remove(l.file); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove stale %s: %v", l.file, err)
+		}
+	}
+}
+
+// refresh extends the database lease until the lock is released
+func (l *syncLock) refresh() {
+	ticker := time.NewTicker(syncLockLease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := l.db.RefreshSyncLock(l.ctx, l.holder, syncLockLease); err != nil {
+				logger.Warn("failed to refresh sync lock", "error", err)
+			}
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+// release gives up both locks. The lease is given up even if the sync was
+// cancelled, so other syncs don't have to wait for it to expire.
+func (l *syncLock) release() {
+	if l.db != nil {
+		close(l.stop)
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(l.ctx), syncLockReleaseTimeout)
+		defer cancel()
+		if err := l.db.ReleaseSyncLock(ctx, l.holder); err != nil {
+			logger.Warn("failed to release sync lock, it expires by itself", "error", err, "lease", syncLockLease.String())
+		}
+	}
+	if l.file != "" {
+		os.Remove(l.file)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Logging settings, set by the global --log-level, --log-format and --log-file flags
+var (
+	logLevel  = "info"
+	logFormat = "text"
+	logFile   string
+)
+
+// logger receives warnings and daemon activity. Command results (tables,
+// per-file sync lines) are still printed to stdout.
+var logger = slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+// setupLogging builds the logger from the global logging flags. The returned
+// closer flushes the log file, if any.
+func setupLogging() (io.Closer, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(logLevel)); err != nil {
+		return nil, fmt.Errorf("invalid --log-level %q (use debug, info, warn or error)", logLevel)
+	}
+
+	var w io.Writer = os.Stderr
+	var closer io.Closer = io.NopCloser(nil)
+	if logFile != "" {
+		f, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open log file: %v", err)
+		}
+		w, closer = f, f
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	switch strings.ToLower(logFormat) {
+	case "text":
+		logger = slog.New(slog.NewTextHandler(w, opts))
+	case "json":
+		logger = slog.New(slog.NewJSONHandler(w, opts))
+	default:
+		closer.Close()
+		return nil, fmt.Errorf("invalid --log-format %q (use text or json)", logFormat)
+	}
+
+	return closer, nil
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+)
+
+// normalizePath returns path absolute and cleaned, without the Windows
+// extended-length prefix, so files found by a scan, --base and the
+// configured base paths all take the same form and relative paths can be
+// derived between them. The os package adds the prefix back for long paths.
+func normalizePath(path string) (string, error) {
+	absPath, err := filepath.Abs(trimExtendedPrefix(path))
+	if err != nil {
+		return "", fmt.Errorf("failed to get absolute path: %v", err)
+	}
+	return absPath, nil
+}
+
+// gitCommand runs git with the options needed to read checkouts at any path
+func gitCommand(args ...string) *exec.Cmd {
+	return exec.Command("git", append(gitPathOptions(), args...)...)
+}
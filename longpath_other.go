@@ -0,0 +1,13 @@
+//go:build !windows
+
+package main
+
+// trimExtendedPrefix returns path unchanged: only Windows has extended-length paths
+func trimExtendedPrefix(path string) string {
+	return path
+}
+
+// gitPathOptions returns no options: only Windows limits path lengths
+func gitPathOptions() []string {
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNormalizePath(t *testing.T) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := t.TempDir()
+
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{"absolute", filepath.Join(base, "app", ".env"), filepath.Join(base, "app", ".env")},
+		{"unclean absolute", base + string(filepath.Separator) + filepath.Join("app", "..", "api", ".", ".env"), filepath.Join(base, "api", ".env")},
+		{"trailing separator", filepath.Join(base, "app") + string(filepath.Separator), filepath.Join(base, "app")},
+		{"relative", filepath.Join("app", ".env"), filepath.Join(cwd, "app", ".env")},
+		{"relative parent", filepath.Join("..", "app", ".env"), filepath.Join(filepath.Dir(cwd), "app", ".env")},
+		{"dot", ".", cwd},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := normalizePath(tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("normalizePath(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLocalFileIdentifierNormalizesPaths(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	base := t.TempDir()
+	t.Chdir(base)
+
+	tests := []struct {
+		name     string
+		filePath string
+		basePath string
+	}{
+		{"absolute", filepath.Join(base, "app", ".env"), base},
+		{"unclean", filepath.Join(base, "api", "..", "app", ".env"), base + string(filepath.Separator)},
+		{"relative file", filepath.Join("app", ".env"), base},
+		{"relative base", filepath.Join(base, "app", ".env"), "."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repoID, relativePath, err := localFileIdentifier(tt.filePath, tt.basePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if repoID != localRepoID || relativePath != "app/.env" {
+				t.Errorf("localFileIdentifier(%q, %q) = %q, %q, want %q, %q", tt.filePath, tt.basePath, repoID, relativePath, localRepoID, "app/.env")
+			}
+		})
+	}
+}
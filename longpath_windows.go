@@ -0,0 +1,26 @@
+//go:build windows
+
+package main
+
+import "strings"
+
+// Extended-length prefixes, which lift the MAX_PATH limit: \\?\D:\dir and
+// \\?\UNC\server\share\dir for \\server\share\dir
+const (
+	extendedPrefix    = `\\?\`
+	extendedUNCPrefix = `\\?\UNC\`
+)
+
+// trimExtendedPrefix turns an extended-length path into its usual form
+func trimExtendedPrefix(path string) string {
+	if rest, ok := strings.CutPrefix(path, extendedUNCPrefix); ok {
+		return `\\` + rest
+	}
+	return strings.TrimPrefix(path, extendedPrefix)
+}
+
+// gitPathOptions lets Git for Windows open files beyond MAX_PATH, as deep
+// node_modules-style trees in monorepos often are
+func gitPathOptions() []string {
+	return []string{"-c", "core.longpaths=true"}
+}
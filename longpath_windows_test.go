@@ -0,0 +1,85 @@
+//go:build windows
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestTrimExtendedPrefix(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{"extended drive", `\\?\C:\src\app\.env`, `C:\src\app\.env`},
+		{"extended UNC", `\\?\UNC\server\share\app\.env`, `\\server\share\app\.env`},
+		{"UNC", `\\server\share\app\.env`, `\\server\share\app\.env`},
+		{"drive", `C:\src\app\.env`, `C:\src\app\.env`},
+		{"relative", `app\.env`, `app\.env`},
+		{"device namespace", `\\.\C:\src\.env`, `\\.\C:\src\.env`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := trimExtendedPrefix(tt.path); got != tt.want {
+				t.Errorf("trimExtendedPrefix(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeExtendedPath(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{"extended drive", `\\?\C:\src\app\.env`, `C:\src\app\.env`},
+		{"extended unclean", `\\?\C:\src\api\..\app\.env`, `C:\src\app\.env`},
+		{"extended UNC", `\\?\UNC\server\share\app\.env`, `\\server\share\app\.env`},
+		{"UNC", `\\server\share\app\.env`, `\\server\share\app\.env`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := normalizePath(tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("normalizePath(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+// Files found under a long path must get the same ID as when the scan or
+// --base gave the short form, or they'd be stored twice
+func TestLocalFileIdentifierOfExtendedPaths(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("USERPROFILE", t.TempDir())
+	base := t.TempDir()
+
+	tests := []struct {
+		name     string
+		filePath string
+		basePath string
+	}{
+		{"extended file", `\\?\` + filepath.Join(base, "app", ".env"), base},
+		{"extended base", filepath.Join(base, "app", ".env"), `\\?\` + base},
+		{"both extended", `\\?\` + filepath.Join(base, "app", ".env"), `\\?\` + base},
+		{"extended UNC file", `\\?\UNC\server\share\repo\app\.env`, `\\server\share\repo`},
+		{"extended UNC base", `\\server\share\repo\app\.env`, `\\?\UNC\server\share\repo`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repoID, relativePath, err := localFileIdentifier(tt.filePath, tt.basePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if repoID != localRepoID || relativePath != "app/.env" {
+				t.Errorf("localFileIdentifier(%q, %q) = %q, %q, want %q, %q", tt.filePath, tt.basePath, repoID, relativePath, localRepoID, "app/.env")
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// A file can opt out of syncing, or opt in despite a name that isn't a
+// dotenv name or a configured pattern, with a marker comment on its first
+// line, e.g. "# env-sync: ignore" or "// env-sync: sync"
+const (
+	markerIgnore = "ignore"
+	markerSync   = "sync"
+)
+
+var markerPattern = regexp.MustCompile(`^\s*(?:#|//|;)\s*env-sync:\s*([a-z]+)\s*$`)
+
+// maxMarkerFileSize bounds the files opened to look for an opt-in marker
+const maxMarkerFileSize = 64 * 1024
+
+// markerExtensions are the extensions of files that may opt in; binaries and
+// source files are never opened
+var markerExtensions = map[string]bool{
+	"": true, ".env": true, ".sh": true, ".conf": true, ".cfg": true, ".ini": true,
+	".json": true, ".yaml": true, ".yml": true, ".toml": true, ".properties": true, ".txt": true,
+}
+
+// contentsMarker returns the marker on the first line of contents, or ""
+func contentsMarker(contents string) string {
+	line, _, _ := strings.Cut(strings.TrimPrefix(contents, "\ufeff"), "\n")
+	if m := markerPattern.FindStringSubmatch(strings.TrimSuffix(line, "\r")); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// readFileMarker returns the marker on the first line of a file, or ""
+func readFileMarker(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	line, err := bufio.NewReaderSize(f, 256).ReadSlice('\n')
+	if err != nil && len(line) == 0 {
+		return ""
+	}
+	return contentsMarker(string(line))
+}
+
+// isMarkerCandidate reports whether a file that isn't a secret file by name
+// is small and plain enough to check for an opt-in marker
+func isMarkerCandidate(name string, size int64) bool {
+	return size <= maxMarkerFileSize && markerExtensions[strings.ToLower(filepath.Ext(name))]
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+)
+
+// maskValue hides a secret for display. Long values keep a recognizable
+// prefix such as "sk_live_" and their last four characters, so
+// "sk_live_abcdef0123456789" becomes "sk_live_****6789". Short values are
+// hidden completely.
+func maskValue(value string) string {
+	runes := []rune(unquoteEnvValue(value))
+	if len(runes) == 0 {
+		return ""
+	}
+	if len(runes) < 12 {
+		return "****"
+	}
+
+	// Keep a type prefix ending in "_" or "-" from the first few characters,
+	// as long as most of the value stays hidden
+	prefix := ""
+	head := string(runes[:min(10, len(runes)/2)])
+	if i := strings.LastIndexAny(head, "_-"); i >= 0 {
+		prefix = head[:i+1]
+	}
+
+	suffix := ""
+	if len(runes) >= 16 {
+		suffix = string(runes[len(runes)-4:])
+	}
+
+	return prefix + "****" + suffix
+}
+
+// maskEnvLine renders a KEY=VALUE line with its value masked
+func maskEnvLine(line EnvLine) string {
+	return line.Key + "=" + maskValue(line.Value)
+}
+
+// maskSecretLine masks a line of a non-dotenv secret file such as YAML,
+// tfvars or INI, keeping anything before the first ':' or '=' visible
+func maskSecretLine(raw string) string {
+	trimmed := strings.TrimSpace(raw)
+	if trimmed == "" || strings.HasPrefix(trimmed, "#") || strings.HasPrefix(trimmed, "-----") {
+		return raw
+	}
+	if i := strings.IndexAny(raw, ":="); i >= 0 {
+		value := strings.TrimSpace(raw[i+1:])
+		if value == "" {
+			return raw
+		}
+		return raw[:i+1] + " " + maskValue(value)
+	}
+	return maskValue(trimmed)
+}
+
+// displayEnvLine returns a raw .env line as it should be printed: values are
+// masked unless showValues is set, and comments and blank lines are unchanged
+func displayEnvLine(raw string, showValues bool) string {
+	line := parseEnvLine(raw)
+	if showValues || line.Key == "" {
+		return raw
+	}
+	return maskEnvLine(line)
+}
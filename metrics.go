@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// syncDurationBuckets are the upper bounds (seconds) of the sync duration histogram
+var syncDurationBuckets = []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+// syncMetrics accumulates daemon sync counters for the /metrics endpoint,
+// in the Prometheus text exposition format
+type syncMetrics struct {
+	mu              sync.Mutex
+	uploaded        int64
+	downloaded      int64
+	merged          int64
+	moved           int64
+	conflicts       int64
+	corrupted       int64
+	fileErrors      int64
+	syncsSucceeded  int64
+	syncsFailed     int64
+	lastSyncAt      time.Time
+	lastSuccessAt   time.Time
+	durationCounts  []int64 // Per bucket, not cumulative
+	durationSum     float64
+	durationSamples int64
+}
+
+func newSyncMetrics() *syncMetrics {
+	return &syncMetrics{durationCounts: make([]int64, len(syncDurationBuckets))}
+}
+
+// observe records the outcome of one sync run
+func (m *syncMetrics) observe(stats *SyncStats, err error, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	m.lastSyncAt = now
+	if stats != nil {
+		m.uploaded += atomic.LoadInt64(&stats.FilesUploaded)
+		m.downloaded += atomic.LoadInt64(&stats.FilesDownloaded)
+		m.merged += atomic.LoadInt64(&stats.FilesMerged)
+		m.moved += atomic.LoadInt64(&stats.FilesMoved)
+		m.conflicts += atomic.LoadInt64(&stats.FilesConflict)
+		m.corrupted += atomic.LoadInt64(&stats.FilesCorrupted)
+		m.fileErrors += atomic.LoadInt64(&stats.FilesError)
+	}
+	if err != nil {
+		m.syncsFailed++
+	} else {
+		m.syncsSucceeded++
+		m.lastSuccessAt = now
+	}
+
+	seconds := duration.Seconds()
+	for i, bound := range syncDurationBuckets {
+		if seconds <= bound {
+			m.durationCounts[i]++
+			break
+		}
+	}
+	m.durationSum += seconds
+	m.durationSamples++
+}
+
+func (m *syncMetrics) writeTo(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	counter := func(name, help string, value int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, value)
+	}
+	counter("env_sync_files_uploaded_total", "Files uploaded to the database.", m.uploaded)
+	counter("env_sync_files_downloaded_total", "Files downloaded from the database.", m.downloaded)
+	counter("env_sync_files_merged_total", "Files merged key by key.", m.merged)
+	counter("env_sync_files_moved_total", "Files renamed or moved within their repo.", m.moved)
+	counter("env_sync_files_conflicts_total", "Files with conflicting changes.", m.conflicts)
+	counter("env_sync_files_corrupted_total", "Files whose stored copy didn't match its hash.", m.corrupted)
+	counter("env_sync_file_errors_total", "Files that failed to sync.", m.fileErrors)
+
+	fmt.Fprintf(w, "# HELP env_sync_syncs_total Sync runs by result.\n# TYPE env_sync_syncs_total counter\n")
+	fmt.Fprintf(w, "env_sync_syncs_total{result=\"success\"} %d\n", m.syncsSucceeded)
+	fmt.Fprintf(w, "env_sync_syncs_total{result=\"failure\"} %d\n", m.syncsFailed)
+
+	gauge := func(name, help string, t time.Time) {
+		value := 0.0
+		if !t.IsZero() {
+			value = float64(t.UnixNano()) / 1e9
+		}
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %.3f\n", name, help, name, name, value)
+	}
+	gauge("env_sync_last_sync_timestamp_seconds", "Unix time of the last sync run (0 if none yet).", m.lastSyncAt)
+	gauge("env_sync_last_success_timestamp_seconds", "Unix time of the last successful sync run (0 if none yet).", m.lastSuccessAt)
+
+	fmt.Fprintf(w, "# HELP env_sync_sync_duration_seconds Duration of sync runs.\n# TYPE env_sync_sync_duration_seconds histogram\n")
+	var cumulative int64
+	for i, bound := range syncDurationBuckets {
+		cumulative += m.durationCounts[i]
+		fmt.Fprintf(w, "env_sync_sync_duration_seconds_bucket{le=\"%g\"} %d\n", bound, cumulative)
+	}
+	fmt.Fprintf(w, "env_sync_sync_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.durationSamples)
+	fmt.Fprintf(w, "env_sync_sync_duration_seconds_sum %g\n", m.durationSum)
+	fmt.Fprintf(w, "env_sync_sync_duration_seconds_count %d\n", m.durationSamples)
+}
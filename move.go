@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// fileMove is a local file with no stored copy paired with a stored file of
+// the same checkout and contents that has no local copy: one file under two
+// names, renamed on one side since the last sync
+type fileMove struct {
+	record     EnvFileRecord // The stored file, under its old name if moved locally
+	localPath  string        // The local file
+	remotePath string        // Where the stored file belongs locally
+	// Moved on this machine, so the stored file is renamed to match.
+	// Otherwise another machine moved it and the local file follows.
+	movedLocally bool
+	relativePath string // The local file's relative path
+	hash         string
+}
+
+// findMoves pairs up files that were renamed or moved within a checkout,
+// keyed by the local file's path. Which side moved is told by the sync state:
+// the name this machine synced before is the old one. Files whose contents
+// match more than one candidate, or that neither side synced before, aren't
+// treated as moves.
+func findMoves(files []string, basePath string, remoteOnly map[string]EnvFileRecord, stored map[string]bool, state *syncState, opts SyncOptions) map[string]*fileMove {
+	type group struct {
+		local  []*fileMove
+		remote []string
+	}
+	groups := make(map[string]*group) // checkout root and hash -> candidates
+	groupOf := func(root, hash string) *group {
+		key := root + "\x00" + hash
+		if groups[key] == nil {
+			groups[key] = &group{}
+		}
+		return groups[key]
+	}
+
+	for remotePath, record := range remoteOnly {
+		root, ok := strings.CutSuffix(remotePath, filepath.FromSlash(record.RelativePath))
+		if ok {
+			g := groupOf(root, record.FileHash)
+			g.remote = append(g.remote, remotePath)
+		}
+	}
+	if len(groups) == 0 {
+		return nil
+	}
+
+	for _, file := range files {
+		file = filepath.Clean(file)
+		if stored[file] {
+			continue
+		}
+		_, relativePath, err := GetFileIdentifier(file, basePath)
+		if err != nil {
+			continue
+		}
+		root, ok := strings.CutSuffix(file, filepath.FromSlash(relativePath))
+		if !ok {
+			continue
+		}
+		contents, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		hash := envFileHash(file, contents)
+		if g := groups[root+"\x00"+hash]; g != nil {
+			g.local = append(g.local, &fileMove{localPath: file, relativePath: relativePath, hash: hash})
+		}
+	}
+
+	moves := make(map[string]*fileMove)
+	for _, g := range groups {
+		if len(g.local) != 1 || len(g.remote) != 1 {
+			continue
+		}
+		move := g.local[0]
+		move.remotePath = g.remote[0]
+		move.record = remoteOnly[move.remotePath]
+
+		_, remoteSynced := state.get(move.remotePath, move.record.RepoID, move.record.RelativePath)
+		localBase, localSynced := state.get(move.localPath, move.record.RepoID, move.relativePath)
+		switch {
+		case remoteSynced && !localSynced && opts.allows(actionUpload):
+			move.movedLocally = true
+		case localSynced && !remoteSynced && localBase == move.hash && opts.allows(actionDownload):
+			move.movedLocally = false
+		default:
+			continue
+		}
+		moves[move.localPath] = move
+		delete(remoteOnly, move.remotePath)
+	}
+	return moves
+}
+
+// syncMovedFile renames the stored file to the local file's new name, or the
+// local file to the stored file's new name, keeping contents and history.
+// The stored copy is re-encrypted under its new name (see binding.go).
+func syncMovedFile(ctx context.Context, db Store, move *fileMove, password string, stats *SyncStats, state *syncState, opts SyncOptions) (string, string, error) {
+	repoID := move.record.RepoID
+	from, to := move.record.RelativePath, move.relativePath
+	if !move.movedLocally {
+		from, to = to, from
+	}
+	displayName := fmt.Sprintf("%s → %s (%s)", from, to, shortenRepoID(repoID))
+
+	if move.movedLocally {
+		if !opts.budget.take() {
+			return deferWrite(stats, displayName)
+		}
+		if !opts.DryRun {
+			if err := db.MoveEnvFile(ctx, repoID, from, to); err != nil {
+				return "", "", err
+			}
+			if err := rebindEnvFile(ctx, db, repoID, to, password); err != nil {
+				return "", "", err
+			}
+			state.forget(move.remotePath)
+			state.set(move.localPath, repoID, to, move.hash)
+			entry := newAuditEntry(auditMove, repoID, to, move.hash, move.hash)
+			entry.Detail = "from " + from
+			recordAudit(ctx, db, entry)
+		}
+		atomic.AddInt64(&stats.FilesMoved, 1)
+		return actionMove, fmt.Sprintf("↪ Moved: %s (moved locally)%s", displayName, dryRunSuffix(opts.DryRun)), nil
+	}
+
+	if !opts.DryRun {
+		if err := os.MkdirAll(filepath.Dir(move.remotePath), 0755); err != nil {
+			return "", "", fmt.Errorf("failed to create directory: %v", err)
+		}
+		if err := os.Rename(move.localPath, move.remotePath); err != nil {
+			return "", "", fmt.Errorf("failed to move %s: %v", move.localPath, err)
+		}
+		state.forget(move.localPath)
+		state.set(move.remotePath, repoID, to, move.hash)
+	}
+	atomic.AddInt64(&stats.FilesMoved, 1)
+	return actionMove, fmt.Sprintf("↪ Moved: %s (moved remotely)%s", displayName, dryRunSuffix(opts.DryRun)), nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Namespaces let several users or teams share one libsql or PostgreSQL
+// database without seeing each other's files: every row carries the
+// namespace it was written in, and a Database only reads and writes rows of
+// its own. Rows written before namespaces existed are in the default
+// namespace, "".
+
+// envNamespace selects a namespace when --namespace isn't given
+const envNamespace = "ENV_SYNC_NAMESPACE"
+
+// namespaceFlag is set by the global --namespace flag
+var namespaceFlag string
+
+// activeNamespace returns --namespace, else ENV_SYNC_NAMESPACE, else the
+// active profile's "namespace", else the default namespace
+func activeNamespace() string {
+	if namespaceFlag != "" {
+		return strings.TrimSpace(namespaceFlag)
+	}
+	if namespace := os.Getenv(envNamespace); namespace != "" {
+		return strings.TrimSpace(namespace)
+	}
+	if profile, err := loadProfile(); err == nil {
+		if namespace, ok := profile["namespace"].(string); ok {
+			return strings.TrimSpace(namespace)
+		}
+	}
+	return ""
+}
+
+// checkNamespaceSupported fails for backends without namespaces when one is
+// selected, rather than mixing the namespace's files with everyone else's.
+// Only the SQL databases have them.
+func checkNamespaceSupported(connString string) error {
+	namespace := activeNamespace()
+	if namespace == "" {
+		return nil
+	}
+	scheme, _, _ := strings.Cut(connString, "://")
+	switch scheme {
+	case "libsql", "http", "https", "postgres", "postgresql":
+		return nil
+	}
+	return fmt.Errorf("namespace %q needs a libsql or PostgreSQL database; give each namespace its own %s:// prefix instead", namespace, scheme)
+}
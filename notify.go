@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Events that can trigger a notification
+const (
+	notifyUpload    = "upload"
+	notifyDownload  = "download"
+	notifyMerge     = "merge"
+	notifyMove      = "move"
+	notifyConflict  = "conflict"
+	notifyCorrupted = "corrupted"
+	notifyError     = "error"
+)
+
+var allNotifyEvents = []string{notifyUpload, notifyDownload, notifyMerge, notifyMove, notifyConflict, notifyCorrupted, notifyError}
+
+// maxNotifiedFiles bounds the file lines in one message
+const maxNotifiedFiles = 10
+
+// notifier tells the user about daemon syncs that changed something, through
+// a webhook (Slack-compatible or generic JSON) and/or desktop notifications
+type notifier struct {
+	webhookURL    string
+	webhookFormat string // "slack" or "json"
+	desktop       bool
+	events        map[string]bool
+	client        *http.Client
+}
+
+// webhookPayload is the body posted to generic JSON webhooks
+type webhookPayload struct {
+	Event   string           `json:"event"`
+	Machine string           `json:"machine"`
+	Time    string           `json:"time"`
+	Summary string           `json:"summary"`
+	Files   []syncFileReport `json:"files,omitempty"`
+	Error   string           `json:"error,omitempty"`
+	Digest  *syncDigest      `json:"digest,omitempty"`
+}
+
+// newNotifier validates the notification flags. It returns nil when neither
+// a webhook nor desktop notifications are configured.
+func newNotifier(webhookURL, webhookFormat string, desktop bool, events []string) (*notifier, error) {
+	if webhookURL == "" && !desktop {
+		return nil, nil
+	}
+
+	if webhookURL != "" {
+		u, err := url.Parse(webhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("invalid --webhook URL: %s", webhookURL)
+		}
+		if webhookFormat == "" {
+			webhookFormat = "json"
+			if strings.HasSuffix(u.Hostname(), "slack.com") {
+				webhookFormat = "slack"
+			}
+		}
+		if webhookFormat != "slack" && webhookFormat != "json" {
+			return nil, fmt.Errorf("invalid --webhook-format: %s (use slack or json)", webhookFormat)
+		}
+	}
+	if desktop && runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		return nil, fmt.Errorf("desktop notifications are not supported on %s", runtime.GOOS)
+	}
+
+	if len(events) == 0 {
+		events = allNotifyEvents
+	}
+	wanted := make(map[string]bool)
+	for _, list := range events {
+		for _, event := range strings.Split(list, ",") {
+			event = strings.TrimSpace(event)
+			if !slices.Contains(allNotifyEvents, event) {
+				return nil, fmt.Errorf("invalid --notify-on event: %s (use %s)", event, joinOr(allNotifyEvents))
+			}
+			wanted[event] = true
+		}
+	}
+
+	return &notifier{
+		webhookURL:    webhookURL,
+		webhookFormat: webhookFormat,
+		desktop:       desktop,
+		events:        wanted,
+		client:        &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// syncFinished reports the files of one sync that match the configured events
+func (n *notifier) syncFinished(results []syncFileReport) {
+	var files []syncFileReport
+	counts := make(map[string]int)
+	for _, result := range results {
+		event := result.Action
+		if result.Error != "" {
+			event = notifyError
+		}
+		if n.events[event] {
+			files = append(files, result)
+			counts[event]++
+		}
+	}
+	if len(files) == 0 {
+		return
+	}
+
+	var parts []string
+	for _, event := range allNotifyEvents {
+		if counts[event] > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", counts[event], pluralEvent(event, counts[event])))
+		}
+	}
+	summary := strings.Join(parts, ", ")
+
+	lines := []string{fmt.Sprintf("env-sync on %s: %s", auditMachine(), summary)}
+	for i, file := range files {
+		if i == maxNotifiedFiles {
+			lines = append(lines, fmt.Sprintf("…and %d more", len(files)-maxNotifiedFiles))
+			break
+		}
+		if file.Error != "" {
+			lines = append(lines, fmt.Sprintf("✗ %s: %s", file.File, file.Error))
+		} else {
+			lines = append(lines, file.Message)
+		}
+	}
+
+	n.send("sync", summary, strings.Join(lines, "\n"), webhookPayload{Files: files})
+}
+
+// syncFailed reports a sync that couldn't run at all
+func (n *notifier) syncFailed(err error) {
+	if !n.events[notifyError] {
+		return
+	}
+	text := fmt.Sprintf("env-sync on %s: sync failed: %v", auditMachine(), err)
+	n.send("error", "sync failed", text, webhookPayload{Error: err.Error()})
+}
+
+// send delivers a notification. Failures are logged, never returned, so a
+// broken webhook doesn't stop the daemon.
+func (n *notifier) send(event, summary, text string, payload webhookPayload) {
+	if n.desktop {
+		if err := desktopNotification("env-sync", text); err != nil {
+			logger.Warn("desktop notification failed", "error", err)
+		}
+	}
+	if n.webhookURL == "" {
+		return
+	}
+
+	var body interface{} = map[string]string{"text": text}
+	if n.webhookFormat == "json" {
+		payload.Event = event
+		payload.Machine = auditMachine()
+		payload.Time = time.Now().UTC().Format(time.RFC3339)
+		payload.Summary = summary
+		body = payload
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		logger.Warn("webhook failed", "error", err)
+		return
+	}
+
+	resp, err := n.client.Post(n.webhookURL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		logger.Warn("webhook failed", "error", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		logger.Warn("webhook failed", "status", resp.Status)
+	}
+}
+
+// desktopNotification shows a notification with notify-send on Linux or
+// osascript on macOS
+func desktopNotification(title, text string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "linux":
+		cmd = exec.Command("notify-send", title, text)
+	case "darwin":
+		script := fmt.Sprintf("display notification %s with title %s", appleScriptQuote(text), appleScriptQuote(title))
+		cmd = exec.Command("osascript", "-e", script)
+	default:
+		return fmt.Errorf("not supported on %s", runtime.GOOS)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// appleScriptQuote quotes a string literal for AppleScript
+func appleScriptQuote(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	return `"` + r.Replace(s) + `"`
+}
+
+// pluralEvent names an event count, e.g. "2 uploads"
+func pluralEvent(event string, count int) string {
+	if count == 1 || event == notifyCorrupted {
+		return event
+	}
+	return event + "s"
+}
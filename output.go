@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// jsonOutput is set by the global --json flag. Commands that support it print
+// a single JSON document to stdout and send human-oriented notes to stderr.
+var jsonOutput bool
+
+// verboseOutput is set by the global --verbose flag and makes commands print
+// more detail, e.g. sync lists unchanged files too
+var verboseOutput bool
+
+// globalFlag is a flag every command accepts, anywhere on the command line
+type globalFlag struct {
+	name  string
+	arg   string // value placeholder shown in help; empty for switches
+	usage string
+	value *string
+	isSet *bool
+}
+
+var globalFlags = []globalFlag{
+	{name: "json", usage: "Machine-readable JSON output (scan, list, sync, status, verify, get, repos list, audit)", isSet: &jsonOutput},
+	{name: "verbose", usage: "More detailed output (sync lists unchanged files)", isSet: &verboseOutput},
+	{name: "profile", arg: "name", usage: "Config profile to take flag defaults from (default: ENV_SYNC_PROFILE or default_profile)", value: &profileName},
+	{name: "config", arg: "path", usage: "Config file (default: ~/.env-sync/config.json)", value: &configPath},
+	{name: "log-level", arg: "level", usage: "Log level: debug, info, warn or error (default: info)", value: &logLevel},
+	{name: "log-format", arg: "format", usage: "Log format: text or json (default: text)", value: &logFormat},
+	{name: "log-file", arg: "path", usage: "Append logs to this file instead of stderr", value: &logFile},
+	{name: "password-file", arg: "path", usage: "Read the encryption password from the first line of this file, or stdin for -", value: &passwordFile},
+	{name: "namespace", arg: "name", usage: "Namespace of a shared libsql or PostgreSQL database to work in; others' files stay invisible (default: ENV_SYNC_NAMESPACE)", value: &namespaceFlag},
+	{name: "ssh", arg: "user@host", usage: "Tunnel PostgreSQL and libsql connections through this SSH bastion (host may end in :port)", value: &sshTunnel},
+	{name: "ssh-key", arg: "path", usage: "Private key for --ssh (default: ssh-agent, then ~/.ssh/id_ed25519, id_ecdsa, id_rsa)", value: &sshKeyFile},
+	{name: "kdf-memory", arg: "MiB", usage: "Argon2 memory for new encryptions (default: 64)", value: &kdfMemory},
+	{name: "kdf-iterations", arg: "n", usage: "Argon2 iterations for new encryptions (default: 1)", value: &kdfIterations},
+}
+
+// extractGlobalFlags removes global flags from args, wherever they appear,
+// so subcommand flag sets never see them
+func extractGlobalFlags(args []string) []string {
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			// Leave everything after "--" to the command
+			return append(rest, args[i:]...)
+		}
+		if !strings.HasPrefix(arg, "-") {
+			rest = append(rest, arg)
+			continue
+		}
+
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		global := lookupGlobalFlag(name)
+		if global == nil {
+			rest = append(rest, arg)
+			continue
+		}
+
+		if global.isSet != nil {
+			if hasValue {
+				rest = append(rest, arg)
+				continue
+			}
+			*global.isSet = true
+			continue
+		}
+
+		if !hasValue && i+1 < len(args) {
+			i++
+			value = args[i]
+		}
+		*global.value = value
+	}
+	return rest
+}
+
+// lookupGlobalFlag finds a global flag by name
+func lookupGlobalFlag(name string) *globalFlag {
+	for i := range globalFlags {
+		if globalFlags[i].name == name {
+			return &globalFlags[i]
+		}
+	}
+	return nil
+}
+
+// notef prints a human-oriented message, moving it to stderr in JSON mode
+// so stdout stays machine-readable
+func notef(format string, args ...interface{}) {
+	var w io.Writer = os.Stdout
+	if jsonOutput {
+		w = os.Stderr
+	}
+	fmt.Fprintf(w, format, args...)
+}
+
+// printJSON writes v to stdout as indented JSON
+func printJSON(v interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// exitWithError reports err in the active output mode and exits
+func exitWithError(err error) {
+	if jsonOutput {
+		printJSON(map[string]string{"error": err.Error()})
+	} else {
+		fmt.Printf("Error: %v\n", err)
+	}
+	os.Exit(1)
+}
+
+type syncFileReport struct {
+	File    string `json:"file"`
+	Action  string `json:"action,omitempty"`
+	Message string `json:"message,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type syncStatsReport struct {
+	Uploaded   int64 `json:"uploaded"`
+	Downloaded int64 `json:"downloaded"`
+	Skipped    int64 `json:"skipped"`
+	Merged     int64 `json:"merged"`
+	Moved      int64 `json:"moved"`
+	Conflicts  int64 `json:"conflicts"`
+	Corrupted  int64 `json:"corrupted"`
+	Deferred   int64 `json:"deferred"`
+	TooLarge   int64 `json:"too_large"`
+	Invalid    int64 `json:"invalid"`
+	Errors     int   `json:"errors"`
+}
+
+type syncPerformanceReport struct {
+	TotalFiles  int   `json:"total_files"`
+	Workers     int   `json:"workers"`
+	DBConnectMs int64 `json:"db_connect_ms"`
+	SyncMs      int64 `json:"sync_ms"`
+	TotalMs     int64 `json:"total_ms"`
+}
+
+type syncReport struct {
+	RunID       string                `json:"run_id"`
+	DryRun      bool                  `json:"dry_run"`
+	Files       []syncFileReport      `json:"files"`
+	Stats       syncStatsReport       `json:"stats"`
+	Performance syncPerformanceReport `json:"performance"`
+	Targets     []replicaReport       `json:"targets,omitempty"`
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/zalando/go-keyring"
+	"golang.org/x/term"
+)
+
+const (
+	keyringService = "env-sync"
+	keyringUser    = "encryption-password"
+)
+
+// resolvedPassword is the password found by the last resolvePassword call
+var resolvedPassword string
+
+// passwordFile is set by the global --password-file flag
+var passwordFile string
+
+// resolvePassword returns the encryption password from, in order:
+// the --password flag, --password-file, ENV_SYNC_PASSWORD,
+// ENV_SYNC_PASSWORD_FILE, the OS keychain (see 'env-sync login'),
+// or an interactive prompt.
+// When age recipients or a KMS key are configured no password is needed and
+// "" is returned.
+// The result is remembered, so later calls with no flag don't prompt again.
+func resolvePassword(flagValue string) (string, error) {
+	if flagValue != "" {
+		resolvedPassword = flagValue
+		return flagValue, nil
+	}
+	if resolvedPassword != "" {
+		return resolvedPassword, nil
+	}
+	if passwordFile != "" {
+		password, err := readPasswordFile(passwordFile)
+		if err != nil {
+			return "", err
+		}
+		resolvedPassword = password
+		return password, nil
+	}
+	if password := os.Getenv(envPassword); password != "" {
+		return password, nil
+	}
+	if file := os.Getenv(envPasswordFile); file != "" {
+		password, err := readPasswordFile(file)
+		if err != nil {
+			return "", err
+		}
+		resolvedPassword = password
+		return password, nil
+	}
+
+	if passwordless() {
+		return "", nil
+	}
+
+	if password, err := keyring.Get(keyringService, keyringUser); err == nil && password != "" {
+		return password, nil
+	}
+
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return "", fmt.Errorf("no password given: use --password, --password-file or ENV_SYNC_PASSWORD, run 'env-sync login', or run interactively")
+	}
+
+	password, err := promptPassword("Encryption password: ")
+	if err != nil {
+		return "", err
+	}
+	resolvedPassword = password
+	return password, nil
+}
+
+// readPasswordFile reads the password from the first line of a file, or of
+// stdin for "-", so it never has to appear in argv or the environment.
+// A file other users can read is used, but warned about.
+func readPasswordFile(path string) (string, error) {
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		if info, statErr := os.Stat(path); statErr == nil && runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+			logger.Warn("password file is readable by other users, consider chmod 600", "path", path, "mode", fmt.Sprintf("%04o", info.Mode().Perm()))
+		}
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read password file: %v", err)
+	}
+
+	password, _, _ := strings.Cut(string(data), "\n")
+	password = strings.TrimSuffix(password, "\r")
+	if password == "" {
+		return "", fmt.Errorf("password file %s is empty", path)
+	}
+	return password, nil
+}
+
+// promptPassword reads a password from the terminal without echoing it
+func promptPassword(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	data, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("failed to read password: %v", err)
+	}
+	if len(data) == 0 {
+		return "", fmt.Errorf("password cannot be empty")
+	}
+	return string(data), nil
+}
+
+// loginKeyring prompts for the encryption password and stores it in the OS keychain
+// (macOS Keychain, Windows Credential Manager, or libsecret on Linux)
+func loginKeyring() error {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return fmt.Errorf("login must be run interactively")
+	}
+
+	password, err := promptPassword("Encryption password: ")
+	if err != nil {
+		return err
+	}
+	confirm, err := promptPassword("Confirm password: ")
+	if err != nil {
+		return err
+	}
+	if password != confirm {
+		return fmt.Errorf("passwords do not match")
+	}
+
+	if err := keyring.Set(keyringService, keyringUser, password); err != nil {
+		return fmt.Errorf("failed to store password in keychain: %v", err)
+	}
+
+	fmt.Println("✓ Password saved to the OS keychain. --password can now be omitted.")
+	return nil
+}
+
+// logoutKeyring removes the stored encryption password from the OS keychain
+func logoutKeyring() error {
+	err := keyring.Delete(keyringService, keyringUser)
+	if errors.Is(err, keyring.ErrNotFound) {
+		fmt.Println("No password stored in the OS keychain")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to remove password from keychain: %v", err)
+	}
+
+	fmt.Println("✓ Password removed from the OS keychain")
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// getPatternsFile returns ~/.env-sync/patterns.txt, which lists extra secret
+// file names to sync besides .env files, one glob per line
+func getPatternsFile() (string, error) {
+	dir, err := getStorageDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "patterns.txt"), nil
+}
+
+// loadSecretPatterns reads the configured file name globs (e.g. "*.pem")
+func loadSecretPatterns() ([]string, error) {
+	patternsFile, err := getPatternsFile()
+	if err != nil {
+		return nil, err
+	}
+	return readGlobFile(patternsFile)
+}
+
+// addSecretPatterns appends new globs to ~/.env-sync/patterns.txt so later
+// scans and syncs pick up the same files
+func addSecretPatterns(patterns []string) error {
+	patternsFile, err := getPatternsFile()
+	if err != nil {
+		return err
+	}
+	return appendGlobFile(patternsFile, patterns)
+}
+
+// readGlobFile reads one glob per line, skipping blank lines and # comments.
+// A missing file has no globs.
+func readGlobFile(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var globs []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			globs = append(globs, line)
+		}
+	}
+	return globs, scanner.Err()
+}
+
+// appendGlobFile adds the globs a glob file doesn't list yet
+func appendGlobFile(file string, globs []string) error {
+	existing, err := readGlobFile(file)
+	if err != nil {
+		return err
+	}
+
+	known := make(map[string]bool)
+	for _, glob := range existing {
+		known[glob] = true
+	}
+	for _, glob := range globs {
+		if _, err := path.Match(glob, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %v", glob, err)
+		}
+		if !known[glob] {
+			known[glob] = true
+			existing = append(existing, glob)
+		}
+	}
+	return os.WriteFile(file, []byte(strings.Join(existing, "\n")+"\n"), 0644)
+}
+
+// isDotenvName reports whether a file name is a dotenv file (.env or .env.*)
+func isDotenvName(name string) bool {
+	return name == ".env" || strings.HasPrefix(name, ".env.")
+}
+
+// isSecretFile reports whether a file name is a dotenv file or matches one of
+// the configured secret file patterns
+func isSecretFile(name string, patterns []string) bool {
+	if isDotenvName(name) {
+		return true
+	}
+	return matchAnyGlob(patterns, name)
+}
+
+// isBinaryContents reports whether file contents can't be treated as text
+func isBinaryContents(contents string) bool {
+	return strings.IndexByte(contents, 0) >= 0 || !utf8.ValidString(contents)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The SQL is written once, for SQLite, and PostgreSQL runs the same
+// statements. Queries use ? placeholders, which postgresConnector rebinds to
+// $1, $2, ... on every connection. The schema's column types differ, and
+// schemaDDL adapts them. Everything else (upserts, ON CONFLICT DO NOTHING,
+// substr, COALESCE) is written in the syntax both accept.
+
+// postgresConnector hands out lib/pq connections that rebind placeholders
+type postgresConnector struct {
+	driver.Connector
+}
+
+// postgresDriverConn is what postgresConn needs of a lib/pq connection
+type postgresDriverConn interface {
+	driver.Conn
+	driver.ConnPrepareContext
+	driver.ConnBeginTx
+	driver.ExecerContext
+	driver.QueryerContext
+	driver.Pinger
+	driver.SessionResetter
+	driver.Validator
+}
+
+func (c postgresConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pc, ok := conn.(postgresDriverConn)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected PostgreSQL driver connection %T", conn)
+	}
+	return postgresConn{pc}, nil
+}
+
+// postgresConn rebinds the placeholders of every statement before lib/pq
+// sees it
+type postgresConn struct {
+	postgresDriverConn
+}
+
+func (c postgresConn) Prepare(query string) (driver.Stmt, error) {
+	return c.postgresDriverConn.Prepare(rebindPlaceholders(query))
+}
+
+func (c postgresConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	return c.postgresDriverConn.PrepareContext(ctx, rebindPlaceholders(query))
+}
+
+func (c postgresConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	return c.postgresDriverConn.ExecContext(ctx, rebindPlaceholders(query), args)
+}
+
+func (c postgresConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return c.postgresDriverConn.QueryContext(ctx, rebindPlaceholders(query), args)
+}
+
+// rebindPlaceholders numbers the ? placeholders of query as $1, $2, ...,
+// leaving string literals, quoted identifiers and comments alone
+func rebindPlaceholders(query string) string {
+	if !strings.Contains(query, "?") {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for i := 0; i < len(query); i++ {
+		switch c := query[i]; c {
+		case '\'', '"':
+			end := i + 1
+			for end < len(query) {
+				if query[end] == c {
+					// A doubled quote is an escaped one
+					if end+1 < len(query) && query[end+1] == c {
+						end += 2
+						continue
+					}
+					break
+				}
+				end++
+			}
+			end = min(end+1, len(query))
+			b.WriteString(query[i:end])
+			i = end - 1
+		case '-':
+			if strings.HasPrefix(query[i:], "--") {
+				end := strings.IndexByte(query[i:], '\n')
+				if end < 0 {
+					end = len(query) - i
+				}
+				b.WriteString(query[i : i+end])
+				i += end - 1
+			} else {
+				b.WriteByte(c)
+			}
+		case '?':
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// postgresNow is CURRENT_TIMESTAMP as PostgreSQL stores it in a TEXT column:
+// RFC3339 UTC, as env-sync writes timestamps itself
+const postgresNow = `to_char(CURRENT_TIMESTAMP AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"')`
+
+// postgresColumnTypes turns the SQLite column types of the schema into
+// PostgreSQL's. Timestamps stay text, as they are in SQLite, so they compare
+// and sort the same way on both.
+var postgresColumnTypes = strings.NewReplacer(
+	"INTEGER PRIMARY KEY AUTOINCREMENT", "BIGSERIAL PRIMARY KEY",
+	"DATETIME DEFAULT CURRENT_TIMESTAMP", "TEXT DEFAULT "+postgresNow,
+	"DATETIME", "TEXT",
+)
+
+// schemaDDL returns a CREATE TABLE or ALTER TABLE statement of the schema in
+// the dialect of the database
+func schemaDDL(query string, postgres bool) string {
+	if !postgres {
+		return query
+	}
+	return postgresColumnTypes.Replace(query)
+}
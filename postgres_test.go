@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestRebindPlaceholders(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{"none", `SELECT COUNT(*) FROM env_blobs`, `SELECT COUNT(*) FROM env_blobs`},
+		{"numbered in order", `UPDATE sync_lock SET expires_at = ? WHERE namespace = ? AND holder = ?`, `UPDATE sync_lock SET expires_at = $1 WHERE namespace = $2 AND holder = $3`},
+		{"string literal", `SELECT 'why?' FROM t WHERE a = ?`, `SELECT 'why?' FROM t WHERE a = $1`},
+		{"escaped quote", `SELECT 'it''s ?' FROM t WHERE a = ?`, `SELECT 'it''s ?' FROM t WHERE a = $1`},
+		{"quoted identifier", `SELECT "a?" FROM t WHERE b = ?`, `SELECT "a?" FROM t WHERE b = $1`},
+		{"comment", "SELECT a -- b = ?\nFROM t WHERE c = ?", "SELECT a -- b = ?\nFROM t WHERE c = $1"},
+		{"unterminated literal", `SELECT 'a?`, `SELECT 'a?`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rebindPlaceholders(tt.query); got != tt.want {
+				t.Errorf("rebindPlaceholders(%q) = %q, want %q", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSchemaDDL(t *testing.T) {
+	query := `CREATE TABLE t (id INTEGER PRIMARY KEY AUTOINCREMENT, at DATETIME NOT NULL, created_at DATETIME DEFAULT CURRENT_TIMESTAMP)`
+	if got := schemaDDL(query, false); got != query {
+		t.Errorf("schemaDDL for SQLite changed the query: %q", got)
+	}
+	want := `CREATE TABLE t (id BIGSERIAL PRIMARY KEY, at TEXT NOT NULL, created_at TEXT DEFAULT ` + postgresNow + `)`
+	if got := schemaDDL(query, true); got != want {
+		t.Errorf("schemaDDL for PostgreSQL = %q, want %q", got, want)
+	}
+}
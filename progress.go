@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/term"
+)
+
+const progressBarWidth = 30
+
+// progressBar draws a single self-updating "completed/total" line with an ETA
+type progressBar struct {
+	out      io.Writer
+	total    int
+	done     int
+	start    time.Time
+	lastDraw time.Time
+	drawn    bool
+}
+
+// newProgressBar draws on stderr so the bar never mixes with stdout output
+func newProgressBar(total int) *progressBar {
+	return &progressBar{out: os.Stderr, total: total, start: time.Now()}
+}
+
+// Increment marks one more item as done and redraws, at most ten times a second
+func (p *progressBar) Increment() {
+	p.done++
+	if p.done < p.total && time.Since(p.lastDraw) < 100*time.Millisecond {
+		return
+	}
+	p.draw()
+}
+
+// Printf prints a line above the bar without leaving a partial bar behind
+func (p *progressBar) Printf(format string, args ...interface{}) {
+	p.Clear()
+	fmt.Printf(format, args...)
+	p.draw()
+}
+
+// Clear erases the bar from the current line
+func (p *progressBar) Clear() {
+	if p.drawn {
+		fmt.Fprintf(p.out, "\r%s\r", strings.Repeat(" ", p.lineWidth()))
+		p.drawn = false
+	}
+}
+
+// Finish draws the final state and moves past the bar
+func (p *progressBar) Finish() {
+	p.draw()
+	fmt.Fprintln(p.out)
+	p.drawn = false
+}
+
+func (p *progressBar) draw() {
+	p.lastDraw = time.Now()
+
+	filled := progressBarWidth
+	percent := 100
+	if p.total > 0 {
+		filled = progressBarWidth * p.done / p.total
+		percent = 100 * p.done / p.total
+	}
+
+	eta := "--"
+	if p.done > 0 && p.done < p.total {
+		perItem := time.Since(p.start) / time.Duration(p.done)
+		eta = (perItem * time.Duration(p.total-p.done)).Round(time.Second).String()
+	} else if p.done >= p.total {
+		eta = "0s"
+	}
+
+	line := fmt.Sprintf("[%s%s] %d/%d %3d%% ETA %s",
+		strings.Repeat("#", filled), strings.Repeat("-", progressBarWidth-filled),
+		p.done, p.total, percent, eta)
+
+	// Pad so a shorter line fully overwrites the previous one
+	fmt.Fprintf(p.out, "\r%-*s", p.lineWidth(), line)
+	p.drawn = true
+}
+
+func (p *progressBar) lineWidth() int {
+	width := progressBarWidth + 40
+	if w, _, err := term.GetSize(int(os.Stderr.Fd())); err == nil && w > 0 && w-1 < width {
+		width = w - 1
+	}
+	return width
+}
+
+// startScanCounter redraws "Scanning... N directories" on stderr while a
+// scan runs, when stderr is a terminal. The returned func erases the line.
+func startScanCounter(scanned *atomic.Int64) (stop func()) {
+	if jsonOutput || !term.IsTerminal(int(os.Stderr.Fd())) {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		width := 0
+		for {
+			select {
+			case <-done:
+				fmt.Fprintf(os.Stderr, "\r%s\r", strings.Repeat(" ", width))
+				return
+			case <-ticker.C:
+				line := fmt.Sprintf("Scanning... %d directories", scanned.Load())
+				width = len(line)
+				fmt.Fprintf(os.Stderr, "\r%s", line)
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// daemonPruneInterval is how often the daemon applies its retention settings
+const daemonPruneInterval = 24 * time.Hour
+
+// historyPruner is implemented by backends that can delete old revisions
+type historyPruner interface {
+	DeleteEnvFileVersions(ctx context.Context, repoID, relativePath string, versions []int) error
+}
+
+// retentionDuration is a flag value that accepts days and weeks ("90d",
+// "2w") as well as time.ParseDuration units
+type retentionDuration time.Duration
+
+func (d *retentionDuration) String() string {
+	return time.Duration(*d).String()
+}
+
+func (d *retentionDuration) Set(value string) error {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if n, ok := strings.CutSuffix(value, suffix); ok {
+			count, err := strconv.Atoi(n)
+			if err != nil || count < 0 {
+				return fmt.Errorf("invalid duration %q", value)
+			}
+			*d = retentionDuration(time.Duration(count) * unit)
+			return nil
+		}
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil || parsed < 0 {
+		return fmt.Errorf("invalid duration %q (use e.g. 90d, 2w or 720h)", value)
+	}
+	*d = retentionDuration(parsed)
+	return nil
+}
+
+// pruneOptions selects the revisions prune removes
+type pruneOptions struct {
+	OlderThan time.Duration
+	Keep      int // Newest revisions of each file kept whatever their age
+	Filter    FileFilter
+	DryRun    bool
+}
+
+// pruneResult counts what a prune removed, or would remove with --dry-run
+type pruneResult struct {
+	Files     int `json:"files"`
+	Revisions int `json:"revisions"`
+	Kept      int `json:"kept_as_delta_base"` // Expired, but a newer delta needs them
+	Skipped   int `json:"skipped"`            // Files whose deltas couldn't be checked
+}
+
+// pruneHistory deletes the revisions older than opts.OlderThan from every
+// matching file. With replicas, each backend's history is pruned on its own,
+// since their version numbers differ; a failing replica is only logged.
+func pruneHistory(ctx context.Context, db Store, password string, opts pruneOptions) (*pruneResult, error) {
+	r, ok := db.(*ReplicatedStore)
+	if !ok {
+		return pruneStoreHistory(ctx, db, password, opts)
+	}
+
+	result, err := pruneStoreHistory(ctx, r.primary(), password, opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, target := range r.targets[1:] {
+		if target.store == nil {
+			continue
+		}
+		if _, err := pruneStoreHistory(ctx, target.store, password, opts); err != nil {
+			logger.Warn("failed to prune replica", "target", target.name, "error", err)
+		}
+	}
+	return result, nil
+}
+
+func pruneStoreHistory(ctx context.Context, db Store, password string, opts pruneOptions) (*pruneResult, error) {
+	pruner, ok := db.(historyPruner)
+	if !ok {
+		return nil, fmt.Errorf("this backend doesn't support pruning history")
+	}
+
+	records, err := db.ListEnvFiles(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	cutoff := time.Now().UTC().Add(-opts.OlderThan)
+	result := &pruneResult{}
+	var entries []AuditEntry
+	for _, record := range records {
+		if !opts.Filter.Match(record.RepoID, record.RelativePath) {
+			continue
+		}
+
+		expired, kept, err := expiredRevisions(ctx, db, record, password, opts.Keep, cutoff)
+		if err != nil {
+			logger.Warn("skipping file", "repo", record.RepoID, "path", record.RelativePath, "error", err)
+			result.Skipped++
+			continue
+		}
+		result.Kept += kept
+		if len(expired) == 0 {
+			continue
+		}
+
+		if !opts.DryRun {
+			if err := pruner.DeleteEnvFileVersions(ctx, record.RepoID, record.RelativePath, expired); err != nil {
+				return nil, err
+			}
+			entry := newAuditEntry(auditPrune, record.RepoID, record.RelativePath, record.FileHash, record.FileHash)
+			entry.Detail = fmt.Sprintf("%d revision(s)", len(expired))
+			entries = append(entries, entry)
+		}
+		result.Files++
+		result.Revisions += len(expired)
+	}
+	recordAudit(ctx, db, entries...)
+	return result, nil
+}
+
+// expiredRevisions returns the versions of a file created before cutoff,
+// except the newest keep (at least the newest, which is the current copy)
+// and any revision a kept delta is stored against. kept counts those.
+func expiredRevisions(ctx context.Context, db Store, record EnvFileRecord, password string, keep int, cutoff time.Time) ([]int, int, error) {
+	versions, err := db.ListEnvFileVersions(ctx, record.RepoID, record.RelativePath)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Versions are newest first, so everything from the first expired one on is too
+	first := len(versions)
+	for i := max(1, keep); i < len(versions); i++ {
+		if created, err := parseStoredTime(versions[i].CreatedAt); err == nil && created.Before(cutoff) {
+			first = i
+			break
+		}
+	}
+	if first == len(versions) {
+		return nil, 0, nil
+	}
+
+	// A delta's base is the revision that was current when it was stored
+	// (or a newer one with the same contents), so only the chain of the
+	// oldest kept revision can reach into the expired ones
+	needed := make(map[int]bool)
+	oldest := versions[first-1]
+	for range maxDeltaDepth {
+		revision, err := db.GetEnvFileVersion(ctx, record.RepoID, record.RelativePath, oldest.Version)
+		if err != nil {
+			return nil, 0, err
+		}
+		baseHash, err := deltaBaseHash(ctx, db, record.RepoID, revision.Contents, password)
+		if err != nil {
+			return nil, 0, err
+		}
+		base := -1
+		for i, version := range versions {
+			if version.FileHash == baseHash {
+				base = i
+				break
+			}
+		}
+		if baseHash == "" || base < first {
+			break
+		}
+		needed[base] = true
+		oldest = versions[base]
+	}
+
+	var expired []int
+	for i := first; i < len(versions); i++ {
+		if !needed[i] {
+			expired = append(expired, versions[i].Version)
+		}
+	}
+	return expired, len(needed), nil
+}
+
+// deltaBaseHash returns the hash of the revision stored contents are a delta
+// against, or "" if they are stored in full
+func deltaBaseHash(ctx context.Context, db Store, repoID, encryptedData, password string) (string, error) {
+	if kind := encryptionKind(encryptedData); kind != passwordPrefix && kind != dataKeyPrefix {
+		return "", nil
+	}
+	payload, err := openPayload(ctx, db, repoID, encryptedData, password)
+	if err == nil {
+		_, err = decompressPlaintext(payload)
+	}
+	var delta *deltaPayload
+	if errors.As(err, &delta) {
+		return delta.baseHash, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("%v (wrong password?)", err)
+	}
+	return "", nil
+}
+
+// runPrune removes old revisions from a database and reports what went
+func runPrune(ctx context.Context, dbConnStr, password string, opts pruneOptions) error {
+	db, err := OpenStore(dbConnStr)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := db.InitSchema(ctx); err != nil {
+		return err
+	}
+
+	result, err := pruneHistory(ctx, db, password, opts)
+	if err != nil {
+		return err
+	}
+
+	if jsonOutput {
+		printJSON(result)
+		return nil
+	}
+
+	verb := "Removed"
+	if opts.DryRun {
+		verb = "Would remove"
+	}
+	fmt.Printf("✓ %s %d revision(s) of %d file(s) older than %s\n", verb, result.Revisions, result.Files, formatAge(opts.OlderThan))
+	if result.Kept > 0 {
+		fmt.Printf("  Kept %d older revision(s) that newer deltas are stored against\n", result.Kept)
+	}
+	if result.Skipped > 0 {
+		fmt.Printf("  Skipped %d file(s) whose revisions couldn't be decrypted\n", result.Skipped)
+	}
+	return nil
+}
+
+// formatAge prints whole days as "90d" and anything else as a duration
+func formatAge(d time.Duration) string {
+	if d > 0 && d%(24*time.Hour) == 0 {
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	}
+	return d.String()
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// When sync or upload can't reach the database, the local files that changed
+// since they were last synced are encrypted and queued in ~/.env-sync/queue,
+// one entry per edit. The next sync or upload that connects stores them,
+// oldest first, before it looks at the local files, so every edit made
+// offline becomes a revision even if the file changes again (or is reverted)
+// before the database is back.
+
+// queueDirectory is where queued edits are kept, under the storage directory
+const queueDirectory = "queue"
+
+// queuedUpload is one local edit waiting for the database
+type queuedUpload struct {
+	LocalPath      string      `json:"local_path"`
+	RepoID         string      `json:"repo_id"`
+	RelativePath   string      `json:"relative_path"`
+	Contents       string      `json:"contents"` // Encrypted with the password, or as configured (see Encrypt)
+	FileHash       string      `json:"file_hash"`
+	FileModifiedAt string      `json:"file_modified_at"`
+	FileMode       os.FileMode `json:"file_mode,omitempty"`
+	// BaseHash is the stored copy the edit was made on: the hash last synced,
+	// or that of the edit queued before it. Empty if the file was never synced.
+	BaseHash string `json:"base_hash,omitempty"`
+	QueuedAt string `json:"queued_at"`
+
+	name string // File name in the queue directory
+}
+
+// offlineError reports a sync or upload that couldn't reach the database,
+// and how many edits it queued instead
+type offlineError struct {
+	queued int
+	cause  error
+}
+
+func (e *offlineError) Error() string {
+	return fmt.Sprintf("database unreachable, %d local edit(s) queued for the next sync: %v", e.queued, e.cause)
+}
+
+func (e *offlineError) Unwrap() error {
+	return e.cause
+}
+
+// unreachableMessages are what connection errors that mean the database
+// couldn't be reached look like once drivers have formatted them
+var unreachableMessages = []string{
+	"connection refused",
+	"no such host",
+	"i/o timeout",
+	"network is unreachable",
+	"no route to host",
+	"connection reset",
+	"name resolution",
+	"dial tcp",
+	"deadline exceeded",
+}
+
+// databaseUnreachable reports whether err, from connecting to the database,
+// means it couldn't be reached (no network, DNS or a server that is down),
+// rather than that it refused the connection or the URL is wrong
+func databaseUnreachable(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	message := strings.ToLower(err.Error())
+	for _, unreachable := range unreachableMessages {
+		if strings.Contains(message, unreachable) {
+			return true
+		}
+	}
+	return false
+}
+
+func getQueueDir() (string, error) {
+	dir, err := getStorageDir()
+	if err != nil {
+		return "", err
+	}
+	queueDir := filepath.Join(dir, queueDirectory)
+	if err := os.MkdirAll(queueDir, 0700); err != nil {
+		return "", err
+	}
+	return queueDir, nil
+}
+
+// loadUploadQueue returns the queued edits, oldest first. Entries that
+// don't parse are skipped with a warning and left in place.
+func loadUploadQueue() ([]queuedUpload, error) {
+	dir, err := getQueueDir()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upload queue: %v", err)
+	}
+
+	var queue []queuedUpload
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			logger.Warn("failed to read queued upload", "entry", entry.Name(), "error", err)
+			continue
+		}
+		var upload queuedUpload
+		if err := json.Unmarshal(data, &upload); err != nil {
+			logger.Warn("failed to parse queued upload", "entry", entry.Name(), "error", err)
+			continue
+		}
+		upload.name = entry.Name()
+		queue = append(queue, upload)
+	}
+	// Names start with the time queued
+	sort.Slice(queue, func(i, j int) bool { return queue[i].name < queue[j].name })
+	return queue, nil
+}
+
+// addToUploadQueue writes an entry after the others
+func addToUploadQueue(upload queuedUpload) error {
+	dir, err := getQueueDir()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(upload, "", "  ")
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%020d-%.8s.json", time.Now().UnixNano(), upload.FileHash)
+	tmp := filepath.Join(dir, name+".tmp")
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to queue upload: %v", err)
+	}
+	return os.Rename(tmp, filepath.Join(dir, name))
+}
+
+// removeFromUploadQueue drops an entry once it's stored or superseded
+func removeFromUploadQueue(upload queuedUpload) {
+	dir, err := getQueueDir()
+	if err != nil {
+		return
+	}
+	if err := os.Remove(filepath.Join(dir, upload.name)); err != nil && !os.IsNotExist(err) {
+		logger.Warn("failed to remove queued upload", "entry", upload.name, "error", err)
+	}
+}
+
+// queueOfflineEdits queues the files among files that changed since they
+// were last synced or queued, after the database couldn't be reached with
+// cause. It returns an *offlineError saying how many edits are queued, or
+// cause itself if this sync wouldn't upload or the queue can't be read.
+func queueOfflineEdits(files []string, basePath, password string, opts SyncOptions, cause error) error {
+	if opts.DryRun || !opts.allows(actionUpload) {
+		return cause
+	}
+	state, err := loadSyncState()
+	if err != nil {
+		return cause
+	}
+	queue, err := loadUploadQueue()
+	if err != nil {
+		logger.Warn("can't queue local edits", "error", err)
+		return cause
+	}
+	lastQueued := make(map[string]string)
+	for _, upload := range queue {
+		lastQueued[upload.LocalPath] = upload.FileHash
+	}
+
+	queued := 0
+	for _, file := range files {
+		upload, ok := offlineEdit(file, basePath, password, state, lastQueued, opts)
+		if !ok {
+			continue
+		}
+		if err := addToUploadQueue(upload); err != nil {
+			logger.Warn("failed to queue local edit", "file", file, "error", err)
+			continue
+		}
+		queueNote(opts, "⏳ Queued: %s (%s), uploaded on the next sync that reaches the database", upload.RelativePath, shortenRepoID(upload.RepoID))
+		queued++
+	}
+	return &offlineError{queued: len(queue) + queued, cause: cause}
+}
+
+// queueOfflineSync is queueOfflineEdits for a sync that couldn't connect
+// before it scanned for files, like the daemon's
+func queueOfflineSync(basePath, password string, opts SyncOptions, cause error) error {
+	files, err := scanFilesToSync(basePath, opts)
+	if err != nil {
+		return cause
+	}
+	return queueOfflineEdits(files, basePath, password, opts, cause)
+}
+
+// queueNote prints what happened to a queued edit, or logs it in the daemon
+func queueNote(opts SyncOptions, format string, args ...interface{}) {
+	if opts.LogResults {
+		logger.Info(fmt.Sprintf(format, args...))
+		return
+	}
+	notef(format+"\n", args...)
+}
+
+// offlineEdit reads a local file into a queue entry, unless it's unchanged
+// since it was last synced or queued, or sync wouldn't upload it anyway
+func offlineEdit(file, basePath, password string, state *syncState, lastQueued map[string]string, opts SyncOptions) (queuedUpload, bool) {
+	info, err := os.Stat(file)
+	if err != nil || opts.tooLarge(info.Size()) {
+		return queuedUpload{}, false
+	}
+	contents, err := readEnvFile(file)
+	if err != nil || contentsMarker(string(contents)) == markerIgnore {
+		return queuedUpload{}, false
+	}
+	if err := lintUpload(&SyncStats{}, file, string(contents), opts); err != nil {
+		logger.Warn("not queuing local edit", "file", file, "error", err)
+		return queuedUpload{}, false
+	}
+	repoID, relativePath, err := GetFileIdentifier(file, basePath)
+	if err != nil {
+		return queuedUpload{}, false
+	}
+
+	hash := HashFile(string(contents))
+	baseHash, ok := lastQueued[file]
+	if !ok {
+		baseHash, _ = state.get(file, repoID, relativePath)
+	}
+	if hash == baseHash {
+		return queuedUpload{}, false
+	}
+
+	encrypted, err := Encrypt(string(contents), password)
+	if err != nil {
+		logger.Warn("failed to encrypt local edit for the queue", "file", file, "error", err)
+		return queuedUpload{}, false
+	}
+	lastQueued[file] = hash
+	return queuedUpload{
+		LocalPath:      file,
+		RepoID:         repoID,
+		RelativePath:   relativePath,
+		Contents:       encrypted,
+		FileHash:       hash,
+		FileModifiedAt: formatStoredTime(toServerTime(info.ModTime())),
+		FileMode:       localFileMode(file),
+		BaseHash:       baseHash,
+		QueuedAt:       storedNow(),
+	}, true
+}
+
+// flushUploadQueue stores the queued edits in db, oldest first, each only if
+// the stored copy is still the one it was made on. An edit whose file was
+// changed elsewhere meanwhile is dropped: the local file, which has the
+// latest edit, goes through sync's conflict handling as usual. Edits that
+// fail to upload stay queued for the next sync.
+func flushUploadQueue(ctx context.Context, db Store, password string, state *syncState, opts SyncOptions) {
+	queue, err := loadUploadQueue()
+	if err != nil {
+		logger.Warn("failed to read upload queue", "error", err)
+		return
+	}
+	if len(queue) == 0 {
+		return
+	}
+
+	flushed := 0
+	for _, upload := range queue {
+		if ctx.Err() != nil {
+			return
+		}
+		repoID := storedRepoID(ctx, db, upload.LocalPath, upload.RepoID, upload.RelativePath)
+		displayName := fmt.Sprintf("%s (%s)", upload.RelativePath, shortenRepoID(repoID))
+		stored, err := db.GetEnvFileWithMetadata(ctx, repoID, upload.RelativePath)
+		if err != nil {
+			logger.Warn("failed to read stored file for queued edit", "file", upload.LocalPath, "error", err)
+			continue
+		}
+
+		superseded := false
+		switch {
+		case stored != nil && stored.FileHash == upload.FileHash:
+			// Already stored, e.g. by a sync that was interrupted
+		case (stored == nil && upload.BaseHash == "") || (stored != nil && stored.FileHash == upload.BaseHash):
+			err := flushQueuedUpload(ctx, db, repoID, password, upload, stored)
+			var stale *staleWriteError
+			if errors.As(err, &stale) {
+				superseded = true
+				break
+			}
+			if err != nil {
+				logger.Warn("failed to upload queued edit, keeping it queued", "file", upload.LocalPath, "error", err)
+				continue
+			}
+			queueNote(opts, "✓ Uploaded queued edit: %s, from %s", displayName, upload.QueuedAt)
+			recordAudit(ctx, db, newAuditEntry(auditUpload, repoID, upload.RelativePath, upload.BaseHash, upload.FileHash))
+			state.set(upload.LocalPath, repoID, upload.RelativePath, upload.FileHash)
+			flushed++
+		default:
+			superseded = true
+		}
+		if superseded {
+			queueNote(opts, "⚠ Dropped queued edit: %s (changed elsewhere meanwhile; sync compares it with the local file)", displayName)
+		}
+		removeFromUploadQueue(upload)
+	}
+	if flushed > 0 {
+		logger.Info("uploaded edits queued while offline", "edits", flushed)
+		if err := state.save(); err != nil {
+			logger.Warn("failed to save sync state", "error", err)
+		}
+	}
+}
+
+// flushQueuedUpload decrypts a queued edit and stores it over base
+func flushQueuedUpload(ctx context.Context, db Store, repoID, password string, upload queuedUpload, base *EnvFileRecord) error {
+	contents, err := Decrypt(upload.Contents, password)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt queued edit: %v", err)
+	}
+	if HashFile(contents) != upload.FileHash {
+		return fmt.Errorf("queued edit doesn't match its hash")
+	}
+	modTime, err := parseStoredTime(upload.FileModifiedAt)
+	if err != nil {
+		modTime = time.Now()
+	}
+	return uploadContents(ctx, db, repoID, upload.RelativePath, password, contents, modTime, upload.FileMode, base)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimitParam caps the requests per second sent to a libsql database, e.g.
+// libsql://db.turso.io?authToken=...&rate_limit=20, so a bulk sync doesn't
+// trip Turso's rate limits
+const rateLimitParam = "rate_limit"
+
+// libsqlLimiters are the request rate limiters of libsql hosts, by host name
+var libsqlLimiters sync.Map
+
+// splitRateLimit removes the rate_limit parameter from a connection string
+// and returns its value, 0 if it isn't set
+func splitRateLimit(connString string) (string, float64, error) {
+	u, err := url.Parse(connString)
+	if err != nil || !u.Query().Has(rateLimitParam) {
+		return connString, 0, nil
+	}
+	query := u.Query()
+	perSecond, err := strconv.ParseFloat(query.Get(rateLimitParam), 64)
+	if err != nil || perSecond <= 0 {
+		return "", 0, fmt.Errorf("invalid %s %q: expected requests per second, e.g. 20", rateLimitParam, query.Get(rateLimitParam))
+	}
+	query.Del(rateLimitParam)
+	u.RawQuery = query.Encode()
+	return u.String(), perSecond, nil
+}
+
+// limitLibsqlHost makes requests to host wait for the rate limiter. A second
+// of requests may go out at once before it starts pacing them.
+func limitLibsqlHost(host string, perSecond float64) {
+	libsqlLimiters.Store(host, rate.NewLimiter(rate.Limit(perSecond), max(1, int(perSecond))))
+}
+
+// rateLimitedTransport waits for the limiter of a request's host, if it has
+// one, before sending it
+type rateLimitedTransport struct {
+	base http.RoundTripper
+}
+
+func (t *rateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if limiter, ok := libsqlLimiters.Load(req.URL.Hostname()); ok {
+		if err := limiter.(*rate.Limiter).Wait(req.Context()); err != nil {
+			return nil, err
+		}
+	}
+	return t.base.RoundTrip(req)
+}
+
+// writeBudget caps the database writes of one sync (--max-writes). Files
+// left over when it runs out stay changed, so the next sync writes them.
+type writeBudget struct {
+	remaining int64
+}
+
+// newWriteBudget returns a budget of max writes, or nil for no limit
+func newWriteBudget(max int) *writeBudget {
+	if max <= 0 {
+		return nil
+	}
+	return &writeBudget{remaining: int64(max)}
+}
+
+// take spends one write, reporting false once the budget is used up
+func (b *writeBudget) take() bool {
+	if b == nil {
+		return true
+	}
+	return atomic.AddInt64(&b.remaining, -1) >= 0
+}
+
+// refund gives back a write that was taken but didn't happen
+func (b *writeBudget) refund() {
+	if b != nil {
+		atomic.AddInt64(&b.remaining, 1)
+	}
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// connStringList is a repeatable --db flag. Unlike stringList it doesn't split
+// on commas, since connection strings may contain them.
+type connStringList []string
+
+func (l *connStringList) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *connStringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// replicaTarget tracks writes to one backend of a ReplicatedStore
+type replicaTarget struct {
+	name       string
+	connString string
+	store      Store // nil if the backend couldn't be opened
+	writes     int64
+	failures   int64
+	lastErr    error
+}
+
+// ReplicatedStore reads from a primary backend and writes to the primary and
+// every replica. A failing replica is reported but doesn't fail the write.
+type ReplicatedStore struct {
+	mu      sync.Mutex
+	targets []*replicaTarget // targets[0] is the primary
+}
+
+// replicaReport is the per-target status printed after upload and sync
+type replicaReport struct {
+	Target   string `json:"target"`
+	Primary  bool   `json:"primary"`
+	Writes   int64  `json:"writes"`
+	Failures int64  `json:"failures"`
+	Error    string `json:"error,omitempty"`
+}
+
+// openReplicatedStore opens primary, plus a ReplicatedStore wrapper when
+// replicas are given. Replicas that can't be opened are reported, not fatal.
+func openReplicatedStore(primary string, replicas []string) (Store, error) {
+	db, err := OpenStore(primary)
+	if err != nil {
+		return nil, err
+	}
+	if len(replicas) == 0 {
+		return db, nil
+	}
+
+	r := &ReplicatedStore{targets: []*replicaTarget{{name: describeConnString(primary), connString: primary, store: db}}}
+	for _, connString := range replicas {
+		target := &replicaTarget{name: describeConnString(connString), connString: connString}
+		if target.store, err = OpenStore(connString); err != nil {
+			target.lastErr = err
+			logger.Warn("replica unavailable", "target", target.name, "error", err)
+		}
+		r.targets = append(r.targets, target)
+	}
+	return r, nil
+}
+
+// describeConnString returns a connection string without credentials, for display
+func describeConnString(connString string) string {
+	u, err := url.Parse(connString)
+	if err != nil || u.Scheme == "" {
+		return "database"
+	}
+	return u.Scheme + "://" + u.Host + u.Path
+}
+
+func (r *ReplicatedStore) primary() Store {
+	return r.targets[0].store
+}
+
+// write runs fn against every available target concurrently. Only a failure
+// on the primary is returned; replica failures are recorded and logged.
+func (r *ReplicatedStore) write(count int64, fn func(Store) error) error {
+	errs := make([]error, len(r.targets))
+	var wg sync.WaitGroup
+	for i, target := range r.targets {
+		if target.store == nil {
+			errs[i] = target.lastErr
+			continue
+		}
+		wg.Add(1)
+		go func(i int, s Store) {
+			defer wg.Done()
+			errs[i] = fn(s)
+		}(i, target.store)
+	}
+	wg.Wait()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, target := range r.targets {
+		if errs[i] != nil {
+			target.failures += count
+			target.lastErr = errs[i]
+			if i > 0 && target.store != nil {
+				logger.Warn("replica write failed", "target", target.name, "error", errs[i])
+			}
+		} else {
+			target.writes += count
+		}
+	}
+	return errs[0]
+}
+
+// Report returns the per-target write counts
+func (r *ReplicatedStore) Report() []replicaReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var reports []replicaReport
+	for i, target := range r.targets {
+		report := replicaReport{Target: target.name, Primary: i == 0, Writes: target.writes, Failures: target.failures}
+		if target.lastErr != nil {
+			report.Error = target.lastErr.Error()
+		}
+		reports = append(reports, report)
+	}
+	return reports
+}
+
+func (r *ReplicatedStore) Close() error {
+	var firstErr error
+	for _, target := range r.targets {
+		if target.store == nil {
+			continue
+		}
+		if err := target.store.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Ping checks the primary. A replica that fails the check is dropped until
+// reconnectReplicas opens it again.
+func (r *ReplicatedStore) Ping() error {
+	for i, target := range r.targets {
+		pool, ok := target.store.(connPool)
+		if !ok {
+			continue
+		}
+		err := pool.Ping()
+		if i == 0 {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			logger.Warn("replica unavailable", "target", target.name, "error", err)
+			target.lastErr = err
+			target.store.Close()
+			target.store = nil
+		}
+	}
+	return nil
+}
+
+func (r *ReplicatedStore) SetPoolLimits(maxConns int, lifetime time.Duration) {
+	for _, target := range r.targets {
+		if pool, ok := target.store.(connPool); ok {
+			pool.SetPoolLimits(maxConns, lifetime)
+		}
+	}
+}
+
+// reconnectReplicas tries again to open the replicas that were unavailable,
+// for a daemon that keeps the store open between syncs, and catches all of
+// them up on users and repo keys
+func (r *ReplicatedStore) reconnectReplicas(ctx context.Context, maxConns int, lifetime time.Duration) {
+	for _, target := range r.targets[1:] {
+		if target.store != nil {
+			continue
+		}
+		store, err := OpenStore(target.connString)
+		if err == nil {
+			if err = store.InitSchema(ctx); err != nil {
+				store.Close()
+			}
+		}
+		if err != nil {
+			target.lastErr = err
+			continue
+		}
+		if pool, ok := store.(connPool); ok {
+			pool.SetPoolLimits(maxConns, lifetime)
+		}
+		logger.Info("replica reconnected", "target", target.name)
+		target.store, target.lastErr = store, nil
+	}
+	r.copyTeam(ctx)
+}
+
+// resetCounts starts the write counts over, so each of a daemon's syncs
+// reports its own
+func (r *ReplicatedStore) resetCounts() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, target := range r.targets {
+		target.writes, target.failures = 0, 0
+	}
+}
+
+func (r *ReplicatedStore) InitSchema(ctx context.Context) error {
+	if err := r.primary().InitSchema(ctx); err != nil {
+		return err
+	}
+	for _, target := range r.targets[1:] {
+		if target.store == nil {
+			continue
+		}
+		if err := target.store.InitSchema(ctx); err != nil {
+			logger.Warn("replica unavailable", "target", target.name, "error", err)
+			target.lastErr = err
+			target.store.Close()
+			target.store = nil
+		}
+	}
+	r.copyTeam(ctx)
+	return nil
+}
+
+// copyTeam brings the users and repo key grants of the SQL replicas up to
+// date with the primary's. user add, share and unshare write to one
+// database, and without its grants a replica holds the files of shared
+// repos with no key to open them. Failures are reported like failed writes.
+func (r *ReplicatedStore) copyTeam(ctx context.Context) {
+	source, ok := r.primary().(TeamStore)
+	if !ok {
+		return
+	}
+	users, err := source.ListUsers(ctx)
+	if err != nil {
+		logger.Warn("failed to read users to copy to replicas", "error", err)
+		return
+	}
+	grants, err := source.ListAllRepoKeyGrants(ctx)
+	if err != nil {
+		logger.Warn("failed to read repo keys to copy to replicas", "error", err)
+		return
+	}
+
+	for _, target := range r.targets[1:] {
+		if target.store == nil {
+			continue
+		}
+		team, ok := target.store.(TeamStore)
+		if !ok {
+			if len(grants) > 0 {
+				logger.Warn("replica can't hold repo keys, so only the primary opens the files of shared repos", "target", target.name)
+			}
+			continue
+		}
+		if err := copyTeamTo(ctx, team, users, grants); err != nil {
+			logger.Warn("failed to copy users and repo keys to replica", "target", target.name, "error", err)
+			target.lastErr = err
+		}
+	}
+}
+
+// copyTeamTo adds the users team is missing and makes its grants match grants
+func copyTeamTo(ctx context.Context, team TeamStore, users []TeamUser, grants []RepoKeyGrant) error {
+	existingUsers, err := team.ListUsers(ctx)
+	if err != nil {
+		return err
+	}
+	known := make(map[string]string, len(existingUsers))
+	for _, user := range existingUsers {
+		known[user.Name] = user.PublicKey
+	}
+	for _, user := range users {
+		publicKey, ok := known[user.Name]
+		if !ok {
+			if err := team.AddUser(ctx, user.Name, user.PublicKey); err != nil {
+				return err
+			}
+		} else if publicKey != user.PublicKey {
+			return fmt.Errorf("user %s has another public key in the replica", user.Name)
+		}
+	}
+
+	existingGrants, err := team.ListAllRepoKeyGrants(ctx)
+	if err != nil {
+		return err
+	}
+	stale := make(map[[2]string]string, len(existingGrants))
+	for _, grant := range existingGrants {
+		stale[[2]string{grant.RepoID, grant.UserName}] = grant.WrappedKey
+	}
+	for _, grant := range grants {
+		key := [2]string{grant.RepoID, grant.UserName}
+		wrapped, ok := stale[key]
+		delete(stale, key)
+		if ok && wrapped == grant.WrappedKey {
+			continue
+		}
+		if err := team.PutRepoKeyGrant(ctx, grant.RepoID, grant.UserName, grant.WrappedKey); err != nil {
+			return err
+		}
+	}
+	// Grants the primary no longer has were revoked
+	for key := range stale {
+		if err := team.DeleteRepoKeyGrant(ctx, key[0], key[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *ReplicatedStore) UpsertEnvFile(ctx context.Context, repoID, relativePath, encryptedContents, fileHash, fileModTime string, fileMode os.FileMode) error {
+	return r.write(1, func(s Store) error {
+		return s.UpsertEnvFile(ctx, repoID, relativePath, encryptedContents, fileHash, fileModTime, fileMode)
+	})
+}
+
+func (r *ReplicatedStore) UpsertEnvFiles(ctx context.Context, records []EnvFileRecord) error {
+	return r.write(int64(len(records)), func(s Store) error {
+		return s.UpsertEnvFiles(ctx, records)
+	})
+}
+
+// UpsertEnvFileIf writes the primary first, conditionally if it can. Only a
+// write the primary took goes on to the replicas, unconditionally, so they
+// follow the primary rather than check their own copies.
+func (r *ReplicatedStore) UpsertEnvFileIf(ctx context.Context, record EnvFileRecord, base *EnvFileRecord) error {
+	primary := r.primary()
+	primaryErr := upsertIfUnchanged(ctx, primary, record, base)
+	var stale *staleWriteError
+	if errors.As(primaryErr, &stale) {
+		return primaryErr
+	}
+	return r.write(1, func(s Store) error {
+		if s == primary {
+			return primaryErr
+		}
+		return s.UpsertEnvFile(ctx, record.RepoID, record.RelativePath, record.Contents, record.FileHash, record.FileModifiedAt, record.FileMode)
+	})
+}
+
+func (r *ReplicatedStore) GetEnvFile(ctx context.Context, repoID, relativePath string) (string, error) {
+	return r.primary().GetEnvFile(ctx, repoID, relativePath)
+}
+
+func (r *ReplicatedStore) GetEnvFileWithMetadata(ctx context.Context, repoID, relativePath string) (*EnvFileRecord, error) {
+	return r.primary().GetEnvFileWithMetadata(ctx, repoID, relativePath)
+}
+
+func (r *ReplicatedStore) ListEnvFiles(ctx context.Context) ([]EnvFileRecord, error) {
+	return r.primary().ListEnvFiles(ctx)
+}
+
+func (r *ReplicatedStore) ListEnvFilesWithContents(ctx context.Context) ([]EnvFileRecord, error) {
+	return r.primary().ListEnvFilesWithContents(ctx)
+}
+
+func (r *ReplicatedStore) ListEnvFileVersions(ctx context.Context, repoID, relativePath string) ([]EnvFileVersion, error) {
+	return r.primary().ListEnvFileVersions(ctx, repoID, relativePath)
+}
+
+func (r *ReplicatedStore) GetEnvFileVersion(ctx context.Context, repoID, relativePath string, version int) (*EnvFileVersion, error) {
+	return r.primary().GetEnvFileVersion(ctx, repoID, relativePath, version)
+}
+
+func (r *ReplicatedStore) RenameRepo(ctx context.Context, oldRepoID, newRepoID string) error {
+	return r.write(1, func(s Store) error {
+		return s.RenameRepo(ctx, oldRepoID, newRepoID)
+	})
+}
+
+func (r *ReplicatedStore) MoveEnvFile(ctx context.Context, repoID, oldPath, newPath string) error {
+	return r.write(1, func(s Store) error {
+		return s.MoveEnvFile(ctx, repoID, oldPath, newPath)
+	})
+}
+
+func (r *ReplicatedStore) DeleteRepo(ctx context.Context, repoID string) error {
+	return r.write(1, func(s Store) error {
+		return s.DeleteRepo(ctx, repoID)
+	})
+}
+
+func (r *ReplicatedStore) DeleteEnvFile(ctx context.Context, repoID, relativePath string) error {
+	return r.write(1, func(s Store) error {
+		return s.DeleteEnvFile(ctx, repoID, relativePath)
+	})
+}
+
+// replicaReports returns per-target results, or nil if db has no replicas
+func replicaReports(db Store) []replicaReport {
+	if r, ok := db.(*ReplicatedStore); ok {
+		return r.Report()
+	}
+	return nil
+}
+
+// printReplicaReport prints per-target results if db replicates to several backends
+func printReplicaReport(db Store) {
+	reports := replicaReports(db)
+	if reports == nil {
+		return
+	}
+
+	fmt.Printf("\nTargets:\n")
+	for _, report := range reports {
+		role := "replica"
+		if report.Primary {
+			role = "primary"
+		}
+		mark := "✓"
+		if report.Failures > 0 || report.Error != "" {
+			mark = "✗"
+		}
+		fmt.Printf("  %s %-7s %s  (%d written, %d failed)\n", mark, role, report.Target, report.Writes, report.Failures)
+		if report.Error != "" {
+			fmt.Printf("      last error: %s\n", report.Error)
+		}
+	}
+}
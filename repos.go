@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// repoSummary is one line of 'env-sync repos list'
+type repoSummary struct {
+	RepoID      string `json:"repo_id"`
+	Files       int    `json:"files"`
+	LastUpdated string `json:"last_updated"`
+}
+
+// summarizeRepos groups stored files by repo ID
+func summarizeRepos(records []EnvFileRecord) []repoSummary {
+	byRepo := make(map[string]*repoSummary)
+	for _, record := range records {
+		summary, ok := byRepo[record.RepoID]
+		if !ok {
+			summary = &repoSummary{RepoID: record.RepoID}
+			byRepo[record.RepoID] = summary
+		}
+		summary.Files++
+		if record.UpdatedAt > summary.LastUpdated {
+			summary.LastUpdated = record.UpdatedAt
+		}
+	}
+
+	summaries := make([]repoSummary, 0, len(byRepo))
+	for _, summary := range byRepo {
+		summaries = append(summaries, *summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].RepoID < summaries[j].RepoID
+	})
+	return summaries
+}
+
+// manageRepos lists the repo IDs in the database, renames one (e.g. after
+// its remote URL changed) or forgets every file stored for one. Renamed
+// files are re-encrypted under the new ID (see binding.go).
+func manageRepos(ctx context.Context, dbConnStr, password, action string, args []string, force bool) error {
+	db, err := OpenStore(dbConnStr)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := db.InitSchema(ctx); err != nil {
+		return err
+	}
+
+	records, err := db.ListEnvFiles(ctx)
+	if err != nil {
+		return err
+	}
+	summaries := summarizeRepos(records)
+
+	switch action {
+	case "list", "":
+		if jsonOutput {
+			printJSON(map[string]interface{}{"repos": summaries})
+			return nil
+		}
+		if len(summaries) == 0 {
+			fmt.Println("No repos stored")
+			return nil
+		}
+		fmt.Printf("%d repo(s):\n", len(summaries))
+		for _, summary := range summaries {
+			fmt.Printf("  %-50s %3d file(s)  updated %s\n", summary.RepoID, summary.Files, summary.LastUpdated)
+		}
+	case "rename":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: env-sync repos rename <old-repo> <new-repo-id> --db <connection-string>")
+		}
+		oldRepoID, err := resolveRepoID(ctx, db, args[0])
+		if err != nil {
+			return err
+		}
+		newRepoID := args[1]
+		if newRepoID == oldRepoID {
+			return fmt.Errorf("%s already has that name", oldRepoID)
+		}
+
+		// Refuse to merge into a repo that already stores the same paths
+		oldPaths := make(map[string]bool)
+		for _, record := range records {
+			if record.RepoID == oldRepoID {
+				oldPaths[record.RelativePath] = true
+			}
+		}
+		for _, record := range records {
+			if record.RepoID == newRepoID && oldPaths[record.RelativePath] {
+				return fmt.Errorf("%s already has %s; forget one of the repos first", newRepoID, record.RelativePath)
+			}
+		}
+		// or revisions of them, left after their file was removed
+		for relativePath := range oldPaths {
+			versions, err := db.ListEnvFileVersions(ctx, newRepoID, relativePath)
+			if err != nil {
+				return err
+			}
+			if len(versions) > 0 {
+				return fmt.Errorf("%s already has revisions of %s; forget one of the repos first", newRepoID, relativePath)
+			}
+		}
+
+		// Make sure the password is right before renaming anything
+		for relativePath := range oldPaths {
+			record, err := db.GetEnvFileWithMetadata(ctx, oldRepoID, relativePath)
+			if err != nil || record == nil {
+				return fmt.Errorf("failed to read %s:%s: %v", oldRepoID, relativePath, err)
+			}
+			if _, err := openContents(ctx, db, oldRepoID, relativePath, record.Contents, password); err != nil {
+				return fmt.Errorf("failed to decrypt %s:%s: %v (wrong password?)", oldRepoID, relativePath, err)
+			}
+			break
+		}
+
+		if err := db.RenameRepo(ctx, oldRepoID, newRepoID); err != nil {
+			return err
+		}
+		for relativePath := range oldPaths {
+			if err := rebindEnvFile(ctx, db, newRepoID, relativePath, password); err != nil {
+				return err
+			}
+		}
+		var entries []AuditEntry
+		for _, record := range records {
+			if record.RepoID == oldRepoID {
+				entry := newAuditEntry(auditRename, newRepoID, record.RelativePath, record.FileHash, record.FileHash)
+				entry.Detail = "from " + oldRepoID
+				entries = append(entries, entry)
+			}
+		}
+		recordAudit(ctx, db, entries...)
+		fmt.Printf("✓ Renamed %s to %s (%d file(s))\n", oldRepoID, newRepoID, len(oldPaths))
+	case "forget":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: env-sync repos forget <repo> --force --db <connection-string>")
+		}
+		repoID, err := resolveRepoID(ctx, db, args[0])
+		if err != nil {
+			return err
+		}
+		files := 0
+		for _, summary := range summaries {
+			if summary.RepoID == repoID {
+				files = summary.Files
+			}
+		}
+		if !force {
+			return fmt.Errorf("this deletes %d file(s) of %s and their history; run again with --force to confirm", files, repoID)
+		}
+
+		if err := db.DeleteRepo(ctx, repoID); err != nil {
+			return err
+		}
+		var entries []AuditEntry
+		for _, record := range records {
+			if record.RepoID == repoID {
+				entries = append(entries, newAuditEntry(auditDelete, repoID, record.RelativePath, record.FileHash, ""))
+			}
+		}
+		recordAudit(ctx, db, entries...)
+		fmt.Printf("✓ Forgot %s (%d file(s) and their history deleted)\n", repoID, files)
+	default:
+		return fmt.Errorf("unknown repos action: %s (use list, rename or forget)", action)
+	}
+	return nil
+}
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// S3Store keeps encrypted env files as JSON objects in an S3 bucket
+// Layout under the prefix:
+//
+//	files/<escaped repo_id>/<escaped relative_path>.json           current copy
+//	versions/<escaped repo_id>/<escaped relative_path>/<n>.json    revision history
+type S3Store struct {
+	client *s3.Client
+	bucket string
+	prefix string
+}
+
+// s3Object is the JSON document stored for each env file and revision
+type s3Object struct {
+	RepoID         string      `json:"repo_id"`
+	RelativePath   string      `json:"relative_path"`
+	Version        int         `json:"version,omitempty"`
+	Contents       string      `json:"contents"`
+	FileHash       string      `json:"file_hash"`
+	FileModifiedAt string      `json:"file_modified_at"`
+	FileMode       os.FileMode `json:"file_mode,omitempty"`
+	CreatedAt      string      `json:"created_at"`
+	UpdatedAt      string      `json:"updated_at"`
+}
+
+// NewS3Store connects to an S3 (or S3-compatible) bucket
+// URL format: s3://bucket/prefix[?region=us-east-1&endpoint=https://minio.local:9000]
+// Credentials come from the standard AWS chain (env vars, shared config, SSO, instance role)
+func NewS3Store(connString string) (*S3Store, error) {
+	u, err := url.Parse(connString)
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 URL: %v", err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid S3 URL: missing bucket name (use s3://bucket/prefix)")
+	}
+
+	ctx := context.Background()
+	var opts []func(*config.LoadOptions) error
+	if region := u.Query().Get("region"); region != "" {
+		opts = append(opts, config.WithRegion(region))
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %v", err)
+	}
+
+	endpoint := u.Query().Get("endpoint")
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if endpoint != "" {
+			// S3-compatible services (MinIO, R2, ...) generally need path-style addressing
+			o.BaseEndpoint = aws.String(endpoint)
+			o.UsePathStyle = true
+		}
+	})
+
+	store := &S3Store{
+		client: client,
+		bucket: u.Host,
+		prefix: strings.Trim(u.Path, "/"),
+	}
+
+	if _, err := client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(store.bucket)}); err != nil {
+		return nil, fmt.Errorf("failed to access bucket %s: %v", store.bucket, err)
+	}
+
+	return store, nil
+}
+
+// Close is a no-op, the S3 client holds no persistent connection
+func (s *S3Store) Close() error {
+	return nil
+}
+
+// InitSchema is a no-op, objects are created on first upload
+func (s *S3Store) InitSchema(ctx context.Context) error {
+	return nil
+}
+
+func (s *S3Store) key(parts ...string) string {
+	if s.prefix != "" {
+		parts = append([]string{s.prefix}, parts...)
+	}
+	return path.Join(parts...)
+}
+
+func (s *S3Store) fileKey(repoID, relativePath string) string {
+	return s.key("files", url.PathEscape(repoID), escapeObjectPath(relativePath)+".json")
+}
+
+func (s *S3Store) versionsPrefix(repoID, relativePath string) string {
+	return s.key("versions", url.PathEscape(repoID), escapeObjectPath(relativePath)) + "/"
+}
+
+// escapeObjectPath escapes each segment of relativePath like the repo ID, so
+// a path with ".." segments can't reach the keys of another repo or outside
+// the prefix. "." segments and the leading "./" of stored paths are dropped,
+// as path.Join would.
+func escapeObjectPath(relativePath string) string {
+	var segments []string
+	for _, segment := range strings.Split(relativePath, "/") {
+		switch segment {
+		case "", ".":
+		case "..":
+			// url.PathEscape leaves dots alone
+			segments = append(segments, "%2E%2E")
+		default:
+			segments = append(segments, url.PathEscape(segment))
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+func (s *S3Store) getObject(ctx context.Context, key string) (*s3Object, error) {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var noKey *types.NoSuchKey
+		if errors.As(err, &noKey) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer out.Body.Close()
+
+	data, err := io.ReadAll(out.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var obj s3Object
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, fmt.Errorf("invalid object %s: %v", key, err)
+	}
+	return &obj, nil
+}
+
+func (s *S3Store) putObject(ctx context.Context, key string, obj *s3Object) error {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+	})
+	return err
+}
+
+func (s *S3Store) listKeys(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range page.Contents {
+			keys = append(keys, aws.ToString(obj.Key))
+		}
+	}
+	return keys, nil
+}
+
+// UpsertEnvFile writes the current copy and appends a new revision
+func (s *S3Store) UpsertEnvFile(ctx context.Context, repoID, relativePath, encryptedContents, fileHash, fileModTime string, fileMode os.FileMode) error {
+	now := storedNow()
+	fileModTime = normalizeStoredTime(fileModTime)
+
+	existing, err := s.getObject(ctx, s.fileKey(repoID, relativePath))
+	if err != nil {
+		return fmt.Errorf("failed to upsert env file: %v", err)
+	}
+	createdAt := now
+	if existing != nil {
+		createdAt = normalizeStoredTime(existing.CreatedAt)
+	}
+
+	obj := &s3Object{
+		RepoID:         repoID,
+		RelativePath:   relativePath,
+		Contents:       encryptedContents,
+		FileHash:       fileHash,
+		FileModifiedAt: fileModTime,
+		FileMode:       fileMode,
+		CreatedAt:      createdAt,
+		UpdatedAt:      now,
+	}
+	if err := s.putObject(ctx, s.fileKey(repoID, relativePath), obj); err != nil {
+		return fmt.Errorf("failed to upsert env file: %v", err)
+	}
+
+	versions, err := s.ListEnvFileVersions(ctx, repoID, relativePath)
+	if err != nil {
+		return fmt.Errorf("failed to record env file version: %v", err)
+	}
+	next := 1
+	if len(versions) > 0 {
+		next = versions[0].Version + 1
+	}
+
+	version := *obj
+	version.Version = next
+	version.CreatedAt = now
+	key := s.versionsPrefix(repoID, relativePath) + fmt.Sprintf("%08d.json", next)
+	if err := s.putObject(ctx, key, &version); err != nil {
+		return fmt.Errorf("failed to record env file version: %v", err)
+	}
+
+	return nil
+}
+
+// UpsertEnvFiles writes many env files. S3 has no transactions, so each
+// object is written in turn and the first failure is returned.
+func (s *S3Store) UpsertEnvFiles(ctx context.Context, records []EnvFileRecord) error {
+	for _, record := range records {
+		if err := s.UpsertEnvFile(ctx, record.RepoID, record.RelativePath, record.Contents, record.FileHash, record.FileModifiedAt, record.FileMode); err != nil {
+			return fmt.Errorf("%s:%s: %v", record.RepoID, record.RelativePath, err)
+		}
+	}
+	return nil
+}
+
+// GetEnvFile retrieves the encrypted contents of an env file
+func (s *S3Store) GetEnvFile(ctx context.Context, repoID, relativePath string) (string, error) {
+	obj, err := s.getObject(ctx, s.fileKey(repoID, relativePath))
+	if err != nil {
+		return "", fmt.Errorf("failed to query env file: %v", err)
+	}
+	if obj == nil {
+		return "", fmt.Errorf("env file not found: %s:%s", repoID, relativePath)
+	}
+	return obj.Contents, nil
+}
+
+// GetEnvFileWithMetadata retrieves an env file with its metadata
+func (s *S3Store) GetEnvFileWithMetadata(ctx context.Context, repoID, relativePath string) (*EnvFileRecord, error) {
+	obj, err := s.getObject(ctx, s.fileKey(repoID, relativePath))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query env file: %v", err)
+	}
+	if obj == nil {
+		return nil, nil // Not found
+	}
+	return obj.record(), nil
+}
+
+// ListEnvFiles returns all env files in the bucket, without their contents
+func (s *S3Store) ListEnvFiles(ctx context.Context) ([]EnvFileRecord, error) {
+	records, err := s.ListEnvFilesWithContents(ctx)
+	for i := range records {
+		records[i].Contents = ""
+	}
+	return records, err
+}
+
+// ListEnvFilesWithContents returns all env files including their encrypted
+// contents. Listing reads every object anyway, so this costs nothing extra.
+func (s *S3Store) ListEnvFilesWithContents(ctx context.Context) ([]EnvFileRecord, error) {
+	keys, err := s.listKeys(ctx, s.key("files")+"/")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query env files: %v", err)
+	}
+
+	var records []EnvFileRecord
+	for _, key := range keys {
+		obj, err := s.getObject(ctx, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", key, err)
+		}
+		if obj == nil {
+			continue
+		}
+		records = append(records, *obj.record())
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].RepoID != records[j].RepoID {
+			return records[i].RepoID < records[j].RepoID
+		}
+		return records[i].RelativePath < records[j].RelativePath
+	})
+
+	return records, nil
+}
+
+// ListEnvFileVersions returns all recorded revisions of an env file, newest first
+func (s *S3Store) ListEnvFileVersions(ctx context.Context, repoID, relativePath string) ([]EnvFileVersion, error) {
+	prefix := s.versionsPrefix(repoID, relativePath)
+	keys, err := s.listKeys(ctx, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query env file versions: %v", err)
+	}
+
+	var versions []EnvFileVersion
+	for _, key := range keys {
+		name := strings.TrimSuffix(strings.TrimPrefix(key, prefix), ".json")
+		if strings.Contains(name, "/") {
+			// Belongs to a nested path, not this file
+			continue
+		}
+		if _, err := strconv.Atoi(name); err != nil {
+			continue
+		}
+		obj, err := s.getObject(ctx, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", key, err)
+		}
+		if obj == nil {
+			continue
+		}
+		version := obj.version()
+		version.Contents = ""
+		versions = append(versions, *version)
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Version > versions[j].Version
+	})
+
+	return versions, nil
+}
+
+// GetEnvFileVersion retrieves a specific revision of an env file
+func (s *S3Store) GetEnvFileVersion(ctx context.Context, repoID, relativePath string, version int) (*EnvFileVersion, error) {
+	key := s.versionsPrefix(repoID, relativePath) + fmt.Sprintf("%08d.json", version)
+	obj, err := s.getObject(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query env file version: %v", err)
+	}
+	if obj == nil {
+		return nil, fmt.Errorf("version %d not found for %s:%s", version, repoID, relativePath)
+	}
+	return obj.version(), nil
+}
+
+// RenameRepo copies every file and revision of oldRepoID to newRepoID, then
+// deletes the originals. S3 has no transactions, so a failure part way
+// through leaves both copies and the rename can simply be run again.
+func (s *S3Store) RenameRepo(ctx context.Context, oldRepoID, newRepoID string) error {
+	for _, area := range []string{"files", "versions"} {
+		oldPrefix := s.key(area, url.PathEscape(oldRepoID)) + "/"
+		newPrefix := s.key(area, url.PathEscape(newRepoID)) + "/"
+
+		keys, err := s.listKeys(ctx, oldPrefix)
+		if err != nil {
+			return fmt.Errorf("failed to list %s: %v", oldPrefix, err)
+		}
+		for _, key := range keys {
+			obj, err := s.getObject(ctx, key)
+			if err != nil {
+				return fmt.Errorf("failed to read %s: %v", key, err)
+			}
+			if obj == nil {
+				continue
+			}
+			obj.RepoID = newRepoID
+			if err := s.putObject(ctx, newPrefix+strings.TrimPrefix(key, oldPrefix), obj); err != nil {
+				return fmt.Errorf("failed to write %s: %v", key, err)
+			}
+			if err := s.deleteObject(ctx, key); err != nil {
+				return fmt.Errorf("failed to delete %s: %v", key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// MoveEnvFile copies a file and its revisions to newPath, file last, then
+// deletes the originals. Like RenameRepo, an interrupted move can be run again.
+func (s *S3Store) MoveEnvFile(ctx context.Context, repoID, oldPath, newPath string) error {
+	existing, err := s.getObject(ctx, s.fileKey(repoID, newPath))
+	if err != nil {
+		return fmt.Errorf("failed to check %s: %v", newPath, err)
+	}
+	if existing != nil {
+		return fmt.Errorf("%s is already stored", newPath)
+	}
+	// Revisions left under newPath would be overwritten or mixed in
+	if revisions, err := s.listKeys(ctx, s.versionsPrefix(repoID, newPath)); err != nil {
+		return fmt.Errorf("failed to check %s: %v", newPath, err)
+	} else if len(revisions) > 0 {
+		return fmt.Errorf("%s is already stored", newPath)
+	}
+
+	oldPrefix := s.versionsPrefix(repoID, oldPath)
+	keys, err := s.listKeys(ctx, oldPrefix)
+	if err != nil {
+		return fmt.Errorf("failed to list %s: %v", oldPrefix, err)
+	}
+	keys = append(keys, s.fileKey(repoID, oldPath))
+	for _, key := range keys {
+		obj, err := s.getObject(ctx, key)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", key, err)
+		}
+		if obj == nil {
+			continue
+		}
+		obj.RelativePath = newPath
+		newKey := s.fileKey(repoID, newPath)
+		if rest, ok := strings.CutPrefix(key, oldPrefix); ok {
+			newKey = s.versionsPrefix(repoID, newPath) + rest
+		}
+		if err := s.putObject(ctx, newKey, obj); err != nil {
+			return fmt.Errorf("failed to write %s: %v", newKey, err)
+		}
+	}
+	for _, key := range keys {
+		if err := s.deleteObject(ctx, key); err != nil {
+			return fmt.Errorf("failed to delete %s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// DeleteRepo removes every file and revision of repoID
+func (s *S3Store) DeleteRepo(ctx context.Context, repoID string) error {
+	for _, area := range []string{"files", "versions"} {
+		keys, err := s.listKeys(ctx, s.key(area, url.PathEscape(repoID))+"/")
+		if err != nil {
+			return fmt.Errorf("failed to list %s: %v", area, err)
+		}
+		for _, key := range keys {
+			if err := s.deleteObject(ctx, key); err != nil {
+				return fmt.Errorf("failed to delete %s: %v", key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// DeleteEnvFile removes a file and its revisions
+func (s *S3Store) DeleteEnvFile(ctx context.Context, repoID, relativePath string) error {
+	keys, err := s.listKeys(ctx, s.versionsPrefix(repoID, relativePath))
+	if err != nil {
+		return fmt.Errorf("failed to list versions of %s: %v", relativePath, err)
+	}
+	for _, key := range append(keys, s.fileKey(repoID, relativePath)) {
+		if err := s.deleteObject(ctx, key); err != nil {
+			return fmt.Errorf("failed to delete %s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// DeleteEnvFileVersions removes revisions of a file
+func (s *S3Store) DeleteEnvFileVersions(ctx context.Context, repoID, relativePath string, versions []int) error {
+	for _, version := range versions {
+		key := s.versionsPrefix(repoID, relativePath) + fmt.Sprintf("%08d.json", version)
+		if err := s.deleteObject(ctx, key); err != nil {
+			return fmt.Errorf("failed to delete %s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+func (s *S3Store) deleteObject(ctx context.Context, key string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+// record converts an object to a file record. Objects written before
+// RFC3339 timestamps aren't rewritten, their times are converted on read.
+func (o *s3Object) record() *EnvFileRecord {
+	return &EnvFileRecord{
+		RepoID:         o.RepoID,
+		RelativePath:   o.RelativePath,
+		Contents:       o.Contents,
+		FileHash:       o.FileHash,
+		FileModifiedAt: normalizeStoredTime(o.FileModifiedAt),
+		FileMode:       o.FileMode,
+		CreatedAt:      normalizeStoredTime(o.CreatedAt),
+		UpdatedAt:      normalizeStoredTime(o.UpdatedAt),
+	}
+}
+
+func (o *s3Object) version() *EnvFileVersion {
+	return &EnvFileVersion{
+		RepoID:         o.RepoID,
+		RelativePath:   o.RelativePath,
+		Version:        o.Version,
+		Contents:       o.Contents,
+		FileHash:       o.FileHash,
+		FileModifiedAt: normalizeStoredTime(o.FileModifiedAt),
+		FileMode:       o.FileMode,
+		CreatedAt:      normalizeStoredTime(o.CreatedAt),
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEscapeObjectPath(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"./.env", ".env"},
+		{".env", ".env"},
+		{"./config/.env.local", "config/.env.local"},
+		{"./my app/.env", "my%20app/.env"},
+		{"./a%2Fb/.env", "a%252Fb/.env"},
+		{"../other/.env", "%2E%2E/other/.env"},
+		{"./config/../../.env", "config/%2E%2E/%2E%2E/.env"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			if got := escapeObjectPath(tt.in); got != tt.want {
+				t.Errorf("escapeObjectPath(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestS3KeysStayInRepo(t *testing.T) {
+	s := &S3Store{prefix: "team"}
+	for _, relativePath := range []string{"../other/.env", "./../../.env", "./config/../../../x"} {
+		if got, want := s.fileKey("repo", relativePath), "team/files/repo/"; !strings.HasPrefix(got, want) {
+			t.Errorf("fileKey(%q) = %q, want it under %q", relativePath, got, want)
+		}
+		if got, want := s.versionsPrefix("repo", relativePath), "team/versions/repo/"; !strings.HasPrefix(got, want) {
+			t.Errorf("versionsPrefix(%q) = %q, want it under %q", relativePath, got, want)
+		}
+	}
+}
@@ -4,26 +4,42 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
-func scanForEnvFiles(rootPath string) error {
-	files, err := scanForEnvFilesQuiet(rootPath)
+func scanForEnvFiles(rootPath string, followSymlinks bool) error {
+	var scanned atomic.Int64
+	stop := startScanCounter(&scanned)
+	files, err := walkForEnvFiles(rootPath, &scanned, followSymlinks)
+	stop()
 	if err != nil {
 		return err
 	}
 
 	if len(files) == 0 {
-		fmt.Println("No .env files found")
+		if jsonOutput {
+			printJSON(map[string]interface{}{"root": rootPath, "files": []string{}, "directories": scanned.Load()})
+			return nil
+		}
+		fmt.Printf("No .env or matching secret files found in %d directories\n", scanned.Load())
 		return nil
 	}
 
 	// Save the found files
-	if err := saveEnvFiles(files); err != nil {
+	if err := saveEnvFiles(files, rootPath); err != nil {
 		return fmt.Errorf("error saving env files: %v", err)
 	}
 
-	fmt.Printf("Found and saved %d .env file(s):\n", len(files))
+	if jsonOutput {
+		printJSON(map[string]interface{}{"root": rootPath, "files": files, "directories": scanned.Load()})
+		return nil
+	}
+
+	fmt.Printf("Found and saved %d secret file(s) in %d directories:\n", len(files), scanned.Load())
 	for _, file := range files {
 		fmt.Printf("  - %s\n", file)
 	}
@@ -31,8 +47,124 @@ func scanForEnvFiles(rootPath string) error {
 	return nil
 }
 
+// scanSyncRoots scans basePath plus any extra roots for sync, remembering
+// newly discovered files so list and upload see them too. With showCount, a
+// live directory counter is drawn on stderr.
+func scanSyncRoots(basePath string, extraRoots []string, rescan, followSymlinks, showCount bool) ([]string, error) {
+	roots := append([]string{basePath}, extraRoots...)
+	if rescan {
+		store, err := loadEnvFileStore()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load remembered scan roots: %v", err)
+		}
+		roots = append(roots, store.Roots...)
+	}
+
+	var scanned atomic.Int64
+	stop := func() {}
+	if showCount {
+		stop = startScanCounter(&scanned)
+	}
+
+	seen := make(map[string]bool)
+	var files []string
+	for i, root := range roots {
+		found, err := walkForEnvFiles(root, &scanned, followSymlinks)
+		if err != nil {
+			if i == 0 {
+				stop()
+				return nil, err
+			}
+			logger.Warn("skipping scan root", "root", root, "error", err)
+			continue
+		}
+		for _, file := range found {
+			absFile, err := filepath.Abs(file)
+			if err != nil {
+				absFile = file
+			}
+			if !seen[absFile] {
+				seen[absFile] = true
+				files = append(files, file)
+			}
+		}
+	}
+	stop()
+
+	if len(extraRoots) > 0 || rescan {
+		added, err := rememberEnvFiles(files, extraRoots)
+		if err != nil {
+			logger.Warn("failed to remember scanned files", "error", err)
+		} else if len(added) > 0 {
+			notef("Discovered %d new .env file(s)\n", len(added))
+		}
+	}
+
+	return files, nil
+}
+
+// scanWorkers is how many directories a scan reads at once
+const scanWorkers = 16
+
+// defaultSkipDirs are never descended into, besides hidden directories
+var defaultSkipDirs = []string{"node_modules", "vendor"}
+
+// getSkipDirsFile returns ~/.env-sync/skip.txt, which lists extra directory
+// names scans never descend into, one glob per line
+func getSkipDirsFile() (string, error) {
+	dir, err := getStorageDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "skip.txt"), nil
+}
+
+// loadSkipDirs returns the default and configured directory names to skip
+func loadSkipDirs() ([]string, error) {
+	skipFile, err := getSkipDirsFile()
+	if err != nil {
+		return defaultSkipDirs, err
+	}
+	extra, err := readGlobFile(skipFile)
+	return append(append([]string{}, defaultSkipDirs...), extra...), err
+}
+
+// addSkipDirs appends new directory name globs to ~/.env-sync/skip.txt so
+// later scans and syncs skip the same directories
+func addSkipDirs(names []string) error {
+	for _, name := range names {
+		if strings.ContainsRune(name, '/') {
+			return fmt.Errorf("invalid skip directory %q: give a directory name, not a path", name)
+		}
+	}
+	skipFile, err := getSkipDirsFile()
+	if err != nil {
+		return err
+	}
+	return appendGlobFile(skipFile, names)
+}
+
 // scanForEnvFilesQuiet scans for env files without printing output
 func scanForEnvFilesQuiet(rootPath string) ([]string, error) {
+	return walkForEnvFiles(rootPath, new(atomic.Int64), false)
+}
+
+// walkForEnvFiles scans rootPath for env files, reading up to scanWorkers
+// directories in parallel and counting each one in scanned. The files are
+// returned sorted, as absolute paths, so a relative or extended-length root
+// (\\?\D:\...) yields the same paths as any other spelling of it.
+//
+// With followSymlinks, symlinked directories are descended into too, and
+// their files keep the path through the link. A link back to a directory
+// it's in is a cycle and skipped, as are links to directories under the
+// root, which are scanned anyway. A file reached through several links is
+// returned once, under the first of its paths in sorted order.
+func walkForEnvFiles(rootPath string, scanned *atomic.Int64, followSymlinks bool) ([]string, error) {
+	rootPath, err := normalizePath(rootPath)
+	if err != nil {
+		return nil, err
+	}
+
 	// Verify the path exists
 	info, err := os.Stat(rootPath)
 	if err != nil {
@@ -42,40 +174,140 @@ func scanForEnvFilesQuiet(rootPath string) ([]string, error) {
 		return nil, fmt.Errorf("path is not a directory: %s", rootPath)
 	}
 
-	var envFiles []string
+	ignore := newIgnoreMatcher(rootPath)
 
-	// Walk through the directory recursively
-	err = filepath.Walk(rootPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			// Skip directories we can't access
-			return nil
+	patterns, err := loadSecretPatterns()
+	if err != nil {
+		logger.Warn("failed to load secret file patterns", "error", err)
+	}
+	skipDirs, err := loadSkipDirs()
+	if err != nil {
+		logger.Warn("failed to load skip directories", "error", err)
+	}
+
+	realRoot := rootPath
+	if followSymlinks {
+		if realRoot, err = filepath.EvalSymlinks(rootPath); err != nil {
+			return nil, err
 		}
+	}
 
-		// Skip hidden directories and node_modules, vendor, etc.
-		if info.IsDir() {
-			name := info.Name()
-			if strings.HasPrefix(name, ".") && name != "." {
-				return filepath.SkipDir
-			}
-			if name == "node_modules" || name == "vendor" {
-				return filepath.SkipDir
+	var (
+		mu       sync.Mutex
+		envFiles []string
+		realOf   = make(map[string]string) // found file -> its path with links resolved
+		wg       sync.WaitGroup
+		slots    = make(chan struct{}, scanWorkers)
+	)
+
+	// Each directory gets a goroutine, but only scanWorkers read at a time.
+	// real is dir with links resolved, and targets the links followed to
+	// reach it, resolved, for cycle detection.
+	var walk func(dir, real string, targets []string)
+	walk = func(dir, real string, targets []string) {
+		defer wg.Done()
+
+		slots <- struct{}{}
+		found, subdirs, links := scanDir(dir, ignore, patterns, skipDirs, followSymlinks)
+		<-slots
+		scanned.Add(1)
+
+		if len(found) > 0 {
+			mu.Lock()
+			envFiles = append(envFiles, found...)
+			for _, file := range found {
+				realOf[file] = filepath.Join(real, filepath.Base(file))
 			}
+			mu.Unlock()
 		}
-
-		// Check if it's a .env file
-		if !info.IsDir() {
-			name := info.Name()
-			if name == ".env" || strings.HasPrefix(name, ".env.") {
-				envFiles = append(envFiles, path)
+		for _, subdir := range subdirs {
+			wg.Add(1)
+			go walk(subdir, filepath.Join(real, filepath.Base(subdir)), targets)
+		}
+		for _, link := range links {
+			target, err := filepath.EvalSymlinks(link)
+			if err != nil {
+				logger.Debug("skipping broken symlink", "path", link, "error", err)
+				continue
 			}
+			if within(realRoot, target) || slices.ContainsFunc(append(targets, real), func(visited string) bool { return within(target, visited) }) {
+				logger.Debug("skipping symlink cycle or link into the scanned tree", "path", link, "target", target)
+				continue
+			}
+			wg.Add(1)
+			go walk(link, target, append(slices.Clip(targets), target))
 		}
+	}
 
-		return nil
-	})
+	wg.Add(1)
+	walk(rootPath, realRoot, nil)
+	wg.Wait()
+
+	sort.Strings(envFiles)
+	if followSymlinks {
+		// The same file through several links: keep its first path
+		seen := make(map[string]bool, len(envFiles))
+		envFiles = slices.DeleteFunc(envFiles, func(file string) bool {
+			if seen[realOf[file]] {
+				return true
+			}
+			seen[realOf[file]] = true
+			return false
+		})
+	}
+	return envFiles, nil
+}
 
+// scanDir returns the secret files directly in dir and the subdirectories
+// to descend into; with followSymlinks, also the symlinks to directories.
+// Directories that can't be read are skipped.
+func scanDir(dir string, ignore *ignoreMatcher, patterns, skipDirs []string, followSymlinks bool) (found, subdirs, links []string) {
+	entries, err := os.ReadDir(dir)
 	if err != nil {
-		return nil, fmt.Errorf("error scanning directory: %v", err)
+		return nil, nil, nil
 	}
 
-	return envFiles, nil
+	for _, entry := range entries {
+		name := entry.Name()
+		path := filepath.Join(dir, name)
+
+		// Honor .envsyncignore files at the root and in any directory below it
+		if ignore.Ignored(path, entry.IsDir()) {
+			continue
+		}
+
+		// Skip hidden directories, node_modules, vendor and configured names.
+		// Symlinked directories are only followed with followSymlinks.
+		if entry.IsDir() {
+			if !strings.HasPrefix(name, ".") && !matchAnyGlob(skipDirs, name) {
+				subdirs = append(subdirs, path)
+			}
+			continue
+		}
+		// Windows junctions are irregular rather than symlinks
+		if followSymlinks && entry.Type()&(os.ModeSymlink|os.ModeIrregular) != 0 && !strings.HasPrefix(name, ".") && !matchAnyGlob(skipDirs, name) {
+			if info, err := os.Stat(path); err == nil && info.IsDir() {
+				if !ignore.Ignored(path, true) {
+					links = append(links, path)
+				}
+				continue
+			}
+		}
+
+		// Check if it's a .env file or matches a configured secret file pattern,
+		// unless the file opts out (or in) with a marker comment
+		if isSecretFile(name, patterns) {
+			if readFileMarker(path) != markerIgnore {
+				found = append(found, path)
+			}
+			continue
+		}
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		if info, err := entry.Info(); err == nil && isMarkerCandidate(name, info.Size()) && readFileMarker(path) == markerSync {
+			found = append(found, path)
+		}
+	}
+	return found, subdirs, links
 }
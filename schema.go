@@ -0,0 +1,706 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// schemaMigration is one step of the SQL schema. Steps run in order, once
+// each, in a transaction, and only add tables and columns, move rows or
+// rewrite values in a newer format; they never drop data. Databases set up
+// before schema_version existed are in an unknown state, so every step
+// checks for what it creates.
+type schemaMigration struct {
+	version int
+	name    string
+	apply   func(tx *schemaTx) error
+}
+
+// schemaTx is the transaction a migration runs in. The schema is written for
+// SQLite; on PostgreSQL, ddl adapts its column types and tableColumns looks
+// tables up in information_schema instead of sqlite_master.
+type schemaTx struct {
+	*sql.Tx
+	postgres bool
+}
+
+// ddl returns a CREATE TABLE or ALTER TABLE statement for this database
+func (tx *schemaTx) ddl(query string) string {
+	return schemaDDL(query, tx.postgres)
+}
+
+var schemaMigrations = []schemaMigration{
+	{1, "move path-based env_files to env_files_legacy", renameLegacyFiles},
+	{2, "create env_files and env_file_versions", createFileTables},
+	{3, "copy legacy files found on this machine", func(tx *schemaTx) error {
+		_, left, err := adoptLegacyFiles(tx, "")
+		if left > 0 {
+			logger.Warn("kept files from the path-based schema whose paths aren't on this machine; run env-sync migrate where they are",
+				"table", legacyFilesTable, "rows", left)
+		}
+		return err
+	}},
+	{4, "add file_mode", addFileModeColumns},
+	{5, "create env_blobs and add blob_hash", createBlobTable},
+	{6, "create users and repo_keys", createTeamTables},
+	{7, "create audit_log", createAuditTable},
+	{8, "create sync_lock", createSyncLockTable},
+	{9, "create env_file_tags", createTagTable},
+	{10, "create password_verifier", createVerifierTable},
+	{11, "store timestamps as RFC3339 UTC", normalizeTimestamps},
+	{12, "create ci_tokens", createCITokenTable},
+	{13, "add row_version", addRowVersionColumn},
+	{14, "add namespace", addNamespaceColumns},
+}
+
+// latestSchemaVersion is the schema this build writes
+var latestSchemaVersion = schemaMigrations[len(schemaMigrations)-1].version
+
+// legacyFilesTable holds rows of the path-based schema that couldn't be
+// given a repo ID yet
+const legacyFilesTable = "env_files_legacy"
+
+// migrate brings the schema up to date, running only the migrations the
+// database hasn't recorded in schema_version
+func (db *Database) migrate(ctx context.Context) error {
+	_, err := db.conn.ExecContext(ctx, schemaDDL(`
+	CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	`, db.postgres))
+	if err != nil {
+		return fmt.Errorf("failed to create schema_version table: %v", err)
+	}
+
+	current, err := db.schemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if current > latestSchemaVersion {
+		logger.Warn("database schema is newer than this env-sync, consider upgrading", "schema", current, "supported", latestSchemaVersion)
+		return nil
+	}
+
+	for _, m := range schemaMigrations {
+		if m.version <= current {
+			continue
+		}
+		if err := db.applyMigration(ctx, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// schemaVersion returns the newest migration applied, 0 for a new database
+// or one set up before migrations were recorded
+func (db *Database) schemaVersion(ctx context.Context) (int, error) {
+	var version int
+	if err := db.conn.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&version); err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %v", err)
+	}
+	return version, nil
+}
+
+func (db *Database) applyMigration(ctx context.Context, m schemaMigration) error {
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if err := m.apply(&schemaTx{Tx: tx, postgres: db.postgres}); err != nil {
+		return fmt.Errorf("schema migration %d (%s) failed: %v", m.version, m.name, err)
+	}
+	// Another process may have applied it meanwhile; the steps are idempotent
+	if _, err := tx.Exec(`INSERT INTO schema_version (version, name) VALUES (?, ?) ON CONFLICT (version) DO NOTHING`, m.version, m.name); err != nil {
+		return fmt.Errorf("failed to record schema migration %d: %v", m.version, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit schema migration %d: %v", m.version, err)
+	}
+	logger.Debug("applied schema migration", "version", m.version, "name", m.name)
+	return nil
+}
+
+// tableColumns returns the columns of a table, or nil if it doesn't exist
+func tableColumns(tx *schemaTx, table string) (map[string]bool, error) {
+	query := `SELECT name FROM sqlite_master WHERE type = 'table' AND name = ?`
+	if tx.postgres {
+		query = `SELECT table_name FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = ?`
+	}
+	var name string
+	err := tx.QueryRow(query, table).Scan(&name)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query(fmt.Sprintf(`SELECT * FROM %s LIMIT 0`, table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	names, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]bool, len(names))
+	for _, name := range names {
+		columns[name] = true
+	}
+	return columns, nil
+}
+
+// ensureColumn adds a column to an existing table if it isn't there yet
+func ensureColumn(tx *schemaTx, table, column, definition string) error {
+	columns, err := tableColumns(tx, table)
+	if err != nil {
+		return fmt.Errorf("failed to read columns of %s: %v", table, err)
+	}
+	if columns[column] {
+		return nil
+	}
+	if _, err := tx.Exec(tx.ddl(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, definition))); err != nil {
+		return fmt.Errorf("failed to add %s.%s: %v", table, column, err)
+	}
+	return nil
+}
+
+// renameLegacyFiles sets aside an env_files table from before files were
+// keyed by git remote, which stored them by absolute path instead
+func renameLegacyFiles(tx *schemaTx) error {
+	columns, err := tableColumns(tx, "env_files")
+	if err != nil {
+		return fmt.Errorf("failed to read columns of env_files: %v", err)
+	}
+	if !columns["path"] || columns["repo_id"] {
+		return nil
+	}
+	if _, err := tx.Exec(fmt.Sprintf(`ALTER TABLE env_files RENAME TO %s`, legacyFilesTable)); err != nil {
+		return fmt.Errorf("failed to rename path-based env_files: %v", err)
+	}
+	return nil
+}
+
+// createFileTables creates env_files, keyed by repo ID (git remote URL) and
+// path within the repo, and env_file_versions, which keeps every upload as a
+// numbered revision so it can be rolled back
+func createFileTables(tx *schemaTx) error {
+	filesQuery := `
+	CREATE TABLE IF NOT EXISTS env_files (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		repo_id TEXT NOT NULL,
+		relative_path TEXT NOT NULL,
+		contents TEXT NOT NULL,
+		file_hash TEXT NOT NULL,
+		file_modified_at DATETIME NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(repo_id, relative_path)
+	);
+	`
+	if _, err := tx.Exec(tx.ddl(filesQuery)); err != nil {
+		return fmt.Errorf("failed to create table: %v", err)
+	}
+
+	if _, err := tx.Exec(`CREATE INDEX IF NOT EXISTS idx_env_files_repo_id ON env_files(repo_id);`); err != nil {
+		return fmt.Errorf("failed to create repo_id index: %v", err)
+	}
+
+	versionsQuery := `
+	CREATE TABLE IF NOT EXISTS env_file_versions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		repo_id TEXT NOT NULL,
+		relative_path TEXT NOT NULL,
+		version INTEGER NOT NULL,
+		contents TEXT NOT NULL,
+		file_hash TEXT NOT NULL,
+		file_modified_at DATETIME NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(repo_id, relative_path, version)
+	);
+	`
+	if _, err := tx.Exec(tx.ddl(versionsQuery)); err != nil {
+		return fmt.Errorf("failed to create versions table: %v", err)
+	}
+	return nil
+}
+
+// addFileModeColumns stores each file's permission bits; 0 means unknown
+func addFileModeColumns(tx *schemaTx) error {
+	for _, table := range []string{"env_files", "env_file_versions"} {
+		if err := ensureColumn(tx, table, "file_mode", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createBlobTable stores contents once per distinct encrypted copy,
+// referenced by its hash, so identical files and unchanged revisions share a
+// row. Rows written before keep their contents inline with an empty blob_hash.
+func createBlobTable(tx *schemaTx) error {
+	blobsQuery := `
+	CREATE TABLE IF NOT EXISTS env_blobs (
+		hash TEXT PRIMARY KEY,
+		contents TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	`
+	if _, err := tx.Exec(tx.ddl(blobsQuery)); err != nil {
+		return fmt.Errorf("failed to create blobs table: %v", err)
+	}
+
+	for _, table := range []string{"env_files", "env_file_versions"} {
+		if err := ensureColumn(tx, table, "blob_hash", "TEXT NOT NULL DEFAULT ''"); err != nil {
+			return err
+		}
+	}
+
+	// Uploads look for stored copies of the same contents to reuse
+	if _, err := tx.Exec(`CREATE INDEX IF NOT EXISTS idx_env_files_file_hash ON env_files(file_hash);`); err != nil {
+		return fmt.Errorf("failed to create file hash index: %v", err)
+	}
+	return nil
+}
+
+// createSyncLockTable holds the lease of the sync that is writing, if any
+func createSyncLockTable(tx *schemaTx) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS sync_lock (
+		name TEXT PRIMARY KEY,
+		holder TEXT NOT NULL,
+		acquired_at DATETIME NOT NULL,
+		expires_at DATETIME NOT NULL
+	);
+	`
+	if _, err := tx.Exec(tx.ddl(query)); err != nil {
+		return fmt.Errorf("failed to create sync_lock table: %v", err)
+	}
+	return nil
+}
+
+// timestampColumns are the columns normalizeTimestamps rewrites, by table
+var timestampColumns = map[string][]string{
+	"env_files":         {"file_modified_at", "created_at", "updated_at"},
+	"env_file_versions": {"file_modified_at", "created_at"},
+	"audit_log":         {"created_at"},
+	"users":             {"created_at"},
+	"sync_lock":         {"acquired_at", "expires_at"},
+}
+
+// normalizeTimestamps rewrites timestamps stored as "2006-01-02 15:04:05"
+// (by CURRENT_TIMESTAMP or older versions) as RFC3339 UTC. Each distinct
+// value is parsed once and every row holding it updated together.
+func normalizeTimestamps(tx *schemaTx) error {
+	for table, timeColumns := range timestampColumns {
+		columns, err := tableColumns(tx, table)
+		if err != nil {
+			return fmt.Errorf("failed to read columns of %s: %v", table, err)
+		}
+		for _, column := range timeColumns {
+			if !columns[column] {
+				continue
+			}
+			rows, err := tx.Query(fmt.Sprintf(`SELECT DISTINCT %s FROM %s WHERE %s IS NOT NULL`, column, table, column))
+			if err != nil {
+				return fmt.Errorf("failed to read %s.%s: %v", table, column, err)
+			}
+			var values []string
+			for rows.Next() {
+				var value string
+				if err := rows.Scan(&value); err != nil {
+					rows.Close()
+					return fmt.Errorf("failed to read %s.%s: %v", table, column, err)
+				}
+				values = append(values, value)
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return fmt.Errorf("failed to read %s.%s: %v", table, column, err)
+			}
+
+			for _, value := range values {
+				normalized := normalizeStoredTime(value)
+				if normalized == value {
+					continue
+				}
+				if _, err := tx.Exec(fmt.Sprintf(`UPDATE %s SET %s = ? WHERE %s = ?`, table, column, column), normalized, value); err != nil {
+					return fmt.Errorf("failed to rewrite %s.%s: %v", table, column, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// addRowVersionColumn counts the writes to each current copy, so a write can
+// check that nobody else wrote since it read the file
+func addRowVersionColumn(tx *schemaTx) error {
+	return ensureColumn(tx, "env_files", "row_version", "INTEGER NOT NULL DEFAULT 0")
+}
+
+// namespacedTables are the tables addNamespaceColumns rebuilds with the
+// namespace in their keys, as they are defined from then on, and the
+// indexes they had
+var namespacedTables = []struct {
+	name, definition string
+	indexes          []string
+}{
+	{"env_files", `(
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		namespace TEXT NOT NULL DEFAULT '',
+		repo_id TEXT NOT NULL,
+		relative_path TEXT NOT NULL,
+		contents TEXT NOT NULL,
+		blob_hash TEXT NOT NULL DEFAULT '',
+		file_hash TEXT NOT NULL,
+		file_modified_at DATETIME NOT NULL,
+		file_mode INTEGER NOT NULL DEFAULT 0,
+		row_version INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(namespace, repo_id, relative_path)
+	)`, []string{
+		`CREATE INDEX IF NOT EXISTS idx_env_files_repo_id ON env_files(namespace, repo_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_env_files_file_hash ON env_files(file_hash)`,
+	}},
+	{"env_file_versions", `(
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		namespace TEXT NOT NULL DEFAULT '',
+		repo_id TEXT NOT NULL,
+		relative_path TEXT NOT NULL,
+		version INTEGER NOT NULL,
+		contents TEXT NOT NULL,
+		blob_hash TEXT NOT NULL DEFAULT '',
+		file_hash TEXT NOT NULL,
+		file_modified_at DATETIME NOT NULL,
+		file_mode INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(namespace, repo_id, relative_path, version)
+	)`, nil},
+	{"env_file_tags", `(
+		namespace TEXT NOT NULL DEFAULT '',
+		repo_id TEXT NOT NULL,
+		relative_path TEXT NOT NULL,
+		tag TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (namespace, repo_id, relative_path, tag)
+	)`, nil},
+	{"users", `(
+		namespace TEXT NOT NULL DEFAULT '',
+		name TEXT NOT NULL,
+		public_key TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (namespace, name),
+		UNIQUE(namespace, public_key)
+	)`, nil},
+	{"repo_keys", `(
+		namespace TEXT NOT NULL DEFAULT '',
+		repo_id TEXT NOT NULL,
+		user_name TEXT NOT NULL,
+		wrapped_key TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (namespace, repo_id, user_name)
+	)`, nil},
+	{"password_verifier", `(
+		namespace TEXT NOT NULL DEFAULT '' PRIMARY KEY,
+		verifier TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`, nil},
+	{"sync_lock", `(
+		namespace TEXT NOT NULL DEFAULT '',
+		name TEXT NOT NULL,
+		holder TEXT NOT NULL,
+		acquired_at DATETIME NOT NULL,
+		expires_at DATETIME NOT NULL,
+		PRIMARY KEY (namespace, name)
+	)`, nil},
+}
+
+// addNamespaceColumns gives every row the namespace it belongs to (see
+// namespace.go); existing rows go to the default namespace "". Tables keyed
+// by repo, user or name get the namespace in their keys, which SQLite can
+// only change by copying the rows into a new table. The audit log and CI
+// tokens are keyed by ID and only gain the column. Blobs are shared: they
+// are addressed by the hash of their encrypted contents, only a file or
+// revision of the namespace leads to one, and a blob is only deleted once
+// no row of any namespace refers to it. PostgreSQL gets the same rebuild,
+// with its own column types (see schemaTx), so both end up with the same keys.
+func addNamespaceColumns(tx *schemaTx) error {
+	for _, table := range namespacedTables {
+		if err := rebuildTable(tx, table.name, table.definition); err != nil {
+			return err
+		}
+		for _, index := range table.indexes {
+			if _, err := tx.Exec(index); err != nil {
+				return fmt.Errorf("failed to index %s: %v", table.name, err)
+			}
+		}
+	}
+	for _, table := range []string{"audit_log", "ci_tokens"} {
+		if err := ensureColumn(tx, table, "namespace", "TEXT NOT NULL DEFAULT ''"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebuildTable recreates a table as definition, copying the rows over by the
+// columns the two have in common, unless it already has a namespace column
+func rebuildTable(tx *schemaTx, table, definition string) error {
+	columns, err := tableColumns(tx, table)
+	if err != nil {
+		return fmt.Errorf("failed to read columns of %s: %v", table, err)
+	}
+	if columns == nil || columns["namespace"] {
+		return nil
+	}
+
+	rebuilt := table + "_rebuilt"
+	if _, err := tx.Exec(tx.ddl(fmt.Sprintf(`CREATE TABLE %s %s`, rebuilt, definition))); err != nil {
+		return fmt.Errorf("failed to create new %s: %v", table, err)
+	}
+	newColumns, err := tableColumns(tx, rebuilt)
+	if err != nil {
+		return fmt.Errorf("failed to read columns of new %s: %v", table, err)
+	}
+	var common []string
+	for column := range columns {
+		if newColumns[column] {
+			common = append(common, column)
+		}
+	}
+	sort.Strings(common)
+	copied := strings.Join(common, ", ")
+	if _, err := tx.Exec(fmt.Sprintf(`INSERT INTO %s (%s) SELECT %s FROM %s`, rebuilt, copied, copied, table)); err != nil {
+		return fmt.Errorf("failed to copy %s: %v", table, err)
+	}
+	if _, err := tx.Exec(fmt.Sprintf(`DROP TABLE %s`, table)); err != nil {
+		return fmt.Errorf("failed to replace %s: %v", table, err)
+	}
+	if _, err := tx.Exec(fmt.Sprintf(`ALTER TABLE %s RENAME TO %s`, rebuilt, table)); err != nil {
+		return fmt.Errorf("failed to replace %s: %v", table, err)
+	}
+	// The copied IDs don't advance a PostgreSQL sequence as they do SQLite's
+	if tx.postgres && newColumns["id"] {
+		if _, err := tx.Exec(fmt.Sprintf(`SELECT setval(pg_get_serial_sequence('%s', 'id'), COALESCE(MAX(id), 0) + 1, false) FROM %s`, table, table)); err != nil {
+			return fmt.Errorf("failed to reset the IDs of %s: %v", table, err)
+		}
+	}
+	return nil
+}
+
+// adoptLegacyFiles copies rows of the path-based schema into env_files under
+// the repo ID and relative path sync gives them today, worked out from the
+// file's directory on this machine. Files outside a git repo with a remote
+// are stored as "__local__" relative to basePath if it contains them. Rows
+// that can't be placed stay in env_files_legacy for a machine that has them.
+func adoptLegacyFiles(tx *schemaTx, basePath string) (adopted, left int, err error) {
+	columns, err := tableColumns(tx, legacyFilesTable)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read columns of %s: %v", legacyFilesTable, err)
+	}
+	if columns == nil {
+		return 0, 0, nil
+	}
+	if !columns["path"] || !columns["contents"] {
+		return 0, 0, fmt.Errorf("%s has no path or contents column", legacyFilesTable)
+	}
+
+	// Early tables may lack some columns; fill those the way new rows would be
+	optional := func(column, fallback string) string {
+		if columns[column] {
+			return fmt.Sprintf("COALESCE(%s, %s)", column, fallback)
+		}
+		return fallback
+	}
+	query := fmt.Sprintf(`SELECT rowid, path, contents, %s, %s, %s, %s FROM %s ORDER BY %s DESC`,
+		optional("file_hash", "''"),
+		optional("file_modified_at", "CURRENT_TIMESTAMP"),
+		optional("created_at", "CURRENT_TIMESTAMP"),
+		optional("updated_at", "CURRENT_TIMESTAMP"),
+		legacyFilesTable,
+		optional("updated_at", "rowid"))
+
+	type legacyRow struct {
+		rowid                                int64
+		path, contents, fileHash             string
+		fileModifiedAt, createdAt, updatedAt string
+	}
+	rows, err := tx.Query(query)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read %s: %v", legacyFilesTable, err)
+	}
+	var legacy []legacyRow
+	for rows.Next() {
+		var r legacyRow
+		if err := rows.Scan(&r.rowid, &r.path, &r.contents, &r.fileHash, &r.fileModifiedAt, &r.createdAt, &r.updatedAt); err != nil {
+			rows.Close()
+			return 0, 0, fmt.Errorf("failed to read %s: %v", legacyFilesTable, err)
+		}
+		legacy = append(legacy, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, fmt.Errorf("failed to read %s: %v", legacyFilesTable, err)
+	}
+
+	for _, r := range legacy {
+		repoID, relativePath, ok := legacyFileIdentifier(r.path, basePath)
+		if !ok {
+			left++
+			continue
+		}
+		// Newest first, so of two clones of one repo the latest upload wins
+		// and the other stays behind
+		result, err := tx.Exec(`INSERT INTO env_files (repo_id, relative_path, contents, file_hash, file_modified_at, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?) ON CONFLICT DO NOTHING`,
+			repoID, relativePath, r.contents, r.fileHash, normalizeStoredTime(r.fileModifiedAt), normalizeStoredTime(r.createdAt), normalizeStoredTime(r.updatedAt))
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to copy %s: %v", r.path, err)
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			left++
+			continue
+		}
+		if _, err := tx.Exec(fmt.Sprintf(`DELETE FROM %s WHERE rowid = ?`, legacyFilesTable), r.rowid); err != nil {
+			return 0, 0, fmt.Errorf("failed to remove copied row %s: %v", r.path, err)
+		}
+		adopted++
+	}
+
+	if left == 0 {
+		if _, err := tx.Exec(fmt.Sprintf(`DROP TABLE %s`, legacyFilesTable)); err != nil {
+			return 0, 0, fmt.Errorf("failed to remove empty %s: %v", legacyFilesTable, err)
+		}
+	}
+	return adopted, left, nil
+}
+
+// legacyFileIdentifier works out the repo ID and relative path of a file
+// stored by absolute path, if its directory exists here
+func legacyFileIdentifier(path, basePath string) (string, string, bool) {
+	path = filepath.FromSlash(path)
+	if !filepath.IsAbs(path) {
+		return "", "", false
+	}
+	if info, err := os.Stat(filepath.Dir(path)); err != nil || !info.IsDir() {
+		return "", "", false
+	}
+
+	gitInfo, err := GetGitInfo(path)
+	if err == nil && gitInfo.IsGitRepo && gitInfo.RemoteURL != "" {
+		return gitInfo.RemoteURL, gitInfo.RelativePath, true
+	}
+	if basePath == "" {
+		return "", "", false
+	}
+	relPath, err := filepath.Rel(basePath, path)
+	if err != nil || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+		return "", "", false
+	}
+	return "__local__", filepath.ToSlash(relPath), true
+}
+
+// appliedMigration is a row of schema_version
+type appliedMigration struct {
+	Version   int    `json:"version"`
+	Name      string `json:"name"`
+	AppliedAt string `json:"applied_at"`
+}
+
+// migrationReport is what the migrate command prints
+type migrationReport struct {
+	Version       int                `json:"version"`
+	Latest        int                `json:"latest"`
+	Applied       []appliedMigration `json:"applied"`
+	LegacyAdopted int                `json:"legacy_adopted"`
+	LegacyLeft    int                `json:"legacy_left"`
+}
+
+// runMigrate brings a database's schema up to date, copies any files of the
+// path-based schema found on this machine and reports the schema version
+func runMigrate(ctx context.Context, dbConnStr, basePath string) error {
+	if basePath != "" {
+		abs, err := filepath.Abs(basePath)
+		if err != nil {
+			return fmt.Errorf("failed to resolve base path: %v", err)
+		}
+		basePath = abs
+	}
+
+	store, err := OpenStore(dbConnStr)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	if err := store.InitSchema(ctx); err != nil {
+		return err
+	}
+	db := databaseOf(store)
+	if db == nil {
+		if !jsonOutput {
+			fmt.Println("✓ This backend has no schema to migrate")
+		}
+		return nil
+	}
+
+	report := &migrationReport{Latest: latestSchemaVersion}
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+	report.LegacyAdopted, report.LegacyLeft, err = adoptLegacyFiles(&schemaTx{Tx: tx, postgres: db.postgres}, basePath)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit: %v", err)
+	}
+
+	rows, err := db.conn.QueryContext(ctx, `SELECT version, name, applied_at FROM schema_version ORDER BY version`)
+	if err != nil {
+		return fmt.Errorf("failed to read schema_version: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var m appliedMigration
+		if err := rows.Scan(&m.Version, &m.Name, &m.AppliedAt); err != nil {
+			return fmt.Errorf("failed to read schema_version: %v", err)
+		}
+		report.Applied = append(report.Applied, m)
+		report.Version = max(report.Version, m.Version)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read schema_version: %v", err)
+	}
+
+	if jsonOutput {
+		printJSON(report)
+		return nil
+	}
+
+	fmt.Printf("✓ Schema version %d (this env-sync writes %d)\n", report.Version, report.Latest)
+	for _, m := range report.Applied {
+		fmt.Printf("  %3d  %s  %s\n", m.Version, m.AppliedAt, m.Name)
+	}
+	if report.LegacyAdopted > 0 {
+		fmt.Printf("  Copied %d file(s) from the path-based schema\n", report.LegacyAdopted)
+	}
+	if report.LegacyLeft > 0 {
+		fmt.Printf("  %d file(s) remain in %s; run migrate on the machine that has them\n", report.LegacyLeft, legacyFilesTable)
+	}
+	return nil
+}
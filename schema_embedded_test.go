@@ -0,0 +1,105 @@
+//go:build libsql_embedded
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// These tests need a local SQLite database, which only the go-libsql driver
+// of libsql_embedded builds opens: go test -tags libsql_embedded
+
+// openTestDatabase returns an up-to-date database in a temporary file
+func openTestDatabase(t *testing.T) *Database {
+	t.Helper()
+	t.Setenv("HOME", t.TempDir())
+	conn, err := sql.Open("libsql", "file:"+filepath.Join(t.TempDir(), "env-sync.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	db := &Database{conn: conn}
+	if err := db.InitSchema(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestNormalizeTimestampsMigration(t *testing.T) {
+	db := openTestDatabase(t)
+	_, err := db.conn.Exec(`INSERT INTO env_files (repo_id, relative_path, contents, file_hash, file_modified_at, created_at, updated_at)
+		VALUES ('repo', '.env', '', 'h', '2025-01-10 09:00:00', '2025-01-10T11:00:00+02:00', '2025-01-10T09:00:00Z')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.conn.Exec(`INSERT INTO sync_lock (name, holder, acquired_at, expires_at) VALUES ('sync', 'other', '2025-01-10 09:00:00', 'not a time')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := normalizeTimestamps(&schemaTx{Tx: tx}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	var modified, created, updated string
+	if err := db.conn.QueryRow(`SELECT file_modified_at, created_at, updated_at FROM env_files`).Scan(&modified, &created, &updated); err != nil {
+		t.Fatal(err)
+	}
+	for name, got := range map[string]string{"file_modified_at": modified, "created_at": created, "updated_at": updated} {
+		if got != "2025-01-10T09:00:00Z" {
+			t.Errorf("%s = %q, want 2025-01-10T09:00:00Z", name, got)
+		}
+	}
+	var acquired, expires string
+	if err := db.conn.QueryRow(`SELECT acquired_at, expires_at FROM sync_lock`).Scan(&acquired, &expires); err != nil {
+		t.Fatal(err)
+	}
+	if acquired != "2025-01-10T09:00:00Z" || expires != "not a time" {
+		t.Errorf("sync_lock = %q, %q, want the legacy time rewritten and the unparseable one kept", acquired, expires)
+	}
+}
+
+func TestAcquireSyncLockReadsLegacyLeases(t *testing.T) {
+	now := time.Now().UTC()
+	tests := []struct {
+		name      string
+		expiresAt string
+		wantHeld  bool
+	}{
+		{"legacy, expired", now.Add(-time.Hour).Format(legacyStoredTimeFormat), false},
+		{"legacy, running", now.Add(time.Hour).Format(legacyStoredTimeFormat), true},
+		{"offset, running", now.Add(time.Hour).In(time.FixedZone("UTC-5", -5*60*60)).Format(time.RFC3339), true},
+		{"expired", formatStoredTime(now.Add(-time.Minute)), false},
+		{"running", formatStoredTime(now.Add(time.Minute)), true},
+		{"unreadable", "not a time", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openTestDatabase(t)
+			if _, err := db.conn.Exec(`INSERT INTO sync_lock (name, holder, acquired_at, expires_at) VALUES ('sync', 'other', ?, ?)`, formatStoredTime(now), tt.expiresAt); err != nil {
+				t.Fatal(err)
+			}
+			heldBy, err := db.AcquireSyncLock(context.Background(), "me", time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantHeld && heldBy != "other" {
+				t.Errorf("lease until %q: took the lock, want it held by other", tt.expiresAt)
+			}
+			if !tt.wantHeld && heldBy != "" {
+				t.Errorf("lease until %q: held by %q, want it taken", tt.expiresAt, heldBy)
+			}
+		})
+	}
+}
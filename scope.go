@@ -0,0 +1,31 @@
+package main
+
+import (
+	"os"
+)
+
+// repoScopeFlags choose which repos sync, upload and download touch. Giving
+// any of them on the command line turns off scoping to the current repo;
+// --include, --exclude and --path only narrow it further.
+var repoScopeFlags = []string{"all", "base", "repo", "scan", "rescan", "output"}
+
+// currentRepoScope returns the root and repo IDs (remote URL and aliases) of
+// the git checkout the command runs in, so that "env-sync sync" in a project
+// only syncs that project. ok is false outside a checkout with a remote, or
+// when the command line already says which files to use.
+func currentRepoScope() (root string, repoIDs []string, ok bool) {
+	for _, name := range repoScopeFlags {
+		if commandLineFlags[name] {
+			return "", nil, false
+		}
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return "", nil, false
+	}
+	root, repoID, err := GetRepoRoot(cwd)
+	if err != nil {
+		return "", nil, false
+	}
+	return root, append([]string{repoID}, gitRemoteAliases(root, repoID)...), true
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// credentialPattern recognizes a kind of credential by the shape of its
+// value and, for shapes too generic on their own, the name of its key
+type credentialPattern struct {
+	kind  string
+	value *regexp.Regexp
+	key   *regexp.Regexp // nil: any key
+}
+
+var credentialPatterns = []credentialPattern{
+	{kind: "AWS access key", value: regexp.MustCompile(`^(AKIA|ASIA)[0-9A-Z]{16}$`)},
+	{kind: "AWS secret key", value: regexp.MustCompile(`^[A-Za-z0-9/+]{40}$`), key: regexp.MustCompile(`(?i)aws.*secret|secret.*access.*key`)},
+	{kind: "Stripe live key", value: regexp.MustCompile(`^(sk|rk)_live_[0-9A-Za-z]{16,}$`)},
+	{kind: "Private key", value: regexp.MustCompile(`-----BEGIN ([A-Z0-9]+ )*PRIVATE KEY( BLOCK)?-----`)},
+	{kind: "GitHub token", value: regexp.MustCompile(`^(gh[pousr]_[0-9A-Za-z]{36}|github_pat_[0-9A-Za-z_]{60,})$`)},
+	{kind: "Slack token", value: regexp.MustCompile(`^xox[abposr]-[0-9A-Za-z-]{10,}$`)},
+	{kind: "Google API key", value: regexp.MustCompile(`^AIza[0-9A-Za-z_-]{35}$`)},
+	{kind: "SendGrid API key", value: regexp.MustCompile(`^SG\.[0-9A-Za-z_-]{22}\.[0-9A-Za-z_-]{43}$`)},
+}
+
+// credentialFinding is a credential found in a stored file, and since when
+// the file has held it
+type credentialFinding struct {
+	RepoID       string    `json:"repo_id"`
+	RelativePath string    `json:"relative_path"`
+	Key          string    `json:"key"`
+	Kind         string    `json:"kind"`
+	Value        string    `json:"value"` // Masked
+	Since        time.Time `json:"since"`
+	AgeDays      int       `json:"age_days"`
+	// The oldest stored revision already had it, so it may be older still
+	// (earlier revisions were pruned, or it came with the first upload)
+	OldestRevision bool `json:"oldest_revision"`
+
+	value string // In the clear, to look for in earlier revisions
+}
+
+// findCredentials returns the lines of contents whose values look like
+// credentials. Lines that aren't KEY=value, as in YAML or INI files, are
+// split at the first ':' or '='.
+func findCredentials(contents string) []credentialFinding {
+	var findings []credentialFinding
+	for _, line := range ParseEnv(contents).Lines {
+		key, value := line.Key, unquoteEnvValue(line.Value)
+		if key == "" {
+			trimmed := strings.TrimSpace(line.Raw)
+			if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+				continue
+			}
+			key, value = "", trimmed
+			if i := strings.IndexAny(trimmed, ":="); i >= 0 {
+				key, value = strings.TrimSpace(trimmed[:i]), unquoteEnvValue(strings.TrimSpace(trimmed[i+1:]))
+			}
+		}
+		for _, pattern := range credentialPatterns {
+			if (pattern.key == nil || pattern.key.MatchString(key)) && pattern.value.MatchString(value) {
+				masked := maskValue(value)
+				if match := pattern.value.FindString(value); strings.HasPrefix(match, "-----BEGIN") {
+					// The block's header says what it is and gives nothing away
+					masked = match
+				}
+				findings = append(findings, credentialFinding{Key: key, Kind: pattern.kind, Value: masked, value: value})
+				break
+			}
+		}
+	}
+	return findings
+}
+
+// auditSecrets lists the credentials in the stored files filter selects, the
+// longest-held first, leaving out those held for less than minAge. It
+// returns an error if any are found.
+func auditSecrets(ctx context.Context, dbConnStr, password string, filter FileFilter, minAge time.Duration) error {
+	db, err := OpenStore(dbConnStr)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := db.InitSchema(ctx); err != nil {
+		return err
+	}
+	records, err := db.ListEnvFiles(ctx)
+	if err != nil {
+		return err
+	}
+	tags, err := loadFileTags(ctx, db, filter)
+	if err != nil {
+		return err
+	}
+	filter.tagged = tags
+
+	now := time.Now()
+	findings := []credentialFinding{}
+	files := 0
+	for _, record := range records {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !filter.Match(record.RepoID, record.RelativePath) {
+			continue
+		}
+		full, err := db.GetEnvFileWithMetadata(ctx, record.RepoID, record.RelativePath)
+		if err != nil || full == nil {
+			logger.Warn("failed to read stored file", "repo", record.RepoID, "path", record.RelativePath, "error", err)
+			continue
+		}
+		contents, err := openContents(ctx, db, record.RepoID, record.RelativePath, full.Contents, password)
+		if err != nil {
+			logger.Warn("failed to decrypt (wrong password?)", "repo", record.RepoID, "path", record.RelativePath, "error", err)
+			continue
+		}
+		found := findCredentials(contents)
+		if len(found) == 0 {
+			continue
+		}
+		files++
+
+		since, _ := parseStoredTime(full.UpdatedAt)
+		for i := range found {
+			found[i].RepoID, found[i].RelativePath, found[i].Since = record.RepoID, record.RelativePath, since
+		}
+		credentialsSince(ctx, db, record, password, found)
+		for _, finding := range found {
+			age := now.Sub(finding.Since)
+			if age < minAge {
+				continue
+			}
+			finding.AgeDays = int(age / (24 * time.Hour))
+			findings = append(findings, finding)
+		}
+	}
+
+	sort.SliceStable(findings, func(i, j int) bool { return findings[i].Since.Before(findings[j].Since) })
+
+	if jsonOutput {
+		printJSON(findings)
+	} else if len(findings) == 0 {
+		fmt.Println("No credentials found in the stored files")
+	} else {
+		for _, finding := range findings {
+			age := fmt.Sprintf("%dd", finding.AgeDays)
+			if finding.OldestRevision {
+				age = "≥" + age
+			}
+			key := finding.Key
+			if key == "" {
+				key = "-"
+			}
+			fmt.Printf("⚠ %6s  %-17s %-28s %s (%s)  %s\n", age, finding.Kind, key, finding.RelativePath, shortenRepoID(finding.RepoID), finding.Value)
+		}
+		fmt.Printf("\n%d credential(s) in %d file(s), held since %s at the longest (≥: since the oldest stored revision)\n",
+			len(findings), files, findings[0].Since.Local().Format("2006-01-02"))
+	}
+
+	if len(findings) > 0 {
+		return fmt.Errorf("%d credential(s) found", len(findings))
+	}
+	return nil
+}
+
+// credentialsSince moves each finding's Since back to the oldest revision of
+// the file it has been in since, walking back from the newest revision
+func credentialsSince(ctx context.Context, db Store, record EnvFileRecord, password string, findings []credentialFinding) {
+	versions, err := db.ListEnvFileVersions(ctx, record.RepoID, record.RelativePath)
+	if err != nil || len(versions) == 0 {
+		// Only the last upload's time is known
+		for i := range findings {
+			findings[i].OldestRevision = true
+		}
+		return
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Version > versions[j].Version })
+
+	held := make([]bool, len(findings))
+	for i := range held {
+		held[i] = true
+	}
+	for n, version := range versions {
+		stored, err := db.GetEnvFileVersion(ctx, record.RepoID, record.RelativePath, version.Version)
+		if err != nil {
+			return
+		}
+		contents, err := openRevisionContents(ctx, db, record.RepoID, record.RelativePath, stored.Contents, password)
+		if err != nil {
+			return
+		}
+		createdAt, err := parseStoredTime(version.CreatedAt)
+		if err != nil {
+			return
+		}
+		still := false
+		for i := range findings {
+			if held[i] = held[i] && strings.Contains(contents, findings[i].value); held[i] {
+				findings[i].Since = createdAt
+				findings[i].OldestRevision = n == len(versions)-1
+				still = true
+			}
+		}
+		if !still {
+			return
+		}
+	}
+}
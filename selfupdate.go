@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// version is this build's release tag, set with -ldflags "-X main.version=v1.2.3"
+var version = "v0.2.0"
+
+// releasePublicKey verifies the signature of a release's checksums.txt. It is
+// the base64 of a raw Ed25519 public key, set by the release build with
+// -ldflags "-X main.releasePublicKey=..." and empty in builds from source.
+var releasePublicKey = ""
+
+// releasesURL lists the GitHub releases self-update chooses from
+var releasesURL = "https://api.github.com/repos/markibanez/env-sync/releases"
+
+const (
+	checksumsAsset = "checksums.txt"
+	signatureAsset = "checksums.txt.sig"
+)
+
+// githubRelease is the part of a GitHub release self-update reads
+type githubRelease struct {
+	TagName    string `json:"tag_name"`
+	Draft      bool   `json:"draft"`
+	Prerelease bool   `json:"prerelease"`
+	HTMLURL    string `json:"html_url"`
+	Assets     []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+// assetURL returns the download URL of the release's asset called name
+func (r *githubRelease) assetURL(name string) (string, bool) {
+	for _, asset := range r.Assets {
+		if asset.Name == name {
+			return asset.URL, true
+		}
+	}
+	return "", false
+}
+
+// releaseAssetName is the binary a release publishes for this platform
+func releaseAssetName() string {
+	switch {
+	case runtime.GOOS == "darwin":
+		return "env-sync-macos-" + runtime.GOARCH
+	case runtime.GOOS == "linux" && runtime.GOARCH == "amd64":
+		return "env-sync-linux"
+	case runtime.GOOS == "windows" && runtime.GOARCH == "amd64":
+		return "env-sync-windows.exe"
+	case runtime.GOOS == "windows":
+		return "env-sync-windows-" + runtime.GOARCH + ".exe"
+	}
+	return "env-sync-" + runtime.GOOS + "-" + runtime.GOARCH
+}
+
+var updateClient = &http.Client{Timeout: 5 * time.Minute}
+
+// fetch downloads url, failing on anything but 200 OK
+func fetch(url string) ([]byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "env-sync/"+version)
+	if strings.HasPrefix(url, "https://api.github.com/") {
+		req.Header.Set("Accept", "application/vnd.github+json")
+		if token := os.Getenv("GITHUB_TOKEN"); token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+
+	resp, err := updateClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// latestRelease returns the newest published release of a channel: stable
+// skips prereleases, prerelease takes whichever is newest
+func latestRelease(channel string) (*githubRelease, error) {
+	data, err := fetch(releasesURL + "?per_page=30")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list releases: %v", err)
+	}
+	var releases []githubRelease
+	if err := json.Unmarshal(data, &releases); err != nil {
+		return nil, fmt.Errorf("failed to parse releases: %v", err)
+	}
+
+	var latest *githubRelease
+	for i := range releases {
+		r := &releases[i]
+		if r.Draft || (r.Prerelease && channel != "prerelease") {
+			continue
+		}
+		if latest == nil || compareVersions(r.TagName, latest.TagName) > 0 {
+			latest = r
+		}
+	}
+	if latest == nil {
+		return nil, fmt.Errorf("no %s release found", channel)
+	}
+	return latest, nil
+}
+
+// compareVersions orders tags like v1.2.3 and v1.3.0-rc.1 by semantic
+// version, with a prerelease before its release
+func compareVersions(a, b string) int {
+	parse := func(v string) ([3]int, string) {
+		v = strings.TrimPrefix(v, "v")
+		v, _, _ = strings.Cut(v, "+")
+		v, pre, _ := strings.Cut(v, "-")
+		var nums [3]int
+		for i, part := range strings.SplitN(v, ".", 3) {
+			nums[i], _ = strconv.Atoi(part)
+		}
+		return nums, pre
+	}
+	aNums, aPre := parse(a)
+	bNums, bPre := parse(b)
+	for i := range aNums {
+		if aNums[i] != bNums[i] {
+			if aNums[i] < bNums[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case aPre == bPre:
+		return 0
+	case aPre == "":
+		return 1
+	case bPre == "":
+		return -1
+	}
+	return comparePrereleases(aPre, bPre)
+}
+
+// comparePrereleases orders prerelease tags like rc.9 and rc.10 the way
+// semver does: identifier by identifier, numbers by value and before words,
+// and a tag before the longer ones it starts
+func comparePrereleases(a, b string) int {
+	aIDs, bIDs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(aIDs) && i < len(bIDs); i++ {
+		aNum, aErr := strconv.ParseUint(aIDs[i], 10, 64)
+		bNum, bErr := strconv.ParseUint(bIDs[i], 10, 64)
+		switch {
+		case aErr == nil && bErr == nil:
+			if aNum != bNum {
+				if aNum < bNum {
+					return -1
+				}
+				return 1
+			}
+		case aErr == nil:
+			return -1
+		case bErr == nil:
+			return 1
+		case aIDs[i] != bIDs[i]:
+			if aIDs[i] < bIDs[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case len(aIDs) < len(bIDs):
+		return -1
+	case len(aIDs) > len(bIDs):
+		return 1
+	}
+	return 0
+}
+
+// verifyRelease checks binary against the release's checksums.txt and, when
+// this build knows the release key, the checksums against their signature
+func verifyRelease(release *githubRelease, assetName string, binary []byte) error {
+	checksumsURL, ok := release.assetURL(checksumsAsset)
+	if !ok {
+		return fmt.Errorf("release %s has no %s", release.TagName, checksumsAsset)
+	}
+	checksums, err := fetch(checksumsURL)
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %v", checksumsAsset, err)
+	}
+
+	if releasePublicKey != "" {
+		publicKey, err := base64.StdEncoding.DecodeString(releasePublicKey)
+		if err != nil || len(publicKey) != ed25519.PublicKeySize {
+			return fmt.Errorf("invalid release public key in this build")
+		}
+		signatureURL, ok := release.assetURL(signatureAsset)
+		if !ok {
+			return fmt.Errorf("release %s is not signed (no %s)", release.TagName, signatureAsset)
+		}
+		encoded, err := fetch(signatureURL)
+		if err != nil {
+			return fmt.Errorf("failed to download %s: %v", signatureAsset, err)
+		}
+		signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+		if err != nil || !ed25519.Verify(publicKey, checksums, signature) {
+			return fmt.Errorf("signature of %s in release %s doesn't match the release key", checksumsAsset, release.TagName)
+		}
+	} else {
+		logger.Warn("this build has no release key, so only the checksum is verified")
+	}
+
+	// sha256sum format: "<hex>  <name>", with a * before binary names
+	scanner := bufio.NewScanner(bytes.NewReader(checksums))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || strings.TrimPrefix(fields[1], "*") != assetName {
+			continue
+		}
+		sum := sha256.Sum256(binary)
+		if !strings.EqualFold(fields[0], hex.EncodeToString(sum[:])) {
+			return fmt.Errorf("checksum of %s doesn't match %s", assetName, checksumsAsset)
+		}
+		return nil
+	}
+	return fmt.Errorf("%s of release %s has no entry for %s", checksumsAsset, release.TagName, assetName)
+}
+
+// replaceExecutable swaps the running binary for a new one. The new file is
+// written next to it and renamed over it, so a failed update leaves the old
+// binary in place. Windows can't overwrite a running executable but can
+// rename it, so the old one is moved aside to <name>.old first.
+func replaceExecutable(binary []byte) (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("failed to find the running binary: %v", err)
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return "", fmt.Errorf("failed to find the running binary: %v", err)
+	}
+	mode := os.FileMode(0755)
+	if info, err := os.Stat(exe); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(exe), ".env-sync-update-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to write next to %s (try with sudo): %v", exe, err)
+	}
+	_, err = tmp.Write(binary)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), mode)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("failed to write the new binary: %v", err)
+	}
+
+	if runtime.GOOS == "windows" {
+		old := exe + ".old"
+		os.Remove(old)
+		if err := os.Rename(exe, old); err != nil {
+			os.Remove(tmp.Name())
+			return "", fmt.Errorf("failed to move %s aside: %v", exe, err)
+		}
+	}
+	if err := os.Rename(tmp.Name(), exe); err != nil {
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("failed to replace %s: %v", exe, err)
+	}
+	return exe, nil
+}
+
+// selfUpdate installs the newest release of channel over the running binary,
+// after checking its checksum and signature. With checkOnly it only reports
+// whether there is one; with force it reinstalls even if it isn't newer.
+func selfUpdate(channel string, checkOnly, force bool) error {
+	// Left behind by the last update on Windows
+	if exe, err := os.Executable(); err == nil {
+		os.Remove(exe + ".old")
+	}
+
+	release, err := latestRelease(channel)
+	if err != nil {
+		return err
+	}
+	newer := compareVersions(release.TagName, version) > 0
+	if jsonOutput && checkOnly {
+		printJSON(map[string]interface{}{"current": version, "latest": release.TagName, "channel": channel, "update_available": newer, "url": release.HTMLURL})
+		return nil
+	}
+	if !newer && !force {
+		fmt.Printf("✓ env-sync %s is up to date (latest %s release: %s)\n", version, channel, release.TagName)
+		return nil
+	}
+	if checkOnly {
+		fmt.Printf("env-sync %s is available (running %s): %s\n", release.TagName, version, release.HTMLURL)
+		return nil
+	}
+
+	assetName := releaseAssetName()
+	binaryURL, ok := release.assetURL(assetName)
+	if !ok {
+		return fmt.Errorf("release %s has no binary for %s/%s (%s)", release.TagName, runtime.GOOS, runtime.GOARCH, assetName)
+	}
+	notef("Downloading %s %s...\n", assetName, release.TagName)
+	binary, err := fetch(binaryURL)
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %v", assetName, err)
+	}
+	if err := verifyRelease(release, assetName, binary); err != nil {
+		return err
+	}
+
+	exe, err := replaceExecutable(binary)
+	if err != nil {
+		return err
+	}
+	if jsonOutput {
+		printJSON(map[string]interface{}{"previous": version, "installed": release.TagName, "path": exe})
+		return nil
+	}
+	fmt.Printf("✓ Updated %s from %s to %s\n", exe, version, release.TagName)
+	return nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"v1.2.3", "v1.2.3", 0},
+		{"v1.2.3", "1.2.3", 0},
+		{"v1.2.3", "v1.2.4", -1},
+		{"v1.10.0", "v1.9.0", 1},
+		{"v2.0.0", "v1.99.99", 1},
+		{"v1.3.0-rc.1", "v1.3.0", -1},
+		{"v1.3.0", "v1.3.0-rc.1", 1},
+		{"v1.3.0-rc.1", "v1.2.9", 1},
+		{"v1.3.0-rc.10", "v1.3.0-rc.9", 1},
+		{"v1.3.0-rc.2", "v1.3.0-rc.10", -1},
+		{"v1.3.0-alpha", "v1.3.0-beta", -1},
+		{"v1.3.0-alpha", "v1.3.0-alpha.1", -1},
+		{"v1.3.0-alpha.1", "v1.3.0-alpha.beta", -1},
+		{"v1.3.0-beta.11", "v1.3.0-rc.1", -1},
+		{"v1.3.0-rc.1", "v1.3.0-rc.1", 0},
+		{"v1.3.0+build.5", "v1.3.0", 0},
+		{"v1.3.0-rc.1+build.5", "v1.3.0-rc.2", -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.a+" vs "+tt.b, func(t *testing.T) {
+			if got := compareVersions(tt.a, tt.b); got != tt.want {
+				t.Errorf("compareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
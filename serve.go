@@ -0,0 +1,486 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	envsyncv1 "github.com/markibanez/env-sync/api/envsync/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const envServeToken = "ENV_SYNC_SERVE_TOKEN"
+
+// serveOptions configures `env-sync serve`
+type serveOptions struct {
+	Listen       string
+	Token        string // Clients send it as "authorization: Bearer <token>"
+	TLSCert      string
+	TLSKey       string
+	Insecure     bool // Allow plaintext on a non-loopback address
+	PollInterval time.Duration
+	ReadOnly     bool
+}
+
+// serveGRPC serves the EnvSync gRPC API (api/envsync/v1) for dbConnStr
+// until ctx is cancelled. The server decrypts with password, so every call
+// must carry opts.Token.
+func serveGRPC(ctx context.Context, dbConnStr, password string, opts serveOptions) error {
+	if len(opts.Token) < 16 {
+		return fmt.Errorf("the token must be at least 16 characters")
+	}
+	var serverOpts []grpc.ServerOption
+	if opts.TLSCert != "" || opts.TLSKey != "" {
+		creds, err := credentials.NewServerTLSFromFile(opts.TLSCert, opts.TLSKey)
+		if err != nil {
+			return fmt.Errorf("failed to load TLS certificate: %v", err)
+		}
+		serverOpts = append(serverOpts, grpc.Creds(creds))
+	} else if !isLoopbackAddr(opts.Listen) && !opts.Insecure {
+		return fmt.Errorf("%s isn't a loopback address: use --tls-cert and --tls-key, or --insecure if something else encrypts the traffic", opts.Listen)
+	}
+
+	db, err := OpenStore(dbConnStr)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := db.InitSchema(ctx); err != nil {
+		return err
+	}
+	if err := checkPassword(ctx, db, password); err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", opts.Listen)
+	if err != nil {
+		return err
+	}
+
+	auth := tokenAuth(opts.Token)
+	serverOpts = append(serverOpts, grpc.UnaryInterceptor(auth.unary), grpc.StreamInterceptor(auth.stream))
+	server := grpc.NewServer(serverOpts...)
+	hub := newWatchHub(db, opts.PollInterval)
+	envsyncv1.RegisterEnvSyncServer(server, &grpcServer{db: db, password: password, readOnly: opts.ReadOnly, watch: hub})
+	// Lets grpcurl and similar tools discover the API
+	reflection.Register(server)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go hub.run(ctx)
+	go func() {
+		<-ctx.Done()
+		// Watch streams end once the hub stops, so this doesn't wait on them
+		server.GracefulStop()
+	}()
+
+	logger.Info("gRPC server listening", "addr", listener.Addr().String(), "tls", opts.TLSCert != "", "read_only", opts.ReadOnly, "poll_interval", opts.PollInterval.String())
+	if err := server.Serve(listener); err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+		return err
+	}
+	logger.Info("gRPC server stopped")
+	return nil
+}
+
+// isLoopbackAddr reports whether a listen address only accepts connections
+// from this machine
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// tokenAuth rejects calls without the server's bearer token
+type tokenAuth string
+
+func (t tokenAuth) check(ctx context.Context) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get("authorization") {
+		if token, ok := strings.CutPrefix(value, "Bearer "); ok && subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "missing or wrong bearer token")
+}
+
+func (t tokenAuth) unary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if err := t.check(ctx); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (t tokenAuth) stream(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := t.check(ss.Context()); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+// grpcServer implements the EnvSync service on top of a store
+type grpcServer struct {
+	envsyncv1.UnimplementedEnvSyncServer
+	db       Store
+	password string
+	readOnly bool
+	watch    *watchHub
+	putMu    sync.Mutex // Keeps a put's expected_hash check and write together
+}
+
+func (s *grpcServer) List(ctx context.Context, req *envsyncv1.ListRequest) (*envsyncv1.ListResponse, error) {
+	records, err := s.db.ListEnvFiles(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list files: %v", err)
+	}
+	tags, err := loadFileTags(ctx, s.db, FileFilter{Tags: req.Tags})
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+
+	resp := &envsyncv1.ListResponse{}
+	for _, record := range records {
+		if !matchesRepo(record.RepoID, req.Repo) {
+			continue
+		}
+		fileTags := tags[auditKey(record.RepoID, record.RelativePath)]
+		if !hasAllTags(fileTags, req.Tags) {
+			continue
+		}
+		resp.Files = append(resp.Files, envFileMessage(record, fileTags))
+	}
+	return resp, nil
+}
+
+func (s *grpcServer) Get(ctx context.Context, req *envsyncv1.GetRequest) (*envsyncv1.GetResponse, error) {
+	if req.RepoId == "" || req.RelativePath == "" {
+		return nil, status.Error(codes.InvalidArgument, "repo_id and relative_path are required")
+	}
+	record, err := s.db.GetEnvFileWithMetadata(ctx, req.RepoId, req.RelativePath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to read %s: %v", req.RelativePath, err)
+	}
+	if record == nil {
+		return nil, status.Errorf(codes.NotFound, "no file %s in %s", req.RelativePath, req.RepoId)
+	}
+	tags, _ := loadFileTags(ctx, s.db, FileFilter{})
+	fileTags := tags[auditKey(record.RepoID, record.RelativePath)]
+
+	if req.Version <= 0 {
+		contents, err := openVerifiedRecord(ctx, s.db, record, s.password)
+		if err != nil {
+			return nil, status.Error(codes.DataLoss, err.Error())
+		}
+		return &envsyncv1.GetResponse{File: envFileMessage(*record, fileTags), Contents: []byte(contents)}, nil
+	}
+
+	version, err := s.db.GetEnvFileVersion(ctx, record.RepoID, record.RelativePath, int(req.Version))
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "version %d of %s: %v", req.Version, req.RelativePath, err)
+	}
+	contents, err := openRevisionContents(ctx, s.db, record.RepoID, record.RelativePath, version.Contents, s.password)
+	if err != nil {
+		return nil, status.Errorf(codes.DataLoss, "failed to decrypt version %d: %v", req.Version, err)
+	}
+	file := envFileMessage(*record, fileTags)
+	file.FileHash, file.FileMode = version.FileHash, uint32(version.FileMode)
+	file.ModifiedAt, file.UpdatedAt = storedTimestamp(version.FileModifiedAt), storedTimestamp(version.CreatedAt)
+	return &envsyncv1.GetResponse{File: file, Contents: []byte(contents)}, nil
+}
+
+// storedRelativePath returns relativePath in the form sync stores it, with a
+// leading ./, which callers of Put may leave out. ok is false unless it's a
+// clean path within the repo.
+func storedRelativePath(relativePath string) (string, bool) {
+	trimmed := strings.TrimPrefix(relativePath, "./")
+	if clean := path.Clean(trimmed); clean != trimmed || clean == "." || path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", false
+	}
+	return "./" + trimmed, true
+}
+
+func (s *grpcServer) Put(ctx context.Context, req *envsyncv1.PutRequest) (*envsyncv1.PutResponse, error) {
+	if s.readOnly {
+		return nil, status.Error(codes.PermissionDenied, "the server is read-only (--read-only)")
+	}
+	if req.RepoId == "" || req.RelativePath == "" {
+		return nil, status.Error(codes.InvalidArgument, "repo_id and relative_path are required")
+	}
+	relativePath, ok := storedRelativePath(req.RelativePath)
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "relative_path must be a clean path within the repo, e.g. %q", "./config/.env")
+	}
+	req.RelativePath = relativePath
+	if len(req.Contents) > defaultMaxFileSize {
+		return nil, status.Errorf(codes.InvalidArgument, "contents are %s, over the %s limit", formatBytes(int64(len(req.Contents))), formatBytes(defaultMaxFileSize))
+	}
+
+	s.putMu.Lock()
+	defer s.putMu.Unlock()
+
+	current, err := s.db.GetEnvFileWithMetadata(ctx, req.RepoId, req.RelativePath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to read %s: %v", req.RelativePath, err)
+	}
+	hashBefore := ""
+	if current != nil {
+		hashBefore = current.FileHash
+	}
+	switch {
+	case req.ExpectedHash == "":
+	case req.ExpectedHash == "new" && current != nil:
+		return nil, status.Errorf(codes.FailedPrecondition, "%s already exists", req.RelativePath)
+	case req.ExpectedHash != "new" && req.ExpectedHash != hashBefore:
+		return nil, status.Errorf(codes.FailedPrecondition, "%s changed: stored hash is %q", req.RelativePath, hashBefore)
+	}
+
+	contents := string(req.Contents)
+	hashAfter := HashFile(contents)
+	changed := hashAfter != hashBefore
+	if changed {
+		mode := os.FileMode(req.FileMode) & os.ModePerm
+		if mode == 0 && current != nil {
+			mode = current.FileMode
+		}
+		if mode == 0 {
+			mode = 0600
+		}
+		if err := uploadContents(ctx, s.db, req.RepoId, req.RelativePath, s.password, contents, time.Now().UTC(), mode, current); err != nil {
+			var stale *staleWriteError
+			if errors.As(err, &stale) {
+				return nil, status.Error(codes.Aborted, err.Error())
+			}
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		entry := newAuditEntry(auditUpload, req.RepoId, req.RelativePath, hashBefore, hashAfter)
+		entry.Detail = "grpc put"
+		recordAudit(ctx, s.db, entry)
+	}
+
+	record, err := s.db.GetEnvFileWithMetadata(ctx, req.RepoId, req.RelativePath)
+	if err != nil || record == nil {
+		return nil, status.Errorf(codes.Internal, "failed to read back %s: %v", req.RelativePath, err)
+	}
+	tags, _ := loadFileTags(ctx, s.db, FileFilter{})
+	return &envsyncv1.PutResponse{File: envFileMessage(*record, tags[auditKey(record.RepoID, record.RelativePath)]), Changed: changed}, nil
+}
+
+func (s *grpcServer) Watch(req *envsyncv1.WatchRequest, stream grpc.ServerStreamingServer[envsyncv1.WatchEvent]) error {
+	events, unsubscribe := s.watch.subscribe()
+	defer unsubscribe()
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				if s.watch.stopped() {
+					return status.Error(codes.Unavailable, "server shutting down")
+				}
+				return status.Error(codes.ResourceExhausted, "watcher fell behind, reconnect")
+			}
+			if !matchesRepo(event.File.RepoId, req.Repo) {
+				continue
+			}
+			if err := stream.Send(event); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+// matchesRepo reports whether repoID is repo, by full or short ID; an empty
+// repo matches all
+func matchesRepo(repoID, repo string) bool {
+	return repo == "" || repoID == repo || shortenRepoID(repoID) == repo
+}
+
+func hasAllTags(fileTags, wanted []string) bool {
+	for _, tag := range wanted {
+		if !slices.Contains(fileTags, tag) {
+			return false
+		}
+	}
+	return true
+}
+
+func envFileMessage(record EnvFileRecord, tags []string) *envsyncv1.EnvFile {
+	return &envsyncv1.EnvFile{
+		RepoId:       record.RepoID,
+		RelativePath: record.RelativePath,
+		FileHash:     record.FileHash,
+		ModifiedAt:   storedTimestamp(record.FileModifiedAt),
+		UpdatedAt:    storedTimestamp(record.UpdatedAt),
+		FileMode:     uint32(record.FileMode),
+		Tags:         tags,
+	}
+}
+
+// storedTimestamp converts a stored time; unset if it doesn't parse
+func storedTimestamp(value string) *timestamppb.Timestamp {
+	t, err := parseStoredTime(value)
+	if err != nil {
+		return nil
+	}
+	return timestamppb.New(t)
+}
+
+// watchHub polls the store for changes while anyone watches and fans the
+// events out to every Watch stream
+type watchHub struct {
+	db       Store
+	interval time.Duration
+
+	mu   sync.Mutex
+	subs map[chan *envsyncv1.WatchEvent]bool
+	done bool
+}
+
+func newWatchHub(db Store, interval time.Duration) *watchHub {
+	return &watchHub{db: db, interval: interval, subs: make(map[chan *envsyncv1.WatchEvent]bool)}
+}
+
+// subscribe returns a channel of events and a function to stop receiving
+// them. The channel is closed if the subscriber falls behind or the hub
+// stops.
+func (h *watchHub) subscribe() (<-chan *envsyncv1.WatchEvent, func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	events := make(chan *envsyncv1.WatchEvent, 64)
+	if h.done {
+		close(events)
+		return events, func() {}
+	}
+	h.subs[events] = true
+	return events, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if h.subs[events] {
+			delete(h.subs, events)
+			close(events)
+		}
+	}
+}
+
+func (h *watchHub) stopped() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.done
+}
+
+func (h *watchHub) watching() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs) > 0
+}
+
+// run polls until ctx is cancelled. Without subscribers it doesn't poll,
+// and the first poll after one subscribes only takes a baseline.
+func (h *watchHub) run(ctx context.Context) {
+	defer func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.done = true
+		for events := range h.subs {
+			delete(h.subs, events)
+			close(events)
+		}
+	}()
+
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	var last map[string]EnvFileRecord
+	for {
+		if !h.watching() {
+			last = nil
+		} else if current, err := h.poll(ctx); err != nil {
+			logger.Warn("watch poll failed", "error", err)
+		} else {
+			if last != nil {
+				h.publish(ctx, watchEvents(last, current))
+			}
+			last = current
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (h *watchHub) poll(ctx context.Context) (map[string]EnvFileRecord, error) {
+	records, err := h.db.ListEnvFiles(ctx)
+	if err != nil {
+		return nil, err
+	}
+	current := make(map[string]EnvFileRecord, len(records))
+	for _, record := range records {
+		current[auditKey(record.RepoID, record.RelativePath)] = record
+	}
+	return current, nil
+}
+
+func (h *watchHub) publish(ctx context.Context, events []*envsyncv1.WatchEvent) {
+	if len(events) == 0 {
+		return
+	}
+	tags, _ := loadFileTags(ctx, h.db, FileFilter{})
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, event := range events {
+		event.File.Tags = tags[auditKey(event.File.RepoId, event.File.RelativePath)]
+		for events := range h.subs {
+			select {
+			case events <- event:
+			default:
+				// A stalled client gets disconnected rather than holding up the rest
+				delete(h.subs, events)
+				close(events)
+			}
+		}
+	}
+}
+
+// watchEvents compares two polls of the store, in a stable order
+func watchEvents(before, after map[string]EnvFileRecord) []*envsyncv1.WatchEvent {
+	var events []*envsyncv1.WatchEvent
+	for key, record := range after {
+		previous, existed := before[key]
+		switch {
+		case !existed:
+			events = append(events, &envsyncv1.WatchEvent{Type: envsyncv1.WatchEvent_TYPE_CREATED, File: envFileMessage(record, nil)})
+		case previous.FileHash != record.FileHash || previous.UpdatedAt != record.UpdatedAt:
+			events = append(events, &envsyncv1.WatchEvent{Type: envsyncv1.WatchEvent_TYPE_UPDATED, File: envFileMessage(record, nil)})
+		}
+	}
+	for key, record := range before {
+		if _, exists := after[key]; !exists {
+			events = append(events, &envsyncv1.WatchEvent{Type: envsyncv1.WatchEvent_TYPE_DELETED, File: envFileMessage(record, nil)})
+		}
+	}
+	slices.SortFunc(events, func(a, b *envsyncv1.WatchEvent) int {
+		return strings.Compare(auditKey(a.File.RepoId, a.File.RelativePath), auditKey(b.File.RepoId, b.File.RelativePath))
+	})
+	return events
+}
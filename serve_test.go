@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestStoredRelativePath(t *testing.T) {
+	tests := []struct {
+		in     string
+		want   string
+		wantOK bool
+	}{
+		{".env", "./.env", true},
+		{"./.env", "./.env", true},
+		{"config/.env", "./config/.env", true},
+		{"./config/.env", "./config/.env", true},
+		{"./", "", false},
+		{".", "", false},
+		{"..", "", false},
+		{"../.env", "", false},
+		{"./../.env", "", false},
+		{"config/../../.env", "", false},
+		{"/etc/.env", "", false},
+		{"config//.env", "", false},
+		{"././.env", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, ok := storedRelativePath(tt.in)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("storedRelativePath(%q) = %q, %v, want %q, %v", tt.in, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
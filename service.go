@@ -0,0 +1,320 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+const (
+	serviceName  = "env-sync"
+	launchdLabel = "com.github.markibanez.env-sync"
+)
+
+// manageService installs or removes the daemon as a system service: a systemd
+// user unit on Linux, a launchd agent on macOS, or a Windows service
+func manageService(action string, args []string) error {
+	switch action {
+	case "install":
+		exe, daemonArgs, err := serviceCommand(args)
+		if err != nil {
+			return err
+		}
+		switch runtime.GOOS {
+		case "linux":
+			return installSystemdUnit(exe, daemonArgs)
+		case "darwin":
+			return installLaunchdAgent(exe, daemonArgs)
+		case "windows":
+			return installWindowsService(exe, daemonArgs)
+		}
+	case "uninstall":
+		switch runtime.GOOS {
+		case "linux":
+			return uninstallSystemdUnit()
+		case "darwin":
+			return uninstallLaunchdAgent()
+		case "windows":
+			return uninstallWindowsService()
+		}
+	default:
+		return fmt.Errorf("unknown daemon action: %s (use install or uninstall)", action)
+	}
+	return fmt.Errorf("installing the daemon as a service is not supported on %s", runtime.GOOS)
+}
+
+// serviceCommand builds the executable path and "daemon ..." arguments the
+// service will run, filling in an absolute --base and the global log flags
+func serviceCommand(args []string) (string, []string, error) {
+	if !hasFlag(args, "db") {
+		return "", nil, fmt.Errorf("--db is required\nUsage: env-sync daemon install --db <connection-string> [daemon flags]")
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to find the env-sync executable: %v", err)
+	}
+	if resolved, err := filepath.EvalSymlinks(exe); err == nil {
+		exe = resolved
+	}
+
+	daemonArgs := append([]string{"daemon"}, args...)
+	if !hasFlag(args, "base") {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to get current directory: %v", err)
+		}
+		daemonArgs = append(daemonArgs, "--base", cwd)
+	}
+
+	if profileName != "" {
+		daemonArgs = append(daemonArgs, "--profile", profileName)
+	}
+	if configPath != "" {
+		abs, err := filepath.Abs(configPath)
+		if err != nil {
+			return "", nil, err
+		}
+		daemonArgs = append(daemonArgs, "--config", abs)
+	}
+	if logLevel != "info" {
+		daemonArgs = append(daemonArgs, "--log-level", logLevel)
+	}
+	if logFormat != "text" {
+		daemonArgs = append(daemonArgs, "--log-format", logFormat)
+	}
+	if logFile != "" {
+		abs, err := filepath.Abs(logFile)
+		if err != nil {
+			return "", nil, err
+		}
+		daemonArgs = append(daemonArgs, "--log-file", abs)
+	} else if runtime.GOOS == "windows" {
+		// Services have no console, so keep the logs somewhere findable
+		dir, err := getStorageDir()
+		if err != nil {
+			return "", nil, err
+		}
+		daemonArgs = append(daemonArgs, "--log-file", filepath.Join(dir, "daemon.log"))
+	}
+
+	if namespaceFlag != "" {
+		daemonArgs = append(daemonArgs, "--namespace", namespaceFlag)
+	}
+	if sshTunnel != "" {
+		daemonArgs = append(daemonArgs, "--ssh", sshTunnel)
+	}
+	if sshKeyFile != "" {
+		abs, err := filepath.Abs(sshKeyFile)
+		if err != nil {
+			return "", nil, err
+		}
+		daemonArgs = append(daemonArgs, "--ssh-key", abs)
+	}
+	if passwordFile == "-" {
+		return "", nil, fmt.Errorf("a service can't read the password from stdin: give --password-file a path")
+	}
+	if passwordFile != "" {
+		abs, err := filepath.Abs(passwordFile)
+		if err != nil {
+			return "", nil, err
+		}
+		daemonArgs = append(daemonArgs, "--password-file", abs)
+	} else if !hasFlag(args, "password") && !passwordless() {
+		fmt.Println("Note: no --password given, so the service will use the password saved by 'env-sync login'.")
+	}
+
+	return exe, daemonArgs, nil
+}
+
+// hasFlag reports whether args contain -name or --name, with or without "=value"
+func hasFlag(args []string, name string) bool {
+	for _, arg := range args {
+		flagName, _, _ := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if strings.HasPrefix(arg, "-") && flagName == name {
+			return true
+		}
+	}
+	return false
+}
+
+func runServiceCommand(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s failed: %v\n%s", name, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func systemdUnitPath() (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "systemd", "user", serviceName+".service"), nil
+}
+
+// systemdQuote quotes an argument for an ExecStart line
+func systemdQuote(arg string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "%", "%%", "$", "$$")
+	return `"` + r.Replace(arg) + `"`
+}
+
+func installSystemdUnit(exe string, args []string) error {
+	unitPath, err := systemdUnitPath()
+	if err != nil {
+		return err
+	}
+
+	command := []string{systemdQuote(exe)}
+	for _, arg := range args {
+		command = append(command, systemdQuote(arg))
+	}
+
+	unit := fmt.Sprintf(`[Unit]
+Description=env-sync daemon
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+ExecStart=%s
+ExecReload=/bin/kill -HUP $MAINPID
+Restart=on-failure
+RestartSec=30
+
+[Install]
+WantedBy=default.target
+`, strings.Join(command, " "))
+
+	if err := os.MkdirAll(filepath.Dir(unitPath), 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %v", filepath.Dir(unitPath), err)
+	}
+	// The unit may contain the connection string and password
+	if err := os.WriteFile(unitPath, []byte(unit), 0600); err != nil {
+		return fmt.Errorf("failed to write unit file: %v", err)
+	}
+
+	if err := runServiceCommand("systemctl", "--user", "daemon-reload"); err != nil {
+		return err
+	}
+	if err := runServiceCommand("systemctl", "--user", "enable", "--now", serviceName+".service"); err != nil {
+		return err
+	}
+
+	fmt.Printf("✓ Installed systemd user unit %s\n", unitPath)
+	fmt.Println("  Logs:   journalctl --user -u env-sync -f")
+	fmt.Println("  To keep it running while you're logged out: loginctl enable-linger $USER")
+	return nil
+}
+
+func uninstallSystemdUnit() error {
+	unitPath, err := systemdUnitPath()
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(unitPath); os.IsNotExist(err) {
+		return fmt.Errorf("no systemd unit installed at %s", unitPath)
+	}
+
+	if err := runServiceCommand("systemctl", "--user", "disable", "--now", serviceName+".service"); err != nil {
+		return err
+	}
+	if err := os.Remove(unitPath); err != nil {
+		return fmt.Errorf("failed to remove unit file: %v", err)
+	}
+	if err := runServiceCommand("systemctl", "--user", "daemon-reload"); err != nil {
+		return err
+	}
+
+	fmt.Printf("✓ Removed systemd user unit %s\n", unitPath)
+	return nil
+}
+
+func launchdPlistPath() (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(homeDir, "Library", "LaunchAgents", launchdLabel+".plist"), nil
+}
+
+func xmlEscape(s string) string {
+	r := strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;", "'", "&apos;")
+	return r.Replace(s)
+}
+
+func installLaunchdAgent(exe string, args []string) error {
+	plistPath, err := launchdPlistPath()
+	if err != nil {
+		return err
+	}
+	storageDir, err := getStorageDir()
+	if err != nil {
+		return err
+	}
+	logPath := filepath.Join(storageDir, "daemon.log")
+
+	var programArgs strings.Builder
+	for _, arg := range append([]string{exe}, args...) {
+		programArgs.WriteString("\t\t<string>" + xmlEscape(arg) + "</string>\n")
+	}
+
+	plist := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>%s</string>
+	<key>ProgramArguments</key>
+	<array>
+%s	</array>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<true/>
+	<key>StandardOutPath</key>
+	<string>%s</string>
+	<key>StandardErrorPath</key>
+	<string>%s</string>
+</dict>
+</plist>
+`, launchdLabel, programArgs.String(), xmlEscape(logPath), xmlEscape(logPath))
+
+	if err := os.MkdirAll(filepath.Dir(plistPath), 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %v", filepath.Dir(plistPath), err)
+	}
+	if err := os.WriteFile(plistPath, []byte(plist), 0600); err != nil {
+		return fmt.Errorf("failed to write launchd plist: %v", err)
+	}
+
+	if err := runServiceCommand("launchctl", "load", "-w", plistPath); err != nil {
+		return err
+	}
+
+	fmt.Printf("✓ Installed launchd agent %s\n", plistPath)
+	fmt.Printf("  Logs: %s\n", logPath)
+	return nil
+}
+
+func uninstallLaunchdAgent() error {
+	plistPath, err := launchdPlistPath()
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(plistPath); os.IsNotExist(err) {
+		return fmt.Errorf("no launchd agent installed at %s", plistPath)
+	}
+
+	if err := runServiceCommand("launchctl", "unload", "-w", plistPath); err != nil {
+		return err
+	}
+	if err := os.Remove(plistPath); err != nil {
+		return fmt.Errorf("failed to remove launchd plist: %v", err)
+	}
+
+	fmt.Printf("✓ Removed launchd agent %s\n", plistPath)
+	return nil
+}
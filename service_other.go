@@ -0,0 +1,23 @@
+//go:build !windows
+
+package main
+
+import "fmt"
+
+func installWindowsService(exe string, args []string) error {
+	return fmt.Errorf("Windows services can only be installed on Windows")
+}
+
+func uninstallWindowsService() error {
+	return fmt.Errorf("Windows services can only be removed on Windows")
+}
+
+// isWindowsService reports whether the process was started by the Windows service manager
+func isWindowsService() bool {
+	return false
+}
+
+func runWindowsService(run func()) error {
+	run()
+	return nil
+}
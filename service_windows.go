@@ -0,0 +1,184 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+	"golang.org/x/term"
+)
+
+// installWindowsService creates the service to run as the installing user
+// rather than LocalSystem, so it reads that user's config, identity and
+// keychain entry and can do no more than the user can. Windows needs the
+// account's password to start it, so it is asked for.
+func installWindowsService(exe string, args []string) error {
+	account, err := user.Current()
+	if err != nil {
+		return fmt.Errorf("failed to find the current user: %v", err)
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to the service manager (run as Administrator): %v", err)
+	}
+	defer m.Disconnect()
+
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists (run 'env-sync daemon uninstall' first)", serviceName)
+	}
+
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return fmt.Errorf("daemon install must be run interactively: the service runs as %s and asks for that account's Windows password", account.Username)
+	}
+	password, err := promptPassword(fmt.Sprintf("Windows password of %s, for the service to log on as you: ", account.Username))
+	if err != nil {
+		return err
+	}
+	if err := grantServiceLogon(account.Username); err != nil {
+		return err
+	}
+
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName:      "env-sync daemon",
+		Description:      "Keeps .env files in sync with the env-sync database",
+		StartType:        mgr.StartAutomatic,
+		ServiceStartName: account.Username,
+		Password:         password,
+	}, args...)
+	if err != nil {
+		return fmt.Errorf("failed to create service: %v", err)
+	}
+	defer s.Close()
+
+	if err := s.Start(); err != nil {
+		return fmt.Errorf("service installed but failed to start (wrong password?): %v", err)
+	}
+
+	fmt.Printf("✓ Installed and started Windows service %s, running as %s\n", serviceName, account.Username)
+	fmt.Println("  After changing your Windows password, run 'env-sync daemon uninstall' and install it again.")
+	return nil
+}
+
+// Local security policy access needed to grant an account a right
+const (
+	policyCreateAccount = 0x00000010
+	policyLookupNames   = 0x00000800
+)
+
+var (
+	advapi32                = windows.NewLazySystemDLL("advapi32.dll")
+	procLsaOpenPolicy       = advapi32.NewProc("LsaOpenPolicy")
+	procLsaAddAccountRights = advapi32.NewProc("LsaAddAccountRights")
+	procLsaClose            = advapi32.NewProc("LsaClose")
+)
+
+// grantServiceLogon gives account the "Log on as a service" right. Picking
+// a log-on account in services.msc grants it, but the service manager API
+// doesn't, and without it the service fails to start.
+func grantServiceLogon(account string) error {
+	sid, _, _, err := windows.LookupSID("", account)
+	if err != nil {
+		return fmt.Errorf("failed to look up %s: %v", account, err)
+	}
+
+	attributes := windows.OBJECT_ATTRIBUTES{Length: uint32(unsafe.Sizeof(windows.OBJECT_ATTRIBUTES{}))}
+	var policy windows.Handle
+	status, _, _ := procLsaOpenPolicy.Call(0, uintptr(unsafe.Pointer(&attributes)), policyCreateAccount|policyLookupNames, uintptr(unsafe.Pointer(&policy)))
+	if status != 0 {
+		return fmt.Errorf("failed to open the local security policy: %v", windows.NTStatus(status))
+	}
+	defer procLsaClose.Call(uintptr(policy))
+
+	right, err := windows.NewNTUnicodeString("SeServiceLogonRight")
+	if err != nil {
+		return err
+	}
+	status, _, _ = procLsaAddAccountRights.Call(uintptr(policy), uintptr(unsafe.Pointer(sid)), uintptr(unsafe.Pointer(right)), 1)
+	if status != 0 {
+		return fmt.Errorf("failed to let %s log on as a service: %v", account, windows.NTStatus(status))
+	}
+	return nil
+}
+
+func uninstallWindowsService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to the service manager (run as Administrator): %v", err)
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", serviceName)
+	}
+	defer s.Close()
+
+	// Stop it first; an already stopped service just returns an error here
+	if status, err := s.Control(svc.Stop); err == nil {
+		for deadline := time.Now().Add(30 * time.Second); status.State != svc.Stopped && time.Now().Before(deadline); {
+			time.Sleep(500 * time.Millisecond)
+			if status, err = s.Query(); err != nil {
+				break
+			}
+		}
+	}
+
+	if err := s.Delete(); err != nil {
+		return fmt.Errorf("failed to delete service: %v", err)
+	}
+
+	fmt.Printf("✓ Removed Windows service %s\n", serviceName)
+	return nil
+}
+
+// isWindowsService reports whether the process was started by the Windows service manager
+func isWindowsService() bool {
+	ok, err := svc.IsWindowsService()
+	return err == nil && ok
+}
+
+// daemonService adapts runDaemon to the Windows service control protocol
+type daemonService struct {
+	run func()
+}
+
+func (d *daemonService) Execute(args []string, requests <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	changes <- svc.Status{State: svc.StartPending}
+
+	done := make(chan struct{})
+	go func() {
+		d.run()
+		close(done)
+	}()
+
+	changes <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case request := <-requests:
+			switch request.Cmd {
+			case svc.Interrogate:
+				changes <- request.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				changes <- svc.Status{State: svc.StopPending}
+				stopDaemon()
+				<-done
+				return false, 0
+			}
+		case <-done:
+			return false, 0
+		}
+	}
+}
+
+func runWindowsService(run func()) error {
+	return svc.Run(serviceName, &daemonService{run: run})
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// loadRepoEnv opens the database and reads a stored .env file with readRepoEnv
+func loadRepoEnv(ctx context.Context, dbConnStr, password, repoRef, file string) ([][2]string, error) {
+	db, err := OpenStore(dbConnStr)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	if err := db.InitSchema(ctx); err != nil {
+		return nil, err
+	}
+	return readRepoEnv(ctx, db, password, repoRef, file)
+}
+
+// readRepoEnv decrypts a stored .env file and returns its variables in file
+// order, with surrounding quotes removed. With repoRef, file is relative to
+// that repo's root. Without it, the repo checked out in the current directory
+// is used and file is relative to the current directory.
+func readRepoEnv(ctx context.Context, db Store, password, repoRef, file string) ([][2]string, error) {
+	var err error
+	relativePath := path.Clean(filepath.ToSlash(file))
+	var repoIDs []string
+	if repoRef != "" {
+		repoID, err := resolveRepoID(ctx, db, repoRef)
+		if err != nil {
+			return nil, err
+		}
+		repoIDs = []string{repoID}
+	} else {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get current directory: %v", err)
+		}
+		root, repoID, err := GetRepoRoot(cwd)
+		if err != nil {
+			return nil, fmt.Errorf("not in a git checkout with a remote, use --repo: %v", err)
+		}
+		if relativePath, err = toUnixRelativePath(filepath.Join(cwd, filepath.FromSlash(relativePath)), root); err != nil {
+			return nil, err
+		}
+		relativePath = strings.TrimPrefix(relativePath, "./")
+		repoIDs = append([]string{repoID}, gitRemoteAliases(root, repoID)...)
+	}
+
+	var record *EnvFileRecord
+	for _, repoID := range repoIDs {
+		if record, err = db.GetEnvFileWithMetadata(ctx, repoID, relativePath); err != nil {
+			return nil, err
+		}
+		if record != nil {
+			break
+		}
+	}
+	if record == nil {
+		return nil, fmt.Errorf("%s has no stored %s (use --file)", repoIDs[0], relativePath)
+	}
+	if !isDotenvName(path.Base(record.RelativePath)) {
+		return nil, fmt.Errorf("%s is not a .env file", record.RelativePath)
+	}
+
+	contents, err := openContents(ctx, db, record.RepoID, record.RelativePath, record.Contents, password)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt %s: %v (wrong password?)", record.RelativePath, err)
+	}
+
+	doc := ParseEnv(contents)
+	var vars [][2]string
+	for _, key := range doc.Keys() {
+		value, _ := doc.Get(key)
+		vars = append(vars, [2]string{key, unquoteEnvValue(value)})
+	}
+	return vars, nil
+}
+
+// printShellEnv prints a stored .env file as export lines for
+// eval "$(env-sync env)", or as a JSON object with --json
+func printShellEnv(ctx context.Context, dbConnStr, password, repoRef, file string) error {
+	vars, err := loadRepoEnv(ctx, dbConnStr, password, repoRef, file)
+	if err != nil {
+		return err
+	}
+
+	if jsonOutput {
+		values := make(map[string]string, len(vars))
+		for _, v := range vars {
+			values[v[0]] = v[1]
+		}
+		printJSON(values)
+		return nil
+	}
+
+	for _, v := range vars {
+		if !isShellName(v[0]) {
+			logger.Warn("skipping variable that isn't a valid shell name", "key", v[0])
+			continue
+		}
+		fmt.Printf("export %s=%s\n", v[0], shellQuote(v[1]))
+	}
+	return nil
+}
+
+// isShellName reports whether key can be exported by a POSIX shell
+func isShellName(key string) bool {
+	for i, c := range key {
+		if c != '_' && (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (i == 0 || c < '0' || c > '9') {
+			return false
+		}
+	}
+	return key != ""
+}
+
+// shellQuote single-quotes a value for POSIX shells
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// execWithEnv runs a command with a stored .env file added to its
+// environment, overriding variables that are already set. The file never
+// touches the disk. env-sync exits with the command's exit code.
+func execWithEnv(ctx context.Context, dbConnStr, password, repoRef, file string, command []string) error {
+	vars, err := loadRepoEnv(ctx, dbConnStr, password, repoRef, file)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = os.Environ()
+	for _, v := range vars {
+		// The last value of a duplicated key wins
+		cmd.Env = append(cmd.Env, v[0]+"="+v[1])
+	}
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to run %s: %v", command[0], err)
+	}
+
+	// The command decides how to handle Ctrl+C and termination
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		for sig := range sigChan {
+			cmd.Process.Signal(sig)
+		}
+	}()
+	err = cmd.Wait()
+	signal.Stop(sigChan)
+	close(sigChan)
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		code := exitErr.ExitCode()
+		if code < 0 {
+			// Killed by a signal
+			code = 1
+		}
+		os.Exit(code)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to run %s: %v", command[0], err)
+	}
+	return nil
+}
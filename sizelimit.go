@@ -0,0 +1,81 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// defaultMaxFileSize is far above any real env file, but keeps a dump or
+// archive that happens to match an env file name out of the database
+const defaultMaxFileSize = 1 << 20
+
+// byteSize is a flag value that accepts a size in bytes or with a KB, MB or
+// GB suffix ("512KB", "2MB"); 0 means no limit
+type byteSize int64
+
+func (s *byteSize) String() string {
+	if *s == 0 {
+		return "0"
+	}
+	return strings.ReplaceAll(formatBytes(int64(*s)), " ", "")
+}
+
+func (s *byteSize) Set(value string) error {
+	number, unit := strings.ToUpper(strings.TrimSpace(value)), int64(1)
+	for _, suffix := range []struct {
+		suffix string
+		unit   int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1}} {
+		if n, ok := strings.CutSuffix(number, suffix.suffix); ok {
+			number, unit = strings.TrimSpace(n), suffix.unit
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q (use e.g. 512KB or 2MB)", value)
+	}
+	*s = byteSize(n * float64(unit))
+	return nil
+}
+
+// addSizeLimitFlags registers --max-file-size and --force-large
+func addSizeLimitFlags(fs *flag.FlagSet) (maxSize *byteSize, forceLarge *bool) {
+	maxSize = new(byteSize)
+	*maxSize = defaultMaxFileSize
+	fs.Var(maxSize, "max-file-size", "Skip local files larger than this with a warning, e.g. 512KB or 5MB; 0 for no limit (default: 1MB)")
+	forceLarge = fs.Bool("force-large", false, "Upload files over --max-file-size anyway")
+	return maxSize, forceLarge
+}
+
+// tooLarge reports whether a local file of size bytes is skipped by the
+// --max-file-size limit
+func (o SyncOptions) tooLarge(size int64) bool {
+	return o.MaxFileSize > 0 && size > o.MaxFileSize && !o.ForceLarge
+}
+
+// skipLarge reports a local file left alone because of its size
+func skipLarge(stats *SyncStats, displayName string, size int64, opts SyncOptions) (string, string, error) {
+	atomic.AddInt64(&stats.FilesTooLarge, 1)
+	return actionSkip, fmt.Sprintf("⚠ Too large: %s (%s, over the %s --max-file-size; --force-large uploads it)",
+		displayName, formatBytes(size), formatBytes(opts.MaxFileSize)), nil
+}
+
+// dropLargeFiles removes the files over the --max-file-size limit from files,
+// with a warning for each
+func dropLargeFiles(files []string, opts SyncOptions) []string {
+	kept := files[:0:0]
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil && opts.tooLarge(info.Size()) {
+			logger.Warn("skipping file over --max-file-size (use --force-large to upload it)", "file", file,
+				"size", formatBytes(info.Size()), "limit", formatBytes(opts.MaxFileSize))
+			continue
+		}
+		kept = append(kept, file)
+	}
+	return kept
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statsRetention is how long sync runs are kept in the stats history
+const statsRetention = 365 * 24 * time.Hour
+
+// syncRun is one sync's entry in the stats history
+type syncRun struct {
+	ID          string          `json:"id,omitempty"` // Run ID printed in the summary, see newSyncRunID
+	Time        string          `json:"time"`         // When the sync started, UTC
+	DurationMs  int64           `json:"duration_ms"`
+	Files       int             `json:"files"`
+	Stats       syncStatsReport `json:"stats"`
+	Daemon      bool            `json:"daemon,omitempty"`
+	Interrupted bool            `json:"interrupted,omitempty"`
+	Changes     []syncRunChange `json:"changes,omitempty"` // Files that weren't skipped
+}
+
+// syncRunChange is a file a sync changed, or failed or refused to sync
+type syncRunChange struct {
+	RepoID       string `json:"repo_id"`
+	RelativePath string `json:"relative_path"`
+	Action       string `json:"action,omitempty"`
+	Error        bool   `json:"error,omitempty"`
+	// For uploads, downloads and merges: the local file, and the hashes
+	// before and after the sync that undo restores and checks against
+	Path         string `json:"path,omitempty"`
+	LocalBefore  string `json:"local_before,omitempty"`
+	RemoteBefore string `json:"remote_before,omitempty"`
+	After        string `json:"after,omitempty"`
+}
+
+// statsMu serializes writes to the stats history within this process
+var statsMu sync.Mutex
+
+// getStatsFile returns ~/.env-sync/stats.log. Like the inventory, it names
+// repos and paths, so each line is encrypted with the machine key.
+func getStatsFile() (string, error) {
+	dir, err := getStorageDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "stats.log"), nil
+}
+
+// recordSyncRun appends a sync to the stats history. Failing to is logged,
+// not fatal: the sync itself is done.
+func recordSyncRun(run syncRun) {
+	if err := appendSyncRun(run); err != nil {
+		logger.Warn("failed to record sync statistics", "error", err)
+	}
+}
+
+func appendSyncRun(run syncRun) error {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+
+	key, err := loadMachineKey()
+	if err != nil {
+		return err
+	}
+	statsFile, err := getStatsFile()
+	if err != nil {
+		return err
+	}
+	if err := compactStats(statsFile, key); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+	line, err := EncryptWithKey(string(data), key)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(statsFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", statsFile, err)
+	}
+	_, err = f.WriteString(line + "\n")
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// compactStats drops the runs older than statsRetention once the oldest one
+// is, so the history doesn't grow forever. Only the first line is read until then.
+func compactStats(statsFile string, key []byte) error {
+	cutoff := time.Now().UTC().Add(-statsRetention)
+	if oldest, ok := oldestSyncRun(statsFile, key); !ok || !oldest.Before(cutoff) {
+		return nil
+	}
+	runs, err := readSyncRuns(statsFile, key)
+	if err != nil {
+		return err
+	}
+
+	var lines []string
+	for _, run := range runs {
+		if started, err := time.Parse(time.RFC3339, run.Time); err == nil && started.Before(cutoff) {
+			continue
+		}
+		data, err := json.Marshal(run)
+		if err != nil {
+			return err
+		}
+		line, err := EncryptWithKey(string(data), key)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, line+"\n")
+	}
+	// Write then rename, like the inventory
+	tmpFile := statsFile + ".tmp"
+	if err := os.WriteFile(tmpFile, []byte(strings.Join(lines, "")), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, statsFile)
+}
+
+// oldestSyncRun returns when the first run in the stats history started
+func oldestSyncRun(statsFile string, key []byte) (time.Time, bool) {
+	f, err := os.Open(statsFile)
+	if err != nil {
+		return time.Time{}, false
+	}
+	defer f.Close()
+
+	line, _ := bufio.NewReader(f).ReadString('\n')
+	plaintext, err := DecryptWithKey(strings.TrimSpace(line), key)
+	if err != nil {
+		// An unreadable first line is dropped by the next full rewrite
+		return time.Time{}, true
+	}
+	var run syncRun
+	if err := json.Unmarshal([]byte(plaintext), &run); err != nil {
+		return time.Time{}, true
+	}
+	started, err := time.Parse(time.RFC3339, run.Time)
+	return started, err == nil
+}
+
+// readSyncRuns reads the stats history, oldest first. Lines that can't be
+// decrypted, e.g. after machine.key was replaced, are skipped.
+func readSyncRuns(statsFile string, key []byte) ([]syncRun, error) {
+	f, err := os.Open(statsFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", statsFile, err)
+	}
+	defer f.Close()
+
+	var runs []syncRun
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		plaintext, err := DecryptWithKey(line, key)
+		if err != nil {
+			logger.Debug("skipping unreadable stats entry", "error", err)
+			continue
+		}
+		var run syncRun
+		if err := json.Unmarshal([]byte(plaintext), &run); err != nil {
+			logger.Debug("skipping invalid stats entry", "error", err)
+			continue
+		}
+		runs = append(runs, run)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", statsFile, err)
+	}
+	return runs, nil
+}
+
+// statsBucket sums the runs of one day or week
+type statsBucket struct {
+	Start   string `json:"start"`
+	Runs    int    `json:"runs"`
+	Changed int64  `json:"changed"` // Files uploaded, downloaded, merged or moved
+	Errors  int64  `json:"errors"`
+	AvgMs   int64  `json:"avg_ms"`
+	totalMs int64
+}
+
+// churnCount is how often a file or repo showed up in the history
+type churnCount struct {
+	RepoID       string `json:"repo_id"`
+	RelativePath string `json:"relative_path,omitempty"`
+	Changes      int    `json:"changes,omitempty"`
+	Problems     int    `json:"problems,omitempty"` // Errors, conflicts and corrupted copies
+}
+
+// statsReport is what stats prints
+type statsReport struct {
+	Since        string          `json:"since,omitempty"`
+	Runs         int             `json:"runs"`
+	DaemonRuns   int             `json:"daemon_runs"`
+	Interrupted  int             `json:"interrupted"`
+	IdleRuns     int             `json:"idle_runs"`   // Runs that changed nothing
+	FailedRuns   int             `json:"failed_runs"` // Runs with at least one error
+	AvgMs        int64           `json:"avg_ms"`
+	MaxMs        int64           `json:"max_ms"`
+	Totals       syncStatsReport `json:"totals"`
+	Trend        []statsBucket   `json:"trend"`
+	TopFiles     []churnCount    `json:"top_files"`
+	ProblemRepos []churnCount    `json:"problem_repos"`
+}
+
+// showStats summarizes the sync runs of the last since (all kept runs if 0)
+func showStats(since time.Duration, top int) error {
+	key, err := loadMachineKey()
+	if err != nil {
+		return err
+	}
+	statsFile, err := getStatsFile()
+	if err != nil {
+		return err
+	}
+	runs, err := readSyncRuns(statsFile, key)
+	if err != nil {
+		return err
+	}
+
+	var cutoff time.Time
+	if since > 0 {
+		cutoff = time.Now().UTC().Add(-since)
+	}
+	report := buildStatsReport(runs, cutoff, top)
+	if since > 0 {
+		report.Since = cutoff.Format(time.RFC3339)
+	}
+
+	if jsonOutput {
+		printJSON(report)
+		return nil
+	}
+	if report.Runs == 0 {
+		fmt.Println("No syncs recorded yet")
+		return nil
+	}
+	printStatsReport(report, since)
+	return nil
+}
+
+// buildStatsReport sums the runs started after cutoff. Trends are per day,
+// or per week over more than 60 days.
+func buildStatsReport(runs []syncRun, cutoff time.Time, top int) statsReport {
+	report := statsReport{Trend: []statsBucket{}, TopFiles: []churnCount{}, ProblemRepos: []churnCount{}}
+	weekly := false
+	buckets := make(map[string]*statsBucket)
+	files := make(map[string]*churnCount)
+	repos := make(map[string]*churnCount)
+	var totalMs int64
+
+	for _, run := range runs {
+		started, err := time.Parse(time.RFC3339, run.Time)
+		if err != nil || started.Before(cutoff) {
+			continue
+		}
+		if report.Runs == 0 {
+			weekly = time.Since(started) > 60*24*time.Hour
+		}
+		report.Runs++
+		if run.Daemon {
+			report.DaemonRuns++
+		}
+		if run.Interrupted {
+			report.Interrupted++
+		}
+		if run.Stats.Errors > 0 {
+			report.FailedRuns++
+		}
+		changed := run.Stats.Uploaded + run.Stats.Downloaded + run.Stats.Merged + run.Stats.Moved
+		if changed == 0 {
+			report.IdleRuns++
+		}
+		totalMs += run.DurationMs
+		report.MaxMs = max(report.MaxMs, run.DurationMs)
+		addSyncStats(&report.Totals, run.Stats)
+
+		day := started.Truncate(24 * time.Hour)
+		if weekly {
+			day = day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7)) // Monday
+		}
+		bucket := buckets[day.Format("2006-01-02")]
+		if bucket == nil {
+			bucket = &statsBucket{Start: day.Format("2006-01-02")}
+			buckets[bucket.Start] = bucket
+		}
+		bucket.Runs++
+		bucket.Changed += changed
+		bucket.Errors += int64(run.Stats.Errors)
+		bucket.totalMs += run.DurationMs
+
+		for _, change := range run.Changes {
+			problem := change.Error || change.Action == actionConflict || change.Action == actionCorrupted
+			if !problem {
+				fileKey := auditKey(change.RepoID, change.RelativePath)
+				if files[fileKey] == nil {
+					files[fileKey] = &churnCount{RepoID: change.RepoID, RelativePath: change.RelativePath}
+				}
+				files[fileKey].Changes++
+				continue
+			}
+			if repos[change.RepoID] == nil {
+				repos[change.RepoID] = &churnCount{RepoID: change.RepoID}
+			}
+			repos[change.RepoID].Problems++
+		}
+	}
+	if report.Runs > 0 {
+		report.AvgMs = totalMs / int64(report.Runs)
+	}
+
+	for _, bucket := range buckets {
+		bucket.AvgMs = bucket.totalMs / int64(bucket.Runs)
+		report.Trend = append(report.Trend, *bucket)
+	}
+	sort.Slice(report.Trend, func(i, j int) bool { return report.Trend[i].Start < report.Trend[j].Start })
+	report.TopFiles = topChurn(files, top, func(c *churnCount) int { return c.Changes })
+	report.ProblemRepos = topChurn(repos, top, func(c *churnCount) int { return c.Problems })
+	return report
+}
+
+// addSyncStats adds the counts of one run to total
+func addSyncStats(total *syncStatsReport, run syncStatsReport) {
+	total.Uploaded += run.Uploaded
+	total.Downloaded += run.Downloaded
+	total.Skipped += run.Skipped
+	total.Merged += run.Merged
+	total.Moved += run.Moved
+	total.Conflicts += run.Conflicts
+	total.Corrupted += run.Corrupted
+	total.Deferred += run.Deferred
+	total.TooLarge += run.TooLarge
+	total.Invalid += run.Invalid
+	total.Errors += run.Errors
+}
+
+// topChurn returns the n highest counts, highest first
+func topChurn(counts map[string]*churnCount, n int, count func(*churnCount) int) []churnCount {
+	sorted := make([]churnCount, 0, len(counts))
+	for _, c := range counts {
+		sorted = append(sorted, *c)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if ci, cj := count(&sorted[i]), count(&sorted[j]); ci != cj {
+			return ci > cj
+		}
+		return auditKey(sorted[i].RepoID, sorted[i].RelativePath) < auditKey(sorted[j].RepoID, sorted[j].RelativePath)
+	})
+	if n > 0 && len(sorted) > n {
+		sorted = sorted[:n]
+	}
+	return sorted
+}
+
+func printStatsReport(report statsReport, since time.Duration) {
+	period := "since the first recorded sync"
+	if since > 0 {
+		period = "in the last " + formatAge(since)
+	}
+	fmt.Printf("%d sync(s) %s (%d by the daemon)\n", report.Runs, period, report.DaemonRuns)
+	fmt.Printf("  Changed nothing:  %d (%.0f%%)\n", report.IdleRuns, percent(report.IdleRuns, report.Runs))
+	fmt.Printf("  With errors:      %d (%.0f%%)\n", report.FailedRuns, percent(report.FailedRuns, report.Runs))
+	if report.Interrupted > 0 {
+		fmt.Printf("  Interrupted:      %d\n", report.Interrupted)
+	}
+	fmt.Printf("  Duration:         avg %v, max %v\n",
+		(time.Duration(report.AvgMs) * time.Millisecond).Round(time.Millisecond),
+		(time.Duration(report.MaxMs) * time.Millisecond).Round(time.Millisecond))
+
+	t := report.Totals
+	fmt.Printf("\nFiles: ↑ %d uploaded, ↓ %d downloaded, ⇄ %d merged, ↪ %d moved, ⚠ %d conflicts, ✗ %d errors\n",
+		t.Uploaded, t.Downloaded, t.Merged, t.Moved, t.Conflicts, t.Errors)
+
+	fmt.Printf("\n%-12s %6s %8s %7s %10s\n", "PERIOD", "RUNS", "CHANGED", "ERRORS", "AVG TIME")
+	for _, bucket := range report.Trend {
+		fmt.Printf("%-12s %6d %8d %7d %10v\n", bucket.Start, bucket.Runs, bucket.Changed, bucket.Errors,
+			(time.Duration(bucket.AvgMs) * time.Millisecond).Round(time.Millisecond))
+	}
+
+	if len(report.TopFiles) > 0 {
+		fmt.Println("\nMost-changed files:")
+		for _, c := range report.TopFiles {
+			fmt.Printf("  %4d  %s (%s)\n", c.Changes, c.RelativePath, shortenRepoID(c.RepoID))
+		}
+	}
+	if len(report.ProblemRepos) > 0 {
+		fmt.Println("\nRepos with errors, conflicts or corrupted copies:")
+		for _, c := range report.ProblemRepos {
+			fmt.Printf("  %4d  %s\n", c.Problems, shortenRepoID(c.RepoID))
+		}
+	}
+}
+
+// percent returns n as a percentage of total
+func percent(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) * 100 / float64(total)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// File states reported by the status command
+const (
+	statusInSync          = "in-sync"
+	statusLocalNewer      = "local-newer"
+	statusRemoteNewer     = "remote-newer"
+	statusConflict        = "conflict"
+	statusMissingLocally  = "missing-locally"
+	statusMissingRemotely = "missing-remotely"
+)
+
+var statusOrder = []string{statusInSync, statusLocalNewer, statusRemoteNewer, statusConflict, statusMissingLocally, statusMissingRemotely}
+
+type statusEntry struct {
+	RepoID       string `json:"repo_id"`
+	RelativePath string `json:"relative_path"`
+	LocalPath    string `json:"local_path,omitempty"`
+	Status       string `json:"status"`
+	LocalTime    string `json:"local_modified_at,omitempty"`
+	RemoteTime   string `json:"remote_modified_at,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+type statusReport struct {
+	Files  []statusEntry  `json:"files"`
+	Counts map[string]int `json:"counts"`
+}
+
+// compareLocalFile classifies a local file against its database record the
+// same way sync decides what to do, without changing anything. baseHash is
+// the hash recorded at the last sync, or empty if the file was never synced here.
+func compareLocalFile(filePath string, record *EnvFileRecord, baseHash string) (string, error) {
+	if record == nil {
+		return statusMissingRemotely, nil
+	}
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to stat local file: %v", err)
+	}
+	contents, err := os.ReadFile(filePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read local file: %v", err)
+	}
+	localHash := envFileHash(filePath, contents, record.FileHash, baseHash)
+	if localHash == record.FileHash {
+		return statusInSync, nil
+	}
+
+	if baseHash != "" {
+		switch {
+		case record.FileHash == baseHash:
+			return statusLocalNewer, nil
+		case localHash == baseHash:
+			return statusRemoteNewer, nil
+		default:
+			return statusConflict, nil
+		}
+	}
+
+	remoteModTime, err := parseStoredTime(record.FileModifiedAt)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse db timestamp: %v", err)
+	}
+
+	// Same 1 second tolerance as sync
+	timeDiff := toServerTime(info.ModTime()).Sub(remoteModTime).Seconds()
+	switch {
+	case timeDiff > 1:
+		return statusLocalNewer, nil
+	case timeDiff < -1:
+		return statusRemoteNewer, nil
+	default:
+		return statusConflict, nil
+	}
+}
+
+// collectStatus classifies the remembered local files and the stored files
+// that have no local copy, sorted by repo and path
+func collectStatus(ctx context.Context, db Store, files []string, basePath string, filter FileFilter) ([]statusEntry, error) {
+	records, err := db.ListEnvFiles(ctx)
+	if err != nil {
+		return nil, err
+	}
+	remote := make(map[string]*EnvFileRecord, len(records))
+	for i := range records {
+		remote[records[i].RepoID+"\x00"+records[i].RelativePath] = &records[i]
+	}
+
+	state, err := loadSyncState()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []statusEntry
+	seen := make(map[string]bool)
+	for _, file := range files {
+		repoID, relativePath, err := GetFileIdentifier(file, basePath)
+		if err != nil {
+			logger.Warn("failed to get identifier", "file", file, "error", err)
+			continue
+		}
+		if !filter.Match(repoID, relativePath) {
+			continue
+		}
+
+		key := repoID + "\x00" + relativePath
+		record := remote[key]
+		if record == nil {
+			// The file may be stored under another remote of the same repo
+			for _, alias := range fileRemoteAliases(file, repoID) {
+				if record = remote[alias+"\x00"+relativePath]; record != nil {
+					repoID, key = alias, alias+"\x00"+relativePath
+					break
+				}
+			}
+		}
+		entry := statusEntry{RepoID: repoID, RelativePath: relativePath, LocalPath: file}
+		if record != nil {
+			entry.RemoteTime = record.FileModifiedAt
+		}
+
+		if info, err := os.Stat(file); os.IsNotExist(err) {
+			// Remembered from an earlier scan but deleted since
+			if record == nil {
+				continue
+			}
+			entry.Status = statusMissingLocally
+		} else {
+			if err == nil {
+				entry.LocalTime = formatStoredTime(info.ModTime())
+			}
+			baseHash, _ := state.get(file, repoID, relativePath)
+			entry.Status, err = compareLocalFile(file, record, baseHash)
+			if err != nil {
+				entry.Error = err.Error()
+			}
+		}
+
+		seen[key] = true
+		entries = append(entries, entry)
+	}
+
+	for _, record := range records {
+		key := record.RepoID + "\x00" + record.RelativePath
+		if seen[key] || !filter.Match(record.RepoID, record.RelativePath) {
+			continue
+		}
+		entries = append(entries, statusEntry{
+			RepoID:       record.RepoID,
+			RelativePath: record.RelativePath,
+			Status:       statusMissingLocally,
+			RemoteTime:   record.FileModifiedAt,
+		})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].RepoID != entries[j].RepoID {
+			return entries[i].RepoID < entries[j].RepoID
+		}
+		return entries[i].RelativePath < entries[j].RelativePath
+	})
+	return entries, nil
+}
+
+// showStatus compares every remembered local file against the database and
+// prints a table of their sync state. Nothing is uploaded or downloaded.
+func showStatus(ctx context.Context, dbConnStr, basePath string, filter FileFilter) error {
+	files, err := loadEnvFiles()
+	if err != nil {
+		return fmt.Errorf("failed to load remembered files: %v", err)
+	}
+
+	db, err := OpenStore(dbConnStr)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := db.InitSchema(ctx); err != nil {
+		return err
+	}
+	updateClockSkew(ctx, db)
+
+	entries, err := collectStatus(ctx, db, files, basePath, filter)
+	if err != nil {
+		return err
+	}
+
+	counts := make(map[string]int)
+	for _, entry := range entries {
+		if entry.Error == "" {
+			counts[entry.Status]++
+		}
+	}
+
+	if jsonOutput {
+		if entries == nil {
+			entries = []statusEntry{}
+		}
+		printJSON(statusReport{Files: entries, Counts: counts})
+		return nil
+	}
+
+	if len(entries) == 0 {
+		fmt.Println("No env files found locally or in the database. Run 'env-sync scan <path>' first.")
+		return nil
+	}
+
+	fmt.Printf("%-18s %-30s %s\n", "STATUS", "REPO", "PATH")
+	for _, entry := range entries {
+		status := entry.Status
+		if entry.Error != "" {
+			status = "error"
+		}
+		fmt.Printf("%-18s %-30s %s\n", status, shortenRepoID(entry.RepoID), entry.RelativePath)
+		if entry.Error != "" {
+			fmt.Printf("  ✗ %s\n", entry.Error)
+		}
+	}
+
+	fmt.Println("\n" + strings.Repeat("-", 50))
+	for _, status := range statusOrder {
+		if counts[status] > 0 {
+			fmt.Printf("  %-18s %d\n", status+":", counts[status])
+		}
+	}
+	fmt.Println(strings.Repeat("-", 50))
+	return nil
+}
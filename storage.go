@@ -1,16 +1,36 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 )
 
+// EnvFileStore is this machine's inventory: the files scans found and what
+// each looked like when it was last synced. It is kept encrypted in
+// ~/.env-sync/inventory.enc, since the paths alone say a lot about a machine.
 type EnvFileStore struct {
-	Files []string `json:"files"`
+	Files    []string            `json:"files"`
+	Roots    []string            `json:"roots,omitempty"`     // Directories that were scanned to find Files
+	LastScan string              `json:"last_scan,omitempty"` // When Files was last replaced or added to
+	Synced   map[string]syncBase `json:"synced,omitempty"`    // Last-synced version of each local file, see syncState
+	Undone   []string            `json:"undone,omitempty"`    // IDs of the sync runs `env-sync undo` reverted
+	// When the daemon last sent a digest, see digestSchedule
+	DigestSentAt string `json:"digest_sent_at,omitempty"`
 }
 
+// inventoryMu serializes read-modify-write cycles of the inventory within
+// this process, e.g. a daemon rescan while sync state is saved
+var inventoryMu sync.Mutex
+
 func getStorageDir() (string, error) {
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
@@ -31,65 +51,342 @@ func getStorageFile() (string, error) {
 	if err != nil {
 		return "", err
 	}
-	return filepath.Join(dir, "env-files.json"), nil
+	return filepath.Join(dir, "inventory.enc"), nil
 }
 
-func saveEnvFiles(files []string) error {
-	storageFile, err := getStorageFile()
+// legacyInventoryFiles are the plaintext files the inventory was kept in
+// before it was encrypted; they are folded into it and removed
+var legacyInventoryFiles = []string{"env-files.json", "sync-state.json"}
+
+// getMachineKeyFile returns ~/.env-sync/machine.key, the random key the
+// inventory is encrypted with. It never leaves this machine, so the inventory
+// can be read without the encryption password.
+func getMachineKeyFile() (string, error) {
+	dir, err := getStorageDir()
 	if err != nil {
-		return err
+		return "", err
+	}
+	return filepath.Join(dir, "machine.key"), nil
+}
+
+// loadMachineKey returns this machine's key, creating it on first use
+func loadMachineKey() ([]byte, error) {
+	keyFile, err := getMachineKeyFile()
+	if err != nil {
+		return nil, err
 	}
 
-	store := EnvFileStore{
-		Files: files,
+	data, err := os.ReadFile(keyFile)
+	if err == nil {
+		key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("invalid machine key %s", keyFile)
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read machine key: %v", err)
 	}
 
-	data, err := json.MarshalIndent(store, "", "  ")
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate machine key: %v", err)
+	}
+	f, err := os.OpenFile(keyFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		// Another process created it first
+		return loadMachineKey()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create machine key: %v", err)
+	}
+	_, err = f.WriteString(hex.EncodeToString(key) + "\n")
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(keyFile)
+		return nil, fmt.Errorf("failed to write machine key: %v", err)
+	}
+	return key, nil
+}
+
+// saveEnvFiles replaces the remembered files with those found by scanning root
+func saveEnvFiles(files []string, root string) error {
+	return updateEnvFileStore(func(store *EnvFileStore) {
+		store.Files = files
+		store.Roots = nil
+		if absRoot, err := filepath.Abs(root); err == nil {
+			store.Roots = []string{absRoot}
+		}
+		store.LastScan = time.Now().UTC().Format("2006-01-02 15:04:05")
+	})
+}
+
+// updateEnvFileStore loads the inventory, lets update change it and saves it
+func updateEnvFileStore(update func(store *EnvFileStore)) error {
+	inventoryMu.Lock()
+	defer inventoryMu.Unlock()
+
+	store, err := readEnvFileStore()
 	if err != nil {
 		return err
 	}
+	update(store)
+	return writeEnvFileStore(store)
+}
 
-	return os.WriteFile(storageFile, data, 0644)
+func loadEnvFileStore() (*EnvFileStore, error) {
+	inventoryMu.Lock()
+	defer inventoryMu.Unlock()
+	return readEnvFileStore()
 }
 
-func loadEnvFiles() ([]string, error) {
+func readEnvFileStore() (*EnvFileStore, error) {
 	storageFile, err := getStorageFile()
 	if err != nil {
 		return nil, err
 	}
 
-	// Check if file exists
-	if _, err := os.Stat(storageFile); os.IsNotExist(err) {
-		return []string{}, nil
+	data, err := os.ReadFile(storageFile)
+	if os.IsNotExist(err) {
+		return readLegacyEnvFileStore()
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	data, err := os.ReadFile(storageFile)
+	key, err := loadMachineKey()
 	if err != nil {
 		return nil, err
 	}
+	plaintext, err := DecryptWithKey(strings.TrimSpace(string(data)), key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt %s (was machine.key replaced?): %v; remove it and run 'env-sync scan' again", storageFile, err)
+	}
 
-	var store EnvFileStore
-	if err := json.Unmarshal(data, &store); err != nil {
+	store := &EnvFileStore{}
+	if err := json.Unmarshal([]byte(plaintext), store); err != nil {
+		return nil, fmt.Errorf("invalid inventory %s: %v", storageFile, err)
+	}
+	if store.Files == nil {
+		store.Files = []string{}
+	}
+	return store, nil
+}
+
+// readLegacyEnvFileStore builds the inventory from the plaintext files of
+// earlier versions and, if there were any, encrypts it and removes them
+func readLegacyEnvFileStore() (*EnvFileStore, error) {
+	dir, err := getStorageDir()
+	if err != nil {
 		return nil, err
 	}
 
+	store := &EnvFileStore{Files: []string{}}
+	found := false
+	for i, name := range legacyInventoryFiles {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		found = true
+		if i == 0 {
+			err = json.Unmarshal(data, store)
+		} else {
+			var state struct {
+				Files map[string]syncBase `json:"files"`
+			}
+			err = json.Unmarshal(data, &state)
+			store.Synced = state.Files
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", filepath.Join(dir, name), err)
+		}
+	}
+	if !found {
+		return store, nil
+	}
+
+	if err := writeEnvFileStore(store); err != nil {
+		return nil, fmt.Errorf("failed to encrypt the inventory: %v", err)
+	}
+	for _, name := range legacyInventoryFiles {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+			logger.Warn("failed to remove plaintext inventory", "file", name, "error", err)
+		}
+	}
+	logger.Debug("encrypted the inventory", "dir", dir)
+	return store, nil
+}
+
+func writeEnvFileStore(store *EnvFileStore) error {
+	storageFile, err := getStorageFile()
+	if err != nil {
+		return err
+	}
+	key, err := loadMachineKey()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(store)
+	if err != nil {
+		return err
+	}
+	encrypted, err := EncryptWithKey(string(data), key)
+	if err != nil {
+		return err
+	}
+
+	// Write then rename, so a crash never leaves half an inventory
+	tmpFile := storageFile + ".tmp"
+	if err := os.WriteFile(tmpFile, []byte(encrypted+"\n"), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, storageFile)
+}
+
+func loadEnvFiles() ([]string, error) {
+	store, err := loadEnvFileStore()
+	if err != nil {
+		return nil, err
+	}
 	return store.Files, nil
 }
 
-func listEnvFiles() error {
-	files, err := loadEnvFiles()
+// rememberEnvFiles adds newly discovered files and scan roots to the remembered
+// set, returning the files that weren't known before
+func rememberEnvFiles(files, roots []string) ([]string, error) {
+	var added []string
+	err := updateEnvFileStore(func(store *EnvFileStore) {
+		added = addEnvFiles(store, files, roots)
+	})
+	return added, err
+}
+
+// addEnvFiles adds files and roots the store doesn't have yet
+func addEnvFiles(store *EnvFileStore, files, roots []string) []string {
+	known := make(map[string]bool)
+	for _, file := range store.Files {
+		known[file] = true
+	}
+	var added []string
+	for _, file := range files {
+		if !known[file] {
+			known[file] = true
+			store.Files = append(store.Files, file)
+			added = append(added, file)
+		}
+	}
+
+	knownRoots := make(map[string]bool)
+	for _, root := range store.Roots {
+		knownRoots[root] = true
+	}
+	for _, root := range roots {
+		if absRoot, err := filepath.Abs(root); err == nil && !knownRoots[absRoot] {
+			knownRoots[absRoot] = true
+			store.Roots = append(store.Roots, absRoot)
+		}
+	}
+	store.LastScan = time.Now().UTC().Format("2006-01-02 15:04:05")
+	return added
+}
+
+// listEnvFiles prints the remembered files and, given a database, each
+// file's tags and how much it saves by storing identical contents once. With
+// tags, only files stored with one of them are listed.
+func listEnvFiles(ctx context.Context, dbConnStr string, tags []string) error {
+	store, err := loadEnvFileStore()
 	if err != nil {
 		return err
 	}
+	files := store.Files
 
-	if len(files) == 0 {
-		fmt.Println("No .env files remembered. Run 'env-sync scan <path>' first.")
+	var usage *blobUsage
+	var fileTags map[string][]string
+	if dbConnStr != "" {
+		if usage, fileTags, err = loadListDetails(ctx, dbConnStr, FileFilter{Tags: tags}); err != nil {
+			return err
+		}
+	}
+	// Tags of the stored copy of each file, found by its identifier
+	labels := make(map[string][]string)
+	for _, file := range files {
+		if fileTags == nil {
+			break
+		}
+		root := filepath.Dir(file)
+		for _, r := range store.Roots {
+			if rel, err := filepath.Rel(r, file); err == nil && !strings.HasPrefix(rel, "..") {
+				root = r
+				break
+			}
+		}
+		if repoID, relativePath, err := GetFileIdentifier(file, root); err == nil && len(fileTags[auditKey(repoID, relativePath)]) > 0 {
+			labels[file] = fileTags[auditKey(repoID, relativePath)]
+		}
+	}
+	if len(tags) > 0 {
+		files = slices.DeleteFunc(slices.Clone(files), func(file string) bool {
+			return !slices.ContainsFunc(tags, func(tag string) bool {
+				return slices.Contains(labels[file], strings.ToLower(tag))
+			})
+		})
+	}
+
+	if jsonOutput {
+		synced := make(map[string]string)
+		for _, file := range files {
+			if base, ok := store.Synced[file]; ok && base.SyncedAt != "" {
+				synced[file] = base.SyncedAt
+			}
+		}
+		printJSON(struct {
+			Files    []string            `json:"files"`
+			LastScan string              `json:"last_scan,omitempty"`
+			Synced   map[string]string   `json:"last_synced_at"`
+			Tags     map[string][]string `json:"tags,omitempty"`
+			Storage  *blobUsage          `json:"storage,omitempty"`
+		}{append([]string{}, files...), store.LastScan, synced, labels, usage})
 		return nil
 	}
 
-	fmt.Printf("Remembered %d .env file(s):\n", len(files))
-	for i, file := range files {
-		fmt.Printf("%d. %s\n", i+1, file)
+	if len(files) == 0 && len(tags) > 0 {
+		fmt.Printf("No remembered .env files are stored with tag %s.\n", joinOr(tags))
+	} else if len(files) == 0 {
+		fmt.Println("No .env files remembered. Run 'env-sync scan <path>' first.")
+	} else {
+		fmt.Printf("Remembered %d .env file(s)", len(files))
+		if store.LastScan != "" {
+			fmt.Printf(", last scanned %s UTC", store.LastScan)
+		}
+		fmt.Println(":")
+		for i, file := range files {
+			line := fmt.Sprintf("%d. %s", i+1, file)
+			if len(labels[file]) > 0 {
+				line += " [" + strings.Join(labels[file], ", ") + "]"
+			}
+			if base, ok := store.Synced[file]; ok && base.SyncedAt != "" {
+				line += fmt.Sprintf(" (synced %s UTC)", base.SyncedAt)
+			}
+			fmt.Println(line)
+		}
+	}
+
+	if usage != nil {
+		fmt.Printf("\nStored: %d file(s) and %d revision(s) in %d blob(s)\n", usage.Files, usage.Revisions, usage.Blobs)
+		if usage.LogicalBytes > 0 {
+			fmt.Printf("Deduplication saves %s of %s (%.0f%%)\n", formatBytes(usage.SavedBytes()), formatBytes(usage.LogicalBytes),
+				100*float64(usage.SavedBytes())/float64(usage.LogicalBytes))
+		}
+		if !usage.SharedAcrossFiles {
+			fmt.Println("Identical files in different places aren't deduplicated: each copy is bound to its file (set \"share_contents\": true to share them)")
+		}
 	}
 
 	return nil
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Store is a backend that holds encrypted env files.
+// Database (Turso/LibSQL, PostgreSQL), S3Store, GCSMStore and WebDAVStore implement it.
+type Store interface {
+	Close() error
+	InitSchema(ctx context.Context) error
+	UpsertEnvFile(ctx context.Context, repoID, relativePath, encryptedContents, fileHash, fileModTime string, fileMode os.FileMode) error
+	UpsertEnvFiles(ctx context.Context, records []EnvFileRecord) error
+	GetEnvFile(ctx context.Context, repoID, relativePath string) (string, error)
+	GetEnvFileWithMetadata(ctx context.Context, repoID, relativePath string) (*EnvFileRecord, error)
+	ListEnvFiles(ctx context.Context) ([]EnvFileRecord, error)
+	ListEnvFilesWithContents(ctx context.Context) ([]EnvFileRecord, error)
+	ListEnvFileVersions(ctx context.Context, repoID, relativePath string) ([]EnvFileVersion, error)
+	GetEnvFileVersion(ctx context.Context, repoID, relativePath string, version int) (*EnvFileVersion, error)
+	RenameRepo(ctx context.Context, oldRepoID, newRepoID string) error
+	MoveEnvFile(ctx context.Context, repoID, oldPath, newPath string) error
+	DeleteRepo(ctx context.Context, repoID string) error
+	DeleteEnvFile(ctx context.Context, repoID, relativePath string) error
+}
+
+// OpenStore opens the backend matching the connection string
+// S3 URL format: s3://bucket/prefix
+// Secret Manager URL format: gcsm://project-id/prefix
+// WebDAV URL format: webdav://host/path (webdav+http:// without TLS)
+// Everything else is handed to NewDatabase.
+// Any of them can take encrypt_ids=true to store repo IDs and paths encrypted.
+func OpenStore(connString string) (Store, error) {
+	connString, encryptIDs := splitEncryptIDs(connString)
+	store, err := openBackend(connString)
+	if err != nil || !encryptIDs {
+		return store, err
+	}
+
+	sealed, err := newSealedStore(store)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	return sealed, nil
+}
+
+func openBackend(connString string) (Store, error) {
+	if err := checkNamespaceSupported(connString); err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(connString, "s3://") {
+		return NewS3Store(connString)
+	}
+	if strings.HasPrefix(connString, "gcsm://") {
+		return NewGCSMStore(connString)
+	}
+	if strings.HasPrefix(connString, "webdav://") || strings.HasPrefix(connString, "webdav+http://") {
+		return NewWebDAVStore(connString)
+	}
+	return NewDatabase(connString)
+}
+
+// conditionalStore is implemented by backends that can write a file only if
+// nobody else wrote it since it was read (optimistic locking)
+type conditionalStore interface {
+	UpsertEnvFileIf(ctx context.Context, record EnvFileRecord, base *EnvFileRecord) error
+}
+
+// staleWriteError reports a conditional write that was refused because the
+// stored file changed since it was read
+type staleWriteError struct {
+	repoID       string
+	relativePath string
+}
+
+func (e *staleWriteError) Error() string {
+	return fmt.Sprintf("%s:%s was changed in the database by someone else while it was being written", e.repoID, e.relativePath)
+}
+
+// upsertIfUnchanged writes record unless the stored file changed since it
+// was read as base (nil if it wasn't stored then). Backends without
+// conditional writes overwrite it, last writer wins.
+func upsertIfUnchanged(ctx context.Context, db Store, record EnvFileRecord, base *EnvFileRecord) error {
+	if conditional, ok := db.(conditionalStore); ok {
+		return conditional.UpsertEnvFileIf(ctx, record, base)
+	}
+	return db.UpsertEnvFile(ctx, record.RepoID, record.RelativePath, record.Contents, record.FileHash, record.FileModifiedAt, record.FileMode)
+}
@@ -1,60 +1,283 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"path"
+	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"golang.org/x/term"
 )
 
 type SyncStats struct {
 	FilesUploaded   int64
 	FilesDownloaded int64
 	FilesSkipped    int64
+	FilesMerged     int64
+	FilesMoved      int64
 	FilesConflict   int64
+	FilesCorrupted  int64
+	FilesError      int64
+	FilesDeferred   int64 // Left for the next sync by --max-writes
+	FilesTooLarge   int64 // Local files over --max-file-size, left alone
+	FilesInvalid    int64 // Kept out of the database by --strict lint failures
+}
+
+// SyncOptions controls how syncEnvFiles behaves
+type SyncOptions struct {
+	DryRun  bool
+	Workers int
+	Merge   bool // Merge changed files key by key instead of overwriting the whole file
+	Filter  FileFilter
+	// Extra directories to scan besides the base path, and whether to
+	// also rescan every root remembered from earlier scans
+	ScanPaths []string
+	Rescan    bool
+	InRepo    bool     // Scoped to the checkout sync was run in, so the config's base paths aren't scanned
+	Replicas  []string // Extra --db targets that every write is copied to
+	Store     Store    // An open store to use instead of connecting (the daemon's); not closed
+	Direction string   // directionPull or directionPush restrict sync to one way (default: both)
+	Force     bool     // Sync even if another sync holds the lock
+	MaxWrites int      // Write at most this many files to the database; the rest wait for the next sync (0: no limit)
+	// A file that takes longer than FileTimeout to sync fails, the sync
+	// stops after Timeout, and once more than MaxErrorRate percent of the
+	// files done failed the rest are left for the next sync (0: no limit)
+	FileTimeout  time.Duration
+	Timeout      time.Duration
+	MaxErrorRate int
+	// Descend into symlinked directories when scanning, see walkForEnvFiles
+	FollowSymlinks bool
+	// Local files larger than MaxFileSize bytes are skipped with a warning
+	// unless ForceLarge is set (0: no limit)
+	MaxFileSize int64
+	ForceLarge  bool
+	// Lint .env files before uploading them and log what's wrong; with
+	// Strict, a file with issues is an error and isn't uploaded
+	Lint   bool
+	Strict bool
+	// The environment this machine belongs to, and whether files tagged
+	// prod may be synced here anyway (see environmentConflict)
+	Environment string
+	AllowProd   bool
+	// Console output: by default only changed files are listed. Verbose also
+	// lists skipped files, Quiet prints only errors, conflicts and the summary,
+	// and Progress replaces the per-file lines with a progress bar.
+	Verbose    bool
+	Quiet      bool
+	Progress   bool
+	LogResults bool      // Send per-file results and the summary to the logger instead of stdout (daemon mode)
+	Notifier   *notifier // Told about the files each sync changed, in LogResults mode
+
+	budget  *writeBudget // What's left of MaxWrites, set up by syncEnvFiles
+	journal *syncJournal // What the files written looked like before, for undo
+}
+
+// Actions reported for each synced file
+const (
+	actionUpload   = "upload"
+	actionDownload = "download"
+	actionSkip     = "skip"
+	actionMerge    = "merge"
+	actionMove     = "move"
+	actionConflict = "conflict"
+	// The stored copy doesn't match its hash, so neither side is touched
+	actionCorrupted = "corrupted"
+)
+
+// Sync directions
+const (
+	directionBoth = "both"
+	directionPull = "pull" // Only download; the database is never written
+	directionPush = "push" // Only upload; local files are never written
+)
+
+// checkDirection validates a --direction value
+func checkDirection(direction string) error {
+	switch direction {
+	case directionBoth, directionPull, directionPush:
+		return nil
+	}
+	return fmt.Errorf("invalid --direction: %s (use pull, push or both)", direction)
+}
+
+// allows reports whether the sync direction permits an action: uploads write
+// the database, downloads write local files and merges write both
+func (o SyncOptions) allows(action string) bool {
+	switch o.Direction {
+	case directionPull:
+		return action == actionDownload
+	case directionPush:
+		return action == actionUpload
+	}
+	return true
+}
+
+// deferWrite reports a change left for the next sync because the
+// --max-writes budget is used up
+func deferWrite(stats *SyncStats, displayName string) (string, string, error) {
+	atomic.AddInt64(&stats.FilesDeferred, 1)
+	return actionSkip, fmt.Sprintf("⏸ Deferred: %s (--max-writes reached, synced on the next run)", displayName), nil
+}
+
+// directionSkip reports a change that the sync direction leaves alone
+func directionSkip(stats *SyncStats, displayName, reason string, opts SyncOptions) (string, string, error) {
+	atomic.AddInt64(&stats.FilesSkipped, 1)
+	return actionSkip, fmt.Sprintf("= Skipped: %s (%s, --direction %s)", displayName, reason, opts.Direction), nil
+}
+
+// scanFilesToSync scans basePath, and unless the sync is scoped to one
+// checkout the config's base paths and opts.ScanPaths, for the env files
+// opts.Filter selects
+func scanFilesToSync(basePath string, opts SyncOptions) ([]string, error) {
+	scanPaths := opts.ScanPaths
+	if !opts.InRepo {
+		scanPaths = append(basePathRoots(), scanPaths...)
+	}
+	files, err := scanSyncRoots(basePath, scanPaths, opts.Rescan, opts.FollowSymlinks, opts.Progress && !opts.LogResults)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan for env files: %v", err)
+	}
+
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no env files found in %s", basePath)
+	}
+
+	files = filterFiles(files, basePath, opts.Filter)
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no env files in %s match the given filters", basePath)
+	}
+	return files, nil
 }
 
 type syncResult struct {
 	file    string
+	action  string
 	message string
 	err     error
 }
 
-func syncEnvFiles(dbConnStr, password, basePath string, dryRun bool, numWorkers int) error {
+func syncEnvFiles(ctx context.Context, dbConnStr, password, basePath string, opts SyncOptions) (*SyncStats, error) {
 	startTime := time.Now()
+	dryRun := opts.DryRun
+	numWorkers := opts.Workers
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, opts.Timeout, &syncStoppedError{reason: fmt.Sprintf("--timeout %s ran out", opts.Timeout)})
+		defer cancel()
+	}
+
+	// Remotes and submodules may have changed since the daemon's last cycle
+	gitRemotes.Clear()
+	gitSubmodules.Clear()
 
-	// Auto-scan basePath for env files
-	files, err := scanForEnvFilesQuiet(basePath)
+	// Auto-scan basePath (and any extra roots) for env files
+	files, err := scanFilesToSync(basePath, opts)
 	if err != nil {
-		return fmt.Errorf("failed to scan for env files: %v", err)
+		return nil, err
 	}
 
-	if len(files) == 0 {
-		return fmt.Errorf("no env files found in %s", basePath)
+	// Connect to database, unless the daemon holds a connection already
+	dbStartTime := time.Now()
+	db := opts.Store
+	if db == nil {
+		if db, err = openReplicatedStore(dbConnStr, opts.Replicas); err != nil {
+			if databaseUnreachable(err) {
+				return nil, queueOfflineEdits(files, basePath, password, opts, err)
+			}
+			return nil, err
+		}
+		defer db.Close()
+
+		// Initialize schema
+		if err := db.InitSchema(ctx); err != nil {
+			if databaseUnreachable(err) {
+				return nil, queueOfflineEdits(files, basePath, password, opts, err)
+			}
+			return nil, err
+		}
 	}
+	dbConnectTime := time.Since(dbStartTime)
+	updateClockSkew(ctx, db)
 
-	// Connect to database
-	dbStartTime := time.Now()
-	db, err := NewDatabase(dbConnStr)
+	// A dry run writes nothing, so it doesn't need to wait for other syncs
+	lock, err := acquireSyncLock(ctx, db, opts.Force || dryRun)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer db.Close()
-	dbConnectTime := time.Since(dbStartTime)
+	defer lock.release()
 
-	// Initialize schema
-	if err := db.InitSchema(); err != nil {
-		return err
+	if err := checkPassword(ctx, db, password); err != nil {
+		return nil, err
+	}
+
+	state, err := loadSyncState()
+	if err != nil {
+		return nil, err
+	}
+	if !dryRun && opts.allows(actionUpload) {
+		flushUploadQueue(ctx, db, password, state, opts)
+	}
+
+	// Stored files of the same checkouts that have no local copy yet (e.g.
+	// added from another machine) are downloaded to where they belong,
+	// unless they turn out to be a local file under another name
+	records, err := db.ListEnvFiles(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tags, err := loadFileTags(ctx, db, opts.Filter)
+	if err != nil {
+		return nil, err
+	}
+	opts.Filter.tagged = tags
+	remoteOnly, stored := remoteOnlyFiles(records, files, basePath, opts.Filter)
+	moves := findMoves(files, basePath, remoteOnly, stored, state, opts)
+	if !opts.allows(actionDownload) {
+		remoteOnly = nil
+	}
+	for file := range remoteOnly {
+		files = append(files, file)
+	}
+	if files = allowedFiles(files, basePath, remoteOnly, moves, tags, opts); len(files) == 0 {
+		return nil, fmt.Errorf("no env files in %s match the given filters", basePath)
 	}
 
 	stats := &SyncStats{}
+	opts.budget = newWriteBudget(opts.MaxWrites)
+	opts.journal = newSyncJournal()
+	runID := newSyncRunID(startTime)
 
-	if dryRun {
-		fmt.Printf("DRY RUN MODE - No changes will be made\n")
+	if !dryRun {
+		defer func() {
+			if err := state.save(); err != nil {
+				logger.Warn("failed to save sync state", "error", err)
+			}
+		}()
+	}
+
+	if opts.LogResults {
+		logger.Info("syncing", "files", len(files), "workers", numWorkers, "dry_run", dryRun, "direction", opts.Direction)
+	} else {
+		if dryRun {
+			notef("DRY RUN MODE - No changes will be made\n")
+		}
+		switch opts.Direction {
+		case directionPull:
+			notef("PULL ONLY - The database will not be changed\n")
+		case directionPush:
+			notef("PUSH ONLY - Local files will not be changed\n")
+		}
+		if !opts.Quiet {
+			notef("Syncing %d .env file(s) with %d workers...\n\n", len(files), numWorkers)
+		}
 	}
-	fmt.Printf("Syncing %d .env file(s) with %d workers...\n\n", len(files), numWorkers)
 
 	// Use worker pool for parallel processing
 	if len(files) < numWorkers {
@@ -63,6 +286,9 @@ func syncEnvFiles(dbConnStr, password, basePath string, dryRun bool, numWorkers
 
 	jobs := make(chan string, len(files))
 	results := make(chan syncResult, len(files))
+	// Cancelled with a *syncStoppedError when too many files fail
+	ctx, stop := context.WithCancelCause(ctx)
+	defer stop(nil)
 
 	// Start workers
 	var wg sync.WaitGroup
@@ -71,8 +297,19 @@ func syncEnvFiles(dbConnStr, password, basePath string, dryRun bool, numWorkers
 		go func() {
 			defer wg.Done()
 			for file := range jobs {
-				msg, err := syncFileParallel(db, file, basePath, password, stats, dryRun)
-				results <- syncResult{file: file, message: msg, err: err}
+				// After Ctrl+C, finish the files in progress but start no more
+				if ctx.Err() != nil {
+					return
+				}
+				action, msg, err := syncWithTimeout(ctx, opts, func(ctx context.Context) (string, string, error) {
+					if record, ok := remoteOnly[file]; ok {
+						return syncRemoteOnlyFile(ctx, db, record, file, password, stats, state, opts)
+					} else if move, ok := moves[file]; ok {
+						return syncMovedFile(ctx, db, move, password, stats, state, opts)
+					}
+					return syncFileRetrying(ctx, db, file, basePath, password, stats, state, opts)
+				})
+				results <- syncResult{file: file, action: action, message: msg, err: err}
 			}
 		}()
 	}
@@ -91,17 +328,157 @@ func syncEnvFiles(dbConnStr, password, basePath string, dryRun bool, numWorkers
 	}()
 
 	// Collect results
-	errCount := 0
+	var bar *progressBar
+	if opts.Progress && !opts.LogResults && !jsonOutput && term.IsTerminal(int(os.Stderr.Fd())) {
+		bar = newProgressBar(len(files))
+	}
+	printLine := func(line string) {
+		if bar != nil {
+			bar.Printf("%s\n", line)
+		} else {
+			fmt.Println(line)
+		}
+	}
+
+	errCount, failures, done := 0, 0, 0
+	var fileReports []syncFileReport
+	var changes []syncRunChange
 	for result := range results {
+		if result.err != nil && ctx.Err() != nil {
+			// Cut short by the interrupt; it's synced on the next run
+			continue
+		}
+		done++
+		if result.err != nil {
+			failures++
+		}
+		if ctx.Err() == nil && opts.tooManyErrors(failures, done) {
+			stop(&syncStoppedError{reason: fmt.Sprintf("%d of the first %d file(s) failed, over --max-error-rate %d%%", failures, done, opts.MaxErrorRate)})
+		}
+		if result.action != actionSkip || result.err != nil {
+			change := syncRunChange{Action: result.action, Error: result.err != nil}
+			change.RepoID, change.RelativePath, _ = GetFileIdentifier(result.file, basePath)
+			opts.journal.fill(result.file, &change)
+			changes = append(changes, change)
+		}
+		if opts.LogResults {
+			if result.action != actionSkip || result.err != nil {
+				report := syncFileReport{File: result.file, Action: result.action, Message: result.message}
+				if result.err != nil {
+					report.Error = result.err.Error()
+				}
+				fileReports = append(fileReports, report)
+			}
+			if result.err != nil {
+				logger.Error("sync failed", "file", result.file, "error", result.err)
+				errCount++
+			} else if result.action == actionSkip {
+				logger.Debug(result.message, "file", result.file, "action", result.action)
+			} else if result.action == actionConflict {
+				logger.Warn(result.message, "file", result.file, "action", result.action)
+			} else if result.action == actionCorrupted {
+				logger.Error(result.message, "file", result.file, "action", result.action)
+			} else {
+				logger.Info(result.message, "file", result.file, "action", result.action)
+			}
+			continue
+		}
+		if jsonOutput {
+			report := syncFileReport{File: result.file, Action: result.action, Message: result.message}
+			if result.err != nil {
+				report.Error = result.err.Error()
+				errCount++
+			}
+			fileReports = append(fileReports, report)
+			continue
+		}
 		if result.err != nil {
-			fmt.Printf("✗ Error syncing %s: %v\n", result.file, result.err)
+			printLine(fmt.Sprintf("✗ Error syncing %s: %v", result.file, result.err))
 			errCount++
-		} else if result.message != "" {
-			fmt.Println(result.message)
+		} else if result.message != "" && showSyncResult(result.action, opts) {
+			printLine(result.message)
 		}
+		if bar != nil {
+			bar.Increment()
+		}
+	}
+	if bar != nil {
+		bar.Finish()
 	}
 	syncTime := time.Since(syncStartTime)
 	totalTime := time.Since(startTime)
+	atomic.StoreInt64(&stats.FilesError, int64(errCount))
+	var interrupted error
+	if ctx.Err() != nil && done < len(files) {
+		interrupted = fmt.Errorf("sync interrupted after %d of %d file(s); run it again to sync the rest", done, len(files))
+		if reason, ok := stopReason(ctx); ok {
+			interrupted = fmt.Errorf("sync stopped after %d of %d file(s), %s; run it again to sync the rest", done, len(files), reason)
+		}
+	}
+	// Files --strict kept out of the database fail the sync too
+	failed := interrupted
+	if invalid := atomic.LoadInt64(&stats.FilesInvalid); failed == nil && invalid > 0 {
+		failed = fmt.Errorf("%d file(s) failed lint and were not uploaded (--strict)", invalid)
+	}
+	counts := syncStatsReport{
+		Uploaded:   atomic.LoadInt64(&stats.FilesUploaded),
+		Downloaded: atomic.LoadInt64(&stats.FilesDownloaded),
+		Skipped:    atomic.LoadInt64(&stats.FilesSkipped),
+		Merged:     atomic.LoadInt64(&stats.FilesMerged),
+		Moved:      atomic.LoadInt64(&stats.FilesMoved),
+		Conflicts:  atomic.LoadInt64(&stats.FilesConflict),
+		Corrupted:  atomic.LoadInt64(&stats.FilesCorrupted),
+		Deferred:   atomic.LoadInt64(&stats.FilesDeferred),
+		TooLarge:   atomic.LoadInt64(&stats.FilesTooLarge),
+		Invalid:    atomic.LoadInt64(&stats.FilesInvalid),
+		Errors:     errCount,
+	}
+	if !dryRun {
+		recordSyncRun(syncRun{ID: runID, Time: startTime.UTC().Format(time.RFC3339), DurationMs: totalTime.Milliseconds(), Files: len(files), Stats: counts,
+			Daemon: opts.LogResults, Interrupted: interrupted != nil, Changes: changes})
+	}
+
+	if opts.LogResults {
+		logger.Info("sync finished",
+			"uploaded", atomic.LoadInt64(&stats.FilesUploaded),
+			"downloaded", atomic.LoadInt64(&stats.FilesDownloaded),
+			"skipped", atomic.LoadInt64(&stats.FilesSkipped),
+			"merged", atomic.LoadInt64(&stats.FilesMerged),
+			"moved", atomic.LoadInt64(&stats.FilesMoved),
+			"conflicts", atomic.LoadInt64(&stats.FilesConflict),
+			"corrupted", atomic.LoadInt64(&stats.FilesCorrupted),
+			"deferred", atomic.LoadInt64(&stats.FilesDeferred),
+			"too_large", atomic.LoadInt64(&stats.FilesTooLarge),
+			"invalid", atomic.LoadInt64(&stats.FilesInvalid),
+			"errors", errCount,
+			"duration", totalTime.Round(time.Millisecond).String(),
+			"run_id", runID)
+		for _, report := range replicaReports(db) {
+			logger.Info("sync target", "target", report.Target, "primary", report.Primary, "writes", report.Writes, "failures", report.Failures, "error", report.Error)
+		}
+		if opts.Notifier != nil && !dryRun && interrupted == nil {
+			opts.Notifier.syncFinished(fileReports)
+		}
+		return stats, failed
+	}
+
+	if jsonOutput {
+		printJSON(syncReport{
+			RunID:  runID,
+			DryRun: dryRun,
+			Files:  fileReports,
+			Stats:  counts,
+			Performance: syncPerformanceReport{
+				TotalFiles:  len(files),
+				Workers:     numWorkers,
+				DBConnectMs: dbConnectTime.Milliseconds(),
+				SyncMs:      syncTime.Milliseconds(),
+				TotalMs:     totalTime.Milliseconds(),
+			},
+			Targets: replicaReports(db),
+		})
+		return stats, failed
+	}
 
 	// Print summary
 	fmt.Println("\n" + strings.Repeat("-", 50))
@@ -113,13 +490,45 @@ func syncEnvFiles(dbConnStr, password, basePath string, dryRun bool, numWorkers
 	fmt.Printf("  ↑ Uploaded (local newer):   %d\n", atomic.LoadInt64(&stats.FilesUploaded))
 	fmt.Printf("  ↓ Downloaded (remote newer): %d\n", atomic.LoadInt64(&stats.FilesDownloaded))
 	fmt.Printf("  = Skipped (same):           %d\n", atomic.LoadInt64(&stats.FilesSkipped))
+	if atomic.LoadInt64(&stats.FilesMerged) > 0 {
+		fmt.Printf("  ⇄ Merged (key-level):       %d\n", atomic.LoadInt64(&stats.FilesMerged))
+	}
+	if atomic.LoadInt64(&stats.FilesMoved) > 0 {
+		fmt.Printf("  ↪ Moved (renamed):          %d\n", atomic.LoadInt64(&stats.FilesMoved))
+	}
 	if atomic.LoadInt64(&stats.FilesConflict) > 0 {
 		fmt.Printf("  ⚠ Conflicts:                %d\n", atomic.LoadInt64(&stats.FilesConflict))
 	}
+	if atomic.LoadInt64(&stats.FilesCorrupted) > 0 {
+		fmt.Printf("  ✗ Corrupted in database:    %d\n", atomic.LoadInt64(&stats.FilesCorrupted))
+	}
+	if atomic.LoadInt64(&stats.FilesDeferred) > 0 {
+		fmt.Printf("  ⏸ Deferred (--max-writes):  %d\n", atomic.LoadInt64(&stats.FilesDeferred))
+	}
+	if atomic.LoadInt64(&stats.FilesTooLarge) > 0 {
+		fmt.Printf("  ⚠ Too large (skipped):      %d\n", atomic.LoadInt64(&stats.FilesTooLarge))
+	}
+	if atomic.LoadInt64(&stats.FilesInvalid) > 0 {
+		fmt.Printf("  ✗ Failed lint (--strict):   %d\n", atomic.LoadInt64(&stats.FilesInvalid))
+	}
 	if errCount > 0 {
 		fmt.Printf("  ✗ Errors:                   %d\n", errCount)
 	}
 	fmt.Println(strings.Repeat("-", 50))
+	printReplicaReport(db)
+	if !dryRun && slices.ContainsFunc(changes, syncRunChange.undoable) {
+		fmt.Printf("\nRun ID: %s (`env-sync undo %s` reverts it)\n", runID, runID)
+	}
+	if deferred := atomic.LoadInt64(&stats.FilesDeferred); deferred > 0 {
+		fmt.Printf("\n%d file(s) exceeded --max-writes %d; run sync again to write them\n", deferred, opts.MaxWrites)
+	}
+	if tooLarge := atomic.LoadInt64(&stats.FilesTooLarge); tooLarge > 0 {
+		fmt.Printf("\n%d file(s) are over the %s --max-file-size and were not synced (--verbose lists them); use --force-large to sync them anyway\n", tooLarge, formatBytes(opts.MaxFileSize))
+	}
+
+	if opts.Quiet || interrupted != nil {
+		return stats, failed
+	}
 
 	// Print performance metrics
 	fmt.Printf("\nPerformance:\n")
@@ -132,100 +541,428 @@ func syncEnvFiles(dbConnStr, password, basePath string, dryRun bool, numWorkers
 		fmt.Printf("  Throughput:       %.1f files/sec\n", float64(len(files))/syncTime.Seconds())
 	}
 
-	return nil
+	return stats, failed
 }
 
-// syncFileParallel is a parallel-safe version that returns a message instead of printing
-func syncFileParallel(db *Database, filePath, basePath, password string, stats *SyncStats, dryRun bool) (string, error) {
+// showSyncResult reports whether a successful per-file result is printed
+func showSyncResult(action string, opts SyncOptions) bool {
+	switch {
+	case opts.Verbose || action == actionConflict || action == actionCorrupted:
+		return true
+	case opts.Quiet || opts.Progress:
+		return false
+	default:
+		return action != actionSkip
+	}
+}
+
+// remoteOnlyFiles finds the stored files of every checkout being synced that
+// have no local copy, keyed by the local path they would be written to. A
+// checkout is a git repo, or basePath for non-git files, with at least one
+// local file. stored holds the local files that do have a stored copy.
+func remoteOnlyFiles(records []EnvFileRecord, files []string, basePath string, filter FileFilter) (remoteOnly map[string]EnvFileRecord, stored map[string]bool) {
+	checkoutRepos := make(map[string][]string)  // root -> repo ID and aliases
+	present := make(map[string]map[string]bool) // root -> relative paths found locally
+	for _, file := range files {
+		repoID, relativePath, err := GetFileIdentifier(file, basePath)
+		if err != nil {
+			continue
+		}
+		root, ok := strings.CutSuffix(filepath.Clean(file), filepath.FromSlash(relativePath))
+		if !ok {
+			// A non-git file outside basePath
+			continue
+		}
+		if present[root] == nil {
+			present[root] = make(map[string]bool)
+			checkoutRepos[root] = []string{repoID}
+			if !isLocalRepo(repoID) {
+				checkoutRepos[root] = append(checkoutRepos[root], gitRemoteAliases(filepath.Clean(root), repoID)...)
+			}
+		}
+		present[root][relativePath] = true
+	}
+
+	remoteOnly = make(map[string]EnvFileRecord)
+	stored = make(map[string]bool)
+	for root, repoIDs := range checkoutRepos {
+		for _, record := range records {
+			if !slices.Contains(repoIDs, record.RepoID) {
+				continue
+			}
+			localPath := filepath.Join(root, filepath.FromSlash(record.RelativePath))
+			if present[root][record.RelativePath] {
+				stored[localPath] = true
+				continue
+			}
+			if !filter.Match(record.RepoID, record.RelativePath) {
+				continue
+			}
+			if rel, err := filepath.Rel(root, localPath); err != nil || strings.HasPrefix(rel, "..") {
+				logger.Warn("skipping path outside the repository", "repo", record.RepoID, "path", record.RelativePath)
+				continue
+			}
+			if _, err := os.Lstat(localPath); err == nil {
+				// Exists but wasn't scanned: ignored, filtered out or marked
+				// env-sync: ignore, so leave it alone
+				continue
+			}
+			// A file stored under both the repo ID and an alias comes from the repo ID
+			if existing, ok := remoteOnly[localPath]; ok && existing.RepoID == repoIDs[0] {
+				continue
+			}
+			remoteOnly[localPath] = record
+		}
+	}
+	return remoteOnly, stored
+}
+
+// syncRemoteOnlyFile downloads a stored file that has no local copy. A file
+// this machine synced before was deleted locally, so it isn't brought back.
+func syncRemoteOnlyFile(ctx context.Context, db Store, record EnvFileRecord, filePath, password string, stats *SyncStats, state *syncState, opts SyncOptions) (string, string, error) {
+	displayName := fmt.Sprintf("%s (%s)", record.RelativePath, shortenRepoID(record.RepoID))
+
+	if _, synced := state.get(filePath, record.RepoID, record.RelativePath); synced {
+		atomic.AddInt64(&stats.FilesSkipped, 1)
+		return actionSkip, fmt.Sprintf("= Skipped: %s (deleted locally, use download to restore it)", displayName), nil
+	}
+
+	full, err := db.GetEnvFileWithMetadata(ctx, record.RepoID, record.RelativePath)
+	if err != nil || full == nil {
+		return "", "", fmt.Errorf("failed to read %s: %v", displayName, err)
+	}
+	if !opts.DryRun {
+		if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+			return "", "", fmt.Errorf("failed to create directory: %v", err)
+		}
+	}
+	if err := syncDownload(ctx, db, full, filePath, password, opts.DryRun); err != nil {
+		return flagCorrupted(stats, displayName, err)
+	}
+	if !opts.DryRun {
+		state.set(filePath, full.RepoID, full.RelativePath, full.FileHash)
+		recordAudit(ctx, db, newAuditEntry(auditDownload, full.RepoID, full.RelativePath, "", full.FileHash))
+	}
+	atomic.AddInt64(&stats.FilesDownloaded, 1)
+	return actionDownload, fmt.Sprintf("↓ Downloaded: %s (new)%s", displayName, dryRunSuffix(opts.DryRun)), nil
+}
+
+// maxStaleRetries bounds how often a file is synced again after its upload
+// lost a race with another machine's
+const maxStaleRetries = 3
+
+// syncFileRetrying runs syncFileParallel again when its upload was refused
+// because someone else wrote the file after it was read, so the new remote
+// copy goes through conflict resolution instead of being overwritten
+func syncFileRetrying(ctx context.Context, db Store, filePath, basePath, password string, stats *SyncStats, state *syncState, opts SyncOptions) (string, string, error) {
+	for attempt := 1; ; attempt++ {
+		action, msg, err := syncFileParallel(ctx, db, filePath, basePath, password, stats, state, opts)
+		var stale *staleWriteError
+		if !errors.As(err, &stale) || attempt == maxStaleRetries || ctx.Err() != nil {
+			return action, msg, err
+		}
+		opts.budget.refund()
+		logger.Debug("file changed in the database during sync, syncing it again", "file", filePath, "attempt", attempt)
+	}
+}
+
+// syncFileParallel is a parallel-safe version that returns the action taken and a message instead of printing.
+// When this machine has synced the file before, local and remote are compared
+// against that last-synced version; otherwise modification times decide.
+func syncFileParallel(ctx context.Context, db Store, filePath, basePath, password string, stats *SyncStats, state *syncState, opts SyncOptions) (action string, message string, err error) {
+	dryRun := opts.DryRun
+
 	// Get git-based identifier or fallback to relative path
 	repoID, relativePath, err := GetFileIdentifier(filePath, basePath)
 	if err != nil {
-		return "", fmt.Errorf("failed to get file identifier: %v", err)
+		return "", "", fmt.Errorf("failed to get file identifier: %v", err)
 	}
-
+	repoID = storedRepoID(ctx, db, filePath, repoID, relativePath)
 	displayName := fmt.Sprintf("%s (%s)", relativePath, shortenRepoID(repoID))
 
-	// Get local file info
+	// Get local file info; a file over the size limit isn't even read
 	localInfo, err := os.Stat(filePath)
 	if err != nil {
-		return "", fmt.Errorf("failed to stat local file: %v", err)
+		return "", "", fmt.Errorf("failed to stat local file: %v", err)
+	}
+	if opts.tooLarge(localInfo.Size()) {
+		return skipLarge(stats, displayName, localInfo.Size(), opts)
 	}
-	localModTime := localInfo.ModTime().UTC()
+
+	// Once local and remote agree, remember that version as the new base
+	// and record what changed in the audit log. A change skipped because of
+	// the sync direction keeps the old base, so it isn't mistaken for a change
+	// on the other side later.
+	var localHash, remoteHash string
+	defer func() {
+		if err != nil || dryRun || action == actionConflict || action == actionCorrupted || (action == actionSkip && localHash != remoteHash) {
+			return
+		}
+		contents, readErr := os.ReadFile(filePath)
+		if readErr != nil {
+			return
+		}
+		syncedHash := envFileHash(filePath, contents, remoteHash)
+		state.set(filePath, repoID, relativePath, syncedHash)
+		if action != actionSkip {
+			opts.journal.record(filePath, repoID, relativePath, localHash, remoteHash, syncedHash)
+		}
+
+		switch action {
+		case actionUpload:
+			recordAudit(ctx, db, newAuditEntry(auditUpload, repoID, relativePath, remoteHash, syncedHash))
+		case actionDownload:
+			recordAudit(ctx, db, newAuditEntry(auditDownload, repoID, relativePath, localHash, syncedHash))
+		case actionMerge:
+			recordAudit(ctx, db, newAuditEntry(auditMerge, repoID, relativePath, remoteHash, syncedHash))
+		}
+	}()
+
+	localModTime := toServerTime(localInfo.ModTime())
 
 	// Read local file contents for hash comparison
-	localContents, err := os.ReadFile(filePath)
+	rawContents, err := os.ReadFile(filePath)
 	if err != nil {
-		return "", fmt.Errorf("failed to read local file: %v", err)
+		return "", "", fmt.Errorf("failed to read local file: %v", err)
 	}
-	localHash := HashFile(string(localContents))
+	localContents := normalizeEnvContents(filePath, rawContents)
 
 	// Check if file exists in database
-	dbRecord, err := db.GetEnvFileWithMetadata(repoID, relativePath)
+	dbRecord, err := db.GetEnvFileWithMetadata(ctx, repoID, relativePath)
 	if err != nil {
-		return "", fmt.Errorf("failed to check database: %v", err)
+		return "", "", fmt.Errorf("failed to check database: %v", err)
 	}
+	if dbRecord != nil {
+		remoteHash = dbRecord.FileHash
+	}
+	baseHash, hasBase := state.get(filePath, repoID, relativePath)
+	localHash = envFileHash(filePath, rawContents, remoteHash, baseHash)
 
 	if dbRecord == nil {
 		// File doesn't exist in DB, upload it
+		if !opts.allows(actionUpload) {
+			return directionSkip(stats, displayName, "not in the database", opts)
+		}
+		if err := lintUpload(stats, filePath, string(localContents), opts); err != nil {
+			return "", "", err
+		}
+		if !opts.budget.take() {
+			return deferWrite(stats, displayName)
+		}
 		if !dryRun {
-			if err := uploadFile(db, filePath, repoID, relativePath, password, localModTime, localHash); err != nil {
-				return "", err
+			if err := uploadFile(ctx, db, filePath, repoID, relativePath, password, localModTime, localHash, dbRecord); err != nil {
+				return "", "", err
 			}
 		}
 		atomic.AddInt64(&stats.FilesUploaded, 1)
-		return fmt.Sprintf("↑ Uploaded: %s (new)%s", displayName, dryRunSuffix(dryRun)), nil
+		return actionUpload, fmt.Sprintf("↑ Uploaded: %s (new)%s", displayName, dryRunSuffix(dryRun)), nil
 	}
 
 	// Compare file hashes first (most reliable)
 	if localHash == dbRecord.FileHash {
 		// Files are identical, skip
 		atomic.AddInt64(&stats.FilesSkipped, 1)
-		return fmt.Sprintf("= Skipped: %s (identical)", displayName), nil
+		return actionSkip, fmt.Sprintf("= Skipped: %s (identical)", displayName), nil
 	}
 
-	// Hashes differ, compare timestamps to determine direction
-	// Parse database timestamp
-	dbModTime, err := time.Parse("2006-01-02 15:04:05", dbRecord.FileModifiedAt)
+	dbModTime, err := parseStoredTime(dbRecord.FileModifiedAt)
 	if err != nil {
-		// Try RFC3339 format (ISO 8601) as fallback
-		dbModTime, err = time.Parse(time.RFC3339, dbRecord.FileModifiedAt)
-		if err != nil {
-			return "", fmt.Errorf("failed to parse db timestamp: %v", err)
-		}
+		return "", "", fmt.Errorf("failed to parse db timestamp: %v", err)
 	}
 
 	// Compare timestamps (within 1 second tolerance for filesystem differences)
 	timeDiff := localModTime.Sub(dbModTime).Seconds()
 
+	// Only dotenv files can be merged key by key; other secret files are opaque
+	mergeable := isDotenvName(path.Base(relativePath))
+
+	// Hashes differ: if we know the last synced version, check which side changed
+	if hasBase {
+		localChanged := localHash != baseHash
+		remoteChanged := dbRecord.FileHash != baseHash
+
+		switch {
+		case localChanged && !remoteChanged:
+			if !opts.allows(actionUpload) {
+				return directionSkip(stats, displayName, "changed locally", opts)
+			}
+			if err := lintUpload(stats, filePath, string(localContents), opts); err != nil {
+				return "", "", err
+			}
+			if !opts.budget.take() {
+				return deferWrite(stats, displayName)
+			}
+			if !dryRun {
+				if err := uploadFile(ctx, db, filePath, repoID, relativePath, password, localModTime, localHash, dbRecord); err != nil {
+					return "", "", err
+				}
+			}
+			atomic.AddInt64(&stats.FilesUploaded, 1)
+			return actionUpload, fmt.Sprintf("↑ Uploaded: %s (changed locally)%s", displayName, dryRunSuffix(dryRun)), nil
+		case remoteChanged && !localChanged:
+			if !opts.allows(actionDownload) {
+				return directionSkip(stats, displayName, "changed remotely", opts)
+			}
+			if err := syncDownload(ctx, db, dbRecord, filePath, password, dryRun); err != nil {
+				return flagCorrupted(stats, displayName, err)
+			}
+			atomic.AddInt64(&stats.FilesDownloaded, 1)
+			return actionDownload, fmt.Sprintf("↓ Downloaded: %s (changed remotely)%s", displayName, dryRunSuffix(dryRun)), nil
+		case !mergeable:
+			atomic.AddInt64(&stats.FilesConflict, 1)
+			return actionConflict, fmt.Sprintf("⚠ Conflict: %s (changed locally and remotely since the last sync; not a .env file, resolve manually)", displayName), nil
+		case !opts.Merge:
+			atomic.AddInt64(&stats.FilesConflict, 1)
+			return actionConflict, fmt.Sprintf("⚠ Conflict: %s (changed locally and remotely since the last sync; use --merge or resolve manually)", displayName), nil
+		}
+
+		// Both changed: merge against the base if its revision is still stored
+		if baseContents, found := findBaseContents(ctx, db, repoID, relativePath, baseHash, password); found {
+			return mergeFile(ctx, db, dbRecord, filePath, displayName, password, string(localContents), &baseContents, timeDiff >= 0, stats, opts)
+		}
+	}
+
+	if opts.Merge && mergeable {
+		return mergeFile(ctx, db, dbRecord, filePath, displayName, password, string(localContents), nil, timeDiff >= 0, stats, opts)
+	}
+
 	if timeDiff > 1 {
 		// Local file is newer, upload to database
+		if !opts.allows(actionUpload) {
+			return directionSkip(stats, displayName, "local newer", opts)
+		}
+		if err := lintUpload(stats, filePath, string(localContents), opts); err != nil {
+			return "", "", err
+		}
+		if !opts.budget.take() {
+			return deferWrite(stats, displayName)
+		}
 		if !dryRun {
-			if err := uploadFile(db, filePath, repoID, relativePath, password, localModTime, localHash); err != nil {
-				return "", err
+			if err := uploadFile(ctx, db, filePath, repoID, relativePath, password, localModTime, localHash, dbRecord); err != nil {
+				return "", "", err
 			}
 		}
 		atomic.AddInt64(&stats.FilesUploaded, 1)
-		return fmt.Sprintf("↑ Uploaded: %s (local newer)%s", displayName, dryRunSuffix(dryRun)), nil
+		return actionUpload, fmt.Sprintf("↑ Uploaded: %s (local newer)%s", displayName, dryRunSuffix(dryRun)), nil
 	} else if timeDiff < -1 {
 		// Database file is newer, download from database
-		if !dryRun {
-			if err := downloadFile(db, dbRecord, filePath, password); err != nil {
-				return "", err
-			}
+		if !opts.allows(actionDownload) {
+			return directionSkip(stats, displayName, "remote newer", opts)
+		}
+		if err := syncDownload(ctx, db, dbRecord, filePath, password, dryRun); err != nil {
+			return flagCorrupted(stats, displayName, err)
 		}
 		atomic.AddInt64(&stats.FilesDownloaded, 1)
-		return fmt.Sprintf("↓ Downloaded: %s (remote newer)%s", displayName, dryRunSuffix(dryRun)), nil
+		return actionDownload, fmt.Sprintf("↓ Downloaded: %s (remote newer)%s", displayName, dryRunSuffix(dryRun)), nil
 	} else {
 		// Timestamps are similar but hashes differ - this is a conflict
 		// Default to uploading local (prefer local changes)
+		if !opts.allows(actionUpload) {
+			return directionSkip(stats, displayName, "content changed, timestamps similar", opts)
+		}
+		if err := lintUpload(stats, filePath, string(localContents), opts); err != nil {
+			return "", "", err
+		}
+		if !opts.budget.take() {
+			return deferWrite(stats, displayName)
+		}
+		if !dryRun {
+			if err := uploadFile(ctx, db, filePath, repoID, relativePath, password, localModTime, localHash, dbRecord); err != nil {
+				return "", "", err
+			}
+		}
+		atomic.AddInt64(&stats.FilesUploaded, 1)
+		return actionUpload, fmt.Sprintf("↑ Uploaded: %s (content changed, timestamps similar)%s", displayName, dryRunSuffix(dryRun)), nil
+	}
+}
+
+// mergeFile combines local and remote contents key by key. With the base
+// (last synced) contents it does a three-way merge; without it, keys added on
+// either side are kept. Keys whose values conflict are taken from the newer side.
+func mergeFile(ctx context.Context, db Store, dbRecord *EnvFileRecord, filePath, displayName, password, localContents string, base *string, localNewer bool, stats *SyncStats, opts SyncOptions) (string, string, error) {
+	dryRun := opts.DryRun
+	remoteContents, err := openVerifiedRecord(ctx, db, dbRecord, password)
+	if err != nil {
+		return flagCorrupted(stats, displayName, err)
+	}
+	// Copies stored before contents were normalized may have CRLF line
+	// endings, which would otherwise make every line differ
+	remoteContents = string(normalizeEnvContents(filePath, []byte(remoteContents)))
+	if base != nil {
+		normalized := string(normalizeEnvContents(filePath, []byte(*base)))
+		base = &normalized
+	}
+
+	baseContents := ""
+	if base != nil {
+		baseContents = *base
+	}
+	merged, conflicts := mergeEnvContents3(baseContents, localContents, remoteContents, localNewer)
+
+	// A merge that has to write a side the sync direction protects is skipped
+	needed := actionMerge
+	switch merged {
+	case localContents:
+		needed = actionUpload
+	case remoteContents:
+		needed = actionDownload
+	}
+	if !opts.allows(needed) {
+		return directionSkip(stats, displayName, "changed locally and remotely", opts)
+	}
+	if needed != actionDownload {
+		if err := lintUpload(stats, filePath, merged, opts); err != nil {
+			return "", "", err
+		}
+		if !opts.budget.take() {
+			return deferWrite(stats, displayName)
+		}
+	}
+
+	conflictNote := ""
+	if len(conflicts) > 0 {
+		atomic.AddInt64(&stats.FilesConflict, 1)
+		winner := "remote"
+		if localNewer {
+			winner = "local"
+		}
+		conflictNote = fmt.Sprintf(" [conflict on %s, kept %s]", strings.Join(conflicts, ", "), winner)
+	}
+
+	switch merged {
+	case localContents:
+		// Local already has everything, just push it
 		if !dryRun {
-			if err := uploadFile(db, filePath, repoID, relativePath, password, localModTime, localHash); err != nil {
-				return "", err
+			if err := uploadContents(ctx, db, dbRecord.RepoID, dbRecord.RelativePath, password, merged, toServerTime(time.Now()), localFileMode(filePath), dbRecord); err != nil {
+				return "", "", err
 			}
 		}
 		atomic.AddInt64(&stats.FilesUploaded, 1)
-		return fmt.Sprintf("↑ Uploaded: %s (content changed, timestamps similar)%s", displayName, dryRunSuffix(dryRun)), nil
+		return actionUpload, fmt.Sprintf("↑ Uploaded: %s (merged)%s%s", displayName, conflictNote, dryRunSuffix(dryRun)), nil
+	case remoteContents:
+		// Remote already has everything, just pull it
+		if err := syncDownload(ctx, db, dbRecord, filePath, password, dryRun); err != nil {
+			return flagCorrupted(stats, displayName, err)
+		}
+		atomic.AddInt64(&stats.FilesDownloaded, 1)
+		return actionDownload, fmt.Sprintf("↓ Downloaded: %s (merged)%s%s", displayName, conflictNote, dryRunSuffix(dryRun)), nil
 	}
+
+	// Both sides had something the other lacked: write the merge everywhere
+	if !dryRun {
+		if err := writeEnvFile(filePath, []byte(merged), restoreFileMode(0, filePath)); err != nil {
+			return "", "", fmt.Errorf("failed to write merged file: %v", err)
+		}
+		info, err := os.Stat(filePath)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to stat merged file: %v", err)
+		}
+		if err := uploadContents(ctx, db, dbRecord.RepoID, dbRecord.RelativePath, password, merged, toServerTime(info.ModTime()), localFileMode(filePath), dbRecord); err != nil {
+			return "", "", err
+		}
+	}
+	atomic.AddInt64(&stats.FilesMerged, 1)
+	return actionMerge, fmt.Sprintf("⇄ Merged: %s (local and remote keys combined)%s%s", displayName, conflictNote, dryRunSuffix(dryRun)), nil
 }
 
 func dryRunSuffix(dryRun bool) string {
@@ -235,57 +972,141 @@ func dryRunSuffix(dryRun bool) string {
 	return ""
 }
 
-func uploadFile(db *Database, filePath, repoID, relativePath, password string, modTime time.Time, fileHash string) error {
+// uploadFile encrypts and uploads a local file. base is the stored record the
+// upload replaces, as read before deciding to upload (nil if there was
+// none); if someone else wrote the file since, a *staleWriteError is
+// returned instead.
+func uploadFile(ctx context.Context, db Store, filePath, repoID, relativePath, password string, modTime time.Time, fileHash string, base *EnvFileRecord) error {
 	// Read file contents
-	contents, err := os.ReadFile(filePath)
+	contents, err := readEnvFile(filePath)
 	if err != nil {
 		return fmt.Errorf("failed to read file: %v", err)
 	}
 
 	// Encrypt contents
-	encryptedContents, err := Encrypt(string(contents), password)
+	encryptedContents, err := sealEnvFile(ctx, db, repoID, relativePath, string(contents), password)
 	if err != nil {
 		return fmt.Errorf("failed to encrypt: %v", err)
 	}
 
-	// Format mod time
-	fileModTime := modTime.Format("2006-01-02 15:04:05")
+	// Stored in UTC, so machines in other time zones compare it correctly
+	fileModTime := formatStoredTime(modTime)
 
 	// Upload to database
-	if err := db.UpsertEnvFile(repoID, relativePath, encryptedContents, fileHash, fileModTime); err != nil {
-		return fmt.Errorf("failed to upload: %v", err)
+	record := EnvFileRecord{RepoID: repoID, RelativePath: relativePath, Contents: encryptedContents, FileHash: fileHash, FileModifiedAt: fileModTime, FileMode: localFileMode(filePath)}
+	if err := upsertIfUnchanged(ctx, db, record, base); err != nil {
+		return uploadError(err)
 	}
 
 	return nil
 }
 
-func downloadFile(db *Database, record *EnvFileRecord, localPath, password string) error {
-	// Decrypt contents
-	contents, err := Decrypt(record.Contents, password)
+// uploadContents encrypts and uploads contents that aren't (yet) on disk,
+// checking base like uploadFile
+func uploadContents(ctx context.Context, db Store, repoID, relativePath, password, contents string, modTime time.Time, fileMode os.FileMode, base *EnvFileRecord) error {
+	encryptedContents, err := sealEnvFile(ctx, db, repoID, relativePath, contents, password)
 	if err != nil {
-		return fmt.Errorf("failed to decrypt: %v (wrong password?)", err)
+		return fmt.Errorf("failed to encrypt: %v", err)
 	}
 
-	// Parse the database timestamp - try multiple formats
-	var dbModTime time.Time
-	dbModTime, err = time.Parse("2006-01-02 15:04:05", record.FileModifiedAt)
+	record := EnvFileRecord{RepoID: repoID, RelativePath: relativePath, Contents: encryptedContents, FileHash: HashFile(contents), FileModifiedAt: formatStoredTime(modTime), FileMode: fileMode}
+	if err := upsertIfUnchanged(ctx, db, record, base); err != nil {
+		return uploadError(err)
+	}
+
+	return nil
+}
+
+// uploadError wraps a failed upload, keeping a *staleWriteError as it is so
+// callers can tell a lost race from a failure
+func uploadError(err error) error {
+	var stale *staleWriteError
+	if errors.As(err, &stale) {
+		return err
+	}
+	return fmt.Errorf("failed to upload: %v", err)
+}
+
+// corruptedRecordError reports a stored record that decrypts to contents
+// with a different hash than the one stored beside them, e.g. because the
+// row was damaged or modified outside env-sync
+type corruptedRecordError struct {
+	repoID       string
+	relativePath string
+}
+
+func (e *corruptedRecordError) Error() string {
+	return fmt.Sprintf("the stored copy of %s:%s doesn't match its hash (corrupted or modified)", e.repoID, e.relativePath)
+}
+
+// openVerifiedRecord decrypts a stored record and checks the contents
+// against its file_hash and the file they're bound to
+func openVerifiedRecord(ctx context.Context, db Store, record *EnvFileRecord, password string) (string, error) {
+	contents, err := openContents(ctx, db, record.RepoID, record.RelativePath, record.Contents, password)
+	var wrongFile *bindingError
+	if errors.As(err, &wrongFile) {
+		return "", err
+	}
 	if err != nil {
-		// Try RFC3339 format (ISO 8601)
-		dbModTime, err = time.Parse(time.RFC3339, record.FileModifiedAt)
-		if err != nil {
-			return fmt.Errorf("failed to parse timestamp: %v", err)
-		}
+		return "", fmt.Errorf("failed to decrypt: %v (wrong password?)", err)
+	}
+	if HashFile(contents) != record.FileHash {
+		return "", &corruptedRecordError{repoID: record.RepoID, relativePath: record.RelativePath}
+	}
+	return contents, nil
+}
+
+// syncDownload downloads a record for sync. A dry run only checks that the
+// record decrypts and matches its hash.
+func syncDownload(ctx context.Context, db Store, record *EnvFileRecord, localPath, password string, dryRun bool) error {
+	if dryRun {
+		_, err := openVerifiedRecord(ctx, db, record, password)
+		return err
+	}
+	return downloadFile(ctx, db, record, localPath, password)
+}
+
+// flagCorrupted turns a corrupted record, or one copied from another file,
+// into the file's sync result, so both copies are left alone and the rest of
+// the sync carries on. Other errors are returned as they are.
+func flagCorrupted(stats *SyncStats, displayName string, err error) (string, string, error) {
+	var corrupted *corruptedRecordError
+	var wrongFile *bindingError
+	reason := "the stored copy doesn't match its hash"
+	switch {
+	case errors.As(err, &corrupted):
+	case errors.As(err, &wrongFile):
+		reason = "the stored copy belongs to another file"
+	default:
+		return "", "", err
+	}
+	atomic.AddInt64(&stats.FilesCorrupted, 1)
+	return actionCorrupted, fmt.Sprintf("✗ Corrupted: %s (%s; left alone, run 'env-sync verify')", displayName, reason), nil
+}
+
+// downloadFile writes a stored record to localPath, refusing contents that
+// don't match the record's hash
+func downloadFile(ctx context.Context, db Store, record *EnvFileRecord, localPath, password string) error {
+	contents, err := openVerifiedRecord(ctx, db, record, password)
+	if err != nil {
+		return err
+	}
+
+	dbModTime, err := parseStoredTime(record.FileModifiedAt)
+	if err != nil {
+		return fmt.Errorf("failed to parse timestamp: %v", err)
 	}
 
-	// Write file
-	if err := os.WriteFile(localPath, []byte(contents), 0644); err != nil {
+	// Write file with the permissions it was uploaded with
+	if err := writeEnvFile(localPath, []byte(contents), restoreFileMode(record.FileMode, localPath)); err != nil {
 		return fmt.Errorf("failed to write file: %v", err)
 	}
 
-	// Set file modification time to match database
-	if err := os.Chtimes(localPath, dbModTime, dbModTime); err != nil {
+	// Set file modification time to match database, on this machine's clock
+	localModTime := toLocalTime(dbModTime)
+	if err := os.Chtimes(localPath, localModTime, localModTime); err != nil {
 		// Non-critical error, just log it
-		fmt.Printf("  (note: couldn't set file time: %v)\n", err)
+		logger.Warn("couldn't set file time", "file", localPath, "error", err)
 	}
 
 	return nil
@@ -0,0 +1,177 @@
+//go:build libsql_embedded
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// storeRecord stores contents as they are, without encrypting them, and
+// returns the stored record
+func storeRecord(t *testing.T, db *Database, contents string, base *EnvFileRecord) *EnvFileRecord {
+	t.Helper()
+	ctx := context.Background()
+	record := EnvFileRecord{RepoID: "repo", RelativePath: "./.env", Contents: contents, FileHash: HashFile(contents), FileModifiedAt: formatStoredTime(time.Now())}
+	if err := db.UpsertEnvFileIf(ctx, record, base); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := db.GetEnvFileWithMetadata(ctx, "repo", "./.env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stored
+}
+
+func TestUpsertEnvFileIfRefusesStaleWrites(t *testing.T) {
+	tests := []struct {
+		name string
+		base func(first *EnvFileRecord) *EnvFileRecord
+	}{
+		{"stale row version", func(first *EnvFileRecord) *EnvFileRecord { return first }},
+		{"no base for a stored file", func(*EnvFileRecord) *EnvFileRecord { return nil }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			db := openTestDatabase(t)
+			first := storeRecord(t, db, "A=1\n", nil)
+			stored := storeRecord(t, db, "A=2\n", first)
+
+			contents := "A=3\n"
+			record := EnvFileRecord{RepoID: "repo", RelativePath: "./.env", Contents: contents, FileHash: HashFile(contents), FileModifiedAt: formatStoredTime(time.Now())}
+			var stale *staleWriteError
+			if err := db.UpsertEnvFileIf(ctx, record, tt.base(first)); !errors.As(err, &stale) {
+				t.Fatalf("UpsertEnvFileIf() = %v, want a *staleWriteError", err)
+			}
+
+			current, err := db.GetEnvFileWithMetadata(ctx, "repo", "./.env")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if current.FileHash != stored.FileHash || current.RowVersion != stored.RowVersion {
+				t.Errorf("stored file is %q at row version %d, want it unchanged at %q, %d", current.FileHash, current.RowVersion, stored.FileHash, stored.RowVersion)
+			}
+			versions, err := db.ListEnvFileVersions(ctx, "repo", "./.env")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(versions) != 2 {
+				t.Errorf("%d revisions stored, want the refused write not to add one", len(versions))
+			}
+			var blobs int
+			if err := db.conn.QueryRow(`SELECT COUNT(*) FROM env_blobs WHERE hash = ?`, HashFile(contents)).Scan(&blobs); err != nil {
+				t.Fatal(err)
+			}
+			if blobs != 0 {
+				t.Error("the refused write left its contents in env_blobs")
+			}
+		})
+	}
+}
+
+// racingStore writes the file once more, as another machine would, right
+// before its first conditional write
+type racingStore struct {
+	*Database
+	race    func()
+	upserts int
+}
+
+func (s *racingStore) UpsertEnvFileIf(ctx context.Context, record EnvFileRecord, base *EnvFileRecord) error {
+	s.upserts++
+	if race := s.race; race != nil {
+		s.race = nil
+		race()
+	}
+	return s.Database.UpsertEnvFileIf(ctx, record, base)
+}
+
+func TestSyncFileRetryingResolvesLostRace(t *testing.T) {
+	const (
+		synced = "A=1\nB=1\n"
+		local  = "A=local\nB=1\n"
+		remote = "A=1\nB=remote\n"
+		merged = "A=local\nB=remote\n"
+	)
+	tests := []struct {
+		name       string
+		merge      bool
+		wantAction string
+		wantStored string
+		wantLocal  string
+		// The refused upload, plus the merged one
+		wantUpserts int
+	}{
+		{"conflict", false, actionConflict, remote, local, 1},
+		{"merge", true, actionMerge, merged, merged, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cheapKDF(t)
+			ctx := context.Background()
+			db := openTestDatabase(t)
+			basePath := t.TempDir()
+			filePath := filepath.Join(basePath, ".env")
+			repoID, relativePath, err := GetFileIdentifier(filePath, basePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Both sides start from the synced copy, then the local file changes
+			if err := uploadContents(ctx, db, repoID, relativePath, deltaTestPassword, synced, time.Now(), 0o600, nil); err != nil {
+				t.Fatal(err)
+			}
+			state := &syncState{Files: map[string]syncBase{}}
+			state.set(filePath, repoID, relativePath, HashFile(synced))
+			if err := os.WriteFile(filePath, []byte(local), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			store := &racingStore{Database: db}
+			store.race = func() {
+				current, err := db.GetEnvFileWithMetadata(ctx, repoID, relativePath)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := uploadContents(ctx, db, repoID, relativePath, deltaTestPassword, remote, time.Now(), 0o600, current); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			action, msg, err := syncFileRetrying(ctx, store, filePath, basePath, deltaTestPassword, &SyncStats{}, state, SyncOptions{Merge: tt.merge})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if action != tt.wantAction {
+				t.Errorf("syncFileRetrying() = %q (%s), want %q", action, msg, tt.wantAction)
+			}
+			if store.race != nil || store.upserts != tt.wantUpserts {
+				t.Errorf("%d conditional writes, want %d after losing the race once", store.upserts, tt.wantUpserts)
+			}
+
+			record, err := db.GetEnvFileWithMetadata(ctx, repoID, relativePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stored, err := openContents(ctx, db, record.RepoID, record.RelativePath, record.Contents, deltaTestPassword)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored != tt.wantStored {
+				t.Errorf("stored copy is %q, want %q", stored, tt.wantStored)
+			}
+			got, err := os.ReadFile(filePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.wantLocal {
+				t.Errorf("local file is %q, want %q", got, tt.wantLocal)
+			}
+		})
+	}
+}
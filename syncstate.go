@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// syncBase is what a local file looked like the last time it was in sync with
+// the database, used as the common ancestor for three-way comparisons
+type syncBase struct {
+	RepoID       string `json:"repo_id"`
+	RelativePath string `json:"relative_path"`
+	Hash         string `json:"hash"`
+	SyncedAt     string `json:"synced_at,omitempty"`
+}
+
+// syncState holds this machine's last-synced hashes, keyed by local file
+// path. They are kept in the encrypted inventory next to the scanned files.
+type syncState struct {
+	mu    sync.Mutex
+	Files map[string]syncBase
+}
+
+func loadSyncState() (*syncState, error) {
+	store, err := loadEnvFileStore()
+	if err != nil {
+		return nil, err
+	}
+	state := &syncState{Files: store.Synced}
+	if state.Files == nil {
+		state.Files = make(map[string]syncBase)
+	}
+	return state, nil
+}
+
+// get returns the last-synced hash of localPath, if it was synced as repoID/relativePath
+func (s *syncState) get(localPath, repoID, relativePath string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	base, ok := s.Files[localPath]
+	if !ok || base.RepoID != repoID || base.RelativePath != relativePath {
+		return "", false
+	}
+	return base.Hash, true
+}
+
+func (s *syncState) set(localPath, repoID, relativePath, hash string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Files[localPath] = syncBase{RepoID: repoID, RelativePath: relativePath, Hash: hash, SyncedAt: time.Now().UTC().Format("2006-01-02 15:04:05")}
+}
+
+// forget drops localPath, e.g. after the file was moved away
+func (s *syncState) forget(localPath string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.Files, localPath)
+}
+
+func (s *syncState) save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return updateEnvFileStore(func(store *EnvFileStore) {
+		store.Synced = s.Files
+	})
+}
+
+// findBaseContents decrypts the stored revision whose hash matches the last-synced hash
+func findBaseContents(ctx context.Context, db Store, repoID, relativePath, hash, password string) (string, bool) {
+	versions, err := db.ListEnvFileVersions(ctx, repoID, relativePath)
+	if err != nil {
+		return "", false
+	}
+	for _, version := range versions {
+		if version.FileHash != hash {
+			continue
+		}
+		stored, err := db.GetEnvFileVersion(ctx, repoID, relativePath, version.Version)
+		if err != nil {
+			return "", false
+		}
+		contents, err := openRevisionContents(ctx, db, repoID, relativePath, stored.Contents, password)
+		if err != nil || HashFile(contents) != hash {
+			// A damaged base falls back to merging without it
+			return "", false
+		}
+		return contents, true
+	}
+	return "", false
+}
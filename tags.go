@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// tagStore is implemented by backends that can label stored files with tags,
+// such as the environment (dev, staging, prod) a file belongs to
+type tagStore interface {
+	// EnvFileTags returns the tags of every tagged file, by auditKey(repoID, relativePath)
+	EnvFileTags(ctx context.Context) (map[string][]string, error)
+	// SetEnvFileTags replaces the tags of a file; no tags removes them all
+	SetEnvFileTags(ctx context.Context, repoID, relativePath string, tags []string) error
+}
+
+// tagStoreOf returns the tags of the store behind db, if it has them. Like
+// the audit log, tags live in the primary only.
+func tagStoreOf(db Store) tagStore {
+	if r, ok := db.(*ReplicatedStore); ok {
+		db = r.primary()
+	}
+	tags, _ := db.(tagStore)
+	return tags
+}
+
+// validTag is what a tag may look like once lowercased
+var validTag = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{0,63}$`)
+
+// normalizeTags lowercases, checks and de-duplicates tags
+func normalizeTags(tags []string) ([]string, error) {
+	var normalized []string
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if !validTag.MatchString(tag) {
+			return nil, fmt.Errorf("invalid tag %q: use letters, digits, '-', '_' and '.'", tag)
+		}
+		if !slices.Contains(normalized, tag) {
+			normalized = append(normalized, tag)
+		}
+	}
+	sort.Strings(normalized)
+	return normalized, nil
+}
+
+// environmentTags are the tags that name an environment, mapped to the
+// environment they stand for
+var environmentTags = map[string]string{
+	"dev":         "dev",
+	"development": "dev",
+	"test":        "test",
+	"staging":     "staging",
+	"prod":        "prod",
+	"production":  "prod",
+}
+
+// checkEnvironment validates the --environment flag
+func checkEnvironment(environment string) error {
+	if environment == "" {
+		return nil
+	}
+	if _, ok := environmentTags[strings.ToLower(environment)]; !ok {
+		return fmt.Errorf("invalid --environment %q (use dev, test, staging or prod)", environment)
+	}
+	return nil
+}
+
+// environmentConflict returns why a file with these tags mustn't be synced
+// to or from a machine of the given environment, or "" if it may. Files
+// tagged prod need --allow-prod anywhere but on a prod machine; files tagged
+// for other environments are only kept from machines that name their own.
+func environmentConflict(tags []string, environment string, allowProd bool) string {
+	var fileEnvironments []string
+	for _, tag := range tags {
+		if env, ok := environmentTags[tag]; ok && !slices.Contains(fileEnvironments, env) {
+			fileEnvironments = append(fileEnvironments, env)
+		}
+	}
+	if len(fileEnvironments) == 0 {
+		return ""
+	}
+	machine := environmentTags[strings.ToLower(environment)]
+	if slices.Contains(fileEnvironments, machine) {
+		return ""
+	}
+	if slices.Contains(fileEnvironments, "prod") {
+		if allowProd {
+			return ""
+		}
+		return "tagged prod; use --allow-prod, or --environment prod on a production machine"
+	}
+	if machine == "" {
+		return ""
+	}
+	return fmt.Sprintf("tagged %s, and this machine is %s", strings.Join(fileEnvironments, ", "), machine)
+}
+
+// loadFileTags reads the tags of every stored file. It returns nil for
+// backends without tags, unless the filter selects by tag, which needs them.
+func loadFileTags(ctx context.Context, db Store, filter FileFilter) (map[string][]string, error) {
+	tags := tagStoreOf(db)
+	if tags == nil {
+		if len(filter.Tags) > 0 {
+			return nil, fmt.Errorf("tags require a SQL database backend")
+		}
+		return nil, nil
+	}
+	return tags.EnvFileTags(ctx)
+}
+
+// allowedFiles drops the files that the filter's tags don't select or that
+// belong to another environment, warning about the latter. Remote-only and
+// moved files are looked up by their stored record, others by identifier.
+func allowedFiles(files []string, basePath string, remoteOnly map[string]EnvFileRecord, moves map[string]*fileMove, tags map[string][]string, opts SyncOptions) []string {
+	if tags == nil {
+		return files
+	}
+	return slices.DeleteFunc(files, func(file string) bool {
+		var repoID, relativePath string
+		if record, ok := remoteOnly[file]; ok {
+			repoID, relativePath = record.RepoID, record.RelativePath
+		} else if move, ok := moves[file]; ok {
+			repoID, relativePath = move.record.RepoID, move.record.RelativePath
+		} else {
+			var err error
+			if repoID, relativePath, err = GetFileIdentifier(file, basePath); err != nil {
+				return false
+			}
+		}
+		if !opts.Filter.Match(repoID, relativePath) {
+			return true
+		}
+		if reason := environmentConflict(tags[auditKey(repoID, relativePath)], opts.Environment, opts.AllowProd); reason != "" {
+			logger.Warn("skipping file of another environment", "file", file, "reason", reason)
+			return true
+		}
+		return false
+	})
+}
+
+// addFileTags adds tags to the tags each record already has
+func addFileTags(ctx context.Context, db Store, records []EnvFileRecord, add []string) error {
+	tags := tagStoreOf(db)
+	if tags == nil {
+		return fmt.Errorf("tags require a SQL database backend")
+	}
+	existing, err := tags.EnvFileTags(ctx)
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		merged, _ := normalizeTags(append(existing[auditKey(record.RepoID, record.RelativePath)], add...))
+		if err := tags.SetEnvFileTags(ctx, record.RepoID, record.RelativePath, merged); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createTagTable creates env_file_tags, one row per tag of a stored file
+func createTagTable(tx *schemaTx) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS env_file_tags (
+		repo_id TEXT NOT NULL,
+		relative_path TEXT NOT NULL,
+		tag TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (repo_id, relative_path, tag)
+	);
+	`
+	if _, err := tx.Exec(tx.ddl(query)); err != nil {
+		return fmt.Errorf("failed to create env_file_tags table: %v", err)
+	}
+	return nil
+}
+
+func (db *Database) EnvFileTags(ctx context.Context) (map[string][]string, error) {
+	rows, err := db.conn.QueryContext(ctx, `SELECT repo_id, relative_path, tag FROM env_file_tags WHERE namespace = ? ORDER BY tag`, db.namespace)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query tags: %v", err)
+	}
+	defer rows.Close()
+
+	tags := make(map[string][]string)
+	for rows.Next() {
+		var repoID, relativePath, tag string
+		if err := rows.Scan(&repoID, &relativePath, &tag); err != nil {
+			return nil, fmt.Errorf("failed to read tags: %v", err)
+		}
+		key := auditKey(repoID, relativePath)
+		tags[key] = append(tags[key], tag)
+	}
+	return tags, rows.Err()
+}
+
+func (db *Database) SetEnvFileTags(ctx context.Context, repoID, relativePath string, tags []string) error {
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM env_file_tags WHERE namespace = ? AND repo_id = ? AND relative_path = ?`, db.namespace, repoID, relativePath); err != nil {
+		return fmt.Errorf("failed to update tags of %s: %v", relativePath, err)
+	}
+	for _, tag := range tags {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO env_file_tags (namespace, repo_id, relative_path, tag) VALUES (?, ?, ?, ?)`, db.namespace, repoID, relativePath, tag); err != nil {
+			return fmt.Errorf("failed to tag %s: %v", relativePath, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit: %v", err)
+	}
+	return nil
+}
+
+// EnvFileTags decrypts the repo, path and tags of every tagged file
+func (s *SealedDatabase) EnvFileTags(ctx context.Context) (map[string][]string, error) {
+	sealed, err := s.db.EnvFileTags(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tags := make(map[string][]string, len(sealed))
+	for key, sealedTags := range sealed {
+		repoID, relativePath, _ := strings.Cut(key, "\x00")
+		if err := s.ids.openRecord(&repoID, &relativePath); err != nil {
+			return nil, err
+		}
+		opened := make([]string, len(sealedTags))
+		for i, tag := range sealedTags {
+			if opened[i], err = s.ids.open(tag); err != nil {
+				return nil, err
+			}
+		}
+		sort.Strings(opened)
+		tags[auditKey(repoID, relativePath)] = opened
+	}
+	return tags, nil
+}
+
+func (s *SealedDatabase) SetEnvFileTags(ctx context.Context, repoID, relativePath string, tags []string) error {
+	sealed := make([]string, len(tags))
+	for i, tag := range tags {
+		sealed[i] = s.ids.seal(tag)
+	}
+	return s.db.SetEnvFileTags(ctx, s.ids.seal(repoID), s.ids.seal(relativePath), sealed)
+}
+
+// manageTags lists the tags of stored files, or adds or removes tags of one
+func manageTags(ctx context.Context, dbConnStr, action string, args []string, filter FileFilter) error {
+	db, err := OpenStore(dbConnStr)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := db.InitSchema(ctx); err != nil {
+		return err
+	}
+	tags := tagStoreOf(db)
+	if tags == nil {
+		return fmt.Errorf("tags require a SQL database backend")
+	}
+	stored, err := tags.EnvFileTags(ctx)
+	if err != nil {
+		return err
+	}
+
+	if action == "list" {
+		records, err := db.ListEnvFiles(ctx)
+		if err != nil {
+			return err
+		}
+		filter.tagged = stored
+		type taggedFile struct {
+			RepoID       string   `json:"repo_id"`
+			RelativePath string   `json:"relative_path"`
+			Tags         []string `json:"tags"`
+		}
+		files := []taggedFile{}
+		for _, record := range records {
+			if filter.Match(record.RepoID, record.RelativePath) {
+				fileTags := append([]string{}, stored[auditKey(record.RepoID, record.RelativePath)]...)
+				files = append(files, taggedFile{record.RepoID, record.RelativePath, fileTags})
+			}
+		}
+		if jsonOutput {
+			printJSON(map[string]interface{}{"files": files})
+			return nil
+		}
+		if len(files) == 0 {
+			fmt.Println("No stored files match")
+			return nil
+		}
+		for _, file := range files {
+			label := "(untagged)"
+			if len(file.Tags) > 0 {
+				label = strings.Join(file.Tags, ", ")
+			}
+			fmt.Printf("  %-60s %s\n", shortenRepoID(file.RepoID)+"/"+file.RelativePath, label)
+		}
+		return nil
+	}
+
+	if len(args) < 2 {
+		return usageErrorf("a file and at least one tag are required")
+	}
+	changed, err := normalizeTags(args[1:])
+	if err != nil {
+		return err
+	}
+	record, err := resolveEnvFileRef(ctx, db, args[0])
+	if err != nil {
+		return err
+	}
+	current := stored[auditKey(record.RepoID, record.RelativePath)]
+	var updated []string
+	if action == "add" {
+		updated, _ = normalizeTags(append(append([]string{}, current...), changed...))
+	} else {
+		for _, tag := range current {
+			if !slices.Contains(changed, tag) {
+				updated = append(updated, tag)
+			}
+		}
+	}
+	if err := tags.SetEnvFileTags(ctx, record.RepoID, record.RelativePath, updated); err != nil {
+		return err
+	}
+
+	if jsonOutput {
+		printJSON(map[string]interface{}{"repo_id": record.RepoID, "relative_path": record.RelativePath, "tags": append([]string{}, updated...)})
+		return nil
+	}
+	if len(updated) == 0 {
+		fmt.Printf("✓ %s/%s has no tags\n", shortenRepoID(record.RepoID), record.RelativePath)
+	} else {
+		fmt.Printf("✓ %s/%s is tagged %s\n", shortenRepoID(record.RepoID), record.RelativePath, strings.Join(updated, ", "))
+	}
+	return nil
+}
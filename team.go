@@ -0,0 +1,649 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"io"
+
+	"filippo.io/age"
+)
+
+// TeamStore is implemented by backends that support per-user access control.
+// Each shared repo has a random data key, stored once per user wrapped
+// (age-encrypted) to that user's public key.
+type TeamStore interface {
+	AddUser(ctx context.Context, name, publicKey string) error
+	ListUsers(ctx context.Context) ([]TeamUser, error)
+	GetUser(ctx context.Context, name string) (*TeamUser, error)
+	GetUserByPublicKey(ctx context.Context, publicKey string) (*TeamUser, error)
+	RepoHasKey(ctx context.Context, repoID string) (bool, error)
+	GetRepoKeyGrant(ctx context.Context, repoID, userName string) (string, error)
+	PutRepoKeyGrant(ctx context.Context, repoID, userName, wrappedKey string) error
+	DeleteRepoKeyGrant(ctx context.Context, repoID, userName string) error
+	ListRepoKeyGrants(ctx context.Context, repoID string) ([]string, error)
+	// ListAllRepoKeyGrants returns every grant of every repo
+	ListAllRepoKeyGrants(ctx context.Context) ([]RepoKeyGrant, error)
+	// ShareRepoFiles stores the first grant of a repo's data key together
+	// with its files and revisions re-encrypted with that key
+	ShareRepoFiles(ctx context.Context, repoID, userName, wrappedKey string, files []EnvFileRecord, revisions []EnvFileVersion) error
+}
+
+type TeamUser struct {
+	Name      string
+	PublicKey string
+	CreatedAt string
+}
+
+// RepoKeyGrant is a repo's data key wrapped to one user
+type RepoKeyGrant struct {
+	RepoID     string
+	UserName   string
+	WrappedKey string
+}
+
+// createTeamTables creates the users and repo_keys tables
+func createTeamTables(tx *schemaTx) error {
+	usersQuery := `
+	CREATE TABLE IF NOT EXISTS users (
+		name TEXT PRIMARY KEY,
+		public_key TEXT NOT NULL UNIQUE,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	`
+	if _, err := tx.Exec(tx.ddl(usersQuery)); err != nil {
+		return fmt.Errorf("failed to create users table: %v", err)
+	}
+
+	repoKeysQuery := `
+	CREATE TABLE IF NOT EXISTS repo_keys (
+		repo_id TEXT NOT NULL,
+		user_name TEXT NOT NULL,
+		wrapped_key TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (repo_id, user_name)
+	);
+	`
+	if _, err := tx.Exec(tx.ddl(repoKeysQuery)); err != nil {
+		return fmt.Errorf("failed to create repo_keys table: %v", err)
+	}
+
+	return nil
+}
+
+// AddUser registers a teammate and their age public key
+func (db *Database) AddUser(ctx context.Context, name, publicKey string) error {
+	_, err := db.conn.ExecContext(ctx, `INSERT INTO users (namespace, name, public_key, created_at) VALUES (?, ?, ?, ?)`, db.namespace, name, publicKey, storedNow())
+	if err != nil {
+		return fmt.Errorf("failed to add user: %v", err)
+	}
+	return nil
+}
+
+// ListUsers returns all registered users
+func (db *Database) ListUsers(ctx context.Context) ([]TeamUser, error) {
+	rows, err := db.conn.QueryContext(ctx, `SELECT name, public_key, created_at FROM users WHERE namespace = ? ORDER BY name`, db.namespace)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query users: %v", err)
+	}
+	defer rows.Close()
+
+	var users []TeamUser
+	for rows.Next() {
+		var user TeamUser
+		if err := rows.Scan(&user.Name, &user.PublicKey, &user.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %v", err)
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+// GetUser looks up a user by name, returning nil if not found
+func (db *Database) GetUser(ctx context.Context, name string) (*TeamUser, error) {
+	var user TeamUser
+	err := db.conn.QueryRowContext(ctx, `SELECT name, public_key, created_at FROM users WHERE namespace = ? AND name = ?`, db.namespace, name).Scan(&user.Name, &user.PublicKey, &user.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query user: %v", err)
+	}
+	return &user, nil
+}
+
+// GetUserByPublicKey looks up a user by public key, returning nil if not found
+func (db *Database) GetUserByPublicKey(ctx context.Context, publicKey string) (*TeamUser, error) {
+	var user TeamUser
+	err := db.conn.QueryRowContext(ctx, `SELECT name, public_key, created_at FROM users WHERE namespace = ? AND public_key = ?`, db.namespace, publicKey).Scan(&user.Name, &user.PublicKey, &user.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query user: %v", err)
+	}
+	return &user, nil
+}
+
+// RepoHasKey reports whether a repo has been shared (has a data key)
+func (db *Database) RepoHasKey(ctx context.Context, repoID string) (bool, error) {
+	var count int
+	if err := db.conn.QueryRowContext(ctx, `SELECT COUNT(*) FROM repo_keys WHERE namespace = ? AND repo_id = ?`, db.namespace, repoID).Scan(&count); err != nil {
+		return false, fmt.Errorf("failed to query repo keys: %v", err)
+	}
+	return count > 0, nil
+}
+
+// GetRepoKeyGrant returns a user's wrapped data key for a repo, or "" if they have no access
+func (db *Database) GetRepoKeyGrant(ctx context.Context, repoID, userName string) (string, error) {
+	var wrapped string
+	err := db.conn.QueryRowContext(ctx, `SELECT wrapped_key FROM repo_keys WHERE namespace = ? AND repo_id = ? AND user_name = ?`, db.namespace, repoID, userName).Scan(&wrapped)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to query repo key: %v", err)
+	}
+	return wrapped, nil
+}
+
+// PutRepoKeyGrant stores a user's wrapped data key for a repo
+func (db *Database) PutRepoKeyGrant(ctx context.Context, repoID, userName, wrappedKey string) error {
+	query := `
+	INSERT INTO repo_keys (namespace, repo_id, user_name, wrapped_key)
+	VALUES (?, ?, ?, ?)
+	ON CONFLICT (namespace, repo_id, user_name)
+	DO UPDATE SET wrapped_key = excluded.wrapped_key
+	`
+	if _, err := db.conn.ExecContext(ctx, query, db.namespace, repoID, userName, wrappedKey); err != nil {
+		return fmt.Errorf("failed to store repo key: %v", err)
+	}
+	return nil
+}
+
+func (db *Database) ListAllRepoKeyGrants(ctx context.Context) ([]RepoKeyGrant, error) {
+	rows, err := db.conn.QueryContext(ctx, `SELECT repo_id, user_name, wrapped_key FROM repo_keys WHERE namespace = ? ORDER BY repo_id, user_name`, db.namespace)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query repo keys: %v", err)
+	}
+	defer rows.Close()
+
+	var grants []RepoKeyGrant
+	for rows.Next() {
+		var grant RepoKeyGrant
+		if err := rows.Scan(&grant.RepoID, &grant.UserName, &grant.WrappedKey); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %v", err)
+		}
+		grants = append(grants, grant)
+	}
+	return grants, rows.Err()
+}
+
+// ShareRepoFiles grants the repo's data key and points its files and
+// revisions at the copies encrypted with it, in one transaction, so no
+// password-encrypted copy of a shared repo is left behind. Blobs only the
+// old copies referred to are deleted.
+func (db *Database) ShareRepoFiles(ctx context.Context, repoID, userName, wrappedKey string, files []EnvFileRecord, revisions []EnvFileVersion) error {
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `INSERT INTO repo_keys (namespace, repo_id, user_name, wrapped_key) VALUES (?, ?, ?, ?)`, db.namespace, repoID, userName, wrappedKey); err != nil {
+		return fmt.Errorf("failed to store repo key: %v", err)
+	}
+
+	var oldBlobs []string
+	now := storedNow()
+	for _, file := range files {
+		var oldBlob string
+		if err := tx.QueryRowContext(ctx, `SELECT blob_hash FROM env_files WHERE namespace = ? AND repo_id = ? AND relative_path = ?`,
+			db.namespace, repoID, file.RelativePath).Scan(&oldBlob); err != nil {
+			return fmt.Errorf("failed to read %s:%s: %v", repoID, file.RelativePath, err)
+		}
+		blobHash := HashFile(file.Contents)
+		if _, err := tx.ExecContext(ctx, insertBlobQuery, blobHash, file.Contents); err != nil {
+			return fmt.Errorf("failed to store contents of %s:%s: %v", repoID, file.RelativePath, err)
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE env_files SET contents = '', blob_hash = ?, updated_at = ?, row_version = row_version + 1 WHERE namespace = ? AND repo_id = ? AND relative_path = ?`,
+			blobHash, now, db.namespace, repoID, file.RelativePath); err != nil {
+			return fmt.Errorf("failed to update %s:%s: %v", repoID, file.RelativePath, err)
+		}
+		oldBlobs = append(oldBlobs, oldBlob)
+	}
+	for _, revision := range revisions {
+		var oldBlob string
+		if err := tx.QueryRowContext(ctx, `SELECT blob_hash FROM env_file_versions WHERE namespace = ? AND repo_id = ? AND relative_path = ? AND version = ?`,
+			db.namespace, repoID, revision.RelativePath, revision.Version).Scan(&oldBlob); err != nil {
+			return fmt.Errorf("failed to read version %d of %s:%s: %v", revision.Version, repoID, revision.RelativePath, err)
+		}
+		blobHash := HashFile(revision.Contents)
+		if _, err := tx.ExecContext(ctx, insertBlobQuery, blobHash, revision.Contents); err != nil {
+			return fmt.Errorf("failed to store version %d of %s:%s: %v", revision.Version, repoID, revision.RelativePath, err)
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE env_file_versions SET contents = '', blob_hash = ? WHERE namespace = ? AND repo_id = ? AND relative_path = ? AND version = ?`,
+			blobHash, db.namespace, repoID, revision.RelativePath, revision.Version); err != nil {
+			return fmt.Errorf("failed to update version %d of %s:%s: %v", revision.Version, repoID, revision.RelativePath, err)
+		}
+		oldBlobs = append(oldBlobs, oldBlob)
+	}
+	for _, blobHash := range oldBlobs {
+		if err := deleteUnusedBlob(ctx, tx, blobHash); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit: %v", err)
+	}
+	return nil
+}
+
+// DeleteRepoKeyGrant revokes a user's access to a repo
+func (db *Database) DeleteRepoKeyGrant(ctx context.Context, repoID, userName string) error {
+	if _, err := db.conn.ExecContext(ctx, `DELETE FROM repo_keys WHERE namespace = ? AND repo_id = ? AND user_name = ?`, db.namespace, repoID, userName); err != nil {
+		return fmt.Errorf("failed to delete repo key: %v", err)
+	}
+	return nil
+}
+
+// ListRepoKeyGrants returns the users a repo is shared with
+func (db *Database) ListRepoKeyGrants(ctx context.Context, repoID string) ([]string, error) {
+	rows, err := db.conn.QueryContext(ctx, `SELECT user_name FROM repo_keys WHERE namespace = ? AND repo_id = ? ORDER BY user_name`, db.namespace, repoID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query repo keys: %v", err)
+	}
+	defer rows.Close()
+
+	var users []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %v", err)
+		}
+		users = append(users, name)
+	}
+	return users, nil
+}
+
+// localX25519Identity returns this machine's age identity from ~/.env-sync/identity.txt
+func localX25519Identity() (*age.X25519Identity, error) {
+	keys, err := loadAgeKeys()
+	if err != nil {
+		return nil, err
+	}
+	for _, identity := range keys.identities {
+		if x, ok := identity.(*age.X25519Identity); ok {
+			return x, nil
+		}
+	}
+	return nil, fmt.Errorf("no identity found (run 'env-sync keys generate')")
+}
+
+// repoDataKey returns the unwrapped data key for a shared repo, or nil if the
+// repo isn't shared. Keys are cached on the Database for the life of the process.
+func repoDataKey(ctx context.Context, db Store, repoID string) ([]byte, error) {
+	if r, ok := db.(*ReplicatedStore); ok {
+		// Repo keys are read from the primary; replicas get copies of them
+		// when they're opened (see copyTeam)
+		db = r.primary()
+	}
+	team, ok := db.(TeamStore)
+	if !ok {
+		return nil, nil
+	}
+	cache := databaseOf(db)
+	if cache != nil {
+		if key, ok := cache.repoKeys.Load(repoID); ok {
+			return key.([]byte), nil
+		}
+	}
+
+	shared, err := team.RepoHasKey(ctx, repoID)
+	if err != nil {
+		return nil, err
+	}
+	if !shared {
+		if cache != nil {
+			cache.repoKeys.Store(repoID, []byte(nil))
+		}
+		return nil, nil
+	}
+
+	identity, err := localX25519Identity()
+	if err != nil {
+		return nil, fmt.Errorf("%s is shared with per-user keys: %v", repoID, err)
+	}
+	me, err := team.GetUserByPublicKey(ctx, identity.Recipient().String())
+	if err != nil {
+		return nil, err
+	}
+	if me == nil {
+		return nil, fmt.Errorf("%s is shared with per-user keys but your public key is not registered", repoID)
+	}
+
+	wrapped, err := team.GetRepoKeyGrant(ctx, repoID, me.Name)
+	if err != nil {
+		return nil, err
+	}
+	if wrapped == "" {
+		return nil, fmt.Errorf("access denied: %s has not been shared with %s", repoID, me.Name)
+	}
+
+	key, err := unwrapDataKey(wrapped, identity)
+	if err != nil {
+		return nil, err
+	}
+
+	if cache != nil {
+		cache.repoKeys.Store(repoID, key)
+	}
+	return key, nil
+}
+
+func wrapDataKey(key []byte, publicKey string) (string, error) {
+	recipient, err := age.ParseX25519Recipient(publicKey)
+	if err != nil {
+		return "", fmt.Errorf("invalid public key: %v", err)
+	}
+	return encryptAge(string(key), []age.Recipient{recipient})
+}
+
+func unwrapDataKey(wrapped string, identity *age.X25519Identity) ([]byte, error) {
+	key, err := decryptAgeWith(wrapped, []age.Identity{identity})
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap repo key: %v", err)
+	}
+	return []byte(key), nil
+}
+
+// sealContents encrypts a file's contents, using the repo's data key if it
+// has been shared and falling back to the password/recipients otherwise
+func sealContents(ctx context.Context, db Store, repoID, relativePath, plaintext, password string) (string, error) {
+	return sealPayload(ctx, db, repoID, relativePath, compressPlaintext(plaintext), password)
+}
+
+// sealPayload is sealContents for an already encoded plaintext. The payload
+// is bound to the file unless share_contents is set (see binding.go).
+func sealPayload(ctx context.Context, db Store, repoID, relativePath string, payload []byte, password string) (string, error) {
+	payload = filePayload(repoID, relativePath, payload)
+	key, err := repoDataKey(ctx, db, repoID)
+	if err != nil {
+		return "", err
+	}
+	if key != nil {
+		return encryptPayloadWithKey(payload, key)
+	}
+	return encryptPayload(payload, password)
+}
+
+// openContents decrypts the current copy of a repo file, rebuilding it from
+// earlier revisions if it was stored as a delta
+func openContents(ctx context.Context, db Store, repoID, relativePath, encryptedData, password string) (string, error) {
+	contents, _, err := openRevision(ctx, db, repoID, relativePath, encryptedData, password, false, 0)
+	return contents, err
+}
+
+// openRevisionContents is openContents for an earlier revision, which may
+// still be bound to the name the file had before a move or rename
+func openRevisionContents(ctx context.Context, db Store, repoID, relativePath, encryptedData, password string) (string, error) {
+	contents, _, err := openRevision(ctx, db, repoID, relativePath, encryptedData, password, true, 0)
+	return contents, err
+}
+
+// decryptContents decrypts one stored copy without resolving deltas. A copy
+// bound to another file is refused, unless it's an earlier revision.
+func decryptContents(ctx context.Context, db Store, repoID, relativePath, encryptedData, password string, revision bool) (string, error) {
+	payload, err := openPayload(ctx, db, repoID, encryptedData, password)
+	if err != nil {
+		return "", err
+	}
+	binding, payload, err := unbindPayload(payload)
+	if err != nil {
+		return "", err
+	}
+	if binding != "" && binding != contentBinding(repoID, relativePath) {
+		if !revision {
+			return "", &bindingError{binding: binding, repoID: repoID, relativePath: relativePath}
+		}
+		logger.Debug("revision is bound to an earlier name", "repo", repoID, "path", relativePath)
+	}
+	return decompressPlaintext(payload)
+}
+
+// resolveRepoID matches a full or shortened repo ID against the stored files
+func resolveRepoID(ctx context.Context, db Store, ref string) (string, error) {
+	records, err := db.ListEnvFiles(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, record := range records {
+		if record.RepoID == ref || shortenRepoID(record.RepoID) == ref {
+			return record.RepoID, nil
+		}
+	}
+	return "", fmt.Errorf("no stored env files for repo %q", ref)
+}
+
+func openTeamStore(ctx context.Context, dbConnStr string) (Store, TeamStore, error) {
+	db, err := OpenStore(dbConnStr)
+	if err != nil {
+		return nil, nil, err
+	}
+	team, ok := db.(TeamStore)
+	if !ok {
+		db.Close()
+		return nil, nil, fmt.Errorf("team sharing requires a SQL database backend")
+	}
+	if err := db.InitSchema(ctx); err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	return db, team, nil
+}
+
+func manageUsers(ctx context.Context, dbConnStr, action string, args []string) error {
+	db, team, err := openTeamStore(ctx, dbConnStr)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	switch action {
+	case "add":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: env-sync user add <name> <age1...> --db <connection-string>")
+		}
+		if _, err := age.ParseX25519Recipient(args[1]); err != nil {
+			return fmt.Errorf("invalid public key: %v", err)
+		}
+		if err := team.AddUser(ctx, args[0], args[1]); err != nil {
+			return err
+		}
+		fmt.Printf("✓ Added user %s\n", args[0])
+	case "list", "":
+		users, err := team.ListUsers(ctx)
+		if err != nil {
+			return err
+		}
+		if len(users) == 0 {
+			fmt.Println("No users registered")
+			return nil
+		}
+		fmt.Printf("%d user(s):\n", len(users))
+		for _, user := range users {
+			fmt.Printf("  %-20s %s\n", user.Name, user.PublicKey)
+		}
+	default:
+		return fmt.Errorf("unknown user action: %s (use add or list)", action)
+	}
+	return nil
+}
+
+// shareRepo grants a user access to a repo. The first share creates the
+// repo's data key and re-encrypts its files with it.
+func shareRepo(ctx context.Context, dbConnStr, password, repoRef, withUser string) error {
+	db, team, err := openTeamStore(ctx, dbConnStr)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	repoID, err := resolveRepoID(ctx, db, repoRef)
+	if err != nil {
+		return err
+	}
+
+	target, err := team.GetUser(ctx, withUser)
+	if err != nil {
+		return err
+	}
+	if target == nil {
+		return fmt.Errorf("unknown user %q (add them with 'env-sync user add')", withUser)
+	}
+
+	identity, err := localX25519Identity()
+	if err != nil {
+		return err
+	}
+	me, err := team.GetUserByPublicKey(ctx, identity.Recipient().String())
+	if err != nil {
+		return err
+	}
+	if me == nil {
+		return fmt.Errorf("register yourself first: env-sync user add <your-name> %s", identity.Recipient())
+	}
+
+	key, err := repoDataKey(ctx, db, repoID)
+	if err != nil {
+		return err
+	}
+
+	if key == nil {
+		// First share: create the data key, grant it to ourselves and
+		// re-encrypt the repo's files with it
+		key = make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, key); err != nil {
+			return fmt.Errorf("failed to generate repo key: %v", err)
+		}
+		wrapped, err := wrapDataKey(key, me.PublicKey)
+		if err != nil {
+			return err
+		}
+
+		records, err := db.ListEnvFiles(ctx)
+		if err != nil {
+			return err
+		}
+		var reencrypted []EnvFileRecord
+		var revisions []EnvFileVersion
+		for _, record := range records {
+			if record.RepoID != repoID {
+				continue
+			}
+			full, err := db.GetEnvFileWithMetadata(ctx, record.RepoID, record.RelativePath)
+			if err != nil || full == nil {
+				return fmt.Errorf("failed to read %s:%s: %v", record.RepoID, record.RelativePath, err)
+			}
+			plaintext, err := openContents(ctx, db, record.RepoID, record.RelativePath, full.Contents, password)
+			if err != nil {
+				return fmt.Errorf("failed to decrypt %s:%s: %v (wrong password?)", record.RepoID, record.RelativePath, err)
+			}
+			sealed, err := encryptPayloadWithKey(filePayload(record.RepoID, record.RelativePath, compressPlaintext(plaintext)), key)
+			if err != nil {
+				return err
+			}
+			full.Contents = sealed
+			reencrypted = append(reencrypted, *full)
+
+			// Earlier revisions too, stored whole rather than as deltas,
+			// or rollback would bring back copies the password opens
+			versions, err := db.ListEnvFileVersions(ctx, record.RepoID, record.RelativePath)
+			if err != nil {
+				return err
+			}
+			for _, version := range versions {
+				revision, err := db.GetEnvFileVersion(ctx, record.RepoID, record.RelativePath, version.Version)
+				if err != nil {
+					return err
+				}
+				plaintext, err := openRevisionContents(ctx, db, record.RepoID, record.RelativePath, revision.Contents, password)
+				if err != nil {
+					return fmt.Errorf("failed to decrypt version %d of %s:%s: %v", version.Version, record.RepoID, record.RelativePath, err)
+				}
+				if revision.Contents, err = encryptPayloadWithKey(filePayload(record.RepoID, record.RelativePath, compressPlaintext(plaintext)), key); err != nil {
+					return err
+				}
+				revisions = append(revisions, *revision)
+			}
+		}
+
+		if err := team.ShareRepoFiles(ctx, repoID, me.Name, wrapped, reencrypted, revisions); err != nil {
+			return err
+		}
+		entries := make([]AuditEntry, 0, len(reencrypted))
+		for _, record := range reencrypted {
+			entry := newAuditEntry(auditRotate, record.RepoID, record.RelativePath, record.FileHash, record.FileHash)
+			entry.Detail = "re-encrypted with repo data key"
+			entries = append(entries, entry)
+		}
+		recordAudit(ctx, db, entries...)
+		fmt.Printf("✓ Created a data key for %s and re-encrypted %d file(s) and %d revision(s)\n", shortenRepoID(repoID), len(reencrypted), len(revisions))
+	}
+
+	wrapped, err := wrapDataKey(key, target.PublicKey)
+	if err != nil {
+		return err
+	}
+	if err := team.PutRepoKeyGrant(ctx, repoID, target.Name, wrapped); err != nil {
+		return err
+	}
+	entry := newAuditEntry(auditShare, repoID, "", "", "")
+	entry.Detail = "granted to " + target.Name
+	recordAudit(ctx, db, entry)
+
+	fmt.Printf("✓ Shared %s with %s\n", shortenRepoID(repoID), target.Name)
+	return nil
+}
+
+// unshareRepo revokes a user's access to a repo
+func unshareRepo(ctx context.Context, dbConnStr, repoRef, withUser string) error {
+	db, team, err := openTeamStore(ctx, dbConnStr)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	repoID, err := resolveRepoID(ctx, db, repoRef)
+	if err != nil {
+		return err
+	}
+
+	grants, err := team.ListRepoKeyGrants(ctx, repoID)
+	if err != nil {
+		return err
+	}
+	granted := false
+	for _, name := range grants {
+		granted = granted || name == withUser
+	}
+	if !granted {
+		return fmt.Errorf("%s has not been shared with %s", shortenRepoID(repoID), withUser)
+	}
+	if len(grants) <= 1 {
+		return fmt.Errorf("refusing to remove the last user with access to %s", shortenRepoID(repoID))
+	}
+
+	if err := team.DeleteRepoKeyGrant(ctx, repoID, withUser); err != nil {
+		return err
+	}
+	entry := newAuditEntry(auditUnshare, repoID, "", "", "")
+	entry.Detail = "revoked from " + withUser
+	recordAudit(ctx, db, entry)
+
+	fmt.Printf("✓ Revoked %s's access to %s\n", withUser, shortenRepoID(repoID))
+	fmt.Println("Note: they may still hold copies of the data key or files they already downloaded. Rotate the secrets themselves if that matters.")
+	return nil
+}
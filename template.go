@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// templateEnvContents strips every value from .env contents, keeping keys,
+// comments and layout, so the result can be committed as .env.example
+func templateEnvContents(contents, placeholder string) string {
+	doc := ParseEnv(contents)
+	for i, line := range doc.Lines {
+		if line.Key == "" {
+			continue
+		}
+		prefix := ""
+		if strings.HasPrefix(strings.TrimSpace(line.Raw), "export ") {
+			prefix = "export "
+		}
+		doc.Lines[i].Value = placeholder
+		doc.Lines[i].Raw = prefix + line.Key + "=" + placeholder
+	}
+	return doc.Render()
+}
+
+// generateTemplate writes a sanitized example of a stored env file to
+// outputPath, or to stdout if outputPath is empty. ref is "<repo>/<path>",
+// or just "<repo>" together with relativePath.
+func generateTemplate(ctx context.Context, dbConnStr, password, ref, relativePath, outputPath, placeholder string) error {
+	db, err := OpenStore(dbConnStr)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := db.InitSchema(ctx); err != nil {
+		return err
+	}
+
+	var repoID string
+	if match, err := resolveEnvFileRef(ctx, db, ref); err == nil {
+		repoID, relativePath = match.RepoID, match.RelativePath
+	} else if repoID, err = resolveRepoID(ctx, db, ref); err != nil {
+		return err
+	}
+
+	record, err := db.GetEnvFileWithMetadata(ctx, repoID, relativePath)
+	if err != nil {
+		return err
+	}
+	if record == nil {
+		return fmt.Errorf("%s has no stored %s (use --path or <repo>/<path>)", repoID, relativePath)
+	}
+
+	if !isDotenvName(path.Base(record.RelativePath)) {
+		return fmt.Errorf("%s is not a .env file", record.RelativePath)
+	}
+
+	contents, err := openContents(ctx, db, record.RepoID, record.RelativePath, record.Contents, password)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt %s: %v (wrong password?)", record.RelativePath, err)
+	}
+	example := templateEnvContents(contents, placeholder)
+
+	if outputPath == "" {
+		fmt.Print(example)
+		return nil
+	}
+	if err := os.WriteFile(outputPath, []byte(example), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", outputPath, err)
+	}
+	fmt.Printf("✓ Wrote %s from %s (%s)\n", outputPath, record.RelativePath, shortenRepoID(record.RepoID))
+	return nil
+}
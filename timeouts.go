@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"time"
+)
+
+// defaultFileTimeout is far longer than syncing one file takes, even over a
+// slow link with retries, but ends a database call that hangs
+const defaultFileTimeout = 2 * time.Minute
+
+// defaultMaxErrorRate is the percentage of failed files that stops a sync
+const defaultMaxErrorRate = 50
+
+// minErrorRateFiles is how many files must be done before --max-error-rate
+// is applied, so one early failure doesn't stop a sync
+const minErrorRateFiles = 10
+
+// addTimeoutFlags registers --file-timeout, --timeout and --max-error-rate
+func addTimeoutFlags(fs *flag.FlagSet) (fileTimeout, timeout *time.Duration, maxErrorRate *int) {
+	fileTimeout = fs.Duration("file-timeout", defaultFileTimeout, "Give up on a file that takes longer than this to sync; 0 for no limit (default: 2m)")
+	timeout = fs.Duration("timeout", 0, "Stop the sync after this long, e.g. 10m; the files not synced yet wait for the next one (default: no limit)")
+	maxErrorRate = fs.Int("max-error-rate", defaultMaxErrorRate, "Stop the sync once more than this percentage of files failed, after the first 10; 0 to never stop (default: 50)")
+	return fileTimeout, timeout, maxErrorRate
+}
+
+// checkTimeouts rejects negative timeouts and error rates outside 0-100
+func checkTimeouts(fileTimeout, timeout time.Duration, maxErrorRate int) error {
+	if fileTimeout < 0 || timeout < 0 {
+		return usageErrorf("--file-timeout and --timeout can't be negative")
+	}
+	if maxErrorRate < 0 || maxErrorRate > 100 {
+		return usageErrorf("--max-error-rate must be between 0 and 100")
+	}
+	return nil
+}
+
+// syncStoppedError is why a sync stopped before all files were done, other
+// than being interrupted: its --timeout ran out or too many files failed
+type syncStoppedError struct {
+	reason string
+}
+
+func (e *syncStoppedError) Error() string {
+	return e.reason
+}
+
+// stopReason describes why ctx, a sync's context, was cancelled
+func stopReason(ctx context.Context) (string, bool) {
+	var stopped *syncStoppedError
+	if errors.As(context.Cause(ctx), &stopped) {
+		return stopped.reason, true
+	}
+	return "", false
+}
+
+// tooManyErrors reports whether failed of done files is over the error rate
+func (o SyncOptions) tooManyErrors(failed, done int) bool {
+	return o.MaxErrorRate > 0 && done >= minErrorRateFiles && failed*100 > o.MaxErrorRate*done
+}
+
+// syncWithTimeout runs job, the sync of one file, with opts.FileTimeout. A
+// job still running when the time is up is abandoned rather than waited
+// for, so a database call that ignores its context can't hold up a worker.
+func syncWithTimeout(ctx context.Context, opts SyncOptions, job func(context.Context) (string, string, error)) (string, string, error) {
+	if opts.FileTimeout <= 0 {
+		return job(ctx)
+	}
+	fileCtx, cancel := context.WithTimeout(ctx, opts.FileTimeout)
+	defer cancel()
+
+	type outcome struct {
+		action, message string
+		err             error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		action, message, err := job(fileCtx)
+		done <- outcome{action, message, err}
+	}()
+
+	select {
+	case result := <-done:
+		if result.err != nil && ctx.Err() == nil && errors.Is(fileCtx.Err(), context.DeadlineExceeded) {
+			result.err = fmt.Errorf("timed out after %s (--file-timeout): %v", opts.FileTimeout, result.err)
+		}
+		return result.action, result.message, result.err
+	case <-fileCtx.Done():
+		if ctx.Err() != nil {
+			return "", "", context.Cause(ctx)
+		}
+		return "", "", fmt.Errorf("timed out after %s (--file-timeout)", opts.FileTimeout)
+	}
+}
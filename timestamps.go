@@ -0,0 +1,43 @@
+package main
+
+import (
+	"time"
+)
+
+// Stored timestamps (modification times, upload times, audit entries) are
+// RFC3339 in UTC, e.g. 2025-01-10T09:00:00Z, whatever the machine's time
+// zone. Older versions wrote "2006-01-02 15:04:05", also meant as UTC; those
+// are still read, and migration 11 rewrites them in SQL databases.
+const legacyStoredTimeFormat = "2006-01-02 15:04:05"
+
+// formatStoredTime formats t for storage, in UTC to the second
+func formatStoredTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// storedNow is the current time formatted for storage
+func storedNow() string {
+	return formatStoredTime(time.Now())
+}
+
+// parseStoredTime parses a stored timestamp: RFC3339 with any offset, or the
+// legacy format, which has no zone and is taken as UTC. The result is in UTC.
+func parseStoredTime(value string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		if legacy, legacyErr := time.Parse(legacyStoredTimeFormat, value); legacyErr == nil {
+			t, err = legacy, nil
+		}
+	}
+	return t.UTC(), err
+}
+
+// normalizeStoredTime rewrites a stored timestamp as RFC3339 UTC. Values that
+// don't parse, including empty ones, are returned as they are.
+func normalizeStoredTime(value string) string {
+	t, err := parseStoredTime(value)
+	if err != nil {
+		return value
+	}
+	return formatStoredTime(t)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFormatStoredTime(t *testing.T) {
+	zone := time.FixedZone("UTC+2", 2*60*60)
+	tests := []struct {
+		name string
+		t    time.Time
+		want string
+	}{
+		{"utc", time.Date(2025, 1, 10, 9, 0, 0, 0, time.UTC), "2025-01-10T09:00:00Z"},
+		{"other zone", time.Date(2025, 1, 10, 11, 0, 0, 0, zone), "2025-01-10T09:00:00Z"},
+		{"fractional seconds", time.Date(2025, 1, 10, 9, 0, 0, 999_999_999, time.UTC), "2025-01-10T09:00:00Z"},
+		{"across midnight", time.Date(2025, 1, 1, 1, 30, 0, 0, zone), "2024-12-31T23:30:00Z"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatStoredTime(tt.t); got != tt.want {
+				t.Errorf("formatStoredTime(%v) = %q, want %q", tt.t, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeStoredTime(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{"normalized", "2025-01-10T09:00:00Z", "2025-01-10T09:00:00Z"},
+		{"offset", "2025-01-10T11:00:00+02:00", "2025-01-10T09:00:00Z"},
+		{"negative offset", "2025-01-10T04:00:00-05:00", "2025-01-10T09:00:00Z"},
+		{"fractional seconds", "2025-01-10T09:00:00.123456Z", "2025-01-10T09:00:00Z"},
+		{"legacy", "2025-01-10 09:00:00", "2025-01-10T09:00:00Z"},
+		{"empty", "", ""},
+		{"unparseable", "yesterday", "yesterday"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := normalizeStoredTime(tt.value); got != tt.want {
+				t.Errorf("normalizeStoredTime(%q) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStoredTimeRoundTrip(t *testing.T) {
+	zone := time.FixedZone("UTC-7", -7*60*60)
+	for _, want := range []time.Time{
+		time.Date(2025, 1, 10, 9, 0, 0, 0, time.UTC),
+		time.Date(2025, 6, 30, 23, 59, 59, 0, zone),
+		time.Date(1999, 12, 31, 0, 0, 0, 0, time.UTC),
+	} {
+		stored := formatStoredTime(want)
+		got, err := parseStoredTime(stored)
+		if err != nil {
+			t.Fatalf("parseStoredTime(%q): %v", stored, err)
+		}
+		if !got.Equal(want) || got.Location() != time.UTC {
+			t.Errorf("parseStoredTime(formatStoredTime(%v)) = %v, want %v in UTC", want, got, want)
+		}
+		if again := normalizeStoredTime(stored); again != stored {
+			t.Errorf("normalizeStoredTime(%q) = %q, want it unchanged", stored, again)
+		}
+		legacy := want.UTC().Format(legacyStoredTimeFormat)
+		if got := normalizeStoredTime(legacy); got != stored {
+			t.Errorf("normalizeStoredTime(%q) = %q, want %q", legacy, got, stored)
+		}
+	}
+}
+
+// Normalized timestamps compare as text in time order, which sorting and
+// lease checks rely on
+func TestStoredTimesSortAsText(t *testing.T) {
+	earlier := formatStoredTime(time.Date(2025, 1, 10, 9, 0, 0, 0, time.UTC))
+	later := formatStoredTime(time.Date(2025, 1, 10, 8, 30, 0, 0, time.FixedZone("UTC-1", -60*60)))
+	if !(earlier < later) {
+		t.Errorf("%q should sort before %q", earlier, later)
+	}
+}
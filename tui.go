@@ -0,0 +1,762 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+)
+
+// Screens of the TUI
+const (
+	tuiFiles = "files"
+	tuiPager = "pager" // Diff, history and help text
+	tuiLog   = "log"   // Tail of the daemon log
+)
+
+// Key names produced by parseKeys besides printable characters
+const (
+	keyUp     = "up"
+	keyDown   = "down"
+	keyPgUp   = "pgup"
+	keyPgDown = "pgdown"
+	keyHome   = "home"
+	keyEnd    = "end"
+	keyEnter  = "enter"
+	keyEsc    = "esc"
+	keyCtrlC  = "ctrl+c"
+)
+
+var keySequences = []struct{ seq, key string }{
+	{"\x1b[A", keyUp}, {"\x1bOA", keyUp},
+	{"\x1b[B", keyDown}, {"\x1bOB", keyDown},
+	{"\x1b[5~", keyPgUp}, {"\x1b[6~", keyPgDown},
+	{"\x1b[H", keyHome}, {"\x1b[1~", keyHome}, {"\x1bOH", keyHome},
+	{"\x1b[F", keyEnd}, {"\x1b[4~", keyEnd}, {"\x1bOF", keyEnd},
+}
+
+// maxLogLines bounds how much of the daemon log the log screen keeps
+const maxLogLines = 500
+
+const tuiHelp = `Files
+  ↑/↓ j/k       Move          PgUp/PgDn   Scroll a page
+  enter, d      Diff the local and stored copy (values masked)
+  h             Stored revisions of the file
+  s             Sync the file, as 'sync' would
+  m             Sync the file, merging keys when both sides changed
+  L             Resolve by keeping the local copy (uploads it)
+  R             Resolve by keeping the stored copy (downloads it)
+  r             Roll the stored copy back to the revision before it
+  S             Sync every file with a local copy
+  l             Tail the daemon log
+  u             Refresh
+  q             Quit
+
+Other screens
+  ↑/↓ j/k PgUp/PgDn g/G   Scroll
+  q, esc                  Back to the file list`
+
+// tuiModel holds the TUI's state. update changes it for one key press and
+// render draws it, so the terminal handling in runTUI stays separate.
+type tuiModel struct {
+	ctx      context.Context
+	db       Store
+	password string
+	basePath string
+	filter   FileFilter
+	state    *syncState
+	logPath  string
+
+	entries []statusEntry
+	cursor  int
+	scroll  int
+
+	screen      string
+	title       string
+	lines       []string // Contents of the pager and log screens
+	linesScroll int
+
+	message   string
+	confirm   string        // Question awaiting y/n
+	onConfirm func() string // Runs on y and returns the new message
+
+	warnings bytes.Buffer // Log output that would otherwise garble the screen
+	width    int
+	height   int
+}
+
+// runTUI opens the interactive dashboard until the user quits
+func runTUI(ctx context.Context, dbConnStr, password, basePath, logPath string, filter FileFilter) error {
+	stdin, stdout := int(os.Stdin.Fd()), int(os.Stdout.Fd())
+	if !term.IsTerminal(stdin) || !term.IsTerminal(stdout) {
+		return fmt.Errorf("tui needs an interactive terminal")
+	}
+
+	db, err := OpenStore(dbConnStr)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := db.InitSchema(ctx); err != nil {
+		return err
+	}
+	updateClockSkew(ctx, db)
+
+	state, err := loadSyncState()
+	if err != nil {
+		return err
+	}
+
+	m := &tuiModel{ctx: ctx, db: db, password: password, basePath: basePath, filter: filter, state: state, logPath: logPath, screen: tuiFiles}
+	if logFile == "" {
+		// Keep warnings off the screen and show them in the message line
+		previous := logger
+		logger = slog.New(slog.NewTextHandler(&m.warnings, &slog.HandlerOptions{Level: slog.LevelWarn}))
+		defer func() { logger = previous }()
+	}
+	if err := m.refresh(); err != nil {
+		return err
+	}
+
+	oldState, err := term.MakeRaw(stdin)
+	if err != nil {
+		return fmt.Errorf("failed to set up the terminal: %v", err)
+	}
+	defer term.Restore(stdin, oldState)
+
+	// Alternate screen, cursor hidden
+	fmt.Print("\033[?1049h\033[?25l")
+	defer fmt.Print("\033[?25h\033[?1049l")
+
+	input := make(chan []byte)
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				close(input)
+				return
+			}
+			input <- append([]byte(nil), buf[:n]...)
+		}
+	}()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		m.width, m.height, err = term.GetSize(stdout)
+		if err != nil {
+			m.width, m.height = 80, 24
+		}
+		fmt.Print(m.render())
+
+		select {
+		case data, ok := <-input:
+			if !ok {
+				return nil
+			}
+			for _, key := range parseKeys(data) {
+				if m.update(key) {
+					return nil
+				}
+			}
+		case <-ticker.C:
+			// Follow the daemon log; other screens just redraw for resizes
+			if m.screen == tuiLog {
+				m.loadLog()
+			}
+		}
+	}
+}
+
+// parseKeys splits raw terminal input into key names and characters
+func parseKeys(data []byte) []string {
+	var keys []string
+	for len(data) > 0 {
+		matched := false
+		for _, s := range keySequences {
+			if bytes.HasPrefix(data, []byte(s.seq)) {
+				keys = append(keys, s.key)
+				data = data[len(s.seq):]
+				matched = true
+				break
+			}
+		}
+		if matched {
+			continue
+		}
+
+		switch {
+		case bytes.HasPrefix(data, []byte("\x1b[")):
+			// Skip an unknown escape sequence up to its final byte
+			end := 2
+			for end < len(data) && (data[end] < 0x40 || data[end] > 0x7e) {
+				end++
+			}
+			data = data[min(end+1, len(data)):]
+		case data[0] == 0x1b:
+			keys = append(keys, keyEsc)
+			data = data[1:]
+		case data[0] == '\r' || data[0] == '\n':
+			keys = append(keys, keyEnter)
+			data = data[1:]
+		case data[0] == 0x03:
+			keys = append(keys, keyCtrlC)
+			data = data[1:]
+		default:
+			r, size := utf8.DecodeRune(data)
+			keys = append(keys, string(r))
+			data = data[size:]
+		}
+	}
+	return keys
+}
+
+// update applies one key press and reports whether the TUI should quit
+func (m *tuiModel) update(key string) bool {
+	if key == keyCtrlC {
+		return true
+	}
+
+	if m.confirm != "" {
+		if key == "y" || key == "Y" {
+			m.message = m.onConfirm()
+		} else {
+			m.message = "Cancelled"
+		}
+		m.confirm, m.onConfirm = "", nil
+		m.takeWarnings()
+		return false
+	}
+
+	if m.screen != tuiFiles {
+		page := max(1, m.bodyHeight()-1)
+		switch key {
+		case "q", keyEsc:
+			m.screen = tuiFiles
+		case keyUp, "k":
+			m.linesScroll--
+		case keyDown, "j":
+			m.linesScroll++
+		case keyPgUp:
+			m.linesScroll -= page
+		case keyPgDown, " ":
+			m.linesScroll += page
+		case keyHome, "g":
+			m.linesScroll = 0
+		case keyEnd, "G":
+			m.linesScroll = len(m.lines)
+		}
+		m.linesScroll = max(0, min(m.linesScroll, len(m.lines)-m.bodyHeight()))
+		return false
+	}
+
+	m.message = ""
+	switch key {
+	case "q", keyEsc:
+		return true
+	case keyUp, "k":
+		m.moveCursor(-1)
+	case keyDown, "j":
+		m.moveCursor(1)
+	case keyPgUp:
+		m.moveCursor(-m.bodyHeight())
+	case keyPgDown:
+		m.moveCursor(m.bodyHeight())
+	case keyHome, "g":
+		m.moveCursor(-len(m.entries))
+	case keyEnd, "G":
+		m.moveCursor(len(m.entries))
+	case keyEnter, "d":
+		m.showDiff()
+	case "h":
+		m.showHistory()
+	case "s":
+		m.message = m.syncSelected(false)
+	case "m":
+		m.message = m.syncSelected(true)
+	case "S":
+		m.message = m.syncAll()
+	case "L":
+		m.askKeep(true)
+	case "R":
+		m.askKeep(false)
+	case "r":
+		m.askRollback()
+	case "l":
+		m.screen, m.title = tuiLog, "Daemon log: "+m.logPath
+		m.lines, m.linesScroll = nil, 0
+		m.loadLog()
+	case "u":
+		if err := m.refresh(); err != nil {
+			m.message = "✗ " + err.Error()
+		} else {
+			m.message = "Refreshed"
+		}
+	case "?":
+		m.showPager("Help", tuiHelp)
+	}
+	m.takeWarnings()
+	return false
+}
+
+// refresh reloads the sync state of every file
+func (m *tuiModel) refresh() error {
+	files, err := loadEnvFiles()
+	if err != nil {
+		return fmt.Errorf("failed to load remembered files: %v", err)
+	}
+	if m.state, err = loadSyncState(); err != nil {
+		return err
+	}
+	entries, err := collectStatus(m.ctx, m.db, files, m.basePath, m.filter)
+	if err != nil {
+		return err
+	}
+	m.entries = entries
+	m.moveCursor(0)
+	return nil
+}
+
+func (m *tuiModel) moveCursor(delta int) {
+	m.cursor = max(0, min(m.cursor+delta, len(m.entries)-1))
+}
+
+func (m *tuiModel) selected() *statusEntry {
+	if m.cursor < len(m.entries) {
+		return &m.entries[m.cursor]
+	}
+	return nil
+}
+
+// selectedLocal returns the selected entry if it has a local copy
+func (m *tuiModel) selectedLocal() (*statusEntry, string) {
+	entry := m.selected()
+	switch {
+	case entry == nil:
+		return nil, "No file selected"
+	case entry.Status == statusMissingLocally:
+		return nil, fmt.Sprintf("%s has no local copy; run 'env-sync hydrate' in its checkout", entry.RelativePath)
+	}
+	return entry, ""
+}
+
+func (m *tuiModel) showPager(title, text string) {
+	m.screen, m.title = tuiPager, title
+	m.lines = strings.Split(strings.TrimRight(text, "\n"), "\n")
+	m.linesScroll = 0
+}
+
+// showDiff opens the selected file's diff, with values masked
+func (m *tuiModel) showDiff() {
+	entry := m.selected()
+	if entry == nil {
+		return
+	}
+
+	remote, local := "", ""
+	if entry.LocalPath != "" && entry.Status != statusMissingLocally {
+		data, err := readEnvFile(entry.LocalPath)
+		if err != nil {
+			m.message = fmt.Sprintf("✗ failed to read %s: %v", entry.LocalPath, err)
+			return
+		}
+		local = string(data)
+	}
+	record, err := m.db.GetEnvFileWithMetadata(m.ctx, entry.RepoID, entry.RelativePath)
+	if err != nil {
+		m.message = "✗ " + err.Error()
+		return
+	}
+	if record != nil {
+		if remote, err = openContents(m.ctx, m.db, record.RepoID, record.RelativePath, record.Contents, m.password); err != nil {
+			m.message = fmt.Sprintf("✗ failed to decrypt: %v (wrong password?)", err)
+			return
+		}
+	}
+
+	header := fmt.Sprintf("%s (%s)", entry.RelativePath, shortenRepoID(entry.RepoID))
+	var buf bytes.Buffer
+	if remote == local {
+		fmt.Fprintln(&buf, "No differences between local and remote")
+	} else {
+		printDiff(&buf, header, remote, local, isDotenvName(path.Base(entry.RelativePath)), false, false)
+	}
+	m.showPager("Diff: "+header, buf.String())
+}
+
+// showHistory lists the stored revisions of the selected file
+func (m *tuiModel) showHistory() {
+	entry := m.selected()
+	if entry == nil {
+		return
+	}
+	versions, err := m.db.ListEnvFileVersions(m.ctx, entry.RepoID, entry.RelativePath)
+	if err != nil {
+		m.message = "✗ " + err.Error()
+		return
+	}
+
+	var b strings.Builder
+	if len(versions) == 0 {
+		b.WriteString("No history recorded\n")
+	}
+	for i, version := range versions {
+		current := ""
+		if i == 0 {
+			current = "  (current)"
+		}
+		fmt.Fprintf(&b, "v%-4d modified %s  uploaded %s  hash %s%s\n", version.Version, version.FileModifiedAt, version.CreatedAt, version.FileHash[:min(12, len(version.FileHash))], current)
+	}
+	m.showPager(fmt.Sprintf("History: %s (%s)", entry.RelativePath, shortenRepoID(entry.RepoID)), b.String())
+}
+
+// syncSelected syncs the selected file the way sync would
+func (m *tuiModel) syncSelected(merge bool) string {
+	entry, problem := m.selectedLocal()
+	if entry == nil {
+		return problem
+	}
+	_, message, err := syncFileParallel(m.ctx, m.db, entry.LocalPath, m.basePath, m.password, &SyncStats{}, m.state, SyncOptions{Merge: merge})
+	m.saveState()
+	if err != nil {
+		return "✗ " + err.Error()
+	}
+	return message
+}
+
+// syncAll syncs every file that has a local copy
+func (m *tuiModel) syncAll() string {
+	stats := &SyncStats{}
+	for _, entry := range m.entries {
+		if entry.Status == statusMissingLocally || entry.LocalPath == "" {
+			continue
+		}
+		if _, _, err := syncFileParallel(m.ctx, m.db, entry.LocalPath, m.basePath, m.password, stats, m.state, SyncOptions{}); err != nil {
+			stats.FilesError++
+			logger.Warn("sync failed", "file", entry.LocalPath, "error", err)
+		}
+	}
+	m.saveState()
+	message := fmt.Sprintf("Synced: %d uploaded, %d downloaded, %d unchanged, %d conflicts, %d errors",
+		stats.FilesUploaded, stats.FilesDownloaded, stats.FilesSkipped, stats.FilesConflict, stats.FilesError)
+	if stats.FilesCorrupted > 0 {
+		message += fmt.Sprintf(", %d corrupted in the database", stats.FilesCorrupted)
+	}
+	return message
+}
+
+// askKeep asks before resolving the selected file by overwriting one side
+// with the other
+func (m *tuiModel) askKeep(local bool) {
+	entry, problem := m.selectedLocal()
+	if entry == nil {
+		m.message = problem
+		return
+	}
+	selected := *entry
+	if local {
+		m.confirm = fmt.Sprintf("Upload the local %s, replacing the stored copy?", selected.RelativePath)
+		m.onConfirm = func() string { return m.keepLocal(selected) }
+	} else {
+		m.confirm = fmt.Sprintf("Download the stored %s, replacing the local copy (it is backed up first)?", selected.RelativePath)
+		m.onConfirm = func() string { return m.keepRemote(selected) }
+	}
+}
+
+// keepLocal uploads the local copy as the resolved version
+func (m *tuiModel) keepLocal(entry statusEntry) string {
+	info, err := os.Stat(entry.LocalPath)
+	if err != nil {
+		return "✗ " + err.Error()
+	}
+	contents, err := os.ReadFile(entry.LocalPath)
+	if err != nil {
+		return "✗ " + err.Error()
+	}
+	hash := envFileHash(entry.LocalPath, contents)
+
+	record, err := m.db.GetEnvFileWithMetadata(m.ctx, entry.RepoID, entry.RelativePath)
+	if err != nil {
+		return "✗ " + err.Error()
+	}
+	previousHash := ""
+	if record != nil {
+		previousHash = record.FileHash
+	}
+	if err := uploadFile(m.ctx, m.db, entry.LocalPath, entry.RepoID, entry.RelativePath, m.password, toServerTime(info.ModTime()), hash, record); err != nil {
+		return "✗ " + err.Error()
+	}
+	recordAudit(m.ctx, m.db, newAuditEntry(auditUpload, entry.RepoID, entry.RelativePath, previousHash, hash))
+	m.state.set(entry.LocalPath, entry.RepoID, entry.RelativePath, hash)
+	m.saveState()
+	return fmt.Sprintf("↑ Uploaded: %s (kept local)", entry.RelativePath)
+}
+
+// keepRemote downloads the stored copy as the resolved version
+func (m *tuiModel) keepRemote(entry statusEntry) string {
+	record, err := m.db.GetEnvFileWithMetadata(m.ctx, entry.RepoID, entry.RelativePath)
+	if err != nil {
+		return "✗ " + err.Error()
+	}
+	if record == nil {
+		return fmt.Sprintf("%s is not in the database", entry.RelativePath)
+	}
+
+	previousHash := ""
+	if existing, err := os.ReadFile(entry.LocalPath); err == nil {
+		previousHash = envFileHash(entry.LocalPath, existing)
+	}
+	if err := downloadFile(m.ctx, m.db, record, entry.LocalPath, m.password); err != nil {
+		return "✗ " + err.Error()
+	}
+	recordAudit(m.ctx, m.db, newAuditEntry(auditDownload, record.RepoID, record.RelativePath, previousHash, record.FileHash))
+	m.state.set(entry.LocalPath, record.RepoID, record.RelativePath, record.FileHash)
+	m.saveState()
+	return fmt.Sprintf("↓ Downloaded: %s (kept stored copy)", entry.RelativePath)
+}
+
+// askRollback asks before storing the revision before the current one again
+func (m *tuiModel) askRollback() {
+	entry := m.selected()
+	if entry == nil {
+		return
+	}
+	record, err := m.db.GetEnvFileWithMetadata(m.ctx, entry.RepoID, entry.RelativePath)
+	if err != nil || record == nil {
+		m.message = fmt.Sprintf("%s is not in the database", entry.RelativePath)
+		return
+	}
+	versions, err := m.db.ListEnvFileVersions(m.ctx, record.RepoID, record.RelativePath)
+	if err != nil {
+		m.message = "✗ " + err.Error()
+		return
+	}
+
+	// Versions are newest first; roll back to the newest different one
+	var target *EnvFileVersion
+	for i := range versions {
+		if versions[i].FileHash != record.FileHash {
+			target = &versions[i]
+			break
+		}
+	}
+	if target == nil {
+		m.message = fmt.Sprintf("%s has no earlier revision", entry.RelativePath)
+		return
+	}
+
+	version := target.Version
+	m.confirm = fmt.Sprintf("Roll %s back to v%d (modified %s)?", entry.RelativePath, version, target.FileModifiedAt)
+	m.onConfirm = func() string {
+		if err := rollbackRecord(m.ctx, m.db, record, m.password, version); err != nil {
+			return "✗ " + err.Error()
+		}
+		if err := m.refresh(); err != nil {
+			logger.Warn("failed to refresh", "error", err)
+		}
+		return fmt.Sprintf("✓ Rolled back %s to v%d; sync to pull it down", record.RelativePath, version)
+	}
+}
+
+// loadLog reads the end of the daemon log
+func (m *tuiModel) loadLog() {
+	data, err := os.ReadFile(m.logPath)
+	if err != nil {
+		m.lines = []string{fmt.Sprintf("Can't read %s: %v", m.logPath, err), "", "Pass --log with the daemon's --log-file to follow it."}
+		return
+	}
+
+	following := m.linesScroll >= len(m.lines)-m.bodyHeight()
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	m.lines = lines[max(0, len(lines)-maxLogLines):]
+	if following {
+		m.linesScroll = max(0, len(m.lines)-m.bodyHeight())
+	}
+}
+
+func (m *tuiModel) saveState() {
+	if err := m.state.save(); err != nil {
+		logger.Warn("failed to save sync state", "error", err)
+	}
+	if err := m.refresh(); err != nil {
+		logger.Warn("failed to refresh", "error", err)
+	}
+}
+
+// takeWarnings moves logged warnings into the message line
+func (m *tuiModel) takeWarnings() {
+	if m.warnings.Len() == 0 {
+		return
+	}
+	lines := strings.Split(strings.TrimSpace(m.warnings.String()), "\n")
+	m.warnings.Reset()
+	warning := "⚠ " + lines[len(lines)-1]
+	if m.message != "" {
+		warning = m.message + "  " + warning
+	}
+	m.message = warning
+}
+
+// bodyHeight is the number of lines between the title and the footer
+func (m *tuiModel) bodyHeight() int {
+	return max(1, m.height-3)
+}
+
+// render draws the whole screen
+func (m *tuiModel) render() string {
+	var lines []string
+	switch m.screen {
+	case tuiFiles:
+		lines = append(lines, paintLine(colorCyan, m.fit(m.summary())))
+		lines = append(lines, m.renderFiles()...)
+	default:
+		lines = append(lines, paintLine(colorCyan, m.fit(m.title)))
+		start := max(0, min(m.linesScroll, len(m.lines)))
+		for _, line := range m.lines[start:min(len(m.lines), start+m.bodyHeight())] {
+			lines = append(lines, paintDiffLine(m.fit(line)))
+		}
+	}
+	for len(lines) < m.height-2 {
+		lines = append(lines, "")
+	}
+
+	switch {
+	case m.confirm != "":
+		lines = append(lines, paintLine(colorYellow, m.fit(m.confirm+" (y/n)")))
+	default:
+		lines = append(lines, m.fit(m.message))
+	}
+	if m.screen == tuiFiles {
+		lines = append(lines, m.fit("enter diff · s sync · m merge · L/R keep local/remote · r rollback · h history · l log · ? help · q quit"))
+	} else {
+		lines = append(lines, m.fit("↑/↓ scroll · q back"))
+	}
+
+	// Redraw in place, clearing each line's leftovers, to avoid flicker
+	var b strings.Builder
+	b.WriteString("\033[H")
+	for i, line := range lines {
+		if i > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString(line + "\033[K")
+	}
+	b.WriteString("\033[J")
+	return b.String()
+}
+
+// summary is the title line of the file list
+func (m *tuiModel) summary() string {
+	counts := make(map[string]int)
+	for _, entry := range m.entries {
+		counts[entry.Status]++
+	}
+	parts := []string{fmt.Sprintf("env-sync · %d file(s)", len(m.entries))}
+	for _, status := range statusOrder {
+		if counts[status] > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", counts[status], status))
+		}
+	}
+	return strings.Join(parts, " · ")
+}
+
+// renderFiles lists the files grouped under their repo, scrolled so the
+// cursor stays visible
+func (m *tuiModel) renderFiles() []string {
+	if len(m.entries) == 0 {
+		return []string{"No env files found locally or in the database. Run 'env-sync scan <path>' first."}
+	}
+
+	var rows []string
+	cursorRow := 0
+	repo := ""
+	for i, entry := range m.entries {
+		if entry.RepoID != repo {
+			repo = entry.RepoID
+			rows = append(rows, m.fit(shortenRepoID(repo)))
+		}
+		status := entry.Status
+		if entry.Error != "" {
+			status = "error"
+		}
+		row := m.fit(fmt.Sprintf("  %-18s %s", status, entry.RelativePath))
+		if i == m.cursor {
+			cursorRow = len(rows)
+			row = "\033[7m" + row + colorReset
+		} else {
+			row = paintLine(statusColor(status), row)
+		}
+		rows = append(rows, row)
+	}
+
+	height := m.bodyHeight()
+	if cursorRow < m.scroll {
+		m.scroll = cursorRow
+	} else if cursorRow >= m.scroll+height {
+		m.scroll = cursorRow - height + 1
+	}
+	m.scroll = max(0, min(m.scroll, len(rows)-height))
+	return rows[m.scroll:min(len(rows), m.scroll+height)]
+}
+
+// fit cuts a line to the terminal width
+func (m *tuiModel) fit(line string) string {
+	line = strings.ReplaceAll(line, "\t", "    ")
+	if m.width <= 0 || utf8.RuneCountInString(line) <= m.width {
+		return line
+	}
+	runes := []rune(line)
+	return string(runes[:max(0, m.width-1)]) + "…"
+}
+
+func statusColor(status string) string {
+	switch status {
+	case statusInSync:
+		return colorGreen
+	case statusConflict, "error":
+		return colorRed
+	case statusLocalNewer, statusRemoteNewer:
+		return colorYellow
+	}
+	return colorCyan
+}
+
+func paintLine(color, line string) string {
+	if line == "" {
+		return line
+	}
+	return color + line + colorReset
+}
+
+// paintDiffLine colors the lines of a diff shown in the pager
+func paintDiffLine(line string) string {
+	switch {
+	case strings.HasPrefix(line, "==="):
+		return paintLine(colorCyan, line)
+	case strings.HasPrefix(line, "-"):
+		return paintLine(colorRed, line)
+	case strings.HasPrefix(line, "+"):
+		return paintLine(colorGreen, line)
+	}
+	return line
+}
+
+// defaultDaemonLog is where an installed daemon service logs
+func defaultDaemonLog() string {
+	dir, err := getStorageDir()
+	if err != nil {
+		return "daemon.log"
+	}
+	return filepath.Join(dir, "daemon.log")
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/net/proxy"
+)
+
+// sshTunnel and sshKeyFile are set by the global --ssh and --ssh-key flags
+var (
+	sshTunnel  string
+	sshKeyFile string
+)
+
+// sshDialTimeout bounds connecting to the bastion
+const sshDialTimeout = 15 * time.Second
+
+// dialFunc opens a connection to a database server
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// sshTunnelTarget returns --ssh, else ENV_SYNC_SSH
+func sshTunnelTarget() string {
+	if sshTunnel != "" {
+		return sshTunnel
+	}
+	return os.Getenv(envSSH)
+}
+
+// bastion is the SSH connection database connections are tunneled through.
+// It is opened on first use and reopened if it drops, e.g. while the daemon
+// waits between syncs.
+var bastion struct {
+	mu     sync.Mutex
+	client *ssh.Client
+}
+
+// sshDial connects to addr through the bastion, reconnecting once if the
+// SSH connection broke
+func sshDial(ctx context.Context, network, addr string) (net.Conn, error) {
+	for attempt := 0; ; attempt++ {
+		client, err := bastionClient()
+		if err != nil {
+			return nil, err
+		}
+		conn, err := client.DialContext(ctx, network, addr)
+		if err == nil || attempt > 0 || ctx.Err() != nil {
+			if err != nil {
+				return nil, fmt.Errorf("failed to reach %s through %s: %v", addr, sshTunnelTarget(), err)
+			}
+			return conn, nil
+		}
+		logger.Warn("SSH tunnel lost, reconnecting", "bastion", sshTunnelTarget(), "error", err)
+		bastion.mu.Lock()
+		if bastion.client == client {
+			client.Close()
+			bastion.client = nil
+		}
+		bastion.mu.Unlock()
+	}
+}
+
+// bastionClient returns the open SSH connection, connecting first if needed
+func bastionClient() (*ssh.Client, error) {
+	bastion.mu.Lock()
+	defer bastion.mu.Unlock()
+	if bastion.client != nil {
+		return bastion.client, nil
+	}
+
+	target := sshTunnelTarget()
+	userName, host, ok := strings.Cut(target, "@")
+	if !ok {
+		host = target
+		if u, err := user.Current(); err == nil {
+			userName = u.Username
+		}
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "22")
+	}
+
+	auth, err := sshAuthMethods()
+	if err != nil {
+		return nil, err
+	}
+	hostKeys, err := sshHostKeyCallback()
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := ssh.Dial("tcp", host, &ssh.ClientConfig{
+		User:            userName,
+		Auth:            auth,
+		HostKeyCallback: hostKeys,
+		Timeout:         sshDialTimeout,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to SSH bastion %s: %v", target, err)
+	}
+	logger.Debug("SSH tunnel open", "bastion", target)
+	bastion.client = client
+	return client, nil
+}
+
+// sshAuthMethods offers the keys of a running ssh-agent, then --ssh-key or
+// the default unencrypted keys in ~/.ssh
+func sshAuthMethods() ([]ssh.AuthMethod, error) {
+	var signers []ssh.Signer
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			if agentSigners, err := agent.NewClient(conn).Signers(); err == nil {
+				signers = append(signers, agentSigners...)
+			}
+		}
+	}
+
+	keyFiles := []string{sshKeyFile}
+	if sshKeyFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get home directory: %v", err)
+		}
+		keyFiles = nil
+		for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+			keyFiles = append(keyFiles, filepath.Join(home, ".ssh", name))
+		}
+	}
+	for _, keyFile := range keyFiles {
+		data, err := os.ReadFile(keyFile)
+		if os.IsNotExist(err) && sshKeyFile == "" {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read SSH key: %v", err)
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			// Passphrase-protected keys have to come from ssh-agent
+			logger.Debug("skipping SSH key", "key", keyFile, "error", err)
+			if sshKeyFile != "" {
+				return nil, fmt.Errorf("failed to load SSH key %s: %v (add it to ssh-agent instead)", keyFile, err)
+			}
+			continue
+		}
+		signers = append(signers, signer)
+	}
+
+	if len(signers) == 0 {
+		return nil, fmt.Errorf("no SSH key found for %s: start ssh-agent or use --ssh-key", sshTunnelTarget())
+	}
+	return []ssh.AuthMethod{ssh.PublicKeys(signers...)}, nil
+}
+
+// sshHostKeyCallback checks the bastion against ~/.ssh/known_hosts
+func sshHostKeyCallback() (ssh.HostKeyCallback, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get home directory: %v", err)
+	}
+	knownHosts := filepath.Join(home, ".ssh", "known_hosts")
+	callback, err := knownhosts.New(knownHosts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s (connect once with ssh to add the bastion): %v", knownHosts, err)
+	}
+	return callback, nil
+}
+
+// proxyDial connects directly, or through the SOCKS5 proxy in ALL_PROXY,
+// honoring NO_PROXY
+var proxyDial dialFunc = func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return proxy.Dial(ctx, network, addr)
+}
+
+// databaseDialer returns how to reach a database server that env-sync
+// connects to itself: through the SSH bastion if one is set, otherwise
+// directly or through a SOCKS proxy
+func databaseDialer() dialFunc {
+	if sshTunnelTarget() != "" {
+		return sshDial
+	}
+	return proxyDial
+}
+
+// pqDialer adapts a dialFunc to lib/pq's Dialer and DialerContext
+type pqDialer dialFunc
+
+func (d pqDialer) Dial(network, addr string) (net.Conn, error) {
+	return d(context.Background(), network, addr)
+}
+
+func (d pqDialer) DialTimeout(network, addr string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return d(ctx, network, addr)
+}
+
+func (d pqDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return d(ctx, network, addr)
+}
+
+// libsqlHosts are the hosts of libsql URLs whose HTTP requests go through
+// the SSH tunnel
+var libsqlHosts sync.Map
+
+var installTransport sync.Once
+
+// routeLibsqlHost sends the libsql client's requests to host through the SSH
+// tunnel, if there is one. Proxies from HTTPS_PROXY, HTTP_PROXY and, for
+// SOCKS, ALL_PROXY apply otherwise. The libsql client uses Go's default HTTP
+// client, so that is where the routing, and any rate_limit, is installed.
+func routeLibsqlHost(host string) {
+	if sshTunnelTarget() != "" {
+		libsqlHosts.Store(host, true)
+	}
+	installTransport.Do(func() {
+		base, ok := http.DefaultTransport.(*http.Transport)
+		if !ok {
+			return
+		}
+		transport := base.Clone()
+		transport.Proxy = func(req *http.Request) (*url.URL, error) {
+			if _, tunneled := libsqlHosts.Load(req.URL.Hostname()); tunneled {
+				return nil, nil
+			}
+			proxyURL, err := http.ProxyFromEnvironment(req)
+			if proxyURL != nil || err != nil {
+				return proxyURL, err
+			}
+			return allProxy(req.URL.Hostname())
+		}
+		dial := transport.DialContext
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			host, _, _ := net.SplitHostPort(addr)
+			if _, tunneled := libsqlHosts.Load(host); tunneled {
+				return sshDial(ctx, network, addr)
+			}
+			return dial(ctx, network, addr)
+		}
+		http.DefaultTransport = &rateLimitedTransport{base: transport}
+	})
+}
+
+// allProxy returns the proxy in ALL_PROXY (or all_proxy) unless NO_PROXY
+// excludes host. net/http only reads HTTP_PROXY and HTTPS_PROXY.
+func allProxy(host string) (*url.URL, error) {
+	value := os.Getenv("ALL_PROXY")
+	if value == "" {
+		value = os.Getenv("all_proxy")
+	}
+	if value == "" || noProxy(host) {
+		return nil, nil
+	}
+	proxyURL, err := url.Parse(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ALL_PROXY: %v", err)
+	}
+	return proxyURL, nil
+}
+
+// noProxy reports whether NO_PROXY lists host or one of its parent domains
+func noProxy(host string) bool {
+	value := os.Getenv("NO_PROXY")
+	if value == "" {
+		value = os.Getenv("no_proxy")
+	}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "*" {
+			return true
+		}
+		entry = strings.TrimPrefix(strings.TrimPrefix(entry, "*"), ".")
+		if entry != "" && (host == entry || strings.HasSuffix(host, "."+entry)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// newSyncRunID names a sync run in the summary and the stats history, e.g.
+// 20261016-101500-3fa2: when it started, plus a random suffix
+func newSyncRunID(start time.Time) string {
+	suffix := make([]byte, 2)
+	rand.Read(suffix)
+	return start.UTC().Format(backupTimeFormat) + "-" + hex.EncodeToString(suffix)
+}
+
+// syncJournal remembers what each file looked like before a sync wrote it,
+// so `env-sync undo` can put it back
+type syncJournal struct {
+	mu     sync.Mutex
+	writes map[string]syncRunChange
+}
+
+func newSyncJournal() *syncJournal {
+	return &syncJournal{writes: make(map[string]syncRunChange)}
+}
+
+// record notes a file the sync uploaded, downloaded or merged: its hashes
+// on both sides before the sync ("" where it didn't exist yet) and the hash
+// it has now
+func (j *syncJournal) record(filePath, repoID, relativePath, localBefore, remoteBefore, after string) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.writes[filePath] = syncRunChange{RepoID: repoID, RelativePath: relativePath, Path: filePath,
+		LocalBefore: localBefore, RemoteBefore: remoteBefore, After: after}
+}
+
+// fill adds what was recorded for filePath to change
+func (j *syncJournal) fill(filePath string, change *syncRunChange) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if write, ok := j.writes[filePath]; ok {
+		write.Action, write.Error = change.Action, change.Error
+		*change = write
+	}
+}
+
+// undoable reports whether a sync run change wrote a file undo can restore
+func (c syncRunChange) undoable() bool {
+	return !c.Error && c.After != "" && (c.LocalBefore != "" || c.RemoteBefore != "")
+}
+
+// findUndoRun returns the sync run runID, or without one the most recent
+// run on this machine that changed files and wasn't undone yet
+func findUndoRun(runID string) (*syncRun, error) {
+	key, err := loadMachineKey()
+	if err != nil {
+		return nil, err
+	}
+	statsFile, err := getStatsFile()
+	if err != nil {
+		return nil, err
+	}
+	runs, err := readSyncRuns(statsFile, key)
+	if err != nil {
+		return nil, err
+	}
+	store, err := loadEnvFileStore()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(runs) - 1; i >= 0; i-- {
+		run := runs[i]
+		if runID != "" {
+			if run.ID != runID {
+				continue
+			}
+			if slices.Contains(store.Undone, run.ID) {
+				return nil, fmt.Errorf("sync run %s was already undone", runID)
+			}
+			return &run, nil
+		}
+		if run.ID == "" || slices.Contains(store.Undone, run.ID) || !slices.ContainsFunc(run.Changes, syncRunChange.undoable) {
+			continue
+		}
+		return &run, nil
+	}
+	if runID != "" {
+		return nil, fmt.Errorf("no sync run %s on this machine (the run ID is printed in the sync summary)", runID)
+	}
+	return nil, fmt.Errorf("no sync run on this machine has changes to undo")
+}
+
+// undoSyncRun reverts the files a sync run overwrote: local files from the
+// backups taken before the download, database copies by storing the
+// revision from before the upload again. A file changed again since the run
+// is left alone unless force is set. Reverted files come up as conflicts on
+// the next sync, so the run isn't simply repeated.
+func undoSyncRun(ctx context.Context, dbConnStr, password, runID string, dryRun, force bool) error {
+	run, err := findUndoRun(runID)
+	if err != nil {
+		return err
+	}
+
+	db, err := OpenStore(dbConnStr)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := db.InitSchema(ctx); err != nil {
+		return err
+	}
+	lock, err := acquireSyncLock(ctx, db, dryRun)
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+	if err := checkPassword(ctx, db, password); err != nil {
+		return err
+	}
+	state, err := loadSyncState()
+	if err != nil {
+		return err
+	}
+
+	if dryRun {
+		notef("DRY RUN MODE - No changes will be made\n")
+	}
+	fmt.Printf("Undoing sync run %s (started %s)\n\n", run.ID, run.Time)
+
+	restored, kept, skipped, errCount := 0, 0, 0, 0
+	for _, change := range run.Changes {
+		if !change.undoable() {
+			if !change.Error && change.After != "" {
+				fmt.Printf("- Kept: %s (new file, nothing to restore)\n", change.Path)
+				kept++
+			}
+			continue
+		}
+		displayName := fmt.Sprintf("%s (%s)", change.RelativePath, shortenRepoID(change.RepoID))
+
+		var results []string
+		var undoErr error
+		if (change.Action == actionDownload || change.Action == actionMerge) && change.LocalBefore != "" {
+			result, err := undoLocalWrite(change, dryRun, force)
+			if err != nil {
+				undoErr = err
+			} else {
+				results = append(results, result)
+			}
+		}
+		if undoErr == nil && (change.Action == actionUpload || change.Action == actionMerge) && change.RemoteBefore != "" {
+			result, err := undoRemoteWrite(ctx, db, change, password, dryRun, force)
+			if err != nil {
+				undoErr = err
+			} else {
+				results = append(results, result)
+			}
+		}
+
+		var changedSince *undoChangedError
+		switch {
+		case errors.As(undoErr, &changedSince):
+			fmt.Printf("⚠ Skipped: %s (%v)\n", displayName, undoErr)
+			skipped++
+		case undoErr != nil:
+			fmt.Printf("✗ Error undoing %s: %v\n", displayName, undoErr)
+			errCount++
+		case len(results) > 0:
+			fmt.Printf("↩ Restored: %s (%s)%s\n", displayName, strings.Join(results, ", "), dryRunSuffix(dryRun))
+			restored++
+			if !dryRun {
+				// Neither side is in sync with the other now; an empty base
+				// makes the next sync report a conflict instead of redoing the run
+				state.set(change.Path, change.RepoID, change.RelativePath, "")
+			}
+		}
+	}
+
+	if !dryRun {
+		if err := state.save(); err != nil {
+			logger.Warn("failed to save sync state", "error", err)
+		}
+		if errCount == 0 {
+			if err := updateEnvFileStore(func(store *EnvFileStore) {
+				store.Undone = append(store.Undone, run.ID)
+			}); err != nil {
+				return err
+			}
+		}
+	}
+
+	fmt.Printf("\n%d file(s) restored, %d skipped, %d kept, %d error(s)\n", restored, skipped, kept, errCount)
+	if restored > 0 && !dryRun {
+		fmt.Println("The next sync reports the restored files as conflicts: keep one side with upload or download, or combine them with sync --merge")
+	}
+	if errCount > 0 {
+		return fmt.Errorf("%d file(s) could not be restored", errCount)
+	}
+	return nil
+}
+
+// undoChangedError reports a file that changed again after the run
+type undoChangedError struct {
+	what string
+}
+
+func (e *undoChangedError) Error() string {
+	return e.what + " changed since the sync; --force restores it anyway"
+}
+
+// undoLocalWrite restores the local file a sync downloaded over from the
+// backup taken just before
+func undoLocalWrite(change syncRunChange, dryRun, force bool) (string, error) {
+	current, err := os.ReadFile(change.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to read %s: %v", change.Path, err)
+	}
+	if (err != nil || envFileHash(change.Path, current, change.After) != change.After) && !force {
+		return "", &undoChangedError{what: "local file"}
+	}
+
+	contents, session, err := findBackup(change.Path, change.LocalBefore)
+	if err != nil {
+		return "", err
+	}
+	if !dryRun {
+		if err := writeFileWithBackup(change.Path, contents, restoreFileMode(0, change.Path)); err != nil {
+			return "", fmt.Errorf("failed to restore %s: %v", change.Path, err)
+		}
+	}
+	return "local from backup " + session, nil
+}
+
+// undoRemoteWrite stores the revision a sync uploaded over as the newest
+// one again
+func undoRemoteWrite(ctx context.Context, db Store, change syncRunChange, password string, dryRun, force bool) (string, error) {
+	record, err := db.GetEnvFileWithMetadata(ctx, change.RepoID, change.RelativePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to check database: %v", err)
+	}
+	if (record == nil || record.FileHash != change.After) && !force {
+		return "", &undoChangedError{what: "database copy"}
+	}
+	if record == nil {
+		return "", fmt.Errorf("no longer in the database")
+	}
+
+	versions, err := db.ListEnvFileVersions(ctx, change.RepoID, change.RelativePath)
+	if err != nil {
+		return "", err
+	}
+	version := 0
+	for _, v := range versions {
+		if v.FileHash == change.RemoteBefore && v.Version > version {
+			version = v.Version
+		}
+	}
+	if version == 0 {
+		return "", fmt.Errorf("the revision from before the sync is no longer stored (pruned?)")
+	}
+	if !dryRun {
+		if err := rollbackRecord(ctx, db, record, password, version); err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("database to version %d", version), nil
+}
+
+// findBackup returns the newest backup of path whose contents hash to hash,
+// and the session it's in
+func findBackup(path, hash string) ([]byte, string, error) {
+	backupsDir, err := getBackupsDir()
+	if err != nil {
+		return nil, "", err
+	}
+	sessions, err := listBackupSessions()
+	if err != nil {
+		return nil, "", err
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		absPath = path
+	}
+
+	for _, session := range sessions {
+		entries, err := loadBackupManifest(session)
+		if err != nil {
+			continue
+		}
+		for i := len(entries) - 1; i >= 0; i-- {
+			if entries[i].OriginalPath != absPath {
+				continue
+			}
+			contents, err := os.ReadFile(filepath.Join(backupsDir, session, filepath.FromSlash(entries[i].BackupFile)))
+			if err == nil && envFileHash(absPath, contents, hash) == hash {
+				return contents, session, nil
+			}
+		}
+	}
+	return nil, "", fmt.Errorf("the backup from before the sync is gone (backups are kept for %d days)", int(defaultBackupMaxAge.Hours()/24))
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// variableReport is the --json output of get
+type variableReport struct {
+	RepoID       string `json:"repo_id"`
+	RelativePath string `json:"relative_path"`
+	Key          string `json:"key"`
+	Value        string `json:"value"`
+}
+
+// openEnvFileRef opens the stored .env file named by "<repo>/<path>" and
+// returns its record and decrypted contents
+func openEnvFileRef(ctx context.Context, db Store, ref, password string) (*EnvFileRecord, string, error) {
+	match, err := resolveEnvFileRef(ctx, db, ref)
+	if err != nil {
+		return nil, "", err
+	}
+	if !isDotenvName(path.Base(match.RelativePath)) {
+		return nil, "", fmt.Errorf("%s is not a .env file", match.RelativePath)
+	}
+
+	record, err := db.GetEnvFileWithMetadata(ctx, match.RepoID, match.RelativePath)
+	if err != nil {
+		return nil, "", err
+	}
+	if record == nil {
+		return nil, "", fmt.Errorf("no env file matches %q", ref)
+	}
+
+	contents, err := openContents(ctx, db, record.RepoID, record.RelativePath, record.Contents, password)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to decrypt %s: %v (wrong password?)", record.RelativePath, err)
+	}
+	return record, contents, nil
+}
+
+// getVariable prints the value of one key of a stored .env file, without
+// surrounding quotes
+func getVariable(ctx context.Context, dbConnStr, password, ref, key string) error {
+	db, err := OpenStore(dbConnStr)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := db.InitSchema(ctx); err != nil {
+		return err
+	}
+
+	record, contents, err := openEnvFileRef(ctx, db, ref, password)
+	if err != nil {
+		return err
+	}
+	value, ok := ParseEnv(contents).Get(key)
+	if !ok {
+		return fmt.Errorf("%s is not set in %s (%s)", key, record.RelativePath, shortenRepoID(record.RepoID))
+	}
+	value = unquoteEnvValue(value)
+
+	if jsonOutput {
+		printJSON(variableReport{RepoID: record.RepoID, RelativePath: record.RelativePath, Key: key, Value: value})
+		return nil
+	}
+	fmt.Println(value)
+	return nil
+}
+
+// parseAssignments splits KEY=value arguments. Values are stored as written,
+// so quotes have to be part of the argument, e.g. 'GREETING="hello world"'.
+func parseAssignments(args []string) ([][2]string, error) {
+	var assignments [][2]string
+	for _, arg := range args {
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok || key == "" || strings.ContainsAny(key, " \t#") {
+			return nil, usageErrorf("invalid assignment %q (use KEY=value)", arg)
+		}
+		assignments = append(assignments, [2]string{key, value})
+	}
+	return assignments, nil
+}
+
+// setVariables updates keys of a stored .env file and uploads it as a new
+// revision. With local, the copy in the checkout at basePath is updated too.
+func setVariables(ctx context.Context, dbConnStr, password, ref string, assignments [][2]string, local bool, basePath string) error {
+	db, err := OpenStore(dbConnStr)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := db.InitSchema(ctx); err != nil {
+		return err
+	}
+
+	record, contents, err := openEnvFileRef(ctx, db, ref, password)
+	if err != nil {
+		return err
+	}
+
+	// Find the local copy before changing anything, so a wrong checkout
+	// doesn't leave only the stored copy updated
+	var localPath string
+	if local {
+		if localPath, err = localEnvFilePath(record, basePath); err != nil {
+			return err
+		}
+	}
+
+	doc := ParseEnv(contents)
+	var keys []string
+	for _, a := range assignments {
+		doc.Set(a[0], a[1])
+		keys = append(keys, a[0])
+	}
+	updated := doc.Render()
+	name := fmt.Sprintf("%s (%s)", record.RelativePath, shortenRepoID(record.RepoID))
+
+	if updated == contents {
+		fmt.Printf("✓ %s already has %s\n", name, strings.Join(keys, ", "))
+	} else {
+		if err := uploadContents(ctx, db, record.RepoID, record.RelativePath, password, updated, toServerTime(time.Now()), record.FileMode, record); err != nil {
+			return err
+		}
+		entry := newAuditEntry(auditUpload, record.RepoID, record.RelativePath, record.FileHash, HashFile(updated))
+		entry.Detail = "set " + strings.Join(keys, ", ")
+		recordAudit(ctx, db, entry)
+		fmt.Printf("✓ Set %s in %s\n", strings.Join(keys, ", "), name)
+	}
+
+	if local {
+		return setLocalVariables(record, localPath, assignments, updated)
+	}
+	return nil
+}
+
+// localEnvFilePath returns where a stored file lives in the checkout at basePath
+func localEnvFilePath(record *EnvFileRecord, basePath string) (string, error) {
+	root, err := filepath.Abs(basePath)
+	if err != nil {
+		return "", err
+	}
+	if isLocalRepo(record.RepoID) {
+		if root, err = basePathOf(record.RepoID, root); err != nil {
+			return "", err
+		}
+	} else {
+		repoRoot, repoID, err := GetRepoRoot(root)
+		if err != nil {
+			return "", fmt.Errorf("run it inside a checkout of %s (or pass --base): %v", record.RepoID, err)
+		}
+		if repoID != record.RepoID && !slices.Contains(gitRemoteAliases(repoRoot, repoID), record.RepoID) {
+			return "", fmt.Errorf("run it inside a checkout of %s (or pass --base), not %s", record.RepoID, repoID)
+		}
+		root = repoRoot
+	}
+
+	localPath := filepath.Join(root, filepath.FromSlash(record.RelativePath))
+	if rel, err := filepath.Rel(root, localPath); err != nil || strings.HasPrefix(rel, "..") {
+		return "", fmt.Errorf("%s is outside the repository", record.RelativePath)
+	}
+	return localPath, nil
+}
+
+// setLocalVariables applies assignments to the local copy, keeping any other
+// local edits. A missing local file is created from the stored contents.
+func setLocalVariables(record *EnvFileRecord, localPath string, assignments [][2]string, stored string) error {
+	updated := stored
+	if existing, err := readEnvFile(localPath); err == nil {
+		doc := ParseEnv(string(existing))
+		for _, a := range assignments {
+			doc.Set(a[0], a[1])
+		}
+		if updated = doc.Render(); updated == string(existing) {
+			return nil
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read %s: %v", localPath, err)
+	} else if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %v", filepath.Dir(localPath), err)
+	}
+
+	if err := writeEnvFile(localPath, []byte(updated), restoreFileMode(record.FileMode, localPath)); err != nil {
+		return fmt.Errorf("failed to write %s: %v", localPath, err)
+	}
+
+	// When both copies now match, remember them as in sync so the next sync
+	// has a base to merge against
+	if updated == stored {
+		if state, err := loadSyncState(); err == nil {
+			state.set(localPath, record.RepoID, record.RelativePath, HashFile(updated))
+			if err := state.save(); err != nil {
+				logger.Warn("failed to save sync state", "error", err)
+			}
+		}
+	}
+
+	fmt.Printf("✓ Updated %s\n", localPath)
+	return nil
+}
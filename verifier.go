@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// verifierPrefix marks a password verifier: the Argon2 header, a salt of its
+// own and the key derived from the password with them
+const verifierPrefix = "pwv1:"
+
+// passwordVerifierStore is implemented by backends that can remember which
+// password their files are encrypted with, so a mistyped password is caught
+// before it encrypts anything instead of splitting the store into files
+// only one of the two passwords can read
+type passwordVerifierStore interface {
+	// PasswordVerifier returns the stored verifier, or "" if none is set yet
+	PasswordVerifier(ctx context.Context) (string, error)
+	// SetPasswordVerifier stores the verifier unless one is already set, and
+	// returns the one in place afterwards
+	SetPasswordVerifier(ctx context.Context, verifier string) (string, error)
+}
+
+// passwordVerifierOf returns the verifier store behind db, if it has one.
+// Like tags, the verifier lives in the primary only.
+func passwordVerifierOf(db Store) passwordVerifierStore {
+	if r, ok := db.(*ReplicatedStore); ok {
+		db = r.primary()
+	}
+	verifiers, _ := db.(passwordVerifierStore)
+	return verifiers
+}
+
+// wrongPasswordError reports a password that doesn't match the database's verifier
+type wrongPasswordError struct{}
+
+func (e *wrongPasswordError) Error() string {
+	return "wrong password: it doesn't match the one this database's files are encrypted with"
+}
+
+// newPasswordVerifier derives a verifier for password with a fresh salt
+func newPasswordVerifier(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return "", fmt.Errorf("failed to generate salt: %v", err)
+	}
+	params := encryptKDF
+	data := append(append(encodeKDFHeader(params), salt...), deriveKey(password, salt, params)...)
+	return verifierPrefix + base64.StdEncoding.EncodeToString(data), nil
+}
+
+// matchesPasswordVerifier reports whether password is the one verifier was made from
+func matchesPasswordVerifier(verifier, password string) (bool, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(verifier, verifierPrefix))
+	if err != nil || !strings.HasPrefix(verifier, verifierPrefix) {
+		return false, fmt.Errorf("invalid password verifier in the database")
+	}
+	params, err := decodeKDFHeader(data)
+	if err != nil {
+		return false, err
+	}
+	data = data[kdfHeaderSize:]
+	if len(data) != 16+32 {
+		return false, fmt.Errorf("invalid password verifier in the database")
+	}
+	salt, key := data[:16], data[16:]
+	return subtle.ConstantTimeCompare(deriveKey(password, salt, params), key) == 1, nil
+}
+
+// checkPassword makes sure password is the one the database's files are
+// encrypted with before anything is written. The first password used with a
+// database is pinned, like an SSH host key; if files were stored before the
+// verifier existed, the password must first decrypt one of them. Backends
+// without a verifier, and age-only setups without a password, aren't checked.
+func checkPassword(ctx context.Context, db Store, password string) error {
+	verifiers := passwordVerifierOf(db)
+	if verifiers == nil || password == "" {
+		return nil
+	}
+
+	verifier, err := verifiers.PasswordVerifier(ctx)
+	if err != nil {
+		return err
+	}
+	if verifier == "" {
+		if err := checkPasswordAgainstFiles(ctx, db, password); err != nil {
+			return err
+		}
+		if verifier, err = newPasswordVerifier(password); err != nil {
+			return err
+		}
+		// Another machine may have pinned its password meanwhile
+		if verifier, err = verifiers.SetPasswordVerifier(ctx, verifier); err != nil {
+			return err
+		}
+		logger.Debug("pinned the database's password")
+	}
+
+	ok, err := matchesPasswordVerifier(verifier, password)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return &wrongPasswordError{}
+	}
+	return nil
+}
+
+// checkPasswordAgainstFiles decrypts the first password-encrypted file stored
+// before the database had a verifier
+func checkPasswordAgainstFiles(ctx context.Context, db Store, password string) error {
+	records, err := db.ListEnvFilesWithContents(ctx)
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		if !strings.HasPrefix(record.Contents, passwordPrefix) {
+			// Encrypted to age recipients, a repo key or a KMS key, or too old to tell
+			continue
+		}
+		_, err := Decrypt(record.Contents, password)
+		var delta *deltaPayload
+		if err == nil || errors.As(err, &delta) {
+			return nil
+		}
+		return &wrongPasswordError{}
+	}
+	return nil
+}
+
+// createVerifierTable holds the password verifier, a single row (one per
+// namespace since schema version 14)
+func createVerifierTable(tx *schemaTx) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS password_verifier (
+		id INTEGER PRIMARY KEY CHECK (id = 1),
+		verifier TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	`
+	if _, err := tx.Exec(tx.ddl(query)); err != nil {
+		return fmt.Errorf("failed to create password_verifier table: %v", err)
+	}
+	return nil
+}
+
+func (db *Database) PasswordVerifier(ctx context.Context) (string, error) {
+	var verifier string
+	err := db.conn.QueryRowContext(ctx, `SELECT verifier FROM password_verifier WHERE namespace = ?`, db.namespace).Scan(&verifier)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read password verifier: %v", err)
+	}
+	return verifier, nil
+}
+
+func (db *Database) SetPasswordVerifier(ctx context.Context, verifier string) (string, error) {
+	if _, err := db.conn.ExecContext(ctx, `INSERT INTO password_verifier (namespace, verifier) VALUES (?, ?) ON CONFLICT (namespace) DO NOTHING`, db.namespace, verifier); err != nil {
+		return "", fmt.Errorf("failed to store password verifier: %v", err)
+	}
+	return db.PasswordVerifier(ctx)
+}
+
+func (s *SealedDatabase) PasswordVerifier(ctx context.Context) (string, error) {
+	return s.db.PasswordVerifier(ctx)
+}
+
+func (s *SealedDatabase) SetPasswordVerifier(ctx context.Context, verifier string) (string, error) {
+	return s.db.SetPasswordVerifier(ctx, verifier)
+}
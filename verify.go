@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Results reported by the verify command
+const (
+	verifyOK            = "ok"
+	verifyHashMismatch  = "hash-mismatch"
+	verifyUndecryptable = "undecryptable"
+	verifyUnreadable    = "unreadable"
+	verifyWrongFile     = "wrong-file"
+)
+
+type verifyEntry struct {
+	RepoID       string `json:"repo_id"`
+	RelativePath string `json:"relative_path"`
+	Version      int    `json:"version,omitempty"` // 0 for the current record
+	Result       string `json:"result"`
+	Error        string `json:"error,omitempty"`
+}
+
+type verifyReport struct {
+	Checked  int            `json:"checked"`
+	Problems []verifyEntry  `json:"problems"`
+	Counts   map[string]int `json:"counts"`
+}
+
+// verifyContents decrypts one stored copy and checks it against its recorded
+// hash and, unless it's an earlier revision, the file it is bound to
+func verifyContents(ctx context.Context, db Store, repoID, relativePath, encryptedContents, fileHash, password string, revision bool) (string, error) {
+	open := openContents
+	if revision {
+		open = openRevisionContents
+	}
+	contents, err := open(ctx, db, repoID, relativePath, encryptedContents, password)
+	var wrongFile *bindingError
+	if errors.As(err, &wrongFile) {
+		return verifyWrongFile, err
+	}
+	if err != nil {
+		// AES-GCM can't tell a foreign password from corrupted ciphertext
+		return verifyUndecryptable, err
+	}
+	if HashFile(contents) != fileHash {
+		return verifyHashMismatch, fmt.Errorf("stored hash doesn't match the decrypted contents")
+	}
+	return verifyOK, nil
+}
+
+// verifyEnvFiles checks that every stored record decrypts with password and
+// matches its file_hash. It returns an error if any record fails.
+func verifyEnvFiles(ctx context.Context, dbConnStr, password string, filter FileFilter, withVersions bool) error {
+	db, err := OpenStore(dbConnStr)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := db.InitSchema(ctx); err != nil {
+		return err
+	}
+
+	records, err := db.ListEnvFiles(ctx)
+	if err != nil {
+		return err
+	}
+
+	var entries []verifyEntry
+	check := func(entry verifyEntry, encryptedContents, fileHash string) {
+		result, err := verifyContents(ctx, db, entry.RepoID, entry.RelativePath, encryptedContents, fileHash, password, entry.Version > 0)
+		entry.Result = result
+		if err != nil {
+			entry.Error = err.Error()
+		}
+		entries = append(entries, entry)
+	}
+
+	for _, record := range records {
+		if !filter.Match(record.RepoID, record.RelativePath) {
+			continue
+		}
+		entry := verifyEntry{RepoID: record.RepoID, RelativePath: record.RelativePath}
+
+		full, err := db.GetEnvFileWithMetadata(ctx, record.RepoID, record.RelativePath)
+		if err != nil || full == nil {
+			entry.Result = verifyUnreadable
+			entry.Error = fmt.Sprintf("failed to read record: %v", err)
+			entries = append(entries, entry)
+			continue
+		}
+		check(entry, full.Contents, full.FileHash)
+
+		if !withVersions {
+			continue
+		}
+		versions, err := db.ListEnvFileVersions(ctx, record.RepoID, record.RelativePath)
+		if err != nil {
+			entries = append(entries, verifyEntry{RepoID: record.RepoID, RelativePath: record.RelativePath, Result: verifyUnreadable, Error: err.Error()})
+			continue
+		}
+		for _, version := range versions {
+			versionEntry := verifyEntry{RepoID: record.RepoID, RelativePath: record.RelativePath, Version: version.Version}
+			stored, err := db.GetEnvFileVersion(ctx, record.RepoID, record.RelativePath, version.Version)
+			if err != nil {
+				versionEntry.Result = verifyUnreadable
+				versionEntry.Error = err.Error()
+				entries = append(entries, versionEntry)
+				continue
+			}
+			check(versionEntry, stored.Contents, stored.FileHash)
+		}
+	}
+
+	counts := make(map[string]int)
+	problems := []verifyEntry{}
+	for _, entry := range entries {
+		counts[entry.Result]++
+		if entry.Result != verifyOK {
+			problems = append(problems, entry)
+		}
+	}
+
+	if jsonOutput {
+		printJSON(verifyReport{Checked: len(entries), Problems: problems, Counts: counts})
+	} else {
+		for _, entry := range problems {
+			name := fmt.Sprintf("%s (%s)", entry.RelativePath, shortenRepoID(entry.RepoID))
+			if entry.Version > 0 {
+				name += fmt.Sprintf(" v%d", entry.Version)
+			}
+			fmt.Printf("✗ %-14s %s: %s\n", entry.Result, name, entry.Error)
+		}
+
+		fmt.Println("\n" + strings.Repeat("-", 50))
+		fmt.Printf("Verified %d record(s):\n", len(entries))
+		fmt.Printf("  ✓ OK:                       %d\n", counts[verifyOK])
+		if counts[verifyUndecryptable] > 0 {
+			fmt.Printf("  ✗ Undecryptable:            %d  (wrong password or corrupted)\n", counts[verifyUndecryptable])
+		}
+		if counts[verifyHashMismatch] > 0 {
+			fmt.Printf("  ✗ Hash mismatch:            %d\n", counts[verifyHashMismatch])
+		}
+		if counts[verifyWrongFile] > 0 {
+			fmt.Printf("  ✗ Copied from another file: %d\n", counts[verifyWrongFile])
+		}
+		if counts[verifyUnreadable] > 0 {
+			fmt.Printf("  ✗ Unreadable:               %d\n", counts[verifyUnreadable])
+		}
+		fmt.Println(strings.Repeat("-", 50))
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%d of %d record(s) failed verification", len(problems), len(entries))
+	}
+	return nil
+}
@@ -0,0 +1,596 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WebDAVStore keeps encrypted env files as JSON files on a WebDAV server
+// (Nextcloud, ownCloud, Apache mod_dav, ...), in the same layout as S3Store
+// under the collection in the URL:
+//
+//	files/<escaped repo_id>/<escaped relative_path>.json           current copy
+//	versions/<escaped repo_id>/<escaped relative_path>/<n>.json    revision history
+type WebDAVStore struct {
+	client   *http.Client
+	base     *url.URL // The collection holding files/ and versions/, ending in "/"
+	user     string
+	password string
+}
+
+// davPropfind asks only for the resource type, which tells files and
+// collections apart
+const davPropfind = `<?xml version="1.0" encoding="utf-8"?><d:propfind xmlns:d="DAV:"><d:prop><d:resourcetype/></d:prop></d:propfind>`
+
+// davMultistatus is the part of a PROPFIND response that listing needs
+type davMultistatus struct {
+	Responses []struct {
+		Href       string    `xml:"href"`
+		Collection *struct{} `xml:"propstat>prop>resourcetype>collection"`
+	} `xml:"response"`
+}
+
+// NewWebDAVStore connects to a WebDAV collection
+// URL format: webdav://[user[:password]@]host[:port]/path for HTTPS,
+// webdav+http://... for plain HTTP. The user and password can also come from
+// ENV_SYNC_WEBDAV_USER and ENV_SYNC_WEBDAV_PASSWORD. The collection is
+// created if it doesn't exist yet.
+func NewWebDAVStore(connString string) (*WebDAVStore, error) {
+	u, err := url.Parse(connString)
+	if err != nil {
+		return nil, fmt.Errorf("invalid WebDAV URL: %v", err)
+	}
+	switch u.Scheme {
+	case "webdav":
+		u.Scheme = "https"
+	case "webdav+http":
+		u.Scheme = "http"
+	default:
+		return nil, fmt.Errorf("invalid WebDAV URL: unknown scheme %q (use webdav:// or webdav+http://)", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid WebDAV URL: missing host (use webdav://host/path)")
+	}
+
+	store := &WebDAVStore{
+		client:   &http.Client{Timeout: 60 * time.Second},
+		user:     os.Getenv("ENV_SYNC_WEBDAV_USER"),
+		password: os.Getenv("ENV_SYNC_WEBDAV_PASSWORD"),
+	}
+	if u.User != nil {
+		store.user = u.User.Username()
+		if password, ok := u.User.Password(); ok {
+			store.password = password
+		}
+	}
+
+	base := strings.Trim(u.Path, "/")
+	store.base = &url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/" + base}
+	if base != "" {
+		store.base.Path += "/"
+	}
+
+	ctx := context.Background()
+	entries, err := store.propfind(ctx, "", "0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to access %s: %v", store.base.Redacted(), err)
+	}
+	if entries == nil {
+		if err := store.mkcol(ctx, ""); err != nil {
+			return nil, fmt.Errorf("failed to create %s: %v", store.base.Redacted(), err)
+		}
+	}
+
+	return store, nil
+}
+
+// Close is a no-op, requests don't share a session
+func (s *WebDAVStore) Close() error {
+	return nil
+}
+
+// InitSchema is a no-op, collections are created on first upload
+func (s *WebDAVStore) InitSchema(ctx context.Context) error {
+	return nil
+}
+
+func (s *WebDAVStore) key(parts ...string) string {
+	return path.Join(parts...)
+}
+
+func (s *WebDAVStore) fileKey(repoID, relativePath string) string {
+	return s.key("files", url.PathEscape(repoID), escapeObjectPath(relativePath)+".json")
+}
+
+func (s *WebDAVStore) versionsPrefix(repoID, relativePath string) string {
+	return s.key("versions", url.PathEscape(repoID), escapeObjectPath(relativePath)) + "/"
+}
+
+// url returns the address of key. Every segment is escaped once more, so
+// the "%2F" in an escaped repo ID reaches the server as part of the name.
+func (s *WebDAVStore) url(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return s.base.String() + strings.Join(segments, "/")
+}
+
+func (s *WebDAVStore) request(ctx context.Context, method, key string, body []byte, header http.Header) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, s.url(key), reader)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if s.user != "" || s.password != "" {
+		req.SetBasicAuth(s.user, s.password)
+	}
+	return s.client.Do(req)
+}
+
+// davError describes a failed request
+func davError(method, key string, resp *http.Response) error {
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return fmt.Errorf("%s %s: %s (check the user and password, Nextcloud needs an app password with two-factor login)", method, key, resp.Status)
+	}
+	return fmt.Errorf("%s %s: %s", method, key, resp.Status)
+}
+
+// propfind lists the collection at key (depth "1") or just key itself
+// (depth "0"), as keys mapped to whether they are collections. It returns
+// nil if key doesn't exist.
+func (s *WebDAVStore) propfind(ctx context.Context, key, depth string) (map[string]bool, error) {
+	header := http.Header{"Depth": {depth}, "Content-Type": {"application/xml; charset=utf-8"}}
+	resp, err := s.request(ctx, "PROPFIND", key, []byte(davPropfind), header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, davError("PROPFIND", key, resp)
+	}
+
+	var status davMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("invalid PROPFIND response for %s: %v", key, err)
+	}
+	entries := make(map[string]bool, len(status.Responses))
+	for _, response := range status.Responses {
+		href, err := url.Parse(response.Href)
+		if err != nil {
+			return nil, fmt.Errorf("invalid href %q in PROPFIND response: %v", response.Href, err)
+		}
+		name, ok := strings.CutPrefix(href.Path, s.base.Path)
+		if !ok {
+			continue
+		}
+		entries[strings.Trim(name, "/")] = response.Collection != nil
+	}
+	return entries, nil
+}
+
+// mkcol creates the collection at key. One that already exists is fine.
+func (s *WebDAVStore) mkcol(ctx context.Context, key string) error {
+	if key != "" {
+		key += "/"
+	}
+	resp, err := s.request(ctx, "MKCOL", key, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusCreated || resp.StatusCode == http.StatusMethodNotAllowed {
+		return nil
+	}
+	return davError("MKCOL", key, resp)
+}
+
+func (s *WebDAVStore) getObject(ctx context.Context, key string) (*s3Object, error) {
+	resp, err := s.request(ctx, http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, davError("GET", key, resp)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var obj s3Object
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, fmt.Errorf("invalid object %s: %v", key, err)
+	}
+	return &obj, nil
+}
+
+// putObject writes obj to key, creating the collections above it the first
+// time one is missing
+func (s *WebDAVStore) putObject(ctx context.Context, key string, obj *s3Object) error {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+
+	header := http.Header{"Content-Type": {"application/json"}}
+	for attempt := 0; ; attempt++ {
+		resp, err := s.request(ctx, http.MethodPut, key, data, header)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		switch {
+		case resp.StatusCode >= 200 && resp.StatusCode < 300:
+			return nil
+		case attempt == 0 && (resp.StatusCode == http.StatusConflict || resp.StatusCode == http.StatusNotFound):
+			// The parent collection is missing
+			dir := ""
+			for _, segment := range strings.Split(path.Dir(key), "/") {
+				dir = path.Join(dir, segment)
+				if err := s.mkcol(ctx, dir); err != nil {
+					return err
+				}
+			}
+		default:
+			return davError("PUT", key, resp)
+		}
+	}
+}
+
+// listKeys returns every file under the collection prefix, walking it one
+// level at a time since many servers refuse "Depth: infinity"
+func (s *WebDAVStore) listKeys(ctx context.Context, prefix string) ([]string, error) {
+	dir := strings.TrimSuffix(prefix, "/")
+	entries, err := s.propfind(ctx, prefix, "1")
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for key, collection := range entries {
+		if key == dir {
+			continue
+		}
+		if !collection {
+			keys = append(keys, key)
+			continue
+		}
+		nested, err := s.listKeys(ctx, key+"/")
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, nested...)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// deleteObject removes a file, or a collection with everything in it. One
+// that is already gone is fine.
+func (s *WebDAVStore) deleteObject(ctx context.Context, key string) error {
+	resp, err := s.request(ctx, http.MethodDelete, key, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusNotFound {
+		return davError("DELETE", key, resp)
+	}
+	return nil
+}
+
+// UpsertEnvFile writes the current copy and appends a new revision
+func (s *WebDAVStore) UpsertEnvFile(ctx context.Context, repoID, relativePath, encryptedContents, fileHash, fileModTime string, fileMode os.FileMode) error {
+	now := storedNow()
+	fileModTime = normalizeStoredTime(fileModTime)
+
+	existing, err := s.getObject(ctx, s.fileKey(repoID, relativePath))
+	if err != nil {
+		return fmt.Errorf("failed to upsert env file: %v", err)
+	}
+	createdAt := now
+	if existing != nil {
+		createdAt = normalizeStoredTime(existing.CreatedAt)
+	}
+
+	obj := &s3Object{
+		RepoID:         repoID,
+		RelativePath:   relativePath,
+		Contents:       encryptedContents,
+		FileHash:       fileHash,
+		FileModifiedAt: fileModTime,
+		FileMode:       fileMode,
+		CreatedAt:      createdAt,
+		UpdatedAt:      now,
+	}
+	if err := s.putObject(ctx, s.fileKey(repoID, relativePath), obj); err != nil {
+		return fmt.Errorf("failed to upsert env file: %v", err)
+	}
+
+	versions, err := s.ListEnvFileVersions(ctx, repoID, relativePath)
+	if err != nil {
+		return fmt.Errorf("failed to record env file version: %v", err)
+	}
+	next := 1
+	if len(versions) > 0 {
+		next = versions[0].Version + 1
+	}
+
+	version := *obj
+	version.Version = next
+	version.CreatedAt = now
+	key := s.versionsPrefix(repoID, relativePath) + fmt.Sprintf("%08d.json", next)
+	if err := s.putObject(ctx, key, &version); err != nil {
+		return fmt.Errorf("failed to record env file version: %v", err)
+	}
+
+	return nil
+}
+
+// UpsertEnvFiles writes many env files. WebDAV has no transactions, so each
+// file is written in turn and the first failure is returned.
+func (s *WebDAVStore) UpsertEnvFiles(ctx context.Context, records []EnvFileRecord) error {
+	for _, record := range records {
+		if err := s.UpsertEnvFile(ctx, record.RepoID, record.RelativePath, record.Contents, record.FileHash, record.FileModifiedAt, record.FileMode); err != nil {
+			return fmt.Errorf("%s:%s: %v", record.RepoID, record.RelativePath, err)
+		}
+	}
+	return nil
+}
+
+// GetEnvFile retrieves the encrypted contents of an env file
+func (s *WebDAVStore) GetEnvFile(ctx context.Context, repoID, relativePath string) (string, error) {
+	obj, err := s.getObject(ctx, s.fileKey(repoID, relativePath))
+	if err != nil {
+		return "", fmt.Errorf("failed to query env file: %v", err)
+	}
+	if obj == nil {
+		return "", fmt.Errorf("env file not found: %s:%s", repoID, relativePath)
+	}
+	return obj.Contents, nil
+}
+
+// GetEnvFileWithMetadata retrieves an env file with its metadata
+func (s *WebDAVStore) GetEnvFileWithMetadata(ctx context.Context, repoID, relativePath string) (*EnvFileRecord, error) {
+	obj, err := s.getObject(ctx, s.fileKey(repoID, relativePath))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query env file: %v", err)
+	}
+	if obj == nil {
+		return nil, nil // Not found
+	}
+	return obj.record(), nil
+}
+
+// ListEnvFiles returns all env files on the server, without their contents
+func (s *WebDAVStore) ListEnvFiles(ctx context.Context) ([]EnvFileRecord, error) {
+	records, err := s.ListEnvFilesWithContents(ctx)
+	for i := range records {
+		records[i].Contents = ""
+	}
+	return records, err
+}
+
+// ListEnvFilesWithContents returns all env files including their encrypted
+// contents. Listing reads every file anyway, so this costs nothing extra.
+func (s *WebDAVStore) ListEnvFilesWithContents(ctx context.Context) ([]EnvFileRecord, error) {
+	keys, err := s.listKeys(ctx, s.key("files")+"/")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query env files: %v", err)
+	}
+
+	var records []EnvFileRecord
+	for _, key := range keys {
+		obj, err := s.getObject(ctx, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", key, err)
+		}
+		if obj == nil {
+			continue
+		}
+		records = append(records, *obj.record())
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].RepoID != records[j].RepoID {
+			return records[i].RepoID < records[j].RepoID
+		}
+		return records[i].RelativePath < records[j].RelativePath
+	})
+
+	return records, nil
+}
+
+// ListEnvFileVersions returns all recorded revisions of an env file, newest first
+func (s *WebDAVStore) ListEnvFileVersions(ctx context.Context, repoID, relativePath string) ([]EnvFileVersion, error) {
+	prefix := s.versionsPrefix(repoID, relativePath)
+	entries, err := s.propfind(ctx, prefix, "1")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query env file versions: %v", err)
+	}
+
+	var versions []EnvFileVersion
+	for key, collection := range entries {
+		name, ok := strings.CutPrefix(key, prefix)
+		if !ok || collection {
+			// The collection itself, or a nested path's revisions
+			continue
+		}
+		if _, err := strconv.Atoi(strings.TrimSuffix(name, ".json")); err != nil {
+			continue
+		}
+		obj, err := s.getObject(ctx, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", key, err)
+		}
+		if obj == nil {
+			continue
+		}
+		version := obj.version()
+		version.Contents = ""
+		versions = append(versions, *version)
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Version > versions[j].Version
+	})
+
+	return versions, nil
+}
+
+// GetEnvFileVersion retrieves a specific revision of an env file
+func (s *WebDAVStore) GetEnvFileVersion(ctx context.Context, repoID, relativePath string, version int) (*EnvFileVersion, error) {
+	key := s.versionsPrefix(repoID, relativePath) + fmt.Sprintf("%08d.json", version)
+	obj, err := s.getObject(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query env file version: %v", err)
+	}
+	if obj == nil {
+		return nil, fmt.Errorf("version %d not found for %s:%s", version, repoID, relativePath)
+	}
+	return obj.version(), nil
+}
+
+// RenameRepo copies every file and revision of oldRepoID to newRepoID, then
+// deletes the originals. A WebDAV MOVE would keep the old repo ID inside the
+// files, so they are rewritten one by one; a rename interrupted part way
+// leaves both copies and can simply be run again.
+func (s *WebDAVStore) RenameRepo(ctx context.Context, oldRepoID, newRepoID string) error {
+	for _, area := range []string{"files", "versions"} {
+		oldPrefix := s.key(area, url.PathEscape(oldRepoID)) + "/"
+		newPrefix := s.key(area, url.PathEscape(newRepoID)) + "/"
+
+		keys, err := s.listKeys(ctx, oldPrefix)
+		if err != nil {
+			return fmt.Errorf("failed to list %s: %v", oldPrefix, err)
+		}
+		for _, key := range keys {
+			obj, err := s.getObject(ctx, key)
+			if err != nil {
+				return fmt.Errorf("failed to read %s: %v", key, err)
+			}
+			if obj == nil {
+				continue
+			}
+			obj.RepoID = newRepoID
+			if err := s.putObject(ctx, newPrefix+strings.TrimPrefix(key, oldPrefix), obj); err != nil {
+				return fmt.Errorf("failed to write %s: %v", key, err)
+			}
+			if err := s.deleteObject(ctx, key); err != nil {
+				return fmt.Errorf("failed to delete %s: %v", key, err)
+			}
+		}
+		// Drop the collections left empty
+		if err := s.deleteObject(ctx, oldPrefix); err != nil {
+			return fmt.Errorf("failed to delete %s: %v", oldPrefix, err)
+		}
+	}
+	return nil
+}
+
+// MoveEnvFile copies a file and its revisions to newPath, file last, then
+// deletes the originals. Like RenameRepo, an interrupted move can be run again.
+func (s *WebDAVStore) MoveEnvFile(ctx context.Context, repoID, oldPath, newPath string) error {
+	existing, err := s.getObject(ctx, s.fileKey(repoID, newPath))
+	if err != nil {
+		return fmt.Errorf("failed to check %s: %v", newPath, err)
+	}
+	if existing != nil {
+		return fmt.Errorf("%s is already stored", newPath)
+	}
+	// Revisions left under newPath would be overwritten or mixed in
+	if revisions, err := s.listKeys(ctx, s.versionsPrefix(repoID, newPath)); err != nil {
+		return fmt.Errorf("failed to check %s: %v", newPath, err)
+	} else if len(revisions) > 0 {
+		return fmt.Errorf("%s is already stored", newPath)
+	}
+
+	oldPrefix := s.versionsPrefix(repoID, oldPath)
+	keys, err := s.listKeys(ctx, oldPrefix)
+	if err != nil {
+		return fmt.Errorf("failed to list %s: %v", oldPrefix, err)
+	}
+	keys = append(keys, s.fileKey(repoID, oldPath))
+	for _, key := range keys {
+		obj, err := s.getObject(ctx, key)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", key, err)
+		}
+		if obj == nil {
+			continue
+		}
+		obj.RelativePath = newPath
+		newKey := s.fileKey(repoID, newPath)
+		if rest, ok := strings.CutPrefix(key, oldPrefix); ok {
+			newKey = s.versionsPrefix(repoID, newPath) + rest
+		}
+		if err := s.putObject(ctx, newKey, obj); err != nil {
+			return fmt.Errorf("failed to write %s: %v", newKey, err)
+		}
+	}
+	for _, key := range append(keys, oldPrefix) {
+		if err := s.deleteObject(ctx, key); err != nil {
+			return fmt.Errorf("failed to delete %s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// DeleteRepo removes every file and revision of repoID
+func (s *WebDAVStore) DeleteRepo(ctx context.Context, repoID string) error {
+	for _, area := range []string{"files", "versions"} {
+		key := s.key(area, url.PathEscape(repoID)) + "/"
+		if err := s.deleteObject(ctx, key); err != nil {
+			return fmt.Errorf("failed to delete %s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// DeleteEnvFile removes a file and its revisions
+func (s *WebDAVStore) DeleteEnvFile(ctx context.Context, repoID, relativePath string) error {
+	for _, key := range []string{s.versionsPrefix(repoID, relativePath), s.fileKey(repoID, relativePath)} {
+		if err := s.deleteObject(ctx, key); err != nil {
+			return fmt.Errorf("failed to delete %s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// DeleteEnvFileVersions removes revisions of a file
+func (s *WebDAVStore) DeleteEnvFileVersions(ctx context.Context, repoID, relativePath string, versions []int) error {
+	for _, version := range versions {
+		key := s.versionsPrefix(repoID, relativePath) + fmt.Sprintf("%08d.json", version)
+		if err := s.deleteObject(ctx, key); err != nil {
+			return fmt.Errorf("failed to delete %s: %v", key, err)
+		}
+	}
+	return nil
+}